@@ -0,0 +1,170 @@
+// Package auth builds the AWS session of the retagger from the explicit
+// credential options: the shared config profile, a web identity token file,
+// like the ones mounted in the Kubernetes pods using IAM roles for service
+// accounts, and a chain of roles to assume, possibly with MFA.
+package auth
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+// DefaultSessionName is the name of the sessions of the assumed roles
+const DefaultSessionName = "awsRetagger"
+
+// Options are the credential options. Without any, the credentials come from
+// the environment, the shared config and the instance role as usual.
+type Options struct {
+	// Profile is the profile of the shared config and credentials files
+	Profile string
+	// RoleARNs are the roles assumed one after the other, each with the
+	// credentials of the previous one, like a role of a hub account then the
+	// role of the target account
+	RoleARNs []string
+	// ExternalID is given when assuming the last role
+	ExternalID string
+	// SessionName is the name of the sessions of the assumed roles
+	SessionName string
+	// Duration is the validity of the credentials of the assumed roles
+	Duration time.Duration
+	// MFASerial is the MFA device used to assume the first role, its token
+	// code being read from the standard input
+	MFASerial string
+	// WebIdentityTokenFile and WebIdentityRoleARN are the token file and the
+	// role assumed with it, before the RoleARNs
+	WebIdentityTokenFile, WebIdentityRoleARN string
+
+	// prompt is where the MFA token code is asked, input where it is read
+	prompt io.Writer
+	input  io.Reader
+}
+
+// RegisterFlags defines the flags of the credential options. The web identity
+// options default to the AWS_WEB_IDENTITY_TOKEN_FILE and AWS_ROLE_ARN
+// environment variables set by the IAM roles for service accounts of EKS.
+func (o *Options) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&o.Profile, "profile", "", "Profile of the shared AWS config and credentials files, instead of AWS_PROFILE. Environment variable: PROFILE")
+	fs.Var((*roleList)(&o.RoleARNs), "role-arn", "ARN of a role to assume. Repeated or comma-separated, the roles are chained, each one being assumed with the credentials of the previous one. Environment variable: ROLE_ARN")
+	fs.StringVar(&o.ExternalID, "external-id", "", "External ID given when assuming the last -role-arn. Environment variable: EXTERNAL_ID")
+	fs.StringVar(&o.SessionName, "role-session-name", DefaultSessionName, "Name of the sessions of the assumed roles. Environment variable: ROLE_SESSION_NAME")
+	fs.DurationVar(&o.Duration, "role-duration", time.Hour, "Validity of the credentials of the assumed roles, at most 1h when the roles are chained. Environment variable: ROLE_DURATION")
+	fs.StringVar(&o.MFASerial, "mfa-serial", "", "Serial number or ARN of the MFA device used to assume the first -role-arn, the token code being read from the standard input. Environment variable: MFA_SERIAL")
+	fs.StringVar(&o.WebIdentityTokenFile, "web-identity-token-file", os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE"), "Path of the web identity token file used to assume the -web-identity-role-arn, defaults to AWS_WEB_IDENTITY_TOKEN_FILE. Environment variable: WEB_IDENTITY_TOKEN_FILE")
+	fs.StringVar(&o.WebIdentityRoleARN, "web-identity-role-arn", os.Getenv("AWS_ROLE_ARN"), "ARN of the role assumed with the -web-identity-token-file, defaults to AWS_ROLE_ARN. Environment variable: WEB_IDENTITY_ROLE_ARN")
+}
+
+// Validate checks the consistency of the options
+func (o *Options) Validate() error {
+	if (o.WebIdentityTokenFile == "") != (o.WebIdentityRoleARN == "") {
+		return fmt.Errorf("the web identity token file and role ARN must be given together")
+	}
+	if o.MFASerial != "" && len(o.RoleARNs) == 0 {
+		return fmt.Errorf("the MFA device is only used to assume a role, none given")
+	}
+	if o.ExternalID != "" && len(o.RoleARNs) == 0 {
+		return fmt.Errorf("the external ID is only used to assume a role, none given")
+	}
+	return nil
+}
+
+// NewSession creates the session holding the credentials of the options, the
+// given config applying to all its clients
+func (o *Options) NewSession(cfg *aws.Config) (*session.Session, error) {
+	if err := o.Validate(); err != nil {
+		return nil, err
+	}
+	sess, err := session.NewSessionWithOptions(session.Options{
+		Config:                  *cfg,
+		Profile:                 o.Profile,
+		SharedConfigState:       session.SharedConfigEnable,
+		AssumeRoleTokenProvider: o.readTokenCode,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if o.WebIdentityTokenFile != "" {
+		creds := NewWebIdentityCredentials(sess, o.WebIdentityRoleARN, o.WebIdentityTokenFile, o.sessionName(), o.Duration)
+		sess = sess.Copy(&aws.Config{Credentials: creds})
+	}
+	for i, roleARN := range o.RoleARNs {
+		creds := stscreds.NewCredentials(sess, roleARN, o.assumeRoleOptions(i))
+		sess = sess.Copy(&aws.Config{Credentials: creds})
+	}
+	return sess, nil
+}
+
+// assumeRoleOptions returns the options of the assumption of the i-th role:
+// the MFA is used for the first one and the external ID for the last one
+func (o *Options) assumeRoleOptions(i int) func(*stscreds.AssumeRoleProvider) {
+	return func(p *stscreds.AssumeRoleProvider) {
+		p.RoleSessionName = o.sessionName()
+		if o.Duration > 0 {
+			p.Duration = o.Duration
+		}
+		if i == 0 && o.MFASerial != "" {
+			p.SerialNumber = aws.String(o.MFASerial)
+			p.TokenProvider = o.readTokenCode
+		}
+		if i == len(o.RoleARNs)-1 && o.ExternalID != "" {
+			p.ExternalID = aws.String(o.ExternalID)
+		}
+	}
+}
+
+func (o *Options) sessionName() string {
+	if o.SessionName == "" {
+		return DefaultSessionName
+	}
+	return o.SessionName
+}
+
+// readTokenCode asks for the MFA token code on the standard error, keeping the
+// standard output clean, and reads it from the standard input
+func (o *Options) readTokenCode() (string, error) {
+	prompt, input := o.prompt, o.input
+	if prompt == nil {
+		prompt = os.Stderr
+	}
+	if input == nil {
+		input = os.Stdin
+	}
+	fmt.Fprint(prompt, "MFA token code: ")
+	code, err := bufio.NewReader(input).ReadString('\n')
+	if err != nil && (err != io.EOF || code == "") {
+		return "", fmt.Errorf("unable to read the MFA token code: %s", err)
+	}
+	return strings.TrimSpace(code), nil
+}
+
+// Identity returns the identity of the credentials of the session
+func Identity(sess *session.Session) (*sts.GetCallerIdentityOutput, error) {
+	return sts.New(sess).GetCallerIdentity(&sts.GetCallerIdentityInput{})
+}
+
+// roleList is a repeatable flag of role ARNs, each value possibly holding a
+// comma-separated list
+type roleList []string
+
+func (l *roleList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *roleList) Set(s string) error {
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l = append(*l, item)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package auth
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+func TestRegisterFlags(t *testing.T) {
+	var o Options
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	o.RegisterFlags(fs)
+	args := []string{"-role-arn", "arn:aws:iam::111111111111:role/hub", "-role-arn", "arn:aws:iam::222222222222:role/retagger, arn:aws:iam::333333333333:role/retagger", "-role-duration", "30m"}
+	if err := fs.Parse(args); err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	expected := []string{"arn:aws:iam::111111111111:role/hub", "arn:aws:iam::222222222222:role/retagger", "arn:aws:iam::333333333333:role/retagger"}
+	if !reflect.DeepEqual(o.RoleARNs, expected) || o.Duration != 30*time.Minute || o.SessionName != DefaultSessionName {
+		t.Errorf("Expecting the roles %v for 30m as %s, got: %v for %v as %s\n", expected, DefaultSessionName, o.RoleARNs, o.Duration, o.SessionName)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	testData := []struct {
+		options Options
+		isErr   bool
+	}{
+		{Options{}, false},
+		{Options{RoleARNs: []string{"arn:aws:iam::111111111111:role/hub"}, MFASerial: "arn:aws:iam::111111111111:mfa/me", ExternalID: "42"}, false},
+		{Options{WebIdentityTokenFile: "/var/run/token", WebIdentityRoleARN: "arn:aws:iam::111111111111:role/pod"}, false},
+		{Options{WebIdentityTokenFile: "/var/run/token"}, true},
+		{Options{WebIdentityRoleARN: "arn:aws:iam::111111111111:role/pod"}, true},
+		{Options{MFASerial: "arn:aws:iam::111111111111:mfa/me"}, true},
+		{Options{ExternalID: "42"}, true},
+	}
+	for _, d := range testData {
+		if err := d.options.Validate(); (err != nil) != d.isErr {
+			t.Errorf("Expecting error for %+v: %v, got: %v\n", d.options, d.isErr, err)
+		}
+	}
+}
+
+func TestAssumeRoleOptions(t *testing.T) {
+	o := Options{
+		RoleARNs:   []string{"arn:aws:iam::111111111111:role/hub", "arn:aws:iam::222222222222:role/retagger"},
+		ExternalID: "42",
+		MFASerial:  "arn:aws:iam::111111111111:mfa/me",
+		Duration:   time.Hour,
+		input:      strings.NewReader("123456\n"),
+		prompt:     &bytes.Buffer{},
+	}
+
+	// the MFA is used for the hub role and the external ID for the target role
+	hub, target := &stscreds.AssumeRoleProvider{}, &stscreds.AssumeRoleProvider{}
+	o.assumeRoleOptions(0)(hub)
+	o.assumeRoleOptions(1)(target)
+	if aws.StringValue(hub.SerialNumber) != o.MFASerial || hub.TokenProvider == nil || hub.ExternalID != nil {
+		t.Errorf("Expecting the hub role to be assumed with MFA only, got: %+v\n", hub)
+	}
+	if target.SerialNumber != nil || aws.StringValue(target.ExternalID) != "42" {
+		t.Errorf("Expecting the target role to be assumed with the external ID only, got: %+v\n", target)
+	}
+	for _, p := range []*stscreds.AssumeRoleProvider{hub, target} {
+		if p.RoleSessionName != DefaultSessionName || p.Duration != time.Hour {
+			t.Errorf("Expecting the session %s for 1h, got: %s for %v\n", DefaultSessionName, p.RoleSessionName, p.Duration)
+		}
+	}
+
+	code, err := hub.TokenProvider()
+	if err != nil || code != "123456" {
+		t.Errorf("Expecting the token code 123456, got: %q (error: %v)\n", code, err)
+	}
+	if prompt := o.prompt.(*bytes.Buffer).String(); prompt != "MFA token code: " {
+		t.Errorf("Expecting the token code to be asked, got: %q\n", prompt)
+	}
+}
+
+// mockSTSClient is used to mock the calls to STS
+type mockSTSClient struct {
+	Input       *sts.AssumeRoleWithWebIdentityInput
+	ReturnError error
+}
+
+func (m *mockSTSClient) AssumeRoleWithWebIdentity(input *sts.AssumeRoleWithWebIdentityInput) (*sts.AssumeRoleWithWebIdentityOutput, error) {
+	m.Input = input
+	if m.ReturnError != nil {
+		return nil, m.ReturnError
+	}
+	return &sts.AssumeRoleWithWebIdentityOutput{Credentials: &sts.Credentials{
+		AccessKeyId:     aws.String("ASIAPOD"),
+		SecretAccessKey: aws.String("secret"),
+		SessionToken:    aws.String("token"),
+		Expiration:      aws.Time(time.Now().Add(time.Hour)),
+	}}, nil
+}
+
+func TestWebIdentityProvider(t *testing.T) {
+	dir, err := ioutil.TempDir("", "auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tokenFile := filepath.Join(dir, "token")
+	if err = ioutil.WriteFile(tokenFile, []byte("eyJhbGciOiJSUzI1NiJ9.1\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	mockSvc := &mockSTSClient{}
+	p := &WebIdentityProvider{Client: mockSvc, RoleARN: "arn:aws:iam::111111111111:role/pod", TokenFile: tokenFile, RoleSessionName: "test", Duration: time.Hour}
+	value, err := p.Retrieve()
+	if err != nil || value.AccessKeyID != "ASIAPOD" || value.ProviderName != WebIdentityProviderName || p.IsExpired() {
+		t.Errorf("Expecting valid credentials, got: %+v (error: %v)\n", value, err)
+	}
+	if aws.StringValue(mockSvc.Input.WebIdentityToken) != "eyJhbGciOiJSUzI1NiJ9.1" || aws.Int64Value(mockSvc.Input.DurationSeconds) != 3600 || aws.StringValue(mockSvc.Input.RoleArn) != p.RoleARN {
+		t.Errorf("Unexpected input: %v\n", mockSvc.Input)
+	}
+
+	// the rotated token is read again
+	if err = ioutil.WriteFile(tokenFile, []byte("eyJhbGciOiJSUzI1NiJ9.2"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = p.Retrieve(); err != nil || aws.StringValue(mockSvc.Input.WebIdentityToken) != "eyJhbGciOiJSUzI1NiJ9.2" {
+		t.Errorf("Expecting the rotated token to be used, got: %v (error: %v)\n", mockSvc.Input, err)
+	}
+
+	mockSvc.ReturnError = errors.New("AccessDenied")
+	if _, err = p.Retrieve(); err == nil {
+		t.Errorf("Expecting the error of STS\n")
+	}
+	p.TokenFile = filepath.Join(dir, "missing")
+	if _, err = p.Retrieve(); err == nil {
+		t.Errorf("Expecting an error for the missing token file\n")
+	}
+}
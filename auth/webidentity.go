@@ -0,0 +1,79 @@
+package auth
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+// WebIdentityProviderName is the name of the WebIdentityProvider
+const WebIdentityProviderName = "WebIdentityProvider"
+
+// WebIdentityRoler is the subset of the STS client used by the
+// WebIdentityProvider
+type WebIdentityRoler interface {
+	AssumeRoleWithWebIdentity(input *sts.AssumeRoleWithWebIdentityInput) (*sts.AssumeRoleWithWebIdentityOutput, error)
+}
+
+// WebIdentityProvider retrieves the credentials of a role with the web
+// identity token of a file. The file is read again at each retrieval, as the
+// tokens mounted in the Kubernetes pods are rotated.
+type WebIdentityProvider struct {
+	credentials.Expiry
+	Client          WebIdentityRoler
+	RoleARN         string
+	TokenFile       string
+	RoleSessionName string
+	Duration        time.Duration
+	// ExpiryWindow refreshes the credentials before they actually expire
+	ExpiryWindow time.Duration
+}
+
+// NewWebIdentityCredentials creates the credentials of the role assumed with the
+// token file. The calls to STS are not signed, the token being the proof of
+// the identity.
+func NewWebIdentityCredentials(c client.ConfigProvider, roleARN, tokenFile, sessionName string, duration time.Duration) *credentials.Credentials {
+	svc := sts.New(c, &aws.Config{Credentials: credentials.AnonymousCredentials})
+	return credentials.NewCredentials(&WebIdentityProvider{
+		Client:          svc,
+		RoleARN:         roleARN,
+		TokenFile:       tokenFile,
+		RoleSessionName: sessionName,
+		Duration:        duration,
+		ExpiryWindow:    time.Minute,
+	})
+}
+
+// Retrieve assumes the role with the current token of the file
+func (p *WebIdentityProvider) Retrieve() (credentials.Value, error) {
+	token, err := ioutil.ReadFile(p.TokenFile)
+	if err != nil {
+		return credentials.Value{ProviderName: WebIdentityProviderName}, fmt.Errorf("unable to read the web identity token file: %s", err)
+	}
+	input := &sts.AssumeRoleWithWebIdentityInput{
+		RoleArn:          aws.String(p.RoleARN),
+		RoleSessionName:  aws.String(p.RoleSessionName),
+		WebIdentityToken: aws.String(strings.TrimSpace(string(token))),
+	}
+	if p.Duration > 0 {
+		input.DurationSeconds = aws.Int64(int64(p.Duration / time.Second))
+	}
+	result, err := p.Client.AssumeRoleWithWebIdentity(input)
+	if err != nil {
+		return credentials.Value{ProviderName: WebIdentityProviderName}, err
+	}
+
+	p.SetExpiration(*result.Credentials.Expiration, p.ExpiryWindow)
+	return credentials.Value{
+		AccessKeyID:     *result.Credentials.AccessKeyId,
+		SecretAccessKey: *result.Credentials.SecretAccessKey,
+		SessionToken:    *result.Credentials.SessionToken,
+		ProviderName:    WebIdentityProviderName,
+	}, nil
+}
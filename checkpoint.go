@@ -0,0 +1,151 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/VEVO/awsRetagger/runner"
+)
+
+// runIDPattern is the format of the run IDs, which name the checkpoint files
+var runIDPattern = regexp.MustCompile(`^[0-9A-Za-z-]+$`)
+
+// checkpoints saves the progress of the retag runs as json files named after
+// their run ID, so that an interrupted or crashed run can be resumed
+type checkpoints struct {
+	dir      string
+	interval time.Duration
+}
+
+// newCheckpoints returns the checkpoints saved every interval in the given
+// directory, the awsRetagger/checkpoints directory of the user cache directory
+// when empty. It returns nil when the interval is 0.
+func newCheckpoints(dir string, interval time.Duration) *checkpoints {
+	if interval <= 0 {
+		return nil
+	}
+	if dir == "" {
+		cache, err := os.UserCacheDir()
+		if err != nil {
+			log.WithFields(logrus.Fields{"error": err}).Warn("No cache directory to save the checkpoints in, the runs cannot be resumed")
+			return nil
+		}
+		dir = filepath.Join(cache, "awsRetagger", "checkpoints")
+	}
+	return &checkpoints{dir: dir, interval: interval}
+}
+
+// newRunID returns a unique ID for a run, starting with its start time
+func newRunID() string {
+	b := make([]byte, 3)
+	rand.Read(b)
+	return time.Now().UTC().Format("20060102T150405Z") + "-" + hex.EncodeToString(b)
+}
+
+// Start returns the checkpoint of a new run with the config of the given
+// version, or of the run to resume when resume is not empty. A run is only
+// resumed with the config it started with. The checkpoint is also saved when
+// the run exits on a fatal error.
+func (c *checkpoints) Start(resume, configVersion string) *runner.Checkpoint {
+	var err error
+	cp := &runner.Checkpoint{RunID: newRunID(), ConfigHash: configVersion}
+	if resume != "" {
+		if c == nil {
+			log.WithFields(logrus.Fields{"run_id": resume}).Fatal("The checkpoints are disabled, unable to resume the run")
+		}
+		if cp, err = c.load(resume); err != nil {
+			log.WithFields(logrus.Fields{"error": err, "run_id": resume}).Fatal("Unable to load the checkpoint of the run")
+		}
+		if cp.ConfigHash != configVersion {
+			log.WithFields(logrus.Fields{"run_id": resume}).Fatal("The config changed since the checkpoint, refusing to resume the run")
+		}
+		log.WithFields(logrus.Fields{"run_id": cp.RunID, "done": cp.Done, "step": cp.Step, "processed": len(cp.Processed)}).Info("Resuming run")
+	} else {
+		log.WithFields(logrus.Fields{"run_id": cp.RunID}).Info("Starting run")
+	}
+	if c != nil {
+		logrus.RegisterExitHandler(func() { c.save(cp) })
+	}
+	return cp
+}
+
+// Autosave returns the periodic saving of the checkpoints, nil when c is nil
+func (c *checkpoints) Autosave() *runner.Autosave {
+	if c == nil {
+		return nil
+	}
+	return &runner.Autosave{Interval: c.interval, Save: c.save}
+}
+
+// Finish removes the checkpoint of a complete run, or saves it so that the run
+// can be resumed
+func (c *checkpoints) Finish(cp *runner.Checkpoint, complete bool) {
+	if c == nil {
+		return
+	}
+	if complete {
+		if err := os.Remove(c.path(cp.RunID)); err != nil && !os.IsNotExist(err) {
+			log.WithFields(logrus.Fields{"error": err, "run_id": cp.RunID}).Warn("Unable to remove the checkpoint of the complete run")
+		}
+		return
+	}
+	if err := c.save(cp); err != nil {
+		log.WithFields(logrus.Fields{"error": err, "run_id": cp.RunID}).Error("Unable to save the checkpoint, the run cannot be resumed")
+		return
+	}
+	log.WithFields(logrus.Fields{"run_id": cp.RunID, "step": cp.Step, "path": c.path(cp.RunID)}).Warn("Run incomplete, resume it with -resume " + cp.RunID)
+}
+
+// path returns the path of the checkpoint of a run
+func (c *checkpoints) path(runID string) string {
+	return filepath.Join(c.dir, runID+".json")
+}
+
+// load reads the checkpoint of a run
+func (c *checkpoints) load(runID string) (*runner.Checkpoint, error) {
+	if !runIDPattern.MatchString(runID) {
+		return nil, fmt.Errorf("invalid run ID %q", runID)
+	}
+	content, err := ioutil.ReadFile(c.path(runID))
+	if err != nil {
+		return nil, err
+	}
+	cp := &runner.Checkpoint{}
+	if err = json.Unmarshal(content, cp); err != nil {
+		return nil, err
+	}
+	return cp, nil
+}
+
+// save writes the checkpoint of a run. The file is replaced atomically so a
+// crash never leaves a partial checkpoint. A snapshot is written, as the exit
+// handlers save the checkpoint while the run updates it.
+func (c *checkpoints) save(cp *runner.Checkpoint) error {
+	cp = cp.Snapshot()
+	if err := os.MkdirAll(c.dir, 0755); err != nil {
+		return err
+	}
+	path := c.path(cp.RunID)
+	tmp, err := ioutil.TempFile(c.dir, filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err = json.NewEncoder(tmp).Encode(cp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
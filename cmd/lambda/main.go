@@ -0,0 +1,274 @@
+// Command lambda runs the retagger as an AWS Lambda function, either on a
+// schedule to retag all the enabled resources or on the creation events of the
+// resources to retag them as they come.
+//
+// The function is configured with the environment variables of the providers,
+// of the endpoints and of the logs of the command-line tool. The config file
+// defaults to the config.json bundled with the function. The options of the
+// command-line tool keeping files on the local disk, planning the changes of
+// a run first or locking the runs are not supported, and the function refuses
+// to start when they are set.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/gobike/envflag"
+	"github.com/sirupsen/logrus"
+
+	"github.com/VEVO/awsRetagger/events"
+	"github.com/VEVO/awsRetagger/runner"
+)
+
+var log *logrus.Entry
+
+// unsupportedVariables are the environment variables of the command-line tool
+// the function does not support: the change limits need all the changes of a
+// run to be planned before applying any, which a run stopping before the
+// timeout cannot do, the state and the histories are files on the local disk
+// of a single host, and the invocations are not locked
+var unsupportedVariables = []string{"MAX_CHANGES", "MAX_CHANGE_PERCENT", "IGNORE_CHANGE_LIMITS", "STATE", "FULL", "CONTESTED_REPORT", "HISTORY", "LOCK"}
+
+// booleanVariables are the unsupported variables of boolean flags, only set
+// when true
+var booleanVariables = map[string]bool{"IGNORE_CHANGE_LIMITS": true, "FULL": true}
+
+// unsupportedSet returns the unsupported variables that are set. The boolean
+// ones are set when true or not a boolean.
+func unsupportedSet(getenv func(string) string) []string {
+	set := []string{}
+	for _, name := range unsupportedVariables {
+		value := getenv(name)
+		if value == "" {
+			continue
+		}
+		if booleanVariables[name] {
+			if b, err := strconv.ParseBool(value); err == nil && !b {
+				continue
+			}
+		}
+		set = append(set, name)
+	}
+	return set
+}
+
+// Modes of the invocations
+const (
+	modeScheduled = "scheduled"
+	modeEvents    = "events"
+)
+
+// result is returned by the function
+type result struct {
+	Mode string `json:"mode"`
+	// Complete is false when a scheduled run stopped before the timeout, the
+	// next run resuming from the checkpoint
+	Complete   bool               `json:"complete"`
+	Checkpoint *runner.Checkpoint `json:"checkpoint,omitempty"`
+	// Messages is the number of event messages processed
+	Messages int `json:"messages,omitempty"`
+}
+
+// payload holds the fields used to recognize the kind of invocation
+type payload struct {
+	Source     string `json:"source"`
+	DetailType string `json:"detail-type"`
+	// Records are the messages of an SQS trigger
+	Records []struct {
+		EventSource string `json:"eventSource"`
+		MessageID   string `json:"messageId"`
+		Body        string `json:"body"`
+	} `json:"Records"`
+}
+
+// handler handles the invocations of the function
+type handler struct {
+	sess           *session.Session
+	enabled        *runner.Providers
+	configFilePath string
+	// checkpoint is where the progress of the scheduled runs is saved
+	checkpoint *checkpointStore
+	// margin is how long before the timeout the scheduled runs stop
+	margin time.Duration
+}
+
+// Handle runs a full retagging for the scheduled events and retags the
+// created resources for the other events
+func (h *handler) Handle(ctx context.Context, raw json.RawMessage) (*result, error) {
+	m, version, err := runner.ReadConfigVersion(h.configFilePath)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load config file %s: %s", h.configFilePath, err)
+	}
+
+	var p payload
+	if len(bytes.TrimSpace(raw)) > 0 && !bytes.Equal(bytes.TrimSpace(raw), []byte("null")) {
+		if err = json.Unmarshal(raw, &p); err != nil {
+			return nil, fmt.Errorf("invalid payload: %s", err)
+		}
+	}
+
+	// Scheduled events and empty payloads trigger a full run
+	if p.DetailType == "Scheduled Event" || (p.Source == "" && len(p.Records) == 0 && p.DetailType == "") {
+		cp, err := h.checkpoint.Load()
+		if err != nil {
+			return nil, fmt.Errorf("unable to load the checkpoint: %s", err)
+		}
+		// A run is only resumed with the config it started with
+		if cp.ConfigHash != version {
+			if cp.Step != "" || len(cp.Done) > 0 {
+				log.WithFields(logrus.Fields{"done": cp.Done, "step": cp.Step}).Warn("The config changed since the checkpoint, starting the run over")
+			}
+			cp = &runner.Checkpoint{ConfigHash: version}
+		}
+		deadline := time.Time{}
+		if d, ok := ctx.Deadline(); ok {
+			deadline = d.Add(-h.margin)
+		}
+		res := &result{Mode: modeScheduled, Checkpoint: cp}
+		res.Complete = runner.RunSteps(ctx, h.enabled.Steps(h.sess, nil), m, cp, deadline, nil)
+		if res.Complete {
+			err = h.checkpoint.Delete()
+		} else {
+			err = h.checkpoint.Save(cp)
+		}
+		if err != nil {
+			return res, fmt.Errorf("unable to save the checkpoint: %s", err)
+		}
+		log.WithFields(logrus.Fields{"complete": res.Complete, "done": cp.Done}).Info("Scheduled run finished")
+		return res, nil
+	}
+
+	c := events.Consumer{Handlers: h.enabled.EventHandlers(h.sess, m, nil), Region: aws.StringValue(h.sess.Config.Region)}
+	messages := []*events.Message{}
+	for _, r := range p.Records {
+		if r.EventSource == "aws:sqs" {
+			messages = append(messages, &events.Message{ID: r.MessageID, Body: []byte(r.Body)})
+		}
+	}
+	if len(messages) == 0 {
+		messages = append(messages, &events.Message{ID: "payload", Body: raw})
+	}
+
+	failed := 0
+	for _, msg := range messages {
+		if !c.Process(ctx, msg) {
+			failed++
+		}
+	}
+	if failed > 0 {
+		// Failing the invocation has the events delivered again
+		return nil, fmt.Errorf("%d of the %d messages failed", failed, len(messages))
+	}
+	return &result{Mode: modeEvents, Complete: true, Messages: len(messages)}, nil
+}
+
+// checkpointStore saves the checkpoint of the scheduled runs in an S3 object.
+// Without bucket, the runs always start over.
+type checkpointStore struct {
+	svc         s3iface.S3API
+	bucket, key string
+}
+
+// newCheckpointStore creates a store from an s3://bucket/key URI
+func newCheckpointStore(sess *session.Session, uri string) (*checkpointStore, error) {
+	if uri == "" {
+		return &checkpointStore{}, nil
+	}
+	parts := strings.SplitN(strings.TrimPrefix(uri, "s3://"), "/", 2)
+	if !strings.HasPrefix(uri, "s3://") || len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("invalid checkpoint location %q, expecting s3://bucket/key", uri)
+	}
+	return &checkpointStore{svc: s3.New(sess), bucket: parts[0], key: parts[1]}, nil
+}
+
+// Load returns the saved checkpoint or an empty one if there is none
+func (s *checkpointStore) Load() (*runner.Checkpoint, error) {
+	cp := &runner.Checkpoint{}
+	if s.svc == nil {
+		return cp, nil
+	}
+	obj, err := s.svc.GetObject(&s3.GetObjectInput{Bucket: aws.String(s.bucket), Key: aws.String(s.key)})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchKey {
+			return cp, nil
+		}
+		return nil, err
+	}
+	defer obj.Body.Close()
+	return cp, json.NewDecoder(obj.Body).Decode(cp)
+}
+
+// Save saves the checkpoint
+func (s *checkpointStore) Save(cp *runner.Checkpoint) error {
+	if s.svc == nil {
+		log.Warn("No checkpoint location configured, the next run starts over")
+		return nil
+	}
+	body, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+	_, err = s.svc.PutObject(&s3.PutObjectInput{Bucket: aws.String(s.bucket), Key: aws.String(s.key), Body: bytes.NewReader(body)})
+	return err
+}
+
+// Delete removes the checkpoint once a run is complete
+func (s *checkpointStore) Delete() error {
+	if s.svc == nil {
+		return nil
+	}
+	_, err := s.svc.DeleteObject(&s3.DeleteObjectInput{Bucket: aws.String(s.bucket), Key: aws.String(s.key)})
+	return err
+}
+
+func main() {
+	var (
+		configFilePath, logLevel, logFormat, checkpointURI string
+		margin                                             time.Duration
+		enabled                                            runner.Providers
+		endpoints                                          runner.Endpoints
+		err                                                error
+	)
+	flag.StringVar(&configFilePath, "config", filepath.Join(os.Getenv("LAMBDA_TASK_ROOT"), "config.json"), "Path of the json configuration file, defaults to the one bundled with the function. Environment variable: CONFIG")
+	flag.StringVar(&logLevel, "log-level", "info", "Log level. Accepted values: debug, info, warn, error, fatal, panic. Environment variable: LOG_LEVEL")
+	flag.StringVar(&logFormat, "log-format", "json", "Log format. Accepted values: text, json. Environment variable: LOG_FORMAT")
+	flag.StringVar(&checkpointURI, "checkpoint", "", "S3 location (s3://bucket/key) where the progress of the scheduled runs is saved when they stop before the timeout. Environment variable: CHECKPOINT")
+	flag.DurationVar(&margin, "stop-before-timeout", 30*time.Second, "How long before the function timeout the scheduled runs stop. Environment variable: STOP_BEFORE_TIMEOUT")
+	enabled.RegisterFlags(flag.CommandLine)
+	endpoints.RegisterFlags(flag.CommandLine)
+	flag.Parse()
+	envflag.Parse()
+
+	if log, err = runner.NewLogger(logLevel, logFormat, os.Stdout); err != nil {
+		fmt.Printf("Error while setting up the logger: %s\n", err)
+		os.Exit(1)
+	}
+	runner.SetLoggers(log)
+	if set := unsupportedSet(os.Getenv); len(set) > 0 {
+		log.WithFields(logrus.Fields{"variables": strings.Join(set, ",")}).Fatal("Options of the command-line tool not supported by the Lambda function")
+	}
+
+	sess := session.Must(session.NewSession(endpoints.Config()))
+	store, err := newCheckpointStore(sess, checkpointURI)
+	if err != nil {
+		log.WithFields(logrus.Fields{"error": err}).Fatal("Invalid checkpoint location")
+	}
+
+	h := &handler{sess: sess, enabled: &enabled, configFilePath: configFilePath, checkpoint: store, margin: margin}
+	lambda.Start(h.Handle)
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/sirupsen/logrus"
+	logrus_test "github.com/sirupsen/logrus/hooks/test"
+
+	"github.com/VEVO/awsRetagger/runner"
+)
+
+func TestNewCheckpointStore(t *testing.T) {
+	testData := []struct {
+		uri, bucket, key string
+		expectedError    bool
+	}{
+		{"", "", "", false},
+		{"s3://my-bucket/retagger/checkpoint.json", "my-bucket", "retagger/checkpoint.json", false},
+		{"s3://my-bucket/", "", "", true},
+		{"s3://my-bucket", "", "", true},
+		{"my-bucket/checkpoint.json", "", "", true},
+	}
+	sess := session.Must(session.NewSession(&aws.Config{Region: aws.String("us-east-1")}))
+	for _, d := range testData {
+		s, err := newCheckpointStore(sess, d.uri)
+		if (err != nil) != d.expectedError {
+			t.Errorf("Unexpected error for %q: %v\n", d.uri, err)
+			continue
+		}
+		if err == nil && (s.bucket != d.bucket || s.key != d.key) {
+			t.Errorf("Expecting %q to give bucket %q and key %q, got %q and %q\n", d.uri, d.bucket, d.key, s.bucket, s.key)
+		}
+	}
+}
+
+func TestHandle(t *testing.T) {
+	logger, _ := logrus_test.NewNullLogger()
+	log = logrus.NewEntry(logger)
+	runner.SetLoggers(log)
+
+	testData := []struct {
+		payload       string
+		mode          string
+		messages      int
+		expectedError bool
+	}{
+		{`{"source": "aws.events", "detail-type": "Scheduled Event", "detail": {}}`, modeScheduled, 0, false},
+		{``, modeScheduled, 0, false},
+		{`{"source": "aws.s3", "detail-type": "AWS API Call via CloudTrail", "detail": {"eventSource": "s3.amazonaws.com", "eventName": "CreateBucket", "requestParameters": {"bucketName": "b"}}}`, modeEvents, 1, false},
+		{`{"Records": [{"eventSource": "aws:sqs", "messageId": "1", "body": "{}"}, {"eventSource": "aws:sqs", "messageId": "2", "body": "{}"}]}`, modeEvents, 2, false},
+		{`{"Records": [{"eventSource": "aws:sqs", "messageId": "1", "body": "{"}]}`, "", 0, true},
+	}
+	sess := session.Must(session.NewSession(&aws.Config{Region: aws.String("us-east-1")}))
+	h := &handler{sess: sess, enabled: &runner.Providers{}, configFilePath: "../../config-example.json", checkpoint: &checkpointStore{}, margin: time.Second}
+	for _, d := range testData {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		res, err := h.Handle(ctx, json.RawMessage(d.payload))
+		cancel()
+		if (err != nil) != d.expectedError {
+			t.Errorf("Unexpected error for %s: %v\n", d.payload, err)
+			continue
+		}
+		if err == nil && (res.Mode != d.mode || res.Messages != d.messages || !res.Complete) {
+			t.Errorf("Expecting %s to give a complete %s run of %d messages, got: %+v\n", d.payload, d.mode, d.messages, res)
+		}
+	}
+}
+
+// mockS3Client holds the checkpoint object in memory
+type mockS3Client struct {
+	s3iface.S3API
+	body []byte
+}
+
+func (m *mockS3Client) GetObject(input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	if m.body == nil {
+		return nil, awserr.New(s3.ErrCodeNoSuchKey, "no such key", nil)
+	}
+	return &s3.GetObjectOutput{Body: ioutil.NopCloser(bytes.NewReader(m.body))}, nil
+}
+
+func (m *mockS3Client) PutObject(input *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
+	body, err := ioutil.ReadAll(input.Body)
+	m.body = body
+	return &s3.PutObjectOutput{}, err
+}
+
+func (m *mockS3Client) DeleteObject(input *s3.DeleteObjectInput) (*s3.DeleteObjectOutput, error) {
+	m.body = nil
+	return &s3.DeleteObjectOutput{}, nil
+}
+
+func TestHandleCheckpointConfig(t *testing.T) {
+	logger, _ := logrus_test.NewNullLogger()
+	log = logrus.NewEntry(logger)
+	runner.SetLoggers(log)
+
+	configFilePath := "../../config-example.json"
+	_, version, err := runner.ReadConfigVersion(configFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testData := []struct {
+		configHash   string
+		expectedDone []string
+	}{
+		// resumed with the same config
+		{version, []string{"ec2_instances"}},
+		// started over once the config changed
+		{"previous", nil},
+		{"", nil},
+	}
+	sess := session.Must(session.NewSession(&aws.Config{Region: aws.String("us-east-1")}))
+	for _, d := range testData {
+		body, _ := json.Marshal(&runner.Checkpoint{ConfigHash: d.configHash, Done: []string{"ec2_instances"}})
+		svc := &mockS3Client{body: body}
+		h := &handler{sess: sess, enabled: &runner.Providers{}, configFilePath: configFilePath, checkpoint: &checkpointStore{svc: svc, bucket: "b", key: "k"}}
+		res, err := h.Handle(context.Background(), json.RawMessage(``))
+		if err != nil || !res.Complete {
+			t.Errorf("Expecting a complete run, got %+v (error: %v)\n", res, err)
+			continue
+		}
+		if res.Checkpoint.ConfigHash != version || !reflect.DeepEqual(res.Checkpoint.Done, d.expectedDone) {
+			t.Errorf("Expecting the checkpoint of the config %s done with %v, got %+v\n", version, d.expectedDone, res.Checkpoint)
+		}
+	}
+}
+
+func TestUnsupportedSet(t *testing.T) {
+	testData := []struct {
+		env      map[string]string
+		expected []string
+	}{
+		{map[string]string{"EC2_INSTANCES": "true", "MAX_CHANGES": "10", "HISTORY": "/tmp/history.db", "STATE": ""}, []string{"MAX_CHANGES", "HISTORY"}},
+		// the boolean ones are only set when true
+		{map[string]string{"FULL": "false", "IGNORE_CHANGE_LIMITS": "0"}, []string{}},
+		{map[string]string{"FULL": "TRUE", "IGNORE_CHANGE_LIMITS": "1"}, []string{"IGNORE_CHANGE_LIMITS", "FULL"}},
+		{map[string]string{"FULL": "yes"}, []string{"FULL"}},
+	}
+	for _, d := range testData {
+		env := d.env
+		set := unsupportedSet(func(name string) string { return env[name] })
+		if !reflect.DeepEqual(d.expected, set) {
+			t.Errorf("Expecting %v for %v, got %v\n", d.expected, d.env, set)
+		}
+	}
+}
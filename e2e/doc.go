@@ -0,0 +1,9 @@
+// Package e2e holds the end-to-end tests running the awsRetagger binary
+// against a LocalStack-compatible endpoint. They are behind the e2e build tag:
+//
+//	go test -tags e2e ./e2e
+//
+// The tests use the endpoint of the E2E_ENDPOINT environment variable, like
+// http://localhost:4566 for LocalStack, or a local fake of the EC2 and S3 APIs
+// when it is not set.
+package e2e
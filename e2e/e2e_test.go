@@ -0,0 +1,391 @@
+//go:build e2e
+// +build e2e
+
+package e2e
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/s3"
+
+	"github.com/VEVO/awsRetagger/lock"
+)
+
+// e2eConfig maps the Name of the instances and the name of the buckets
+const e2eConfig = `{
+  "tags": [{"source": {"name": "Name", "value": ".*prd.*"}, "destination": [{"name": "env", "value": "prd"}]}],
+  "keys": [{"pattern": ".*web.*", "destination": [{"name": "team", "value": "web"}]}]
+}`
+
+// binary is the path of the awsRetagger binary built for the tests
+var binary string
+
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "awsRetagger-e2e")
+	if err != nil {
+		panic(err)
+	}
+	binary = filepath.Join(dir, "awsRetagger")
+	build := exec.Command("go", "build", "-o", binary, "..")
+	build.Stdout, build.Stderr = os.Stdout, os.Stderr
+	if err = build.Run(); err != nil {
+		panic(err)
+	}
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// endpoint returns the endpoint of the tests, the fake serving it, if any, and
+// the function stopping it
+func endpoint() (string, *fakeAWS, func()) {
+	if url := os.Getenv("E2E_ENDPOINT"); url != "" {
+		return url, nil, func() {}
+	}
+	fake := newFakeAWS()
+	server := httptest.NewServer(fake)
+	return server.URL, fake, server.Close
+}
+
+// retagCommand returns the retag command of the binary against the endpoint
+// and the function removing its files
+func retagCommand(t *testing.T, url string, args ...string) (*exec.Cmd, func()) {
+	dir, err := ioutil.TempDir("", "awsRetagger-e2e")
+	if err != nil {
+		t.Fatal(err)
+	}
+	configPath := filepath.Join(dir, "config.json")
+	if err := ioutil.WriteFile(configPath, []byte(e2eConfig), 0644); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	args = append([]string{"retag", "-config", configPath, "-endpoint", "ec2=" + url + ",s3=" + url + ",sts=" + url}, args...)
+	cmd := exec.Command(binary, args...)
+	cmd.Env = []string{
+		"HOME=" + dir,
+		"AWS_REGION=us-east-1",
+		"AWS_ACCESS_KEY_ID=test",
+		"AWS_SECRET_ACCESS_KEY=test",
+	}
+	return cmd, func() { os.RemoveAll(dir) }
+}
+
+// retag runs the retag command of the binary against the endpoint and returns
+// its output
+func retag(t *testing.T, url string, args ...string) string {
+	cmd, cleanup := retagCommand(t, url, args...)
+	defer cleanup()
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("The retag command failed: %v\n%s", err, out)
+	}
+	return string(out)
+}
+
+func TestRetagEndToEnd(t *testing.T) {
+	url, fake, stop := endpoint()
+	defer stop()
+	sess := session.Must(session.NewSession(&aws.Config{
+		Region:           aws.String("us-east-1"),
+		Endpoint:         aws.String(url),
+		S3ForcePathStyle: aws.Bool(true),
+		Credentials:      credentials.NewStaticCredentials("test", "test", ""),
+	}))
+	ec2Svc, s3Svc := ec2.New(sess), s3.New(sess)
+
+	run, err := ec2Svc.RunInstances(&ec2.RunInstancesInput{
+		ImageId:  aws.String("ami-12345678"),
+		MinCount: aws.Int64(1),
+		MaxCount: aws.Int64(1),
+		TagSpecifications: []*ec2.TagSpecification{{
+			ResourceType: aws.String("instance"),
+			Tags:         []*ec2.Tag{{Key: aws.String("Name"), Value: aws.String("api-prd")}},
+		}},
+	})
+	if err != nil {
+		t.Fatalf("RunInstances failed: %v", err)
+	}
+	instanceID := run.Instances[0].InstanceId
+	bucket := aws.String("e2e-web-assets")
+	if _, err = s3Svc.CreateBucket(&s3.CreateBucketInput{Bucket: bucket}); err != nil {
+		t.Fatalf("CreateBucket failed: %v", err)
+	}
+	_, err = s3Svc.PutBucketTagging(&s3.PutBucketTaggingInput{Bucket: bucket, Tagging: &s3.Tagging{TagSet: []*s3.Tag{{Key: aws.String("Owner"), Value: aws.String("me")}}}})
+	if err != nil {
+		t.Fatalf("PutBucketTagging failed: %v", err)
+	}
+
+	out := retag(t, url, "-ec2-instances", "-s3-buckets")
+	if fake != nil && !strings.Contains(out, "arn:aws:iam::123456789012:user/e2e") {
+		t.Errorf("Expecting the identity of the credentials to be logged, got:\n%s", out)
+	}
+
+	instances, err := ec2Svc.DescribeInstances(&ec2.DescribeInstancesInput{InstanceIds: []*string{instanceID}})
+	if err != nil {
+		t.Fatalf("DescribeInstances failed: %v", err)
+	}
+	instanceTags := map[string]string{}
+	for _, tag := range instances.Reservations[0].Instances[0].Tags {
+		instanceTags[*tag.Key] = *tag.Value
+	}
+	if expected := map[string]string{"Name": "api-prd", "env": "prd"}; !reflect.DeepEqual(instanceTags, expected) {
+		t.Errorf("Expecting the instance tags: %v\nGot: %v\n", expected, instanceTags)
+	}
+
+	tagging, err := s3Svc.GetBucketTagging(&s3.GetBucketTaggingInput{Bucket: bucket})
+	if err != nil {
+		t.Fatalf("GetBucketTagging failed: %v", err)
+	}
+	bucketTags := map[string]string{}
+	for _, tag := range tagging.TagSet {
+		bucketTags[*tag.Key] = *tag.Value
+	}
+	if expected := map[string]string{"Owner": "me", "team": "web"}; !reflect.DeepEqual(bucketTags, expected) {
+		t.Errorf("Expecting the bucket tags: %v\nGot: %v\n", expected, bucketTags)
+	}
+
+	// a 2nd run has nothing to change
+	if fake != nil {
+		writes := fake.writes
+		retag(t, url, "-ec2-instances", "-s3-buckets")
+		if fake.writes != writes {
+			t.Errorf("Expecting no tagging call on the 2nd run, got: %d\n", fake.writes-writes)
+		}
+	}
+}
+
+// retagInterrupted runs the retag command against the fake, interrupting it
+// while listing the instances, and returns its output
+func retagInterrupted(t *testing.T, url string, fake *fakeAWS, args ...string) string {
+	fake.mu.Lock()
+	fake.listing = make(chan struct{}, 1)
+	fake.mu.Unlock()
+	defer func() {
+		fake.mu.Lock()
+		fake.listing = nil
+		fake.mu.Unlock()
+	}()
+
+	cmd, cleanup := retagCommand(t, url, args...)
+	defer cleanup()
+	var out bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &out, &out
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	// the run is interrupted while listing the instances
+	select {
+	case <-fake.listing:
+	case <-time.After(time.Minute):
+		cmd.Process.Kill()
+		t.Fatalf("The instances were never listed:\n%s", out.String())
+	}
+	cmd.Process.Signal(os.Interrupt)
+
+	err := cmd.Wait()
+	if exitErr, ok := err.(*exec.ExitError); !ok || exitErr.Sys().(syscall.WaitStatus).ExitStatus() != 130 {
+		t.Errorf("Expecting the exit code 130, got: %v\n%s", err, out.String())
+	}
+	if !strings.Contains(out.String(), "Run interrupted") {
+		t.Errorf("Expecting the run to be logged as interrupted, got:\n%s", out.String())
+	}
+	return out.String()
+}
+
+func TestRetagInterrupted(t *testing.T) {
+	fake := newFakeAWS()
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	fake.buckets, fake.tags["e2e-web-assets"] = []string{"e2e-web-assets"}, map[string]string{}
+
+	retagInterrupted(t, server.URL, fake, "-ec2-instances", "-s3-buckets")
+	// the buckets are never reached
+	if fake.writes != 0 {
+		t.Errorf("Expecting no tagging call, got: %d\n", fake.writes)
+	}
+}
+
+func TestRetagResume(t *testing.T) {
+	fake := newFakeAWS()
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	fake.buckets, fake.tags["e2e-web-assets"] = []string{"e2e-web-assets"}, map[string]string{}
+	dir, err := ioutil.TempDir("", "awsRetagger-e2e")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	args := []string{"-ec2-instances", "-s3-buckets", "-checkpoint-dir", dir}
+
+	out := retagInterrupted(t, server.URL, fake, args...)
+	match := regexp.MustCompile(`run_id=(\S+)`).FindStringSubmatch(out)
+	if match == nil {
+		t.Fatalf("Expecting the run ID to be logged, got:\n%s", out)
+	}
+	runID := match[1]
+
+	// a changed config is refused
+	changed := filepath.Join(dir, "changed.json")
+	if err = ioutil.WriteFile(changed, []byte(`{"tags": []}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cmd, cleanup := retagCommand(t, server.URL, append(args, "-config", changed, "-resume", runID)...)
+	output, err := cmd.CombinedOutput()
+	cleanup()
+	if err == nil || !strings.Contains(string(output), "The config changed since the checkpoint") {
+		t.Errorf("Expecting the resume with a changed config to be refused, got: %v\n%s", err, output)
+	}
+
+	out = retag(t, server.URL, append(args, "-resume", runID)...)
+	if !strings.Contains(out, "Resuming run") {
+		t.Errorf("Expecting the run to be resumed, got:\n%s", out)
+	}
+	if expected := map[string]string{"team": "web"}; !reflect.DeepEqual(fake.tags["e2e-web-assets"], expected) {
+		t.Errorf("Expecting the bucket tags %v once resumed, got %v\n%s", expected, fake.tags["e2e-web-assets"], out)
+	}
+	// the checkpoint of the complete run is removed
+	if _, err = os.Stat(filepath.Join(dir, runID+".json")); !os.IsNotExist(err) {
+		t.Errorf("Expecting the checkpoint of the complete run to be removed, got: %v\n", err)
+	}
+}
+
+func TestRetagLocked(t *testing.T) {
+	fake := newFakeAWS()
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	fake.buckets, fake.tags["e2e-web-assets"] = []string{"e2e-web-assets"}, map[string]string{}
+	dir, err := ioutil.TempDir("", "awsRetagger-e2e")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	args := []string{"-s3-buckets", "-lock", "file", "-lock-dir", dir}
+
+	// another run on the buckets, whatever its region, holds the lock of the
+	// account
+	backend := &lock.FileBackend{Dir: dir}
+	key := lock.AccountKey("123456789012")
+	if err = backend.Acquire(context.Background(), key, "cron:1", time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	cmd, cleanup := retagCommand(t, server.URL, args...)
+	out, err := cmd.CombinedOutput()
+	cleanup()
+	if exitErr, ok := err.(*exec.ExitError); !ok || exitErr.Sys().(syscall.WaitStatus).ExitStatus() != 5 {
+		t.Errorf("Expecting the exit code 5, got: %v\n%s", err, out)
+	}
+	if !strings.Contains(string(out), "held by cron:1") || fake.writes != 0 {
+		t.Errorf("Expecting the run to stop on the lock held by cron:1 without tagging, got %d tagging calls:\n%s", fake.writes, out)
+	}
+
+	// the lock is taken and released once free
+	if err = backend.Release(context.Background(), key, "cron:1"); err != nil {
+		t.Fatal(err)
+	}
+	out2 := retag(t, server.URL, args...)
+	if !strings.Contains(out2, "Lock acquired") || fake.writes == 0 {
+		t.Errorf("Expecting the run to take the lock and tag the bucket, got:\n%s", out2)
+	}
+	for _, k := range []string{key, lock.Key("123456789012", "us-east-1")} {
+		if err = backend.Acquire(context.Background(), k, "cron:1", time.Now().Add(time.Hour)); err != nil {
+			t.Errorf("Expecting the lock %s to be released at the end of the run, got: %v\n", k, err)
+		}
+	}
+}
+
+func TestRetagContested(t *testing.T) {
+	fake := newFakeAWS()
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	fake.buckets, fake.tags["e2e-web-assets"] = []string{"e2e-web-assets"}, map[string]string{}
+	dir, err := ioutil.TempDir("", "awsRetagger-e2e")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	reportPath := filepath.Join(dir, "contested.txt")
+	args := []string{"-s3-buckets", "-history", filepath.Join(dir, "history.db"), "-flap-threshold", "2", "-flap-max-rewrites", "2", "-contested-report", reportPath}
+
+	// something else removes the team tag after each run
+	for i := 0; i < 3; i++ {
+		retag(t, server.URL, args...)
+		fake.mu.Lock()
+		team := fake.tags["e2e-web-assets"]["team"]
+		delete(fake.tags["e2e-web-assets"], "team")
+		fake.mu.Unlock()
+		if team != "web" {
+			t.Fatalf("Expecting the run %d to set the team tag, got %q\n", i, team)
+		}
+	}
+	report, err := ioutil.ReadFile(reportPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !regexp.MustCompile(`e2e-web-assets\s+team\s+"web"\s+2\s+\S+\s+"" \(2\)`).Match(report) {
+		t.Errorf("Expecting the team tag to be reported as contested, got:\n%s", report)
+	}
+
+	// not rewritten after the max rewrites
+	writes := fake.writes
+	out := retag(t, server.URL, args...)
+	if !strings.Contains(out, "not rewriting it") || fake.writes != writes || fake.tags["e2e-web-assets"]["team"] != "" {
+		t.Errorf("Expecting the contested tag not to be rewritten, got %d tagging calls:\n%s", fake.writes-writes, out)
+	}
+}
+
+func TestRetagHistory(t *testing.T) {
+	fake := newFakeAWS()
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	fake.buckets, fake.tags["e2e-web-assets"] = []string{"e2e-web-assets"}, map[string]string{}
+	dir, err := ioutil.TempDir("", "awsRetagger-e2e")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db := filepath.Join(dir, "history.db")
+	out := retag(t, server.URL, "-s3-buckets", "-history", db)
+	if !strings.Contains(out, "recorded=1") {
+		t.Errorf("Expecting the change to be recorded, got:\n%s", out)
+	}
+
+	// the history command needs no AWS access
+	testData := []struct {
+		args     []string
+		expected string
+	}{
+		{[]string{"history", "arn:aws:s3:::e2e-web-assets", "-history", db, "-format", "csv"}, `e2e-web-assets,team,,web,keys,`},
+		{[]string{"history", "-history", db, "-key", "team", "-value", "web", "-since", "1d", "-format", "csv"}, `e2e-web-assets,team,,web,keys,`},
+		{[]string{"history", "-history", db, "-key", "team", "-value", "data", "-format", "csv"}, ""},
+		{[]string{"history", "i-123", "-history", db, "-format", "csv"}, ""},
+	}
+	for _, d := range testData {
+		cmd := exec.Command(binary, d.args...)
+		cmd.Env = []string{"HOME=" + dir}
+		out, err := cmd.Output()
+		if err != nil {
+			t.Errorf("The history command failed with %v: %v\n", d.args, err)
+			continue
+		}
+		lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+		if d.expected == "" && len(lines) != 1 || d.expected != "" && (len(lines) != 2 || !strings.Contains(lines[1], d.expected)) {
+			t.Errorf("Expecting %q with %v, got:\n%s", d.expected, d.args, out)
+		}
+	}
+}
@@ -0,0 +1,205 @@
+//go:build e2e
+// +build e2e
+
+package e2e
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// fakeAWS serves the subset of the EC2 and STS query APIs and of the S3 REST
+// API, with path-style addressing, used by the tests
+type fakeAWS struct {
+	mu        sync.Mutex
+	instances []string
+	buckets   []string
+	// tags are the tags of the instances and the buckets by ID or name
+	tags map[string]map[string]string
+	// writes counts the tagging calls
+	writes int
+	// listing, when set, receives a value at each DescribeInstances call,
+	// which then hangs until the request is cancelled
+	listing chan struct{}
+}
+
+func newFakeAWS() *fakeAWS {
+	return &fakeAWS{tags: make(map[string]map[string]string)}
+}
+
+type fakeTag struct {
+	Key   string `xml:"key"`
+	Value string `xml:"value"`
+}
+
+type fakeInstance struct {
+	InstanceID string `xml:"instanceId"`
+	State      struct {
+		Code int    `xml:"code"`
+		Name string `xml:"name"`
+	} `xml:"instanceState"`
+	Tags []fakeTag `xml:"tagSet>item"`
+}
+
+type fakeS3Tag struct {
+	Key   string `xml:"Key"`
+	Value string `xml:"Value"`
+}
+
+type fakeTagging struct {
+	XMLName xml.Name    `xml:"Tagging"`
+	TagSet  []fakeS3Tag `xml:"TagSet>Tag"`
+}
+
+func (f *fakeAWS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	listing := f.listing
+	f.mu.Unlock()
+	if listing != nil && r.Method == http.MethodPost && r.URL.Path == "/" && r.FormValue("Action") == "DescribeInstances" {
+		listing <- struct{}{}
+		<-r.Context().Done()
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if r.Method == http.MethodPost && r.URL.Path == "/" {
+		f.serveQuery(w, r)
+		return
+	}
+	f.serveS3(w, r)
+}
+
+func (f *fakeAWS) serveQuery(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	switch action := r.Form.Get("Action"); action {
+	case "RunInstances":
+		id := fmt.Sprintf("i-%08d", len(f.instances)+1)
+		f.instances = append(f.instances, id)
+		f.tags[id] = formTags(r, "TagSpecification.1.Tag")
+		writeXML(w, "RunInstancesResponse", "<reservationId>r-1</reservationId><instancesSet><item>"+f.instanceXML(id)+"</item></instancesSet>")
+	case "DescribeInstances":
+		ids := formList(r, "InstanceId")
+		if len(ids) == 0 {
+			ids = f.instances
+		}
+		items := ""
+		for _, id := range ids {
+			items += "<item>" + f.instanceXML(id) + "</item>"
+		}
+		writeXML(w, "DescribeInstancesResponse", "<reservationSet><item><reservationId>r-1</reservationId><instancesSet>"+items+"</instancesSet></item></reservationSet>")
+	case "GetCallerIdentity":
+		writeXML(w, "GetCallerIdentityResponse", "<GetCallerIdentityResult><Account>123456789012</Account><Arn>arn:aws:iam::123456789012:user/e2e</Arn><UserId>AIDAE2E</UserId></GetCallerIdentityResult>")
+	case "CreateTags":
+		f.writes++
+		for _, id := range formList(r, "ResourceId") {
+			for k, v := range formTags(r, "Tag") {
+				f.tags[id][k] = v
+			}
+		}
+		writeXML(w, "CreateTagsResponse", "<return>true</return>")
+	default:
+		http.Error(w, "unsupported action "+action, http.StatusBadRequest)
+	}
+}
+
+func (f *fakeAWS) instanceXML(id string) string {
+	instance := fakeInstance{InstanceID: id}
+	instance.State.Code, instance.State.Name = 16, "running"
+	for _, k := range sortedKeys(f.tags[id]) {
+		instance.Tags = append(instance.Tags, fakeTag{Key: k, Value: f.tags[id][k]})
+	}
+	out, _ := xml.Marshal(instance)
+	// only the content of the instance is kept
+	s := string(out)
+	return s[len("<fakeInstance>") : len(s)-len("</fakeInstance>")]
+}
+
+func (f *fakeAWS) serveS3(w http.ResponseWriter, r *http.Request) {
+	bucket := strings.Trim(r.URL.Path, "/")
+	_, tagging := r.URL.Query()["tagging"]
+	_, location := r.URL.Query()["location"]
+	switch {
+	case bucket == "" && r.Method == http.MethodGet:
+		items := ""
+		for _, b := range f.buckets {
+			items += "<Bucket><Name>" + b + "</Name><CreationDate>2017-11-22T10:00:00.000Z</CreationDate></Bucket>"
+		}
+		writeXML(w, "ListAllMyBucketsResult", "<Owner><ID>e2e</ID></Owner><Buckets>"+items+"</Buckets>")
+	case f.tags[bucket] == nil && r.Method == http.MethodPut && !tagging:
+		f.buckets = append(f.buckets, bucket)
+		f.tags[bucket] = map[string]string{}
+	case f.tags[bucket] == nil:
+		s3Error(w, http.StatusNotFound, "NoSuchBucket")
+	case location:
+		writeXML(w, "LocationConstraint", "")
+	case tagging && r.Method == http.MethodGet:
+		if len(f.tags[bucket]) == 0 {
+			s3Error(w, http.StatusNotFound, "NoSuchTagSet")
+			return
+		}
+		t := fakeTagging{}
+		for _, k := range sortedKeys(f.tags[bucket]) {
+			t.TagSet = append(t.TagSet, fakeS3Tag{Key: k, Value: f.tags[bucket][k]})
+		}
+		out, _ := xml.Marshal(t)
+		w.Write(out)
+	case tagging && r.Method == http.MethodPut:
+		f.writes++
+		t := fakeTagging{}
+		if err := xml.NewDecoder(r.Body).Decode(&t); err != nil {
+			s3Error(w, http.StatusBadRequest, "MalformedXML")
+			return
+		}
+		f.tags[bucket] = map[string]string{}
+		for _, tag := range t.TagSet {
+			f.tags[bucket][tag.Key] = tag.Value
+		}
+	default:
+		s3Error(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+// formList returns the values of the prefix.N parameters
+func formList(r *http.Request, prefix string) []string {
+	values := []string{}
+	for i := 1; r.Form.Get(fmt.Sprintf("%s.%d", prefix, i)) != ""; i++ {
+		values = append(values, r.Form.Get(fmt.Sprintf("%s.%d", prefix, i)))
+	}
+	return values
+}
+
+// formTags returns the tags of the prefix.N.Key and prefix.N.Value parameters
+func formTags(r *http.Request, prefix string) map[string]string {
+	tags := map[string]string{}
+	for i := 1; r.Form.Get(fmt.Sprintf("%s.%d.Key", prefix, i)) != ""; i++ {
+		tags[r.Form.Get(fmt.Sprintf("%s.%d.Key", prefix, i))] = r.Form.Get(fmt.Sprintf("%s.%d.Value", prefix, i))
+	}
+	return tags
+}
+
+func writeXML(w http.ResponseWriter, root, content string) {
+	w.Header().Set("Content-Type", "text/xml")
+	fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?><%s><requestId>e2e</requestId>%s</%s>`, root, content, root)
+}
+
+func s3Error(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?><Error><Code>%s</Code><Message>%s</Message></Error>`, code, code)
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := []string{}
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"os"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/sirupsen/logrus"
+
+	"github.com/VEVO/awsRetagger/events"
+	"github.com/VEVO/awsRetagger/metrics"
+	"github.com/VEVO/awsRetagger/runner"
+)
+
+// newEventSource returns the source of the events: the standard input for -,
+// an SQS queue for a queue URL and a file otherwise
+func newEventSource(sess *session.Session, eventsSource string) events.Source {
+	switch {
+	case eventsSource == "-":
+		return events.NewReaderSource(os.Stdin, "stdin")
+	case events.IsQueueURL(eventsSource):
+		return events.NewSQSSource(sqs.New(sess), eventsSource)
+	}
+	f, err := os.Open(eventsSource)
+	if err != nil {
+		log.WithFields(logrus.Fields{"error": err, "path": eventsSource}).Fatal("Unable to read the events file")
+	}
+	return events.NewReaderSource(f, eventsSource)
+}
+
+// consumeEvents retags the resources created by the events of the given
+// source as they come, until the context is cancelled
+func consumeEvents(ctx context.Context, sess *session.Session, enabled *runner.Providers, collector *metrics.Collector, hist *changeHistory, configFilePath, eventsSource string) {
+	m, _ := loadConfig(configFilePath)
+	if collector != nil {
+		m.SanityRecorders = append(m.SanityRecorders, collector)
+	}
+
+	// The changes are recorded as they come, as the consumer runs until
+	// stopped
+	c := events.Consumer{
+		Source:   newEventSource(sess, eventsSource),
+		Handlers: enabled.EventHandlers(sess, hist.Mapper(m, newRunID(), 1), collector),
+		Region:   aws.StringValue(sess.Config.Region),
+	}
+	if err := c.Run(ctx); err != nil {
+		log.WithFields(logrus.Fields{"error": err, "source": eventsSource}).Fatal("Unable to receive the events")
+	}
+}
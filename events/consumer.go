@@ -0,0 +1,90 @@
+package events
+
+import (
+	"context"
+	"io"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Handler fetches the resource of the given ID and retags it
+type Handler func(ctx context.Context, id *string) error
+
+// regionless holds the providers of which the resources are not filtered by
+// region: CloudFront is a global service and the S3 provider checks the
+// location of the buckets by itself
+var regionless = map[string]bool{CloudFrontDistributions: true, S3Buckets: true}
+
+// Consumer retags the resources created by the events of a Source
+type Consumer struct {
+	Source Source
+	// Handlers holds the handler of each provider. The resources of the
+	// providers without handler are ignored.
+	Handlers map[string]Handler
+	// Region is the region of the clients used by the handlers. The resources
+	// of the other regions are ignored.
+	Region string
+}
+
+// Run processes the messages until the source has no more or the context is
+// cancelled. The messages are acknowledged when all their resources have been
+// retagged, so the failed ones can be received again when the source supports
+// it, like the ones interrupted.
+func (c *Consumer) Run(ctx context.Context) error {
+	for ctx.Err() == nil {
+		messages, err := c.Source.Receive(ctx)
+		if err == io.EOF || ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		for _, msg := range messages {
+			if !c.Process(ctx, msg) {
+				continue
+			}
+			if err = c.Source.Done(msg); err != nil {
+				log.WithFields(logrus.Fields{"error": err, "message": msg.ID}).Error("Unable to acknowledge the message")
+			}
+		}
+	}
+	return nil
+}
+
+// Process retags the resources created by the events of the message and
+// returns true when there was no error. Once the context is cancelled, the
+// remaining resources are skipped and false is returned.
+func (c *Consumer) Process(ctx context.Context, msg *Message) bool {
+	resources, err := Parse(msg.Body)
+	if err != nil {
+		log.WithFields(logrus.Fields{"error": err, "message": msg.ID}).Error("Unable to parse the message")
+		return false
+	}
+
+	ok := true
+	for _, r := range resources {
+		if ctx.Err() != nil {
+			log.WithFields(logrus.Fields{"message": msg.ID}).Warn("Interrupted, leaving the message to be received again")
+			return false
+		}
+		fields := logrus.Fields{"message": msg.ID, "provider": r.Provider, "resource": r.ID, "event": r.EventName}
+		handler, found := c.Handlers[r.Provider]
+		if !found {
+			log.WithFields(fields).Debug("Skipping resource of a provider that is not enabled")
+			continue
+		}
+		if !regionless[r.Provider] && c.Region != "" && r.Region != "" && r.Region != c.Region {
+			fields["region"] = r.Region
+			log.WithFields(fields).Debug("Skipping resource in different region than session")
+			continue
+		}
+		if err = handler(ctx, &r.ID); err != nil {
+			fields["error"] = err
+			log.WithFields(fields).Error("Unable to retag the resource")
+			ok = false
+			continue
+		}
+		log.WithFields(fields).Info("Resource retagged from event")
+	}
+	return ok
+}
@@ -0,0 +1,171 @@
+package events
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// Providers of the resources, named like the providers of the metrics
+const (
+	Ec2Instances                 = "ec2_instances"
+	RdsInstances                 = "rds_instances"
+	RdsClusters                  = "rds_clusters"
+	CloudwatchLogGroups          = "cloudwatch_log_groups"
+	ElasticsearchDomains         = "elasticsearch_domains"
+	CloudFrontDistributions      = "cloudfront_distributions"
+	RedshiftClusters             = "redshift_clusters"
+	S3Buckets                    = "s3_buckets"
+	ElasticBeanstalkEnvironments = "elasticbeanstalk_environments"
+)
+
+// Resource is a resource created by an API call
+type Resource struct {
+	// Provider is the kind of the resource, one of the constants above
+	Provider string
+	// ID is the identifier used to fetch the resource from its provider
+	ID string
+	// Region is the region of the API call
+	Region string
+	// EventName is the API call that created the resource
+	EventName string
+}
+
+// creationCall defines where to find the identifiers of the resources created
+// by an API call in its CloudTrail record
+type creationCall struct {
+	provider string
+	// paths are the dot-separated paths of the identifiers, the 1st path
+	// giving identifiers is used
+	paths []string
+}
+
+// creationCalls holds the supported API calls by event source and event name
+var creationCalls = map[string]map[string]creationCall{
+	"ec2.amazonaws.com": {
+		"RunInstances": {Ec2Instances, []string{"responseElements.instancesSet.items.instanceId"}},
+	},
+	"rds.amazonaws.com": {
+		"CreateDBInstance":                {RdsInstances, []string{"responseElements.dBInstanceIdentifier", "requestParameters.dBInstanceIdentifier"}},
+		"CreateDBInstanceReadReplica":     {RdsInstances, []string{"responseElements.dBInstanceIdentifier", "requestParameters.dBInstanceIdentifier"}},
+		"RestoreDBInstanceFromDBSnapshot": {RdsInstances, []string{"responseElements.dBInstanceIdentifier", "requestParameters.dBInstanceIdentifier"}},
+		"RestoreDBInstanceToPointInTime":  {RdsInstances, []string{"responseElements.dBInstanceIdentifier", "requestParameters.targetDBInstanceIdentifier"}},
+		"CreateDBCluster":                 {RdsClusters, []string{"responseElements.dBClusterIdentifier", "requestParameters.dBClusterIdentifier"}},
+		"RestoreDBClusterFromSnapshot":    {RdsClusters, []string{"responseElements.dBClusterIdentifier", "requestParameters.dBClusterIdentifier"}},
+		"RestoreDBClusterToPointInTime":   {RdsClusters, []string{"responseElements.dBClusterIdentifier", "requestParameters.dBClusterIdentifier"}},
+		"RestoreDBInstanceFromS3":         {RdsInstances, []string{"responseElements.dBInstanceIdentifier", "requestParameters.dBInstanceIdentifier"}},
+		"RestoreDBClusterFromS3":          {RdsClusters, []string{"responseElements.dBClusterIdentifier", "requestParameters.dBClusterIdentifier"}},
+	},
+	"logs.amazonaws.com": {
+		"CreateLogGroup": {CloudwatchLogGroups, []string{"requestParameters.logGroupName"}},
+	},
+	"es.amazonaws.com": {
+		"CreateElasticsearchDomain": {ElasticsearchDomains, []string{"requestParameters.domainName"}},
+	},
+	"cloudfront.amazonaws.com": {
+		"CreateDistribution":         {CloudFrontDistributions, []string{"responseElements.distribution.id"}},
+		"CreateDistributionWithTags": {CloudFrontDistributions, []string{"responseElements.distribution.id"}},
+	},
+	"redshift.amazonaws.com": {
+		"CreateCluster":              {RedshiftClusters, []string{"responseElements.clusterIdentifier", "requestParameters.clusterIdentifier"}},
+		"RestoreFromClusterSnapshot": {RedshiftClusters, []string{"responseElements.clusterIdentifier", "requestParameters.clusterIdentifier"}},
+	},
+	"s3.amazonaws.com": {
+		"CreateBucket": {S3Buckets, []string{"requestParameters.bucketName"}},
+	},
+}
+
+// record holds the fields of a CloudTrail record used to find the created
+// resources
+type record struct {
+	EventSource       string                 `json:"eventSource"`
+	EventName         string                 `json:"eventName"`
+	AwsRegion         string                 `json:"awsRegion"`
+	ErrorCode         string                 `json:"errorCode"`
+	RequestParameters map[string]interface{} `json:"requestParameters"`
+	ResponseElements  map[string]interface{} `json:"responseElements"`
+}
+
+// envelope holds the fields of the supported message formats: EventBridge
+// events, CloudTrail log files, single CloudTrail records and SNS
+// notifications wrapping any of those
+type envelope struct {
+	record
+	// Detail is the CloudTrail record of an EventBridge event
+	Detail *record `json:"detail"`
+	// Records are the CloudTrail records of a CloudTrail log file
+	Records []*record `json:"Records"`
+	// Type and Message are the fields of an SNS notification
+	Type    string `json:"Type"`
+	Message string `json:"Message"`
+}
+
+// Parse returns the resources created by the API calls of a message. The
+// message is either an EventBridge event, a CloudTrail log file, a single
+// CloudTrail record or an SNS notification wrapping one of those. The failed
+// calls and the calls that do not create a supported resource are ignored.
+func Parse(message []byte) ([]*Resource, error) {
+	var e envelope
+	if err := json.Unmarshal(message, &e); err != nil {
+		return nil, err
+	}
+	if e.Type == "Notification" && e.Message != "" {
+		return Parse([]byte(e.Message))
+	}
+
+	records := e.Records
+	if e.Detail != nil {
+		records = append(records, e.Detail)
+	}
+	if e.EventName != "" {
+		records = append(records, &e.record)
+	}
+
+	resources := []*Resource{}
+	for _, r := range records {
+		resources = append(resources, r.resources()...)
+	}
+	return resources, nil
+}
+
+// resources returns the resources created by the API call of the record
+func (r *record) resources() []*Resource {
+	call, ok := creationCalls[r.EventSource][r.EventName]
+	if !ok || r.ErrorCode != "" {
+		return nil
+	}
+	fields := map[string]interface{}{"requestParameters": r.RequestParameters, "responseElements": r.ResponseElements}
+	for _, path := range call.paths {
+		ids := lookup(fields, strings.Split(path, "."))
+		if len(ids) == 0 {
+			continue
+		}
+		resources := []*Resource{}
+		for _, id := range ids {
+			resources = append(resources, &Resource{Provider: call.provider, ID: id, Region: r.AwsRegion, EventName: r.EventName})
+		}
+		return resources
+	}
+	return nil
+}
+
+// lookup returns the string values found at the given path, walking through
+// all the items of the arrays met on the way
+func lookup(value interface{}, path []string) []string {
+	switch v := value.(type) {
+	case string:
+		if len(path) == 0 && v != "" {
+			return []string{v}
+		}
+	case []interface{}:
+		values := []string{}
+		for _, item := range v {
+			values = append(values, lookup(item, path)...)
+		}
+		return values
+	case map[string]interface{}:
+		if len(path) > 0 {
+			return lookup(v[path[0]], path[1:])
+		}
+	}
+	return nil
+}
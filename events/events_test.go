@@ -0,0 +1,165 @@
+package events
+
+import (
+	"context"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	logrus_test "github.com/sirupsen/logrus/hooks/test"
+)
+
+const (
+	runInstancesEvent = `{
+  "version": "0",
+  "detail-type": "AWS API Call via CloudTrail",
+  "source": "aws.ec2",
+  "region": "us-east-1",
+  "detail": {
+    "eventSource": "ec2.amazonaws.com",
+    "eventName": "RunInstances",
+    "awsRegion": "us-east-1",
+    "requestParameters": {"instanceType": "t2.micro"},
+    "responseElements": {"instancesSet": {"items": [{"instanceId": "i-0123"}, {"instanceId": "i-4567"}]}}
+  }
+}`
+	createBucketRecord = `{"eventSource": "s3.amazonaws.com", "eventName": "CreateBucket", "awsRegion": "us-west-2", "requestParameters": {"bucketName": "my-bucket"}, "responseElements": null}`
+	cloudTrailLog      = `{"Records": [
+  {"eventSource": "rds.amazonaws.com", "eventName": "CreateDBInstance", "awsRegion": "us-east-1", "requestParameters": {"dBInstanceIdentifier": "mydb"}, "responseElements": {"dBInstanceIdentifier": "mydb", "dBInstanceArn": "arn:aws:rds:us-east-1:123456789012:db:mydb"}},
+  {"eventSource": "logs.amazonaws.com", "eventName": "CreateLogGroup", "awsRegion": "us-east-1", "requestParameters": {"logGroupName": "/my/group"}, "responseElements": null},
+  {"eventSource": "logs.amazonaws.com", "eventName": "CreateLogGroup", "awsRegion": "us-east-1", "errorCode": "ResourceAlreadyExistsException", "requestParameters": {"logGroupName": "/my/other"}, "responseElements": null},
+  {"eventSource": "ec2.amazonaws.com", "eventName": "DescribeInstances", "awsRegion": "us-east-1", "requestParameters": {}, "responseElements": null}
+]}`
+	createDistributionEvent = `{"source": "aws.cloudfront", "detail": {"eventSource": "cloudfront.amazonaws.com", "eventName": "CreateDistributionWithTags", "awsRegion": "us-east-1", "requestParameters": {}, "responseElements": {"distribution": {"id": "E2QWRUHEXAMPLE", "aRN": "arn:aws:cloudfront::123456789012:distribution/E2QWRUHEXAMPLE"}}}}`
+)
+
+func TestParse(t *testing.T) {
+	testData := []struct {
+		message       string
+		resources     []*Resource
+		expectedError bool
+	}{
+		{runInstancesEvent, []*Resource{
+			{Provider: Ec2Instances, ID: "i-0123", Region: "us-east-1", EventName: "RunInstances"},
+			{Provider: Ec2Instances, ID: "i-4567", Region: "us-east-1", EventName: "RunInstances"},
+		}, false},
+		{createBucketRecord, []*Resource{{Provider: S3Buckets, ID: "my-bucket", Region: "us-west-2", EventName: "CreateBucket"}}, false},
+		{cloudTrailLog, []*Resource{
+			{Provider: RdsInstances, ID: "mydb", Region: "us-east-1", EventName: "CreateDBInstance"},
+			{Provider: CloudwatchLogGroups, ID: "/my/group", Region: "us-east-1", EventName: "CreateLogGroup"},
+		}, false},
+		{createDistributionEvent, []*Resource{{Provider: CloudFrontDistributions, ID: "E2QWRUHEXAMPLE", Region: "us-east-1", EventName: "CreateDistributionWithTags"}}, false},
+		// SNS notification
+		{`{"Type": "Notification", "MessageId": "abc", "Message": "{\"eventSource\": \"es.amazonaws.com\", \"eventName\": \"CreateElasticsearchDomain\", \"awsRegion\": \"eu-west-1\", \"requestParameters\": {\"domainName\": \"logs\"}}"}`,
+			[]*Resource{{Provider: ElasticsearchDomains, ID: "logs", Region: "eu-west-1", EventName: "CreateElasticsearchDomain"}}, false},
+		// falls back to the request parameters
+		{`{"eventSource": "redshift.amazonaws.com", "eventName": "CreateCluster", "awsRegion": "us-east-1", "requestParameters": {"clusterIdentifier": "dwh"}, "responseElements": null}`,
+			[]*Resource{{Provider: RedshiftClusters, ID: "dwh", Region: "us-east-1", EventName: "CreateCluster"}}, false},
+		{`{"source": "aws.autoscaling", "detail-type": "EC2 Instance Launch Successful", "detail": {"EC2InstanceId": "i-0123"}}`, []*Resource{}, false},
+		{`{"eventSource": "ec2.amazonaws.com",`, nil, true},
+	}
+	for _, d := range testData {
+		res, err := Parse([]byte(d.message))
+		if (err != nil) != d.expectedError {
+			t.Errorf("Unexpected error for %s: %v\n", d.message, err)
+		}
+		if !reflect.DeepEqual(res, d.resources) {
+			t.Errorf("Expecting resources of %s to be:\n", d.message)
+			for _, r := range d.resources {
+				t.Errorf("  %+v", *r)
+			}
+			t.Errorf("Got:\n")
+			for _, r := range res {
+				t.Errorf("  %+v", *r)
+			}
+		}
+	}
+}
+
+// mockSource gives the messages in order and records the acknowledged ones
+type mockSource struct {
+	messages []*Message
+	done     []string
+}
+
+func (s *mockSource) Receive(ctx context.Context) ([]*Message, error) {
+	if len(s.messages) == 0 {
+		return nil, io.EOF
+	}
+	msg := s.messages[0]
+	s.messages = s.messages[1:]
+	return []*Message{msg}, nil
+}
+
+func (s *mockSource) Done(msg *Message) error {
+	s.done = append(s.done, msg.ID)
+	return nil
+}
+
+func TestConsumerRun(t *testing.T) {
+	logger, _ := logrus_test.NewNullLogger()
+	log = logrus.NewEntry(logger)
+
+	source := &mockSource{messages: []*Message{
+		{ID: "ec2", Body: []byte(runInstancesEvent)},
+		{ID: "s3", Body: []byte(createBucketRecord)},
+		{ID: "trail", Body: []byte(cloudTrailLog)},
+		{ID: "cloudfront", Body: []byte(createDistributionEvent)},
+		{ID: "invalid", Body: []byte(`{`)},
+	}}
+	retagged := []string{}
+	handler := func(ctx context.Context, id *string) error {
+		retagged = append(retagged, *id)
+		if *id == "/my/group" {
+			return errors.New("Badaboom")
+		}
+		return nil
+	}
+	c := Consumer{
+		Source:   source,
+		Handlers: map[string]Handler{Ec2Instances: handler, S3Buckets: handler, CloudwatchLogGroups: handler, CloudFrontDistributions: handler},
+		Region:   "us-west-2",
+	}
+	if err := c.Run(context.Background()); err != nil {
+		t.Errorf("Unexpected error: %v\n", err)
+	}
+
+	// ec2 is in another region, rds has no handler, S3 and CloudFront are not
+	// filtered by region
+	expectedRetagged := []string{"my-bucket", "E2QWRUHEXAMPLE"}
+	if !reflect.DeepEqual(retagged, expectedRetagged) {
+		t.Errorf("Expecting to retag %v, got: %v\n", expectedRetagged, retagged)
+	}
+	expectedDone := []string{"ec2", "s3", "trail", "cloudfront"}
+	if !reflect.DeepEqual(source.done, expectedDone) {
+		t.Errorf("Expecting to acknowledge %v, got: %v\n", expectedDone, source.done)
+	}
+
+	// the failed message is not acknowledged
+	c.Region = "us-east-1"
+	source.messages, source.done, retagged = []*Message{{ID: "trail", Body: []byte(cloudTrailLog)}}, nil, []string{}
+	if err := c.Run(context.Background()); err != nil {
+		t.Errorf("Unexpected error: %v\n", err)
+	}
+	if !reflect.DeepEqual(retagged, []string{"/my/group"}) || len(source.done) != 0 {
+		t.Errorf("Expecting to retag /my/group without acknowledging, got: %v and %v\n", retagged, source.done)
+	}
+
+	// the interrupted message is not acknowledged and no more message is
+	// received
+	ctx, cancel := context.WithCancel(context.Background())
+	c.Handlers[RdsInstances] = func(ctx context.Context, id *string) error {
+		retagged = append(retagged, *id)
+		cancel()
+		return nil
+	}
+	source.messages, source.done, retagged = []*Message{{ID: "trail", Body: []byte(cloudTrailLog)}, {ID: "s3", Body: []byte(createBucketRecord)}}, nil, []string{}
+	if err := c.Run(ctx); err != nil {
+		t.Errorf("Unexpected error: %v\n", err)
+	}
+	if !reflect.DeepEqual(retagged, []string{"mydb"}) || len(source.done) != 0 || len(source.messages) != 1 {
+		t.Errorf("Expecting to retag mydb only without acknowledging, got: %v and %v with %d messages left\n", retagged, source.done, len(source.messages))
+	}
+}
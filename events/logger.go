@@ -0,0 +1,10 @@
+package events
+
+import (
+	"github.com/sirupsen/logrus"
+)
+
+var log *logrus.Entry
+
+// SetLogger is used to pass the loger from the main program
+func SetLogger(logger *logrus.Entry) { log = logger }
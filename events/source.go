@@ -0,0 +1,145 @@
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"regexp"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+	"github.com/sirupsen/logrus"
+)
+
+// Message is a message holding events
+type Message struct {
+	// ID identifies the message in the logs
+	ID   string
+	Body []byte
+	// receiptHandle is used to delete the SQS messages once processed
+	receiptHandle *string
+}
+
+// Source gives the messages to process
+type Source interface {
+	// Receive returns the next messages, io.EOF when there is no more
+	Receive(ctx context.Context) ([]*Message, error)
+	// Done acknowledges a message processed successfully
+	Done(msg *Message) error
+}
+
+// ReaderSource reads the messages as a stream of json documents, like a file
+// holding one event per line or a CloudTrail log file
+type ReaderSource struct {
+	decoder *json.Decoder
+	name    string
+	count   int
+}
+
+// NewReaderSource creates a ReaderSource reading from r. The name identifies
+// the messages in the logs.
+func NewReaderSource(r io.Reader, name string) *ReaderSource {
+	return &ReaderSource{decoder: json.NewDecoder(r), name: name}
+}
+
+// Receive returns the next json document. As the reads cannot be cancelled,
+// the context is only checked before reading.
+func (s *ReaderSource) Receive(ctx context.Context) ([]*Message, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	var body json.RawMessage
+	if err := s.decoder.Decode(&body); err != nil {
+		return nil, err
+	}
+	s.count++
+	return []*Message{{ID: fmt.Sprintf("%s#%d", s.name, s.count), Body: body}}, nil
+}
+
+// Done does nothing as a stream cannot be acknowledged
+func (s *ReaderSource) Done(msg *Message) error {
+	return nil
+}
+
+// sqsWaitTime is the duration in seconds of the SQS long polling
+const sqsWaitTime = 20
+
+// The waits between the failed receives, doubling from sqsMinBackoff up to
+// sqsMaxBackoff
+const (
+	sqsMinBackoff = time.Second
+	sqsMaxBackoff = time.Minute
+)
+
+// queuePath matches the path of the URL of an SQS queue: the account ID then
+// the queue name
+var queuePath = regexp.MustCompile(`^/[0-9]{12}/[A-Za-z0-9_-]{1,80}(\.fifo)?/?$`)
+
+// IsQueueURL checks if s is the URL of an SQS queue, like
+// https://sqs.us-east-1.amazonaws.com/123456789012/events or the http URL of
+// a local stand-in like http://localhost:4566/123456789012/events
+func IsQueueURL(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "" && queuePath.MatchString(u.Path)
+}
+
+// SQSSource receives the messages from an SQS queue, deleting them once
+// processed. The messages that failed are received again once their
+// visibility timeout expires.
+type SQSSource struct {
+	svc      sqsiface.SQSAPI
+	queueURL string
+	// backoff is the first wait after a failed receive
+	backoff time.Duration
+}
+
+// NewSQSSource creates a SQSSource receiving the messages of the given queue
+func NewSQSSource(svc sqsiface.SQSAPI, queueURL string) *SQSSource {
+	return &SQSSource{svc: svc, queueURL: queueURL, backoff: sqsMinBackoff}
+}
+
+// Receive waits for the next messages of the queue, until the context is
+// cancelled. The failed receives are logged and retried with an exponential
+// backoff, so it only returns the error of the context. It never returns
+// io.EOF.
+func (s *SQSSource) Receive(ctx context.Context) ([]*Message, error) {
+	var result *sqs.ReceiveMessageOutput
+	for wait := s.backoff; ; {
+		var err error
+		result, err = s.svc.ReceiveMessageWithContext(ctx, &sqs.ReceiveMessageInput{
+			QueueUrl:            aws.String(s.queueURL),
+			MaxNumberOfMessages: aws.Int64(10),
+			WaitTimeSeconds:     aws.Int64(sqsWaitTime),
+		})
+		if err == nil {
+			break
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		log.WithFields(logrus.Fields{"error": err, "queue": s.queueURL, "retry_in": wait}).Warn("Unable to receive the messages, retrying")
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(wait):
+		}
+		if wait *= 2; wait > sqsMaxBackoff {
+			wait = sqsMaxBackoff
+		}
+	}
+	messages := []*Message{}
+	for _, m := range result.Messages {
+		messages = append(messages, &Message{ID: aws.StringValue(m.MessageId), Body: []byte(aws.StringValue(m.Body)), receiptHandle: m.ReceiptHandle})
+	}
+	return messages, nil
+}
+
+// Done deletes the message from the queue
+func (s *SQSSource) Done(msg *Message) error {
+	_, err := s.svc.DeleteMessage(&sqs.DeleteMessageInput{QueueUrl: aws.String(s.queueURL), ReceiptHandle: msg.receiptHandle})
+	return err
+}
@@ -0,0 +1,149 @@
+package events
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/sirupsen/logrus"
+	logrus_test "github.com/sirupsen/logrus/hooks/test"
+)
+
+func TestReaderSource(t *testing.T) {
+	s := NewReaderSource(strings.NewReader(createBucketRecord+"\n"+runInstancesEvent+"\n"), "stdin")
+	ids := []string{}
+	for {
+		messages, err := s.Receive(context.Background())
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Unexpected error: %v\n", err)
+		}
+		for _, msg := range messages {
+			ids = append(ids, msg.ID)
+			if _, err = Parse(msg.Body); err != nil {
+				t.Errorf("Unexpected error parsing %s: %v\n", msg.ID, err)
+			}
+		}
+	}
+	if !reflect.DeepEqual(ids, []string{"stdin#1", "stdin#2"}) {
+		t.Errorf("Expecting to read 2 messages, got: %v\n", ids)
+	}
+}
+
+// sqsStandIn is a minimal SQS endpoint serving the messages of a single queue
+type sqsStandIn struct {
+	mu       sync.Mutex
+	messages []string
+	deleted  []string
+	// failures is the number of requests to fail before serving them
+	failures int
+}
+
+func (q *sqsStandIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.failures > 0 {
+		q.failures--
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, "<ErrorResponse><Error><Type>Sender</Type><Code>AccessDenied</Code><Message>Access to the resource is denied.</Message></Error><RequestId>0</RequestId></ErrorResponse>")
+		return
+	}
+	switch r.Form.Get("Action") {
+	case "ReceiveMessage":
+		fmt.Fprint(w, "<ReceiveMessageResponse><ReceiveMessageResult>")
+		for i, body := range q.messages {
+			sum := md5.Sum([]byte(body))
+			fmt.Fprintf(w, "<Message><MessageId>msg-%d</MessageId><ReceiptHandle>receipt-%d</ReceiptHandle><MD5OfBody>%s</MD5OfBody><Body>%s</Body></Message>",
+				i, i, hex.EncodeToString(sum[:]), html.EscapeString(body))
+		}
+		fmt.Fprint(w, "</ReceiveMessageResult><ResponseMetadata><RequestId>1</RequestId></ResponseMetadata></ReceiveMessageResponse>")
+		q.messages = nil
+	case "DeleteMessage":
+		q.deleted = append(q.deleted, r.Form.Get("ReceiptHandle"))
+		fmt.Fprint(w, "<DeleteMessageResponse><ResponseMetadata><RequestId>2</RequestId></ResponseMetadata></DeleteMessageResponse>")
+	default:
+		http.Error(w, "unsupported action", http.StatusBadRequest)
+	}
+}
+
+func TestSQSSource(t *testing.T) {
+	logger, hook := logrus_test.NewNullLogger()
+	log = logrus.NewEntry(logger)
+	standIn := &sqsStandIn{messages: []string{runInstancesEvent, createBucketRecord}, failures: 2}
+	srv := httptest.NewServer(standIn)
+	defer srv.Close()
+
+	sess := session.Must(session.NewSession(&aws.Config{
+		Region:      aws.String("us-east-1"),
+		Endpoint:    aws.String(srv.URL),
+		Credentials: credentials.NewStaticCredentials("id", "secret", ""),
+	}))
+	s := NewSQSSource(sqs.New(sess), srv.URL+"/123456789012/events")
+	s.backoff = time.Millisecond
+
+	// the failed receives are retried
+	messages, err := s.Receive(context.Background())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	if len(hook.Entries) != 2 {
+		t.Errorf("Expecting the 2 failed receives to be logged, got %d entries\n", len(hook.Entries))
+	}
+	if len(messages) != 2 || string(messages[0].Body) != runInstancesEvent || messages[1].ID != "msg-1" {
+		t.Fatalf("Unexpected messages: %v\n", messages)
+	}
+	if err = s.Done(messages[1]); err != nil {
+		t.Errorf("Unexpected error: %v\n", err)
+	}
+	if !reflect.DeepEqual(standIn.deleted, []string{"receipt-1"}) {
+		t.Errorf("Expecting to delete receipt-1, got: %v\n", standIn.deleted)
+	}
+
+	// the retries stop once the context is cancelled
+	standIn.mu.Lock()
+	standIn.failures = 1000
+	standIn.mu.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err = s.Receive(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Expecting the error of the context, got %v\n", err)
+	}
+}
+
+func TestIsQueueURL(t *testing.T) {
+	testData := []struct {
+		source   string
+		expected bool
+	}{
+		{"https://sqs.us-east-1.amazonaws.com/123456789012/events", true},
+		{"http://localhost:4566/123456789012/events", true},
+		{"https://sqs.us-east-1.amazonaws.com/123456789012/events.fifo", true},
+		{"https://example.com/events.json", false},
+		{"ftp://localhost/123456789012/events", false},
+		{"/var/log/123456789012/events", false},
+		{"events.json", false},
+		{"-", false},
+	}
+	for _, d := range testData {
+		if result := IsQueueURL(d.source); result != d.expected {
+			t.Errorf("Expecting %t for %q, got %t\n", d.expected, d.source, result)
+		}
+	}
+}
@@ -0,0 +1,272 @@
+package filter
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/rds"
+	"github.com/sirupsen/logrus"
+
+	"github.com/VEVO/awsRetagger/mapper"
+)
+
+// Tag matches the resources having the tag Key and, when Value is not nil,
+// the given value
+type Tag struct {
+	Key   string
+	Value *string
+}
+
+// ParseTag parses a tag filter in the key=value or key form
+func ParseTag(s string) Tag {
+	if i := strings.Index(s, "="); i >= 0 {
+		return Tag{Key: s[:i], Value: aws.String(s[i+1:])}
+	}
+	return Tag{Key: s}
+}
+
+// match checks if the tags contain the tag
+func (t Tag) match(tags map[string]string) bool {
+	v, ok := tags[t.Key]
+	return ok && (t.Value == nil || v == *t.Value)
+}
+
+// String gives the tag back in the form it was parsed from
+func (t Tag) String() string {
+	if t.Value == nil {
+		return t.Key
+	}
+	return t.Key + "=" + *t.Value
+}
+
+// Filter selects the resources to retag. A resource is retagged when:
+// * its provider is in IncludeTypes, if any, and not in ExcludeTypes
+// * its ID or ARN matches one of IncludeIDs, if any, and none of ExcludeIDs
+// * it has all the IncludeTags and none of the ExcludeTags
+type Filter struct {
+	IncludeIDs, ExcludeIDs     []*regexp.Regexp
+	IncludeTags, ExcludeTags   []Tag
+	IncludeTypes, ExcludeTypes []string
+	// Ec2 and Rds are passed as-is to the listing calls of the EC2 instances
+	// and RDS instances and clusters, so the filtering happens server-side
+	Ec2 []*ec2.Filter
+	Rds []*rds.Filter
+}
+
+// MatchType checks if the resources of the given provider are selected
+func (f *Filter) MatchType(provider string) bool {
+	if f == nil {
+		return true
+	}
+	for _, t := range f.ExcludeTypes {
+		if t == provider {
+			return false
+		}
+	}
+	if len(f.IncludeTypes) == 0 {
+		return true
+	}
+	for _, t := range f.IncludeTypes {
+		if t == provider {
+			return true
+		}
+	}
+	return false
+}
+
+// Match checks if the resource of the given ID and tags is selected
+func (f *Filter) Match(resourceID string, tags map[string]string) bool {
+	if f == nil {
+		return true
+	}
+	for _, re := range f.ExcludeIDs {
+		if re.MatchString(resourceID) {
+			return false
+		}
+	}
+	for _, t := range f.ExcludeTags {
+		if t.match(tags) {
+			return false
+		}
+	}
+	for _, t := range f.IncludeTags {
+		if !t.match(tags) {
+			return false
+		}
+	}
+	if len(f.IncludeIDs) == 0 {
+		return true
+	}
+	for _, re := range f.IncludeIDs {
+		if re.MatchString(resourceID) {
+			return true
+		}
+	}
+	return false
+}
+
+// Ec2Filters returns the server-side filters of the EC2 instances: the Ec2
+// filters and the IncludeTags
+func (f *Filter) Ec2Filters() []*ec2.Filter {
+	if f == nil {
+		return nil
+	}
+	filters := append([]*ec2.Filter{}, f.Ec2...)
+	for _, t := range f.IncludeTags {
+		if t.Value == nil {
+			filters = append(filters, &ec2.Filter{Name: aws.String("tag-key"), Values: []*string{aws.String(t.Key)}})
+		} else {
+			filters = append(filters, &ec2.Filter{Name: aws.String("tag:" + t.Key), Values: []*string{aws.String(*t.Value)}})
+		}
+	}
+	return filters
+}
+
+// Mapper returns a mapper passing only the selected resources to m. When f is
+// nil, m is returned as-is.
+func (f *Filter) Mapper(m mapper.Iface) mapper.Iface {
+	if f == nil {
+		return m
+	}
+	return &filteredMapper{Iface: m, filter: f}
+}
+
+// filteredMapper skips the resources that are not selected by the filter
+type filteredMapper struct {
+	mapper.Iface
+	filter *Filter
+}
+
+// Retag calls the actual Retag for the selected resources only
+func (m *filteredMapper) Retag(ctx context.Context, resourceID *string, tags *map[string]string, keys []string, setTags mapper.PutTagFn) {
+	if !m.filter.Match(*resourceID, *tags) {
+		log.WithFields(logrus.Fields{"resource": *resourceID}).Debug("Skipping resource excluded by the filters")
+		return
+	}
+	m.Iface.Retag(ctx, resourceID, tags, keys, setTags)
+}
+
+// RegisterFlags defines the flags setting the filter. All the flags can be
+// repeated.
+func (f *Filter) RegisterFlags(fs *flag.FlagSet) {
+	fs.Var((*regexpList)(&f.IncludeIDs), "include-id", "Only retag the resources of which the ID or ARN matches this regular expression. Environment variable: INCLUDE_ID")
+	fs.Var((*regexpList)(&f.ExcludeIDs), "exclude-id", "Do not retag the resources of which the ID or ARN matches this regular expression. Environment variable: EXCLUDE_ID")
+	fs.Var((*tagList)(&f.IncludeTags), "include-tag", "Only retag the resources having this tag, in the key=value or key form. Environment variable: INCLUDE_TAG")
+	fs.Var((*tagList)(&f.ExcludeTags), "exclude-tag", "Do not retag the resources having this tag, in the key=value or key form. Environment variable: EXCLUDE_TAG")
+	fs.Var((*stringList)(&f.IncludeTypes), "include-type", "Only retag the resources of this provider, like ec2_instances or s3_buckets. Environment variable: INCLUDE_TYPE")
+	fs.Var((*stringList)(&f.ExcludeTypes), "exclude-type", "Do not retag the resources of this provider, like ec2_instances or s3_buckets. Environment variable: EXCLUDE_TYPE")
+	fs.Var((*ec2FilterList)(&f.Ec2), "ec2-filter", "Server-side filter of the EC2 instances in the name=value1,value2 form, like vpc-id=vpc-1a2b3c4d. Environment variable: EC2_FILTER")
+	fs.Var((*rdsFilterList)(&f.Rds), "rds-filter", "Server-side filter of the RDS instances and clusters in the name=value1,value2 form, like engine=postgres. Environment variable: RDS_FILTER")
+}
+
+// regexpList is a repeatable flag of regular expressions
+type regexpList []*regexp.Regexp
+
+func (l *regexpList) String() string {
+	items := []string{}
+	for _, re := range *l {
+		items = append(items, re.String())
+	}
+	return strings.Join(items, " ")
+}
+
+func (l *regexpList) Set(s string) error {
+	re, err := regexp.Compile(s)
+	if err != nil {
+		return err
+	}
+	*l = append(*l, re)
+	return nil
+}
+
+// tagList is a repeatable flag of tag filters
+type tagList []Tag
+
+func (l *tagList) String() string {
+	items := []string{}
+	for _, t := range *l {
+		items = append(items, t.String())
+	}
+	return strings.Join(items, " ")
+}
+
+func (l *tagList) Set(s string) error {
+	t := ParseTag(s)
+	if t.Key == "" {
+		return fmt.Errorf("missing tag key in %q", s)
+	}
+	*l = append(*l, t)
+	return nil
+}
+
+// stringList is a repeatable flag of strings, each value possibly holding a
+// comma-separated list
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(s string) error {
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l = append(*l, item)
+		}
+	}
+	return nil
+}
+
+// parseServerFilter parses a server-side filter in the name=value1,value2
+// form
+func parseServerFilter(s string) (*string, []*string, error) {
+	i := strings.Index(s, "=")
+	if i <= 0 || i == len(s)-1 {
+		return nil, nil, fmt.Errorf("invalid filter %q, expecting name=value1,value2", s)
+	}
+	return aws.String(s[:i]), aws.StringSlice(strings.Split(s[i+1:], ",")), nil
+}
+
+// ec2FilterList is a repeatable flag of EC2 filters
+type ec2FilterList []*ec2.Filter
+
+func (l *ec2FilterList) String() string {
+	items := []string{}
+	for _, f := range *l {
+		items = append(items, aws.StringValue(f.Name)+"="+strings.Join(aws.StringValueSlice(f.Values), ","))
+	}
+	return strings.Join(items, " ")
+}
+
+func (l *ec2FilterList) Set(s string) error {
+	name, values, err := parseServerFilter(s)
+	if err != nil {
+		return err
+	}
+	*l = append(*l, &ec2.Filter{Name: name, Values: values})
+	return nil
+}
+
+// rdsFilterList is a repeatable flag of RDS filters
+type rdsFilterList []*rds.Filter
+
+func (l *rdsFilterList) String() string {
+	items := []string{}
+	for _, f := range *l {
+		items = append(items, aws.StringValue(f.Name)+"="+strings.Join(aws.StringValueSlice(f.Values), ","))
+	}
+	return strings.Join(items, " ")
+}
+
+func (l *rdsFilterList) Set(s string) error {
+	name, values, err := parseServerFilter(s)
+	if err != nil {
+		return err
+	}
+	*l = append(*l, &rds.Filter{Name: name, Values: values})
+	return nil
+}
@@ -0,0 +1,119 @@
+package filter
+
+import (
+	"context"
+	"flag"
+	"io/ioutil"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/sirupsen/logrus"
+	logrus_test "github.com/sirupsen/logrus/hooks/test"
+
+	"github.com/VEVO/awsRetagger/mapper"
+)
+
+// parseFilter returns the filter corresponding to the given arguments
+func parseFilter(t *testing.T, args ...string) *Filter {
+	f := &Filter{}
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	f.RegisterFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		t.Fatalf("Unexpected error parsing %v: %v\n", args, err)
+	}
+	return f
+}
+
+func TestMatch(t *testing.T) {
+	testData := []struct {
+		args       []string
+		resourceID string
+		tags       map[string]string
+		match      bool
+	}{
+		{[]string{}, "i-123", map[string]string{}, true},
+		{[]string{"-include-id", "^i-1", "-include-id", "^i-2"}, "i-234", map[string]string{}, true},
+		{[]string{"-include-id", "^i-1", "-include-id", "^i-2"}, "i-345", map[string]string{}, false},
+		{[]string{"-include-id", "^i-", "-exclude-id", "^i-2"}, "i-234", map[string]string{}, false},
+		{[]string{"-include-tag", "team=data"}, "i-123", map[string]string{"team": "data"}, true},
+		{[]string{"-include-tag", "team=data"}, "i-123", map[string]string{"team": "web"}, false},
+		{[]string{"-include-tag", "team=data", "-include-tag", "env"}, "i-123", map[string]string{"team": "data"}, false},
+		{[]string{"-include-tag", "team=data", "-include-tag", "env"}, "i-123", map[string]string{"team": "data", "env": "prod"}, true},
+		{[]string{"-exclude-tag", "retagger=off"}, "i-123", map[string]string{"retagger": "off"}, false},
+		{[]string{"-exclude-tag", "retagger"}, "i-123", map[string]string{"retagger": "on"}, false},
+		{[]string{"-include-tag", "team=", "-include-id", "my-bucket"}, "arn:aws:s3:::my-bucket", map[string]string{"team": ""}, true},
+	}
+	for _, d := range testData {
+		f := parseFilter(t, d.args...)
+		if match := f.Match(d.resourceID, d.tags); match != d.match {
+			t.Errorf("Expecting %v to match %s with %v: %t, got %t\n", d.args, d.resourceID, d.tags, d.match, match)
+		}
+	}
+
+	var f *Filter
+	if !f.Match("i-123", nil) || !f.MatchType("ec2_instances") {
+		t.Errorf("Expecting a nil filter to match everything\n")
+	}
+}
+
+func TestMatchType(t *testing.T) {
+	testData := []struct {
+		args     []string
+		provider string
+		match    bool
+	}{
+		{[]string{}, "ec2_instances", true},
+		{[]string{"-include-type", "ec2_instances,s3_buckets"}, "s3_buckets", true},
+		{[]string{"-include-type", "ec2_instances", "-include-type", "s3_buckets"}, "s3_buckets", true},
+		{[]string{"-include-type", "ec2_instances"}, "s3_buckets", false},
+		{[]string{"-exclude-type", "s3_buckets"}, "s3_buckets", false},
+		{[]string{"-exclude-type", "s3_buckets"}, "rds_instances", true},
+	}
+	for _, d := range testData {
+		f := parseFilter(t, d.args...)
+		if match := f.MatchType(d.provider); match != d.match {
+			t.Errorf("Expecting %v to match %s: %t, got %t\n", d.args, d.provider, d.match, match)
+		}
+	}
+}
+
+func TestEc2Filters(t *testing.T) {
+	f := parseFilter(t, "-ec2-filter", "vpc-id=vpc-1,vpc-2", "-include-tag", "team=data", "-include-tag", "env", "-rds-filter", "engine=postgres")
+	expected := []*ec2.Filter{
+		{Name: aws.String("vpc-id"), Values: aws.StringSlice([]string{"vpc-1", "vpc-2"})},
+		{Name: aws.String("tag:team"), Values: aws.StringSlice([]string{"data"})},
+		{Name: aws.String("tag-key"), Values: aws.StringSlice([]string{"env"})},
+	}
+	if res := f.Ec2Filters(); !reflect.DeepEqual(res, expected) {
+		t.Errorf("Expecting EC2 filters %v, got %v\n", expected, res)
+	}
+	if len(f.Rds) != 1 || *f.Rds[0].Name != "engine" || *f.Rds[0].Values[0] != "postgres" {
+		t.Errorf("Unexpected RDS filters: %v\n", f.Rds)
+	}
+
+	for _, args := range [][]string{{"-ec2-filter", "vpc-id"}, {"-rds-filter", "=postgres"}, {"-include-id", "("}, {"-include-tag", "=data"}} {
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		fs.SetOutput(ioutil.Discard)
+		(&Filter{}).RegisterFlags(fs)
+		if err := fs.Parse(args); err == nil {
+			t.Errorf("Expecting an error parsing %v\n", args)
+		}
+	}
+}
+
+func TestMapperRetag(t *testing.T) {
+	logger, _ := logrus_test.NewNullLogger()
+	log = logrus.NewEntry(logger)
+
+	m := &mapper.MockMapper{}
+	fm := parseFilter(t, "-exclude-tag", "retagger=off").Mapper(m)
+	for id, tags := range map[string]map[string]string{"i-1": {"retagger": "off"}, "i-2": {"team": "data"}} {
+		resourceID, resourceTags := id, tags
+		fm.Retag(context.Background(), &resourceID, &resourceTags, []string{}, nil)
+	}
+	if _, ok := m.ResourceTags["i-1"]; ok || len(m.ResourceTags) != 1 {
+		t.Errorf("Expecting only i-2 to be retagged, got %v\n", m.ResourceTags)
+	}
+}
@@ -0,0 +1,236 @@
+// Package flap detects the tags that something else keeps reverting, like
+// Terraform or a script setting them back after each run, from the changes of
+// the change history of the retagger. A tag changed again to the value it was
+// last changed to has been reverted in between: such a rewrite is a flip, and
+// the value found in place of the written one is a competing value.
+package flap
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/VEVO/awsRetagger/history"
+	"github.com/VEVO/awsRetagger/mapper"
+)
+
+// maxRewrites is the number of rewrites kept per tag
+const maxRewrites = 50
+
+// Options configure the detection of the contested tags
+type Options struct {
+	// ReportPath is where the report of the contested tags is written, - for
+	// the standard output, no report being written when empty
+	ReportPath string
+	// Threshold is the number of rewrites within the Window making a tag
+	// contested
+	Threshold int
+	// Window is the period over which the rewrites are counted
+	Window time.Duration
+	// MaxRewrites, when not 0, is the number of rewrites within the Window
+	// after which a tag is not rewritten anymore
+	MaxRewrites int
+}
+
+// RegisterFlags defines the flags of the detection of the contested tags
+func (o *Options) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&o.ReportPath, "contested-report", "", "Path of the file where the report of the contested tags of the -history is written at the end of the run, - for the standard output. Environment variable: CONTESTED_REPORT")
+	fs.IntVar(&o.Threshold, "flap-threshold", 3, "Number of rewrites of a tag to the same value within the -flap-window making it contested. Environment variable: FLAP_THRESHOLD")
+	fs.DurationVar(&o.Window, "flap-window", 30*24*time.Hour, "Period over which the rewrites of the tags are counted. Environment variable: FLAP_WINDOW")
+	fs.IntVar(&o.MaxRewrites, "flap-max-rewrites", 0, "Number of rewrites of a tag within the -flap-window after which it is not rewritten anymore, a warning being logged instead, 0 to always rewrite it. Environment variable: FLAP_MAX_REWRITES")
+}
+
+// Write is the history of the writes of a tag of a resource
+type Write struct {
+	// Value is the last value written
+	Value string
+	// Written is when the value was last written
+	Written time.Time
+	// Rewrites are when the value was written again after being reverted,
+	// oldest first
+	Rewrites []time.Time
+	// Competing counts the values found in place of Value at each rewrite, the
+	// empty value being a removed tag
+	Competing map[string]int
+}
+
+// rewritesSince counts the rewrites after the given time
+func (w *Write) rewritesSince(since time.Time) int {
+	i := sort.Search(len(w.Rewrites), func(i int) bool { return w.Rewrites[i].After(since) })
+	return len(w.Rewrites) - i
+}
+
+// History holds the writes of the tags by resource and tag name
+type History struct {
+	Resources map[string]map[string]*Write
+}
+
+// New creates an empty history
+func New() *History {
+	return &History{Resources: make(map[string]map[string]*Write)}
+}
+
+// Load builds the history of the writes from the changes of the store within
+// the window
+func Load(store *history.Store, window time.Duration) (*History, error) {
+	changes, err := store.Find(&history.Query{Since: time.Now().Add(-window)})
+	if err != nil {
+		return nil, err
+	}
+	h := New()
+	for _, c := range changes {
+		h.record(c.ResourceID, c.Key, c.NewValue, c.OldValue, c.Time)
+	}
+	return h, nil
+}
+
+// record adds the write of a tag that had the previous value
+func (h *History) record(resourceID, name, value, previous string, now time.Time) {
+	if h.Resources[resourceID] == nil {
+		h.Resources[resourceID] = make(map[string]*Write)
+	}
+	w := h.Resources[resourceID][name]
+	if w == nil || w.Value != value {
+		h.Resources[resourceID][name] = &Write{Value: value, Written: now}
+		return
+	}
+	w.Written = now
+	if w.Rewrites = append(w.Rewrites, now); len(w.Rewrites) > maxRewrites {
+		w.Rewrites = w.Rewrites[len(w.Rewrites)-maxRewrites:]
+	}
+	if w.Competing == nil {
+		w.Competing = make(map[string]int)
+	}
+	w.Competing[previous]++
+}
+
+// Contested is a tag rewritten repeatedly to the same value
+type Contested struct {
+	ResourceID  string
+	Tag         string
+	Value       string
+	Rewrites    int
+	LastRewrite time.Time
+	// Competing counts the values found in place of Value at each rewrite
+	Competing map[string]int
+}
+
+// Contested returns the tags rewritten at least threshold times within the
+// window, the most rewritten first
+func (h *History) Contested(threshold int, window time.Duration) []*Contested {
+	since := time.Now().Add(-window)
+	contested := []*Contested{}
+	for id, writes := range h.Resources {
+		for name, w := range writes {
+			if n := w.rewritesSince(since); n > 0 && n >= threshold {
+				contested = append(contested, &Contested{ResourceID: id, Tag: name, Value: w.Value, Rewrites: n, LastRewrite: w.Rewrites[len(w.Rewrites)-1], Competing: w.Competing})
+			}
+		}
+	}
+	sort.Slice(contested, func(i, j int) bool {
+		if contested[i].Rewrites != contested[j].Rewrites {
+			return contested[i].Rewrites > contested[j].Rewrites
+		}
+		if contested[i].ResourceID != contested[j].ResourceID {
+			return contested[i].ResourceID < contested[j].ResourceID
+		}
+		return contested[i].Tag < contested[j].Tag
+	})
+	return contested
+}
+
+// CompetingValues lists the competing values with their count, the most
+// frequent first
+func (c *Contested) CompetingValues() string {
+	values := []string{}
+	for v := range c.Competing {
+		values = append(values, v)
+	}
+	sort.Slice(values, func(i, j int) bool {
+		if c.Competing[values[i]] != c.Competing[values[j]] {
+			return c.Competing[values[i]] > c.Competing[values[j]]
+		}
+		return values[i] < values[j]
+	})
+	parts := []string{}
+	for _, v := range values {
+		parts = append(parts, fmt.Sprintf("%q (%d)", v, c.Competing[v]))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// WriteReport writes the contested tags as a table
+func WriteReport(w io.Writer, contested []*Contested) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "# Tags rewritten repeatedly to the same value, something else reverting them")
+	fmt.Fprintln(tw, "RESOURCE\tTAG\tVALUE\tREWRITES\tLAST REWRITE\tCOMPETING VALUES")
+	for _, c := range contested {
+		fmt.Fprintf(tw, "%s\t%s\t%q\t%d\t%s\t%s\n", c.ResourceID, c.Tag, c.Value, c.Rewrites, c.LastRewrite.Format(time.RFC3339), c.CompetingValues())
+	}
+	return tw.Flush()
+}
+
+// Mapper returns a mapper withholding the writes of m rewriting the tags
+// contested too often, with MaxRewrites. The writes are recorded by the
+// change history.
+func (h *History) Mapper(m mapper.Iface, options *Options) *Mapper {
+	return &Mapper{Iface: m, history: h, options: options}
+}
+
+// Mapper withholds the writes of the tags contested too often
+type Mapper struct {
+	mapper.Iface
+	history *History
+	options *Options
+	// Withheld is the number of writes of tags withheld as contested
+	Withheld int
+}
+
+// Retag calls the actual Retag, leaving out the rewrites of the tags contested
+// too often
+func (m *Mapper) Retag(ctx context.Context, resourceID *string, tags *map[string]string, keys []string, setTags mapper.PutTagFn) {
+	before := make(map[string]string)
+	for k, v := range *tags {
+		before[k] = v
+	}
+	id := *resourceID
+	m.Iface.Retag(ctx, resourceID, tags, keys, func(rid *string, items []*mapper.TagItem, done mapper.WrittenFn) error {
+		kept := []*mapper.TagItem{}
+		for _, item := range items {
+			if !m.withhold(id, item, before[item.Name]) {
+				kept = append(kept, item)
+			}
+		}
+		if len(kept) == 0 {
+			done.Report(kept, nil)
+			return nil
+		}
+		return setTags(rid, kept, done)
+	})
+}
+
+// withhold checks if the write of the tag is a rewrite of a tag rewritten
+// MaxRewrites times already within the window
+func (m *Mapper) withhold(resourceID string, item *mapper.TagItem, current string) bool {
+	if m.options.MaxRewrites <= 0 || item.Name == "" || current == item.Value {
+		return false
+	}
+	w := m.history.Resources[resourceID][item.Name]
+	if w == nil || w.Value != item.Value {
+		return false
+	}
+	rewrites := w.rewritesSince(time.Now().Add(-m.options.Window))
+	if rewrites < m.options.MaxRewrites {
+		return false
+	}
+	log.WithFields(logrus.Fields{"resource": resourceID, "tag_name": item.Name, "tag_value": item.Value, "current_value": current, "rewrites": rewrites, "rule": item.Rule}).Warn("Tag contested by something else reverting it, not rewriting it")
+	m.Withheld++
+	return true
+}
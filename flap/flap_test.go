@@ -0,0 +1,177 @@
+package flap
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	logrus_test "github.com/sirupsen/logrus/hooks/test"
+
+	"github.com/VEVO/awsRetagger/history"
+	"github.com/VEVO/awsRetagger/mapper"
+)
+
+// fakeMapper sets the same tags on all the resources
+type fakeMapper struct {
+	mapper.Iface
+	tags []*mapper.TagItem
+}
+
+func (m *fakeMapper) Retag(ctx context.Context, resourceID *string, tags *map[string]string, keys []string, setTags mapper.PutTagFn) {
+	setTags(resourceID, m.tags, nil)
+}
+
+func TestMapperRetag(t *testing.T) {
+	logger, _ := logrus_test.NewNullLogger()
+	log = logrus.NewEntry(logger)
+
+	now := time.Now()
+	h := New()
+	h.Resources["i-123"] = map[string]*Write{
+		"team": {Value: "data", Written: now, Rewrites: []time.Time{now.Add(-2 * time.Hour), now.Add(-time.Minute), now}},
+		"env":  {Value: "prd", Written: now, Rewrites: []time.Time{now}},
+	}
+	fm := &fakeMapper{tags: []*mapper.TagItem{{Name: "team", Value: "data", Rule: "tags"}, {Name: "env", Value: "prd"}}}
+	m := h.Mapper(fm, &Options{Window: time.Hour, MaxRewrites: 2})
+
+	testData := []struct {
+		id           string
+		tags         map[string]string
+		setTagsErr   error
+		expectedTags []string
+	}{
+		// the team tag is rewritten twice within the window, not the env one
+		{"i-123", map[string]string{"team": "ops", "env": "stg"}, nil, []string{"env"}},
+		// not a rewrite when already set
+		{"i-123", map[string]string{"team": "data"}, nil, []string{"team", "env"}},
+		{"i-456", map[string]string{"team": "ops"}, nil, []string{"team", "env"}},
+		{"i-123", map[string]string{"team": "ops"}, errors.New("Badaboom"), []string{"env"}},
+	}
+	for i, d := range testData {
+		written := []string{}
+		id, tags := d.id, d.tags
+		m.Retag(context.Background(), &id, &tags, []string{}, func(r *string, items []*mapper.TagItem, done mapper.WrittenFn) error {
+			for _, item := range items {
+				written = append(written, item.Name)
+			}
+			done.Report(items, d.setTagsErr)
+			return d.setTagsErr
+		})
+		if !reflect.DeepEqual(written, d.expectedTags) {
+			t.Errorf("Case %d: expecting %v to be written, got %v\n", i, d.expectedTags, written)
+		}
+	}
+	if m.Withheld != 2 {
+		t.Errorf("Expecting 2 withheld writes, got %d\n", m.Withheld)
+	}
+
+	// nothing is written when all the tags are withheld, the write being
+	// reported done
+	fm.tags = fm.tags[:1]
+	id, tags := "i-123", map[string]string{}
+	written, done := false, false
+	m.Iface = &doneMapper{fakeMapper: fm, done: &done}
+	m.Retag(context.Background(), &id, &tags, []string{}, func(*string, []*mapper.TagItem, mapper.WrittenFn) error {
+		written = true
+		return nil
+	})
+	if written || !done {
+		t.Errorf("Expecting the withheld write to be reported done without writing, got written %t and done %t\n", written, done)
+	}
+}
+
+// doneMapper sets the tags of fakeMapper and records when their write is
+// reported done
+type doneMapper struct {
+	*fakeMapper
+	done *bool
+}
+
+func (m *doneMapper) Retag(ctx context.Context, resourceID *string, tags *map[string]string, keys []string, setTags mapper.PutTagFn) {
+	setTags(resourceID, m.tags, func([]*mapper.TagItem, error) { *m.done = true })
+}
+
+func TestContested(t *testing.T) {
+	now := time.Now().UTC().Truncate(time.Second)
+	h := New()
+	h.Resources["i-1"] = map[string]*Write{
+		"team": {Value: "data", Written: now, Rewrites: []time.Time{now.Add(-2 * time.Hour), now.Add(-time.Minute), now}, Competing: map[string]int{"ops": 2, "": 1}},
+		"env":  {Value: "prod", Written: now},
+	}
+	h.Resources["i-2"] = map[string]*Write{
+		"team": {Value: "data", Written: now, Rewrites: []time.Time{now.Add(-time.Minute), now}, Competing: map[string]int{"ops": 2}},
+	}
+
+	testData := []struct {
+		threshold int
+		window    time.Duration
+		expected  []string
+	}{
+		{2, time.Hour, []string{"i-1/team", "i-2/team"}},
+		{3, time.Hour, []string{}},
+		{3, 3 * time.Hour, []string{"i-1/team"}},
+		{0, time.Hour, []string{"i-1/team", "i-2/team"}},
+	}
+	for _, d := range testData {
+		result := []string{}
+		for _, c := range h.Contested(d.threshold, d.window) {
+			result = append(result, c.ResourceID+"/"+c.Tag)
+		}
+		if !reflect.DeepEqual(result, d.expected) {
+			t.Errorf("Expecting %v with a threshold of %d over %s, got %v\n", d.expected, d.threshold, d.window, result)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := WriteReport(&buf, h.Contested(3, 3*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), `i-1       team  "data"  3         `+now.Format(time.RFC3339)+`  "ops" (2), "" (1)`) {
+		t.Errorf("Unexpected report:\n%s", buf.String())
+	}
+}
+
+func TestLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store := &history.Store{Path: filepath.Join(dir, "history.db")}
+
+	h, err := Load(store, time.Hour)
+	if err != nil || len(h.Resources) != 0 {
+		t.Fatalf("Expecting an empty history from a missing database, got %v and %v\n", h, err)
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	changes := []*history.Change{
+		// out of the window
+		{ResourceID: "i-2", Key: "env", NewValue: "prod", Time: now.Add(-2 * time.Hour)},
+		{ResourceID: "i-1", Key: "team", OldValue: "", NewValue: "data", Time: now.Add(-30 * time.Minute)},
+		{ResourceID: "i-1", Key: "team", OldValue: "ops", NewValue: "data", Time: now.Add(-20 * time.Minute)},
+		{ResourceID: "i-1", Key: "env", OldValue: "", NewValue: "prod", Time: now.Add(-20 * time.Minute)},
+		{ResourceID: "i-1", Key: "team", OldValue: "ops", NewValue: "data", Time: now},
+	}
+	if err = store.Add(changes); err != nil {
+		t.Fatal(err)
+	}
+	if h, err = Load(store, time.Hour); err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	expected := map[string]map[string]*Write{"i-1": {
+		"team": {Value: "data", Written: now, Rewrites: []time.Time{now.Add(-20 * time.Minute), now}, Competing: map[string]int{"ops": 2}},
+		"env":  {Value: "prod", Written: now.Add(-20 * time.Minute)},
+	}}
+	if !reflect.DeepEqual(h.Resources, expected) {
+		t.Errorf("Expecting %v, got %v\n", expected, h.Resources)
+	}
+}
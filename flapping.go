@@ -0,0 +1,71 @@
+package main
+
+import (
+	"io"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/VEVO/awsRetagger/flap"
+	"github.com/VEVO/awsRetagger/history"
+	"github.com/VEVO/awsRetagger/mapper"
+)
+
+// flapping detects the tags something else keeps reverting from the changes of
+// the history database
+type flapping struct {
+	options *flap.Options
+	store   *history.Store
+	// mapper is the mapper of the current run
+	mapper *flap.Mapper
+}
+
+// newFlapping returns the detection of the contested tags of the history
+// database at the given path, or nil when there is none
+func newFlapping(options *flap.Options, historyPath string) *flapping {
+	if historyPath == "" {
+		return nil
+	}
+	return &flapping{options: options, store: &history.Store{Path: historyPath}}
+}
+
+// Mapper returns a mapper withholding the rewrites of the tags contested too
+// often, from the history at the start of the run. When f is nil or the
+// history cannot be read, m is returned as-is.
+func (f *flapping) Mapper(m mapper.Iface) mapper.Iface {
+	if f == nil {
+		return m
+	}
+	f.mapper = nil
+	h, err := flap.Load(f.store, f.options.Window)
+	if err != nil {
+		log.WithFields(logrus.Fields{"error": err, "path": f.store.Path}).Error("Unable to read the history, the contested tags are rewritten")
+		return m
+	}
+	f.mapper = h.Mapper(m, f.options)
+	return f.mapper
+}
+
+// Report reports the contested tags at the end of a run, once its changes are
+// recorded in the history
+func (f *flapping) Report() {
+	if f == nil {
+		return
+	}
+	if f.mapper != nil && f.mapper.Withheld > 0 {
+		log.WithFields(logrus.Fields{"withheld": f.mapper.Withheld}).Warn("Writes of contested tags withheld")
+	}
+	h, err := flap.Load(f.store, f.options.Window)
+	if err != nil {
+		log.WithFields(logrus.Fields{"error": err, "path": f.store.Path}).Error("Unable to read the history, the contested tags are not reported")
+		return
+	}
+	contested := h.Contested(f.options.Threshold, f.options.Window)
+	for _, c := range contested {
+		log.WithFields(logrus.Fields{"resource": c.ResourceID, "tag_name": c.Tag, "tag_value": c.Value, "rewrites": c.Rewrites, "competing_values": c.CompetingValues()}).Warn("Tag contested, something else keeps reverting it")
+	}
+	if f.options.ReportPath != "" {
+		if err := writeOutput(f.options.ReportPath, func(w io.Writer) error { return flap.WriteReport(w, contested) }); err != nil {
+			log.WithFields(logrus.Fields{"error": err, "path": f.options.ReportPath}).Error("Unable to write the contested tags report")
+		}
+	}
+}
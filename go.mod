@@ -3,6 +3,7 @@ module github.com/VEVO/awsRetagger
 go 1.13
 
 require (
+	github.com/aws/aws-lambda-go v1.13.3
 	github.com/aws/aws-sdk-go v1.12.47
 	github.com/go-ini/ini v1.30.0 // indirect
 	github.com/gobike/envflag v0.0.0-20160830095501-ae3268980a29
@@ -11,7 +12,7 @@ require (
 	github.com/onsi/gomega v1.7.1 // indirect
 	github.com/sirupsen/logrus v1.0.4
 	github.com/smartystreets/goconvey v1.6.4 // indirect
-	github.com/stretchr/testify v1.4.0 // indirect
+	go.etcd.io/bbolt v1.3.5
 	golang.org/x/net v0.0.0-20191119073136-fc4aabc6c914 // indirect
 	gopkg.in/airbrake/gobrake.v2 v2.0.9 // indirect
 	gopkg.in/gemnasium/logrus-airbrake-hook.v2 v2.1.2 // indirect
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"io"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/VEVO/awsRetagger/history"
+	"github.com/VEVO/awsRetagger/mapper"
+)
+
+// changeHistory records the tag changes of the runs in the history database
+type changeHistory struct {
+	store *history.Store
+	// mapper is the mapper of the current run
+	mapper *history.Mapper
+}
+
+// newChangeHistory returns the history of the database at the given path, or
+// nil when there is none
+func newChangeHistory(path string) *changeHistory {
+	if path == "" {
+		return nil
+	}
+	return &changeHistory{store: &history.Store{Path: path}}
+}
+
+// Mapper returns a mapper recording the changes m writes for the given run,
+// size changes at a time. When h is nil, m is returned as-is.
+func (h *changeHistory) Mapper(m mapper.Iface, runID string, size int) mapper.Iface {
+	if h == nil {
+		return m
+	}
+	h.mapper = h.store.Mapper(m, runID)
+	h.mapper.Size = size
+	return h.mapper
+}
+
+// Finish records the changes left at the end of the run
+func (h *changeHistory) Finish() {
+	if h == nil || h.mapper == nil {
+		return
+	}
+	h.mapper.Flush()
+	log.WithFields(logrus.Fields{"recorded": h.mapper.Recorded, "path": h.store.Path}).Info("Tag changes recorded in the history")
+}
+
+// showHistory writes the changes of the history database matching the
+// resource, key, value and since of the query
+func showHistory(path, resource, key, value, since, outputPath, format string) {
+	if path == "" {
+		log.Fatal("The history command requires the -history database")
+	}
+	q := &history.Query{Resource: resource, Key: key, Value: value}
+	var err error
+	if q.Since, err = history.ParseSince(since, time.Now()); err != nil {
+		log.WithFields(logrus.Fields{"error": err}).Fatal("Invalid -since")
+	}
+	changes, err := (&history.Store{Path: path}).Find(q)
+	if err != nil {
+		log.WithFields(logrus.Fields{"error": err, "path": path}).Fatal("Unable to read the history")
+	}
+	if err = writeOutput(outputPath, func(w io.Writer) error { return history.Write(w, changes, format) }); err != nil {
+		log.WithFields(logrus.Fields{"error": err, "path": outputPath}).Fatal("Unable to write the history")
+	}
+}
@@ -0,0 +1,331 @@
+// Package history records the tag changes made by the retagger in an embedded
+// bbolt database, so it can be queried later for when and why the tags of a
+// resource changed.
+package history
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/VEVO/awsRetagger/mapper"
+)
+
+// openTimeout is how long the database is waited for when another process
+// has it open
+const openTimeout = 30 * time.Second
+
+// BatchSize is the number of changes a Mapper records per transaction by
+// default
+const BatchSize = 500
+
+// The buckets of the database. The changes are keyed by time then sequence,
+// and the bucket of each resource of resourcesBucket indexes the keys of its
+// changes.
+var (
+	changesBucket   = []byte("changes")
+	resourcesBucket = []byte("resources")
+)
+
+// Change is a tag change made to a resource
+type Change struct {
+	ResourceID string `json:"resource_id"`
+	Key        string `json:"key"`
+	// OldValue is empty when the tag was added
+	OldValue string `json:"old_value"`
+	NewValue string `json:"new_value"`
+	// Rule is the section of the configuration the new value comes from
+	Rule  string    `json:"rule"`
+	RunID string    `json:"run_id"`
+	Time  time.Time `json:"time"`
+}
+
+// Query selects the changes of the history. The empty fields select all the
+// changes.
+type Query struct {
+	// Resource is the ID or the ARN of the resource
+	Resource string
+	Key      string
+	// Value matches both the old and the new values
+	Value string
+	Since time.Time
+}
+
+// match checks if the change matches the key and value of the query
+func (q *Query) match(c *Change) bool {
+	return (q.Key == "" || c.Key == q.Key) && (q.Value == "" || c.OldValue == q.Value || c.NewValue == q.Value)
+}
+
+// Store is the history database at Path. The database is only open while
+// adding or finding changes, so the runs and the queries of several processes
+// can share it.
+type Store struct {
+	Path string
+}
+
+// open opens the database, creating it unless readOnly
+func (s *Store) open(readOnly bool) (*bolt.DB, error) {
+	db, err := bolt.Open(s.Path, 0644, &bolt.Options{Timeout: openTimeout, ReadOnly: readOnly})
+	if err == bolt.ErrTimeout {
+		return nil, fmt.Errorf("timeout opening %s, used by another process", s.Path)
+	}
+	return db, err
+}
+
+// Add records the changes
+func (s *Store) Add(changes []*Change) error {
+	if len(changes) == 0 {
+		return nil
+	}
+	db, err := s.open(false)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.Update(func(tx *bolt.Tx) error {
+		all, err := tx.CreateBucketIfNotExists(changesBucket)
+		if err != nil {
+			return err
+		}
+		resources, err := tx.CreateBucketIfNotExists(resourcesBucket)
+		if err != nil {
+			return err
+		}
+		for _, c := range changes {
+			seq, err := all.NextSequence()
+			if err != nil {
+				return err
+			}
+			key := make([]byte, 16)
+			binary.BigEndian.PutUint64(key, uint64(c.Time.UnixNano()))
+			binary.BigEndian.PutUint64(key[8:], seq)
+			value, err := json.Marshal(c)
+			if err != nil {
+				return err
+			}
+			if err = all.Put(key, value); err != nil {
+				return err
+			}
+			resource, err := resources.CreateBucketIfNotExists([]byte(c.ResourceID))
+			if err != nil {
+				return err
+			}
+			if err = resource.Put(key, nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Find returns the changes matching the query, oldest first. A missing
+// database has no change.
+func (s *Store) Find(q *Query) ([]*Change, error) {
+	changes := []*Change{}
+	if _, err := os.Stat(s.Path); os.IsNotExist(err) {
+		return changes, nil
+	}
+	db, err := s.open(true)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	since := make([]byte, 8)
+	if !q.Since.IsZero() {
+		binary.BigEndian.PutUint64(since, uint64(q.Since.UnixNano()))
+	}
+	err = db.View(func(tx *bolt.Tx) error {
+		all := tx.Bucket(changesBucket)
+		if all == nil {
+			return nil
+		}
+		add := func(value []byte) error {
+			c := &Change{}
+			if err := json.Unmarshal(value, c); err != nil {
+				return err
+			}
+			if q.match(c) {
+				changes = append(changes, c)
+			}
+			return nil
+		}
+		if q.Resource == "" {
+			cur := all.Cursor()
+			for k, v := cur.Seek(since); k != nil; k, v = cur.Next() {
+				if err := add(v); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		// the changes of the IDs of the resource are merged by key
+		keys := [][]byte{}
+		for _, id := range ResourceIDs(q.Resource) {
+			resource := tx.Bucket(resourcesBucket).Bucket([]byte(id))
+			if resource == nil {
+				continue
+			}
+			cur := resource.Cursor()
+			for k, _ := cur.Seek(since); k != nil; k, _ = cur.Next() {
+				keys = append(keys, k)
+			}
+		}
+		sort.Slice(keys, func(i, j int) bool { return bytes.Compare(keys[i], keys[j]) < 0 })
+		for _, k := range keys {
+			if err := add(all.Get(k)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return changes, nil
+}
+
+// ResourceIDs returns the IDs the changes of a resource can be recorded
+// under: the given ID or ARN, and for the ARN of an EC2 instance, of an S3
+// bucket or of a CloudWatch log group, the ID the retagger uses for them
+func ResourceIDs(ref string) []string {
+	ids := []string{ref}
+	parts := strings.SplitN(ref, ":", 6)
+	if len(parts) != 6 || parts[0] != "arn" {
+		return ids
+	}
+	switch resource := parts[5]; {
+	case parts[2] == "s3" && !strings.Contains(resource, "/"):
+		ids = append(ids, resource)
+	case parts[2] == "ec2" && strings.HasPrefix(resource, "instance/"):
+		ids = append(ids, strings.TrimPrefix(resource, "instance/"))
+	case parts[2] == "logs" && strings.HasPrefix(resource, "log-group:"):
+		ids = append(ids, strings.TrimSuffix(strings.TrimPrefix(resource, "log-group:"), ":*"))
+	}
+	return ids
+}
+
+// ParseSince returns the time from which the changes are selected: either a
+// duration before now, in days like 30d or as a Go duration like 12h, or a
+// date like 2018-01-02 or 2018-01-02T15:04:05Z. The empty string gives the
+// zero time.
+func ParseSince(since string, now time.Time) (time.Time, error) {
+	if since == "" {
+		return time.Time{}, nil
+	}
+	if strings.HasSuffix(since, "d") {
+		if days, err := strconv.Atoi(strings.TrimSuffix(since, "d")); err == nil {
+			return now.AddDate(0, 0, -days), nil
+		}
+	}
+	if d, err := time.ParseDuration(since); err == nil {
+		return now.Add(-d), nil
+	}
+	for _, layout := range []string{"2006-01-02", time.RFC3339} {
+		if t, err := time.Parse(layout, since); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid since %q, expecting a duration like 30d or 12h or a date like 2018-01-02", since)
+}
+
+// Write outputs the changes in the given format: table, csv or json
+func Write(w io.Writer, changes []*Change, format string) error {
+	switch format {
+	case "table":
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "TIME\tRESOURCE\tKEY\tOLD VALUE\tNEW VALUE\tRULE\tRUN")
+		for _, c := range changes {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%q\t%q\t%s\t%s\n", c.Time.Format(time.RFC3339), c.ResourceID, c.Key, c.OldValue, c.NewValue, c.Rule, c.RunID)
+		}
+		return tw.Flush()
+	case "csv":
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"time", "resource_id", "key", "old_value", "new_value", "rule", "run_id"})
+		for _, c := range changes {
+			cw.Write([]string{c.Time.Format(time.RFC3339), c.ResourceID, c.Key, c.OldValue, c.NewValue, c.Rule, c.RunID})
+		}
+		cw.Flush()
+		return cw.Error()
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(changes)
+	default:
+		return fmt.Errorf("invalid history format requested: %s", format)
+	}
+}
+
+// Mapper returns a mapper recording the tag changes written by m in the
+// store, under the given run ID, BatchSize changes at a time
+func (s *Store) Mapper(m mapper.Iface, runID string) *Mapper {
+	return &Mapper{Iface: m, store: s, runID: runID, Size: BatchSize}
+}
+
+// Mapper records the tag changes of the resources once written
+type Mapper struct {
+	mapper.Iface
+	store *Store
+	runID string
+	// Size is the number of changes kept to be recorded together in one
+	// transaction, 1 recording them as they are written
+	Size    int
+	pending []*Change
+	// Recorded is the number of changes recorded
+	Recorded int
+}
+
+// Retag calls the actual Retag, recording the changes it writes successfully
+// once written: the batched ones once their batch is sent and the planned ones
+// once applied, never when the plan is not. The changes are the tags actually
+// written, once checked against the constraints of the service.
+func (m *Mapper) Retag(ctx context.Context, resourceID *string, tags *map[string]string, keys []string, setTags mapper.PutTagFn) {
+	before := make(map[string]string)
+	for k, v := range *tags {
+		before[k] = v
+	}
+	id := *resourceID
+	m.Iface.Retag(ctx, resourceID, tags, keys, func(rid *string, items []*mapper.TagItem, done mapper.WrittenFn) error {
+		return setTags(rid, items, func(written []*mapper.TagItem, err error) {
+			defer done.Report(written, err)
+			if err != nil {
+				return
+			}
+			now := time.Now()
+			for _, item := range written {
+				if old, ok := before[item.Name]; item.Name != "" && (!ok || old != item.Value) {
+					m.pending = append(m.pending, &Change{ResourceID: id, Key: item.Name, OldValue: old, NewValue: item.Value, Rule: item.Rule, RunID: m.runID, Time: now})
+				}
+			}
+			if len(m.pending) >= m.Size {
+				m.Flush()
+			}
+		})
+	})
+}
+
+// Flush records the changes kept, the tags being written anyway when it fails
+func (m *Mapper) Flush() {
+	if len(m.pending) == 0 {
+		return
+	}
+	if err := m.store.Add(m.pending); err != nil {
+		log.WithFields(logrus.Fields{"error": err, "path": m.store.Path, "changes": len(m.pending)}).Error("Unable to record the tag changes in the history")
+	} else {
+		m.Recorded += len(m.pending)
+	}
+	m.pending = nil
+}
@@ -0,0 +1,208 @@
+package history
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	logrus_test "github.com/sirupsen/logrus/hooks/test"
+
+	"github.com/VEVO/awsRetagger/mapper"
+)
+
+// fakeMapper sets the same tags on all the resources
+type fakeMapper struct {
+	mapper.Iface
+	tags []*mapper.TagItem
+}
+
+func (m *fakeMapper) Retag(ctx context.Context, resourceID *string, tags *map[string]string, keys []string, setTags mapper.PutTagFn) {
+	setTags(resourceID, m.tags, nil)
+}
+
+// tempStore returns a store in a temporary directory and the function
+// removing it
+func tempStore(t *testing.T) (*Store, func()) {
+	dir, err := ioutil.TempDir("", "history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Store{Path: filepath.Join(dir, "history.db")}, func() { os.RemoveAll(dir) }
+}
+
+func TestStoreFind(t *testing.T) {
+	s, cleanup := tempStore(t)
+	defer cleanup()
+
+	changes, err := s.Find(&Query{})
+	if err != nil || len(changes) != 0 {
+		t.Fatalf("Expecting no change from a missing database, got %v and %v\n", changes, err)
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	err = s.Add([]*Change{
+		{ResourceID: "e2e-bucket", Key: "team", NewValue: "ops", Rule: "defaults", RunID: "r1", Time: now.Add(-48 * time.Hour)},
+		{ResourceID: "i-123", Key: "team", NewValue: "data", Rule: "keys", RunID: "r1", Time: now.Add(-48 * time.Hour)},
+	})
+	if err == nil {
+		err = s.Add([]*Change{
+			{ResourceID: "e2e-bucket", Key: "team", OldValue: "ops", NewValue: "data", Rule: "sanity", RunID: "r2", Time: now},
+			{ResourceID: "i-123", Key: "env", NewValue: "prd", Rule: "tags", RunID: "r2", Time: now},
+		})
+	}
+	if err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+
+	testData := []struct {
+		query    Query
+		expected []string
+	}{
+		{Query{}, []string{"r1 e2e-bucket team", "r1 i-123 team", "r2 e2e-bucket team", "r2 i-123 env"}},
+		{Query{Resource: "i-123"}, []string{"r1 i-123 team", "r2 i-123 env"}},
+		{Query{Resource: "arn:aws:ec2:us-east-1:123456789012:instance/i-123"}, []string{"r1 i-123 team", "r2 i-123 env"}},
+		{Query{Resource: "arn:aws:s3:::e2e-bucket", Since: now.Add(-time.Hour)}, []string{"r2 e2e-bucket team"}},
+		{Query{Key: "team", Value: "data"}, []string{"r1 i-123 team", "r2 e2e-bucket team"}},
+		// the old values match too
+		{Query{Key: "team", Value: "ops", Since: now.Add(-time.Hour)}, []string{"r2 e2e-bucket team"}},
+		{Query{Resource: "i-456"}, []string{}},
+	}
+	for _, d := range testData {
+		changes, err := s.Find(&d.query)
+		if err != nil {
+			t.Errorf("Unexpected error for %+v: %v\n", d.query, err)
+			continue
+		}
+		result := []string{}
+		for _, c := range changes {
+			result = append(result, c.RunID+" "+c.ResourceID+" "+c.Key)
+		}
+		if !reflect.DeepEqual(result, d.expected) {
+			t.Errorf("Expecting %v for %+v, got %v\n", d.expected, d.query, result)
+		}
+	}
+
+	var buf bytes.Buffer
+	changes, _ = s.Find(&Query{Resource: "e2e-bucket", Since: now.Add(-time.Hour)})
+	if err = Write(&buf, changes, "table"); err != nil {
+		t.Fatal(err)
+	}
+	if expected := now.Format(time.RFC3339) + `  e2e-bucket  team  "ops"      "data"     sanity  r2`; !strings.Contains(buf.String(), expected) {
+		t.Errorf("Expecting the table to contain %q, got:\n%s", expected, buf.String())
+	}
+	if err = Write(&buf, changes, "xml"); err == nil {
+		t.Errorf("Expecting an error for an invalid format\n")
+	}
+}
+
+func TestMapperRetag(t *testing.T) {
+	logger, _ := logrus_test.NewNullLogger()
+	log = logrus.NewEntry(logger)
+	mapper.SetLogger(log)
+	s, cleanup := tempStore(t)
+	defer cleanup()
+
+	fm := &fakeMapper{tags: []*mapper.TagItem{{Name: "team", Value: "data", Rule: "keys"}, {Name: "env", Value: "prd", Rule: "tags"}}}
+	// constrained transforms the values like the constraints of a service
+	constrained := mapper.Constrain(&mapper.Constraints{MaxValueLength: 3}, nil, mapper.Direct(func(*string, []*mapper.TagItem) error { return nil }))
+	testData := []struct {
+		tags     map[string]string
+		setTags  mapper.PutTagFn
+		expected []string
+	}{
+		{map[string]string{"env": "prd"}, mapper.Direct(func(*string, []*mapper.TagItem) error { return nil }), []string{"team:data keys"}},
+		// a failed write is not recorded
+		{map[string]string{}, mapper.Direct(func(*string, []*mapper.TagItem) error { return errors.New("Badaboom") }), []string{}},
+		// the values actually written are recorded
+		{map[string]string{"team": "ops", "env": "prd"}, constrained, []string{"team:ops>dat keys"}},
+		// a write never done, like a plan not applied, is not recorded
+		{map[string]string{"team": "ops"}, func(*string, []*mapper.TagItem, mapper.WrittenFn) error { return nil }, []string{}},
+	}
+	for i, d := range testData {
+		runID := string(rune('a' + i))
+		m := s.Mapper(fm, runID)
+		id := "i-123"
+		tags := d.tags
+		m.Retag(context.Background(), &id, &tags, []string{}, d.setTags)
+		m.Flush()
+		changes, err := s.Find(&Query{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		result := []string{}
+		for _, c := range changes {
+			if c.RunID != runID {
+				continue
+			}
+			if c.OldValue != "" {
+				result = append(result, c.Key+":"+c.OldValue+">"+c.NewValue+" "+c.Rule)
+			} else {
+				result = append(result, c.Key+":"+c.NewValue+" "+c.Rule)
+			}
+		}
+		if !reflect.DeepEqual(result, d.expected) || m.Recorded != len(d.expected) {
+			t.Errorf("Case %d: expecting the changes %v, got %v and %d recorded\n", i, d.expected, result, m.Recorded)
+		}
+	}
+
+	// the changes are recorded Size at a time
+	m := s.Mapper(fm, "batched")
+	m.Size = 3
+	for _, id := range []string{"i-1", "i-2"} {
+		m.Retag(context.Background(), &id, &map[string]string{}, []string{}, mapper.Direct(func(*string, []*mapper.TagItem) error { return nil }))
+		if changes, _ := s.Find(&Query{Resource: "i-1"}); (id == "i-1") != (len(changes) == 0) {
+			t.Errorf("Unexpected changes recorded after %s: %v\n", id, changes)
+		}
+	}
+	if m.Recorded != 4 {
+		t.Errorf("Expecting 4 changes recorded, got %d\n", m.Recorded)
+	}
+}
+
+func TestResourceIDs(t *testing.T) {
+	testData := []struct {
+		ref      string
+		expected []string
+	}{
+		{"i-123", []string{"i-123"}},
+		{"arn:aws:ec2:us-east-1:123456789012:instance/i-123", []string{"arn:aws:ec2:us-east-1:123456789012:instance/i-123", "i-123"}},
+		{"arn:aws:s3:::bucket", []string{"arn:aws:s3:::bucket", "bucket"}},
+		{"arn:aws:logs:us-east-1:123456789012:log-group:/aws/lambda/fn:*", []string{"arn:aws:logs:us-east-1:123456789012:log-group:/aws/lambda/fn:*", "/aws/lambda/fn"}},
+		{"arn:aws:rds:us-east-1:123456789012:db:mydb", []string{"arn:aws:rds:us-east-1:123456789012:db:mydb"}},
+	}
+	for _, d := range testData {
+		if result := ResourceIDs(d.ref); !reflect.DeepEqual(result, d.expected) {
+			t.Errorf("Expecting %v for %s, got %v\n", d.expected, d.ref, result)
+		}
+	}
+}
+
+func TestParseSince(t *testing.T) {
+	now := time.Date(2018, 1, 31, 12, 0, 0, 0, time.UTC)
+	testData := []struct {
+		since         string
+		expected      time.Time
+		expectedError bool
+	}{
+		{"", time.Time{}, false},
+		{"30d", time.Date(2018, 1, 1, 12, 0, 0, 0, time.UTC), false},
+		{"12h", time.Date(2018, 1, 31, 0, 0, 0, 0, time.UTC), false},
+		{"2018-01-02", time.Date(2018, 1, 2, 0, 0, 0, 0, time.UTC), false},
+		{"2018-01-02T15:04:05Z", time.Date(2018, 1, 2, 15, 4, 5, 0, time.UTC), false},
+		{"last week", time.Time{}, true},
+	}
+	for _, d := range testData {
+		result, err := ParseSince(d.since, now)
+		if (err != nil) != d.expectedError || !result.Equal(d.expected) {
+			t.Errorf("Expecting %s for %q, got %s and %v\n", d.expected, d.since, result, err)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"github.com/sirupsen/logrus"
+
+	"github.com/VEVO/awsRetagger/mapper"
+	"github.com/VEVO/awsRetagger/state"
+)
+
+// incremental skips the resources unchanged since the previous runs using the
+// state file
+type incremental struct {
+	path  string
+	full  bool
+	state *state.State
+	// mapper is the mapper of the current run
+	mapper *state.Mapper
+}
+
+// newIncremental loads the state file, or returns nil when there is none
+func newIncremental(path string, full bool) *incremental {
+	if path == "" {
+		return nil
+	}
+	s, err := state.Load(path)
+	if err != nil {
+		log.WithFields(logrus.Fields{"error": err, "path": path}).Fatal("Unable to load the state file")
+	}
+	return &incremental{path: path, full: full, state: s}
+}
+
+// Mapper returns a mapper skipping the unchanged resources for a run with the
+// config of the given version, the one m was loaded from. When i is nil, m is
+// returned as-is.
+func (i *incremental) Mapper(m mapper.Iface, configVersion string) mapper.Iface {
+	if i == nil {
+		return m
+	}
+	i.mapper = i.state.Mapper(m, configVersion, i.full)
+	return i.mapper
+}
+
+// Save writes the state file at the end of a run
+func (i *incremental) Save() {
+	if i == nil {
+		return
+	}
+	if i.mapper != nil {
+		log.WithFields(logrus.Fields{"skipped": i.mapper.Skipped}).Info("Resources unchanged since the last run skipped")
+	}
+	if err := i.state.Save(i.path); err != nil {
+		log.WithFields(logrus.Fields{"error": err, "path": i.path}).Error("Unable to write the state file")
+	}
+}
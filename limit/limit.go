@@ -0,0 +1,266 @@
+package limit
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/VEVO/awsRetagger/mapper"
+)
+
+// Limits caps the number of resources a run may change. The limits are keyed
+// by provider, like ec2_instances, the empty key holding the limits of all the
+// providers together. A run exceeding any of them changes nothing unless
+// Force is set.
+type Limits struct {
+	MaxChanges       map[string]int
+	MaxChangePercent map[string]float64
+	// Force applies the changes even when a limit is exceeded
+	Force bool
+}
+
+// Enabled checks if any limit is set
+func (l *Limits) Enabled() bool {
+	return l != nil && (len(l.MaxChanges) > 0 || len(l.MaxChangePercent) > 0)
+}
+
+// RegisterFlags defines the flags setting the limits. The limit flags can be
+// repeated.
+func (l *Limits) RegisterFlags(fs *flag.FlagSet) {
+	fs.Var((*maxChanges)(&l.MaxChanges), "max-changes", "Maximum number of resources a run may change, either for all the providers (100) or for one of them (ec2_instances=10). Nothing is changed when exceeded. Environment variable: MAX_CHANGES")
+	fs.Var((*maxChangePercent)(&l.MaxChangePercent), "max-change-percent", "Maximum percentage of the scanned resources a run may change, either for all the providers (20) or for one of them (s3_buckets=50). Nothing is changed when exceeded. Environment variable: MAX_CHANGE_PERCENT")
+	fs.BoolVar(&l.Force, "ignore-change-limits", false, "Apply the changes even when the -max-changes or -max-change-percent limits are exceeded. Environment variable: IGNORE_CHANGE_LIMITS")
+}
+
+// Change is the update of the tags of a resource, applied once the whole run
+// is planned
+type Change struct {
+	Provider   string
+	ResourceID string
+	Tags       []*mapper.TagItem
+	setTags    mapper.PutTagFn
+	// done receives the outcome of the change once applied, never when the
+	// plan is not
+	done mapper.WrittenFn
+}
+
+// Plan records the changes of a run instead of applying them, so they can be
+// checked against the limits first
+type Plan struct {
+	Changes []*Change
+	// Scanned is the number of resources planned by provider
+	Scanned map[string]int
+	// Failed is the number of changes applied that failed, the batched ones
+	// being counted once their batch is sent
+	Failed int
+}
+
+// NewPlan creates an empty plan
+func NewPlan() *Plan {
+	return &Plan{Scanned: make(map[string]int)}
+}
+
+// Mapper returns a mapper recording in the plan the changes m makes to the
+// resources of the given provider
+func (p *Plan) Mapper(provider string, m mapper.Iface) mapper.Iface {
+	return &plannedMapper{Iface: m, plan: p, provider: provider}
+}
+
+// plannedMapper records the calls to setTags of a provider in the plan
+type plannedMapper struct {
+	mapper.Iface
+	plan     *Plan
+	provider string
+}
+
+// Retag records the change of the actual Retag, if any, without applying it.
+// The write is queued until the change is applied.
+func (m *plannedMapper) Retag(ctx context.Context, resourceID *string, tags *map[string]string, keys []string, setTags mapper.PutTagFn) {
+	m.plan.Scanned[m.provider]++
+	m.Iface.Retag(ctx, resourceID, tags, keys, func(id *string, items []*mapper.TagItem, done mapper.WrittenFn) error {
+		m.plan.Changes = append(m.plan.Changes, &Change{Provider: m.provider, ResourceID: *id, Tags: items, setTags: setTags, done: done})
+		return nil
+	})
+}
+
+// Apply applies the planned changes and returns the number of them that
+// failed so far, see Failed. Once the context is cancelled, the remaining
+// changes are skipped.
+func (p *Plan) Apply(ctx context.Context) int {
+	for i, c := range p.Changes {
+		if ctx.Err() != nil {
+			log.WithFields(logrus.Fields{"skipped": len(p.Changes) - i}).Warn("Run interrupted, remaining planned changes skipped")
+			break
+		}
+		resourceID, done := c.ResourceID, c.done
+		c.setTags(&resourceID, c.Tags, func(written []*mapper.TagItem, err error) {
+			if err != nil {
+				p.Failed++
+			}
+			done.Report(written, err)
+		})
+	}
+	return p.Failed
+}
+
+// Exceeded is a limit exceeded by a plan
+type Exceeded struct {
+	// Provider is empty for the limits of all the providers together
+	Provider string
+	// Limit is the flag of the limit exceeded
+	Limit     string
+	Threshold float64
+	Changes   int
+	Scanned   int
+}
+
+func (e Exceeded) String() string {
+	provider := e.Provider
+	if provider == "" {
+		provider = "all providers"
+	}
+	return fmt.Sprintf("%s: %d of %d resources would change, exceeding -%s %s", provider, e.Changes, e.Scanned, e.Limit, strconv.FormatFloat(e.Threshold, 'f', -1, 64))
+}
+
+// Check returns the limits exceeded by the plan, sorted by provider
+func (p *Plan) Check(l *Limits) []Exceeded {
+	changes := map[string]int{"": len(p.Changes)}
+	for _, c := range p.Changes {
+		changes[c.Provider]++
+	}
+	scanned := map[string]int{}
+	for provider, count := range p.Scanned {
+		scanned[provider] = count
+		scanned[""] += count
+	}
+
+	exceeded := []Exceeded{}
+	for provider, max := range l.MaxChanges {
+		if changes[provider] > max {
+			exceeded = append(exceeded, Exceeded{Provider: provider, Limit: "max-changes", Threshold: float64(max), Changes: changes[provider], Scanned: scanned[provider]})
+		}
+	}
+	for provider, max := range l.MaxChangePercent {
+		if scanned[provider] > 0 && float64(changes[provider])*100/float64(scanned[provider]) > max {
+			exceeded = append(exceeded, Exceeded{Provider: provider, Limit: "max-change-percent", Threshold: max, Changes: changes[provider], Scanned: scanned[provider]})
+		}
+	}
+	sort.Slice(exceeded, func(i, j int) bool {
+		if exceeded[i].Provider != exceeded[j].Provider {
+			return exceeded[i].Provider < exceeded[j].Provider
+		}
+		return exceeded[i].Limit < exceeded[j].Limit
+	})
+	return exceeded
+}
+
+// RuleCount is the number of resources a rule would change
+type RuleCount struct {
+	// Rule is the section of the configuration and the tag it sets, like
+	// sanity Env=prd
+	Rule      string
+	Resources int
+}
+
+// TopRules returns the n rules changing the most resources
+func (p *Plan) TopRules(n int) []RuleCount {
+	counts := map[string]int{}
+	for _, c := range p.Changes {
+		for _, item := range c.Tags {
+			counts[fmt.Sprintf("%s %s=%s", item.Rule, item.Name, item.Value)]++
+		}
+	}
+	rules := []RuleCount{}
+	for rule, count := range counts {
+		rules = append(rules, RuleCount{Rule: rule, Resources: count})
+	}
+	sort.Slice(rules, func(i, j int) bool {
+		if rules[i].Resources != rules[j].Resources {
+			return rules[i].Resources > rules[j].Resources
+		}
+		return rules[i].Rule < rules[j].Rule
+	})
+	if len(rules) > n {
+		rules = rules[:n]
+	}
+	return rules
+}
+
+// parseLimit parses a limit in the value or provider=value form
+func parseLimit(s string) (string, string, error) {
+	provider, value := "", strings.TrimSpace(s)
+	if i := strings.Index(value, "="); i >= 0 {
+		provider, value = strings.TrimSpace(value[:i]), strings.TrimSpace(value[i+1:])
+		if provider == "" {
+			return "", "", fmt.Errorf("missing provider in %q", s)
+		}
+	}
+	return provider, value, nil
+}
+
+// maxChanges is a repeatable flag of limits of number of changes, each value
+// possibly holding a comma-separated list
+type maxChanges map[string]int
+
+func (l *maxChanges) String() string {
+	items := []string{}
+	for provider, max := range *l {
+		items = append(items, strings.TrimPrefix(provider+"="+strconv.Itoa(max), "="))
+	}
+	sort.Strings(items)
+	return strings.Join(items, ",")
+}
+
+func (l *maxChanges) Set(s string) error {
+	for _, item := range strings.Split(s, ",") {
+		provider, value, err := parseLimit(item)
+		if err != nil {
+			return err
+		}
+		max, err := strconv.Atoi(value)
+		if err != nil || max < 0 {
+			return fmt.Errorf("invalid number of changes %q", item)
+		}
+		if *l == nil {
+			*l = make(maxChanges)
+		}
+		(*l)[provider] = max
+	}
+	return nil
+}
+
+// maxChangePercent is a repeatable flag of limits of percentage of changes,
+// each value possibly holding a comma-separated list
+type maxChangePercent map[string]float64
+
+func (l *maxChangePercent) String() string {
+	items := []string{}
+	for provider, max := range *l {
+		items = append(items, strings.TrimPrefix(provider+"="+strconv.FormatFloat(max, 'f', -1, 64), "="))
+	}
+	sort.Strings(items)
+	return strings.Join(items, ",")
+}
+
+func (l *maxChangePercent) Set(s string) error {
+	for _, item := range strings.Split(s, ",") {
+		provider, value, err := parseLimit(item)
+		if err != nil {
+			return err
+		}
+		max, err := strconv.ParseFloat(value, 64)
+		if err != nil || max < 0 || max > 100 {
+			return fmt.Errorf("invalid percentage of changes %q", item)
+		}
+		if *l == nil {
+			*l = make(maxChangePercent)
+		}
+		(*l)[provider] = max
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+package limit
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"io/ioutil"
+	"reflect"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/VEVO/awsRetagger/mapper"
+)
+
+func init() {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	SetLogger(logrus.NewEntry(logger))
+	mapper.SetLogger(logrus.NewEntry(logger))
+}
+
+// parseLimits returns the limits corresponding to the given arguments
+func parseLimits(t *testing.T, args ...string) *Limits {
+	l := &Limits{}
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	l.RegisterFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		t.Fatalf("Unexpected error parsing %v: %v\n", args, err)
+	}
+	return l
+}
+
+func TestRegisterFlags(t *testing.T) {
+	l := parseLimits(t, "-max-changes", "100", "-max-changes", "ec2_instances=10,s3_buckets=0", "-max-change-percent", "rds_instances=12.5")
+	if expected := map[string]int{"": 100, "ec2_instances": 10, "s3_buckets": 0}; !reflect.DeepEqual(expected, l.MaxChanges) {
+		t.Errorf("Expecting: %v\nGot: %v\n", expected, l.MaxChanges)
+	}
+	if expected := map[string]float64{"rds_instances": 12.5}; !reflect.DeepEqual(expected, l.MaxChangePercent) {
+		t.Errorf("Expecting: %v\nGot: %v\n", expected, l.MaxChangePercent)
+	}
+	if !l.Enabled() || parseLimits(t).Enabled() {
+		t.Errorf("Limits enabled only when set\n")
+	}
+
+	for _, args := range [][]string{{"-max-changes", "many"}, {"-max-changes", "=10"}, {"-max-changes", "-1"}, {"-max-change-percent", "150"}} {
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		fs.SetOutput(ioutil.Discard)
+		(&Limits{}).RegisterFlags(fs)
+		if err := fs.Parse(args); err == nil {
+			t.Errorf("Expecting an error parsing %v\n", args)
+		}
+	}
+}
+
+// planRun plans the retagging of the given resources by provider with a
+// mapper setting the Env tag by default
+func planRun(resources map[string][]string) (*Plan, map[string]bool) {
+	m := &mapper.Mapper{DefaultTagValues: map[string]string{"Env": "unknown"}}
+	applied := map[string]bool{}
+	setTags := func(resourceID *string, tags []*mapper.TagItem) error {
+		if *resourceID == "broken" {
+			return errors.New("Badaboom")
+		}
+		applied[*resourceID] = true
+		return nil
+	}
+
+	p := NewPlan()
+	for provider, ids := range resources {
+		pm := p.Mapper(provider, m)
+		for _, id := range ids {
+			tags := map[string]string{}
+			if id == "tagged" {
+				tags["Env"] = "prd"
+			}
+			pm.Retag(context.Background(), &id, &tags, []string{}, mapper.Direct(setTags))
+		}
+	}
+	return p, applied
+}
+
+func TestPlan(t *testing.T) {
+	p, applied := planRun(map[string][]string{"ec2_instances": {"i-1", "i-2", "tagged"}, "s3_buckets": {"broken", "tagged"}})
+	if len(applied) != 0 {
+		t.Errorf("Nothing should be applied while planning, got: %v\n", applied)
+	}
+	if expected := map[string]int{"ec2_instances": 3, "s3_buckets": 2}; !reflect.DeepEqual(expected, p.Scanned) {
+		t.Errorf("Expecting: %v\nGot: %v\n", expected, p.Scanned)
+	}
+	if len(p.Changes) != 3 {
+		t.Errorf("Expecting 3 changes, got: %d\n", len(p.Changes))
+	}
+	if expected := []RuleCount{{Rule: "defaults Env=unknown", Resources: 3}}; !reflect.DeepEqual(expected, p.TopRules(5)) {
+		t.Errorf("Expecting: %v\nGot: %v\n", expected, p.TopRules(5))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if failed := p.Apply(ctx); failed != 0 || len(applied) != 0 {
+		t.Errorf("Expecting nothing to be applied once the run is interrupted, got: %v (%d failed)\n", applied, failed)
+	}
+	if failed := p.Apply(context.Background()); failed != 1 {
+		t.Errorf("Expecting 1 failed change, got: %d\n", failed)
+	}
+	if expected := map[string]bool{"i-1": true, "i-2": true}; !reflect.DeepEqual(expected, applied) {
+		t.Errorf("Expecting: %v\nGot: %v\n", expected, applied)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	p, _ := planRun(map[string][]string{"ec2_instances": {"i-1", "i-2", "tagged"}, "s3_buckets": {"b-1", "tagged", "tagged", "tagged"}})
+	testData := []struct {
+		args     []string
+		expected []Exceeded
+	}{
+		{[]string{}, []Exceeded{}},
+		{[]string{"-max-changes", "3"}, []Exceeded{}},
+		{[]string{"-max-changes", "2"}, []Exceeded{{Provider: "", Limit: "max-changes", Threshold: 2, Changes: 3, Scanned: 7}}},
+		{[]string{"-max-changes", "ec2_instances=1,s3_buckets=1"}, []Exceeded{{Provider: "ec2_instances", Limit: "max-changes", Threshold: 1, Changes: 2, Scanned: 3}}},
+		{[]string{"-max-change-percent", "50"}, []Exceeded{}},
+		{[]string{"-max-change-percent", "50", "-max-change-percent", "ec2_instances=50", "-max-changes", "ec2_instances=1"}, []Exceeded{
+			{Provider: "ec2_instances", Limit: "max-change-percent", Threshold: 50, Changes: 2, Scanned: 3},
+			{Provider: "ec2_instances", Limit: "max-changes", Threshold: 1, Changes: 2, Scanned: 3},
+		}},
+		// providers without resources never exceed a percentage
+		{[]string{"-max-change-percent", "rds_instances=0"}, []Exceeded{}},
+	}
+
+	for _, d := range testData {
+		if got := p.Check(parseLimits(t, d.args...)); !reflect.DeepEqual(d.expected, got) {
+			t.Errorf("Expecting: %v\nGot: %v\nFor: %v\n", d.expected, got, d.args)
+		}
+	}
+}
+
+func TestExceededString(t *testing.T) {
+	e := Exceeded{Limit: "max-change-percent", Threshold: 12.5, Changes: 3, Scanned: 7}
+	if expected := "all providers: 3 of 7 resources would change, exceeding -max-change-percent 12.5"; e.String() != expected {
+		t.Errorf("Expecting: %s\nGot: %s\n", expected, e.String())
+	}
+}
@@ -0,0 +1,172 @@
+package lock
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+// testBackend checks the leases of a backend through a sequence of operations
+func testBackend(t *testing.T, b Backend) {
+	ctx := context.Background()
+	testData := []struct {
+		op, key, owner string
+		expiresIn      time.Duration
+		expectedError  string
+	}{
+		{"acquire", "1/us-east-1", "a", time.Hour, ""},
+		{"acquire", "1/us-east-1", "b", time.Hour, "locked by a"},
+		// another key is another lock
+		{"acquire", "2/us-east-1", "b", time.Hour, ""},
+		{"acquire", "1/us-east-1", "a", time.Hour, ""},
+		{"renew", "1/us-east-1", "b", time.Hour, "lost"},
+		{"renew", "1/us-east-1", "a", time.Hour, ""},
+		{"release", "1/us-east-1", "b", 0, ""},
+		{"acquire", "1/us-east-1", "b", time.Hour, "locked by a"},
+		{"release", "1/us-east-1", "a", 0, ""},
+		{"renew", "1/us-east-1", "a", time.Hour, "lost"},
+		{"acquire", "1/us-east-1", "b", time.Hour, ""},
+		// an expired lease is taken over
+		{"acquire", "3/us-east-1", "a", -time.Minute, ""},
+		{"acquire", "3/us-east-1", "b", time.Hour, ""},
+		{"renew", "3/us-east-1", "a", time.Hour, "lost"},
+	}
+	for i, d := range testData {
+		var err error
+		switch d.op {
+		case "acquire":
+			err = b.Acquire(ctx, d.key, d.owner, time.Now().Add(d.expiresIn))
+		case "renew":
+			err = b.Renew(ctx, d.key, d.owner, time.Now().Add(d.expiresIn))
+		case "release":
+			err = b.Release(ctx, d.key, d.owner)
+		}
+		result := ""
+		if locked, ok := err.(*LockedError); ok {
+			result = "locked by " + locked.Owner
+		} else if err == ErrLost {
+			result = "lost"
+		} else if err != nil {
+			result = err.Error()
+		}
+		if result != d.expectedError {
+			t.Errorf("Expecting the %s of %s by %s at step %d to give %q, got %q\n", d.op, d.key, d.owner, i, d.expectedError, result)
+		}
+	}
+}
+
+func TestFileBackend(t *testing.T) {
+	dir, err := ioutil.TempDir("", "awsRetagger-lock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	testBackend(t, &FileBackend{Dir: dir})
+}
+
+// fakeDynamoDB keeps the items of a table in memory, evaluating the
+// conditions of the writes of DynamoDBBackend
+type fakeDynamoDB struct {
+	dynamodbiface.DynamoDBAPI
+	mu    sync.Mutex
+	items map[string]map[string]*dynamodb.AttributeValue
+}
+
+func conditionalCheckFailed() error {
+	return awserr.New(dynamodb.ErrCodeConditionalCheckFailedException, "The conditional request failed", nil)
+}
+
+// ownedBy checks if the item exists and has the :owner of the values
+func ownedBy(item map[string]*dynamodb.AttributeValue, values map[string]*dynamodb.AttributeValue) bool {
+	return item != nil && *item[ownerAttribute].S == *values[":owner"].S
+}
+
+func (f *fakeDynamoDB) PutItemWithContext(ctx aws.Context, input *dynamodb.PutItemInput, opts ...request.Option) (*dynamodb.PutItemOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key := *input.Item[keyAttribute].S
+	if item := f.items[key]; item != nil {
+		expires, _ := strconv.ParseInt(*item[expiresAttribute].N, 10, 64)
+		now, _ := strconv.ParseInt(*input.ExpressionAttributeValues[":now"].N, 10, 64)
+		if expires >= now && !ownedBy(item, input.ExpressionAttributeValues) {
+			return nil, conditionalCheckFailed()
+		}
+	}
+	f.items[key] = input.Item
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+func (f *fakeDynamoDB) GetItemWithContext(ctx aws.Context, input *dynamodb.GetItemInput, opts ...request.Option) (*dynamodb.GetItemOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return &dynamodb.GetItemOutput{Item: f.items[*input.Key[keyAttribute].S]}, nil
+}
+
+func (f *fakeDynamoDB) UpdateItemWithContext(ctx aws.Context, input *dynamodb.UpdateItemInput, opts ...request.Option) (*dynamodb.UpdateItemOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	item := f.items[*input.Key[keyAttribute].S]
+	if !ownedBy(item, input.ExpressionAttributeValues) {
+		return nil, conditionalCheckFailed()
+	}
+	item[expiresAttribute] = input.ExpressionAttributeValues[":expires"]
+	return &dynamodb.UpdateItemOutput{}, nil
+}
+
+func (f *fakeDynamoDB) DeleteItemWithContext(ctx aws.Context, input *dynamodb.DeleteItemInput, opts ...request.Option) (*dynamodb.DeleteItemOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key := *input.Key[keyAttribute].S
+	if !ownedBy(f.items[key], input.ExpressionAttributeValues) {
+		return nil, conditionalCheckFailed()
+	}
+	delete(f.items, key)
+	return &dynamodb.DeleteItemOutput{}, nil
+}
+
+func TestDynamoDBBackend(t *testing.T) {
+	testBackend(t, &DynamoDBBackend{svc: &fakeDynamoDB{items: map[string]map[string]*dynamodb.AttributeValue{}}, Table: DefaultTable})
+}
+
+// TestDynamoDBBackendLocal runs against the DynamoDB stand-in of the
+// DYNAMODB_ENDPOINT environment variable, like DynamoDB Local or LocalStack on
+// http://localhost:8000, in a table created for the test
+func TestDynamoDBBackendLocal(t *testing.T) {
+	endpoint := os.Getenv("DYNAMODB_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("DYNAMODB_ENDPOINT is not set")
+	}
+	sess := session.Must(session.NewSession(&aws.Config{
+		Region:      aws.String("us-east-1"),
+		Endpoint:    aws.String(endpoint),
+		Credentials: credentials.NewStaticCredentials("test", "test", ""),
+	}))
+	b := NewDynamoDBBackend(sess, "awsRetagger-locks-"+strconv.FormatInt(time.Now().UnixNano(), 36))
+	svc := dynamodb.New(sess)
+	_, err := svc.CreateTable(&dynamodb.CreateTableInput{
+		TableName:             aws.String(b.Table),
+		AttributeDefinitions:  []*dynamodb.AttributeDefinition{{AttributeName: aws.String(keyAttribute), AttributeType: aws.String(dynamodb.ScalarAttributeTypeS)}},
+		KeySchema:             []*dynamodb.KeySchemaElement{{AttributeName: aws.String(keyAttribute), KeyType: aws.String(dynamodb.KeyTypeHash)}},
+		ProvisionedThroughput: &dynamodb.ProvisionedThroughput{ReadCapacityUnits: aws.Int64(1), WriteCapacityUnits: aws.Int64(1)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer svc.DeleteTable(&dynamodb.DeleteTableInput{TableName: aws.String(b.Table)})
+	if err = svc.WaitUntilTableExists(&dynamodb.DescribeTableInput{TableName: aws.String(b.Table)}); err != nil {
+		t.Fatal(err)
+	}
+	testBackend(t, b)
+}
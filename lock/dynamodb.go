@@ -0,0 +1,124 @@
+package lock
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+// The attributes of the items of the leases. Expires is in seconds since the
+// epoch, so it can be the TTL attribute of the table.
+const (
+	keyAttribute     = "LockKey"
+	ownerAttribute   = "Owner"
+	expiresAttribute = "Expires"
+)
+
+// leaseNames are the names of the attributes used in the condition
+// expressions, Owner being a reserved word
+var leaseNames = map[string]*string{"#owner": aws.String(ownerAttribute), "#expires": aws.String(expiresAttribute)}
+
+// DynamoDBBackend stores the leases in a DynamoDB table with a LockKey string
+// partition key, through conditional writes, so the runs of several hosts
+// exclude each other
+type DynamoDBBackend struct {
+	svc   dynamodbiface.DynamoDBAPI
+	Table string
+}
+
+// NewDynamoDBBackend creates a DynamoDBBackend storing the leases in the
+// given table
+func NewDynamoDBBackend(sess *session.Session, table string) *DynamoDBBackend {
+	return &DynamoDBBackend{svc: dynamodb.New(sess), Table: table}
+}
+
+// Acquire takes the lease of the key for owner until expires, when there is
+// none, when it expired or when owner already holds it
+func (b *DynamoDBBackend) Acquire(ctx context.Context, key, owner string, expires time.Time) error {
+	_, err := b.svc.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(b.Table),
+		Item: map[string]*dynamodb.AttributeValue{
+			keyAttribute:     {S: aws.String(key)},
+			ownerAttribute:   {S: aws.String(owner)},
+			expiresAttribute: epoch(expires),
+		},
+		ConditionExpression:      aws.String("attribute_not_exists(" + keyAttribute + ") OR #expires < :now OR #owner = :owner"),
+		ExpressionAttributeNames: leaseNames,
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":now":   epoch(time.Now()),
+			":owner": {S: aws.String(owner)},
+		},
+	})
+	if !conditionFailed(err) {
+		return err
+	}
+	result, err := b.svc.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(b.Table),
+		Key:            map[string]*dynamodb.AttributeValue{keyAttribute: {S: aws.String(key)}},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return err
+	}
+	locked := &LockedError{Key: key}
+	if owner := result.Item[ownerAttribute]; owner != nil {
+		locked.Owner = aws.StringValue(owner.S)
+	}
+	if expires := result.Item[expiresAttribute]; expires != nil {
+		seconds, _ := strconv.ParseInt(aws.StringValue(expires.N), 10, 64)
+		locked.Expires = time.Unix(seconds, 0)
+	}
+	return locked
+}
+
+// Renew extends the lease of owner until expires
+func (b *DynamoDBBackend) Renew(ctx context.Context, key, owner string, expires time.Time) error {
+	_, err := b.svc.UpdateItemWithContext(ctx, &dynamodb.UpdateItemInput{
+		TableName:                aws.String(b.Table),
+		Key:                      map[string]*dynamodb.AttributeValue{keyAttribute: {S: aws.String(key)}},
+		UpdateExpression:         aws.String("SET #expires = :expires"),
+		ConditionExpression:      aws.String("#owner = :owner"),
+		ExpressionAttributeNames: leaseNames,
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":expires": epoch(expires),
+			":owner":   {S: aws.String(owner)},
+		},
+	})
+	if conditionFailed(err) {
+		return ErrLost
+	}
+	return err
+}
+
+// Release removes the lease of owner, if it still holds it
+func (b *DynamoDBBackend) Release(ctx context.Context, key, owner string) error {
+	_, err := b.svc.DeleteItemWithContext(ctx, &dynamodb.DeleteItemInput{
+		TableName:                 aws.String(b.Table),
+		Key:                       map[string]*dynamodb.AttributeValue{keyAttribute: {S: aws.String(key)}},
+		ConditionExpression:       aws.String("#owner = :owner"),
+		ExpressionAttributeNames:  map[string]*string{"#owner": aws.String(ownerAttribute)},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{":owner": {S: aws.String(owner)}},
+	})
+	if conditionFailed(err) {
+		return nil
+	}
+	return err
+}
+
+// epoch returns the number attribute of a time in seconds since the epoch
+func epoch(t time.Time) *dynamodb.AttributeValue {
+	return &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(t.Unix(), 10))}
+}
+
+// conditionFailed checks if the error is the failure of the condition of a
+// write
+func conditionFailed(err error) bool {
+	aerr, ok := err.(awserr.Error)
+	return ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException
+}
@@ -0,0 +1,117 @@
+package lock
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+)
+
+// staleGuard is the age after which the guard of a lock file is considered
+// left by a run that died while holding it
+const staleGuard = 10 * time.Second
+
+// unsafeKeyChars are the characters of the keys replaced in the names of the
+// lock files
+var unsafeKeyChars = regexp.MustCompile(`[^0-9A-Za-z._-]`)
+
+// fileLease is the content of a lock file
+type fileLease struct {
+	Owner   string    `json:"owner"`
+	Expires time.Time `json:"expires"`
+}
+
+// FileBackend stores the leases in lock files, excluding the runs sharing the
+// directory. The reads and writes of a lock file are serialized by a guard
+// directory, as creating a directory is atomic on all the platforms.
+type FileBackend struct {
+	Dir string
+}
+
+// Acquire takes the lease of the key for owner until expires
+func (b *FileBackend) Acquire(ctx context.Context, key, owner string, expires time.Time) error {
+	return b.guard(key, func(path string, current *fileLease) error {
+		if current != nil && current.Owner != owner && time.Now().Before(current.Expires) {
+			return &LockedError{Key: key, Owner: current.Owner, Expires: current.Expires}
+		}
+		return b.write(path, &fileLease{Owner: owner, Expires: expires})
+	})
+}
+
+// Renew extends the lease of owner until expires
+func (b *FileBackend) Renew(ctx context.Context, key, owner string, expires time.Time) error {
+	return b.guard(key, func(path string, current *fileLease) error {
+		if current == nil || current.Owner != owner {
+			return ErrLost
+		}
+		return b.write(path, &fileLease{Owner: owner, Expires: expires})
+	})
+}
+
+// Release removes the lease of owner, if it still holds it
+func (b *FileBackend) Release(ctx context.Context, key, owner string) error {
+	return b.guard(key, func(path string, current *fileLease) error {
+		if current == nil || current.Owner != owner {
+			return nil
+		}
+		return os.Remove(path)
+	})
+}
+
+// guard calls fn with the path and the current lease of the lock file of the
+// key, nil when there is none, while holding its guard
+func (b *FileBackend) guard(key string, fn func(path string, current *fileLease) error) error {
+	if err := os.MkdirAll(b.Dir, 0755); err != nil {
+		return err
+	}
+	path := filepath.Join(b.Dir, "awsRetagger-"+unsafeKeyChars.ReplaceAllString(key, "_")+".lock")
+	guard := path + ".guard"
+	for {
+		err := os.Mkdir(guard, 0755)
+		if err == nil {
+			break
+		}
+		if !os.IsExist(err) {
+			return err
+		}
+		if info, err := os.Stat(guard); err == nil && time.Since(info.ModTime()) > staleGuard {
+			os.Remove(guard)
+			continue
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	defer os.Remove(guard)
+
+	var current *fileLease
+	content, err := ioutil.ReadFile(path)
+	switch {
+	case err == nil:
+		current = &fileLease{}
+		if err = json.Unmarshal(content, current); err != nil {
+			return err
+		}
+	case !os.IsNotExist(err):
+		return err
+	}
+	return fn(path, current)
+}
+
+// write replaces the lock file atomically
+func (b *FileBackend) write(path string, lease *fileLease) error {
+	tmp, err := ioutil.TempFile(b.Dir, filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err = json.NewEncoder(tmp).Encode(lease); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,286 @@
+// Package lock prevents two runs of the retagger from processing the same
+// account and region at the same time. A run holds the lock through a lease
+// with a TTL, renewed while it runs, so the lock of a run that died expires on
+// its own. The leases are stored either in local lock files or in a DynamoDB
+// table, with conditional writes, for the runs of several hosts.
+package lock
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultTable is the default DynamoDB table of the leases
+const DefaultTable = "awsRetagger-locks"
+
+// retryInterval is the time between two attempts to take a lock held by
+// another run
+const retryInterval = 5 * time.Second
+
+// ErrLost is returned when renewing a lease taken over by another run, once
+// expired
+var ErrLost = errors.New("the lease is held by another run")
+
+// LockedError is returned when the lock is held by another run
+type LockedError struct {
+	Key     string
+	Owner   string
+	Expires time.Time
+}
+
+func (e *LockedError) Error() string {
+	return fmt.Sprintf("the lock %s is held by %s until %s", e.Key, e.Owner, e.Expires.Format(time.RFC3339))
+}
+
+// Backend stores the leases of the locks
+type Backend interface {
+	// Acquire takes the lease of the key for owner until expires, unless
+	// another owner holds a lease not expired yet, in which case a
+	// *LockedError is returned
+	Acquire(ctx context.Context, key, owner string, expires time.Time) error
+	// Renew extends the lease of owner until expires, returning ErrLost when
+	// another owner took it over
+	Renew(ctx context.Context, key, owner string, expires time.Time) error
+	// Release removes the lease of owner, if it still holds it
+	Release(ctx context.Context, key, owner string) error
+}
+
+// Key returns the key of the lock of the runs on an account and region
+func Key(account, region string) string {
+	return account + "/" + region
+}
+
+// AccountKey returns the key of the lock of the runs on the global resources
+// of an account, like the S3 buckets of all its regions, taken on top of the
+// lock of their region
+func AccountKey(account string) string {
+	return account
+}
+
+// Owner returns the identity of the current process, as the owner of its
+// leases
+func Owner() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return fmt.Sprintf("%s:%d", host, os.Getpid())
+}
+
+// Options select and configure the backend of the lock
+type Options struct {
+	// Backend is either file or dynamodb, no lock being taken when empty
+	Backend string
+	// Dir is the directory of the lock files, the temporary directory when
+	// empty
+	Dir string
+	// Table is the DynamoDB table of the leases
+	Table string
+	// TTL is the duration of the leases
+	TTL time.Duration
+	// Wait is how long to wait for a lock held by another run
+	Wait time.Duration
+}
+
+// RegisterFlags defines the flags of the lock
+func (o *Options) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&o.Backend, "lock", "", "Backend of the lock preventing two runs from processing the same account and region at the same time: file or dynamodb, no lock when empty. Environment variable: LOCK")
+	fs.StringVar(&o.Dir, "lock-dir", "", "Directory of the lock files of the file lock, the temporary directory when empty. Environment variable: LOCK_DIR")
+	fs.StringVar(&o.Table, "lock-table", DefaultTable, "DynamoDB table of the dynamodb lock, with a LockKey string partition key. Environment variable: LOCK_TABLE")
+	fs.DurationVar(&o.TTL, "lock-ttl", 5*time.Minute, "Duration of the lease of the lock, renewed while the run holds it, after which the lock of a run that died is released. Environment variable: LOCK_TTL")
+	fs.DurationVar(&o.Wait, "lock-wait", 0, "How long to wait for the lock held by another run, 0 to fail right away. Environment variable: LOCK_WAIT")
+}
+
+// NewLocker returns the locker of the options, nil when no backend is set
+func (o *Options) NewLocker(sess *session.Session) (*Locker, error) {
+	if o.Backend == "" {
+		return nil, nil
+	}
+	if o.TTL <= 0 {
+		return nil, fmt.Errorf("invalid lock TTL %s", o.TTL)
+	}
+	l := &Locker{TTL: o.TTL, Wait: o.Wait, Owner: Owner()}
+	switch o.Backend {
+	case "file":
+		dir := o.Dir
+		if dir == "" {
+			dir = os.TempDir()
+		}
+		l.Backend = &FileBackend{Dir: dir}
+	case "dynamodb":
+		l.Backend = NewDynamoDBBackend(sess, o.Table)
+	default:
+		return nil, fmt.Errorf("unknown lock backend %q, expecting file or dynamodb", o.Backend)
+	}
+	return l, nil
+}
+
+// Locker takes the locks of the runs
+type Locker struct {
+	Backend Backend
+	// TTL is the duration of the leases, renewed every third of it
+	TTL time.Duration
+	// Wait is how long Acquire waits for a lock held by another run, failing
+	// right away when 0
+	Wait time.Duration
+	// Owner identifies the run in the leases
+	Owner string
+	// retry is the time between two attempts to take the lock, retryInterval
+	// when zero
+	retry time.Duration
+}
+
+// Acquire takes the locks of the keys, in order, waiting for the other runs
+// holding them up to Wait. When one of them cannot be taken, the ones already
+// taken are given back. The lease is renewed until released. The returned
+// context is cancelled when the lease is lost, as another run may then take
+// the locks. When l is nil, no lock is taken and the context is returned as-is
+// with a nil lease.
+func (l *Locker) Acquire(ctx context.Context, keys ...string) (context.Context, *Lease, error) {
+	if l == nil {
+		return ctx, nil, nil
+	}
+	deadline := time.Now().Add(l.Wait)
+	for i, key := range keys {
+		if err := l.acquire(ctx, key, deadline); err != nil {
+			for _, taken := range keys[:i] {
+				if err := l.Backend.Release(context.Background(), taken, l.Owner); err != nil {
+					log.WithFields(logrus.Fields{"error": err, "key": taken}).Error("Unable to release the lock, it is released once its lease expires")
+				}
+			}
+			return nil, nil, err
+		}
+	}
+
+	leaseCtx, cancel := context.WithCancel(ctx)
+	lease := &Lease{locker: l, keys: keys, cancel: cancel, stop: make(chan struct{}), done: make(chan struct{})}
+	go lease.renew()
+	return leaseCtx, lease, nil
+}
+
+// acquire takes the lock of the key, retrying while another run holds it
+// until the deadline
+func (l *Locker) acquire(ctx context.Context, key string, deadline time.Time) error {
+	retry := l.retry
+	if retry == 0 {
+		retry = retryInterval
+	}
+	for {
+		err := l.Backend.Acquire(ctx, key, l.Owner, time.Now().Add(l.TTL))
+		if err == nil {
+			break
+		}
+		locked, ok := err.(*LockedError)
+		if !ok || !time.Now().Add(retry).Before(deadline) {
+			return err
+		}
+		log.WithFields(logrus.Fields{"key": key, "owner": locked.Owner, "expires": locked.Expires}).Info("Waiting for the lock held by another run")
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(retry):
+		}
+	}
+	log.WithFields(logrus.Fields{"key": key, "owner": l.Owner, "ttl": l.TTL}).Info("Lock acquired")
+	return nil
+}
+
+// Lease is the locks held by a run
+type Lease struct {
+	locker *Locker
+	keys   []string
+	cancel context.CancelFunc
+	stop   chan struct{}
+	done   chan struct{}
+	once   sync.Once
+
+	mu sync.Mutex
+	// lostKey is the key of the lock lost, if any
+	lostKey string
+	lost    bool
+}
+
+// renew extends the lease every third of the TTL until it is released. The
+// lease is lost when another run took it over or when it could not be renewed
+// before it expired. The renewals are not cancelled with the run, so the lock
+// is kept while the run shuts down.
+func (l *Lease) renew() {
+	defer close(l.done)
+	ttl := l.locker.TTL
+	expires := time.Now().Add(ttl)
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-time.After(ttl / 3):
+		}
+		next := time.Now().Add(ttl)
+		key, err := l.renewKeys(next)
+		if err == nil {
+			expires = next
+			continue
+		}
+		if err != ErrLost && time.Now().Before(expires) {
+			log.WithFields(logrus.Fields{"error": err, "key": key, "expires": expires}).Warn("Unable to renew the lease of the lock, retrying")
+			continue
+		}
+		log.WithFields(logrus.Fields{"error": err, "key": key}).Error("Lease of the lock lost, stopping the run")
+		l.mu.Lock()
+		l.lost, l.lostKey = true, key
+		l.mu.Unlock()
+		l.cancel()
+		return
+	}
+}
+
+// renewKeys extends the leases of the locks of all the keys until expires,
+// returning the key of the first one that failed
+func (l *Lease) renewKeys(expires time.Time) (string, error) {
+	for _, key := range l.keys {
+		if err := l.locker.Backend.Renew(context.Background(), key, l.locker.Owner, expires); err != nil {
+			return key, err
+		}
+	}
+	return "", nil
+}
+
+// Lost is true when the lease was lost before being released. l can be nil.
+func (l *Lease) Lost() bool {
+	if l == nil {
+		return false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.lost
+}
+
+// Release stops the renewals and gives the locks back, but the lost one. It can
+// be called several times. l can be nil.
+func (l *Lease) Release() {
+	if l == nil {
+		return
+	}
+	l.once.Do(func() {
+		close(l.stop)
+		<-l.done
+		l.cancel()
+		for _, key := range l.keys {
+			if l.lost && key == l.lostKey {
+				continue
+			}
+			if err := l.locker.Backend.Release(context.Background(), key, l.locker.Owner); err != nil {
+				log.WithFields(logrus.Fields{"error": err, "key": key}).Error("Unable to release the lock, it is released once its lease expires")
+				continue
+			}
+			log.WithFields(logrus.Fields{"key": key}).Debug("Lock released")
+		}
+	})
+}
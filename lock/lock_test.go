@@ -0,0 +1,199 @@
+package lock
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	logrus_test "github.com/sirupsen/logrus/hooks/test"
+)
+
+// mockBackend holds the leases in memory, failing the renewals when lost is
+// set
+type mockBackend struct {
+	mu       sync.Mutex
+	owners   map[string]string
+	lost     bool
+	released int
+}
+
+// owner returns the owner of the lease of the key
+func (b *mockBackend) owner(key string) string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.owners[key]
+}
+
+func (b *mockBackend) Acquire(ctx context.Context, key, owner string, expires time.Time) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if current := b.owners[key]; current != "" && current != owner {
+		return &LockedError{Key: key, Owner: current, Expires: expires}
+	}
+	b.owners[key] = owner
+	return nil
+}
+
+func (b *mockBackend) Renew(ctx context.Context, key, owner string, expires time.Time) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.lost {
+		return ErrLost
+	}
+	return nil
+}
+
+func (b *mockBackend) Release(ctx context.Context, key, owner string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.owners[key] == owner {
+		delete(b.owners, key)
+	}
+	b.released++
+	return nil
+}
+
+func TestLockerAcquire(t *testing.T) {
+	logger, _ := logrus_test.NewNullLogger()
+	log = logrus.NewEntry(logger)
+
+	testData := []struct {
+		heldBy        string
+		wait          time.Duration
+		releaseAfter  time.Duration
+		expectedError bool
+	}{
+		{"", 0, 0, false},
+		// fails fast
+		{"cron:1", 0, 0, true},
+		// waits for the other run
+		{"cron:1", time.Second, 20 * time.Millisecond, false},
+		// waits up to the wait duration
+		{"cron:1", 30 * time.Millisecond, time.Second, true},
+	}
+	for _, d := range testData {
+		b := &mockBackend{owners: map[string]string{}}
+		if d.heldBy != "" {
+			heldBy := d.heldBy
+			b.owners["1/us-east-1"] = heldBy
+			time.AfterFunc(d.releaseAfter, func() { b.Release(context.Background(), "1/us-east-1", heldBy) })
+		}
+		l := &Locker{Backend: b, TTL: time.Minute, Wait: d.wait, Owner: "manual:2", retry: 5 * time.Millisecond}
+		ctx, lease, err := l.Acquire(context.Background(), "1/us-east-1")
+		if (err != nil) != d.expectedError {
+			t.Errorf("Unexpected error with the lock held by %q and a wait of %s: %v\n", d.heldBy, d.wait, err)
+			continue
+		}
+		if err != nil {
+			if _, ok := err.(*LockedError); !ok {
+				t.Errorf("Expecting a LockedError, got: %v\n", err)
+			}
+			continue
+		}
+		if ctx.Err() != nil || b.owner("1/us-east-1") != "manual:2" {
+			t.Errorf("Expecting the lock to be held by manual:2, got %q\n", b.owner("1/us-east-1"))
+		}
+		lease.Release()
+		lease.Release()
+		if ctx.Err() == nil || b.owner("1/us-east-1") != "" || lease.Lost() {
+			t.Errorf("Expecting the released lock to be free, got %q\n", b.owner("1/us-east-1"))
+		}
+	}
+}
+
+func TestLockerAcquireNil(t *testing.T) {
+	var l *Locker
+	ctx := context.Background()
+	runCtx, lease, err := l.Acquire(ctx, "1/us-east-1")
+	if runCtx != ctx || lease != nil || err != nil {
+		t.Errorf("Expecting no lock without a locker, got %v, %v\n", lease, err)
+	}
+	lease.Release()
+}
+
+func TestLockerAcquireKeys(t *testing.T) {
+	logger, _ := logrus_test.NewNullLogger()
+	log = logrus.NewEntry(logger)
+
+	// the locks already taken are given back when the next one is held
+	b := &mockBackend{owners: map[string]string{"1": "manual:1"}}
+	l := &Locker{Backend: b, TTL: time.Minute, Owner: "manual:2"}
+	if _, _, err := l.Acquire(context.Background(), "1/us-east-1", "1"); err == nil || b.owner("1/us-east-1") != "" {
+		t.Errorf("Expecting the lock of the region to be given back, got %q (error: %v)\n", b.owner("1/us-east-1"), err)
+	}
+
+	b.owners = map[string]string{}
+	_, lease, err := l.Acquire(context.Background(), "1/us-east-1", "1")
+	if err != nil || b.owner("1/us-east-1") != "manual:2" || b.owner("1") != "manual:2" {
+		t.Fatalf("Expecting both locks to be taken, got %v (error: %v)\n", b.owners, err)
+	}
+	lease.Release()
+	if b.owner("1/us-east-1") != "" || b.owner("1") != "" {
+		t.Errorf("Expecting both locks to be released, got %v\n", b.owners)
+	}
+}
+
+func TestLeaseLost(t *testing.T) {
+	logger, _ := logrus_test.NewNullLogger()
+	log = logrus.NewEntry(logger)
+
+	b := &mockBackend{owners: map[string]string{}}
+	l := &Locker{Backend: b, TTL: 30 * time.Millisecond, Owner: "manual:2"}
+	ctx, lease, err := l.Acquire(context.Background(), "1/us-east-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// renewed while held
+	time.Sleep(50 * time.Millisecond)
+	if ctx.Err() != nil || lease.Lost() {
+		t.Fatalf("Expecting the lease to be renewed\n")
+	}
+
+	b.mu.Lock()
+	b.lost = true
+	b.mu.Unlock()
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatalf("Expecting the context to be cancelled once the lease is lost\n")
+	}
+	lease.Release()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !lease.Lost() || b.released != 0 {
+		t.Errorf("Expecting the lost lease not to be released, got lost %t and %d releases\n", lease.Lost(), b.released)
+	}
+}
+
+func TestOptionsNewLocker(t *testing.T) {
+	dir, err := ioutil.TempDir("", "awsRetagger-lock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	testData := []struct {
+		options       Options
+		expectedNil   bool
+		expectedError bool
+	}{
+		{Options{TTL: time.Minute}, true, false},
+		{Options{Backend: "file", Dir: dir, TTL: time.Minute}, false, false},
+		{Options{Backend: "file", Dir: dir}, false, true},
+		{Options{Backend: "consul", TTL: time.Minute}, false, true},
+	}
+	for _, d := range testData {
+		l, err := d.options.NewLocker(nil)
+		if (err != nil) != d.expectedError {
+			t.Errorf("Unexpected error for %+v: %v\n", d.options, err)
+			continue
+		}
+		if err == nil && (l == nil) != d.expectedNil {
+			t.Errorf("Expecting a nil locker to be %t for %+v, got %v\n", d.expectedNil, d.options, l)
+		}
+	}
+}
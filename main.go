@@ -1,130 +1,356 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"io"
+	"net/http"
 	"os"
+	"strings"
+	"time"
 
+	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/gobike/envflag"
 	"github.com/sirupsen/logrus"
 
+	"github.com/VEVO/awsRetagger/auth"
+	"github.com/VEVO/awsRetagger/flap"
+	"github.com/VEVO/awsRetagger/history"
+	"github.com/VEVO/awsRetagger/limit"
+	"github.com/VEVO/awsRetagger/lock"
 	"github.com/VEVO/awsRetagger/mapper"
-	"github.com/VEVO/awsRetagger/providers"
+	"github.com/VEVO/awsRetagger/metrics"
+	"github.com/VEVO/awsRetagger/runner"
 )
 
 var log *logrus.Entry
 
-// NewLogger creates a new logger instance
-func NewLogger(logLevel, format string, output io.Writer) (*logrus.Entry, error) {
-	switch format {
-	case "text":
-		logrus.SetFormatter(&logrus.TextFormatter{})
-	case "json":
-		logrus.SetFormatter(&logrus.JSONFormatter{})
-	default:
-		return nil, fmt.Errorf("invalid format requested: %s", format)
-	}
-	logrus.SetOutput(output)
+// usage prints the list of commands before the list of options
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), `Usage: %s [command] [options]
 
-	level, err := logrus.ParseLevel(logLevel)
-	if err != nil {
-		return nil, err
-	}
-	logrus.SetLevel(level)
-	context := logrus.WithFields(logrus.Fields{
-		"app": "awsRetagger",
-	})
+Commands:
+  retag    Retag the enabled resources (default). Exits with code 4 without
+           changing anything when the -max-changes or -max-change-percent
+           limits are exceeded. Without change limits, the progress of the run
+           is saved in the -checkpoint-dir so that an interrupted or crashed
+           run can be continued with -resume <run-id>. With a -lock, exits
+           with code 5 when another run holds the lock of the account and
+           region, or of the account for the S3 buckets and CloudFront
+           distributions, or when the lock is lost
+  suggest  Propose a sanity and copy_tags configuration from the existing tags
+           of the enabled resources, without changing anything
+  check    Report the compliance of the enabled resources with the required
+           tags and allowed values of the configuration, without changing
+           anything. Exits with code 3 when the non-compliant resources exceed
+           the -max-non-compliant-percent threshold
+  serve    Retag the enabled resources on the given -schedule, reloading the
+           config file when it changes, and expose the health, status and
+           metrics of the runs over http on the -listen address
+  events   Retag the resources of the enabled providers as they are created,
+           from the CloudTrail events read from the -events source
+  history  List the tag changes recorded in the -history database for the
+           resource ID or ARN given after the command, or for the -key,
+           -value and -since options, without calling AWS
 
-	return context, nil
+On SIGINT or SIGTERM, the commands stop processing new resources, let the
+in-flight writes finish within the -shutdown-grace period, write their partial
+reports and exit with code 130.
+
+Options:
+`, os.Args[0])
+	flag.PrintDefaults()
 }
 
 func main() {
 	var (
-		configFilePath, logLevel, logFormat                                                                                                                                                                          string
-		processEc2Instances, processRdsInstances, processRdsClusters, processCloudwatchLogGroups, processElasticSearch, processCloudFrontDist, processRedshiftClusters, processElasticBeanstalkEnv, processS3Buckets bool
-		err                                                                                                                                                                                                          error
+		configFilePath, logLevel, logFormat, sanityReportPath, outputPath, reportFormat, metricsListen, metricsTextfile, listen, scheduleSpec, eventsSource, statePath, checkpointDir, resume, historyPath, historyKey, historyValue, since string
+		full                                                                                                                                                                                                                                bool
+		maxNonCompliantPercent                                                                                                                                                                                                              float64
+		shutdownGrace, checkpointInterval                                                                                                                                                                                                   time.Duration
+		enabled                                                                                                                                                                                                                             runner.Providers
+		limits                                                                                                                                                                                                                              limit.Limits
+		endpoints                                                                                                                                                                                                                           runner.Endpoints
+		credentialOptions                                                                                                                                                                                                                   auth.Options
+		lockOptions                                                                                                                                                                                                                         lock.Options
+		flapOptions                                                                                                                                                                                                                         flap.Options
+		collector                                                                                                                                                                                                                           *metrics.Collector
+		err                                                                                                                                                                                                                                 error
 	)
 	flag.StringVar(&configFilePath, "config", "config.json", "Path of the json configuration file. Environment variable: CONFIG")
 	flag.StringVar(&logLevel, "log-level", "info", "Log level. Accepted values: debug, info, warn, error, fatal, panic. Environment variable: LOG_LEVEL")
 	flag.StringVar(&logFormat, "log-format", "text", "Log format. Accepted values: text, json. Environment variable: LOG_FORMAT")
-	flag.BoolVar(&processEc2Instances, "ec2-instances", false, "Enables the re-tagging of the EC2 instances. Environment variable: EC2_INSTANCES")
-	flag.BoolVar(&processRdsInstances, "rds-instances", false, "Enables the re-tagging of the RDS instances. Environment variable: RDS_INSTANCES")
-	flag.BoolVar(&processRdsClusters, "rds-clusters", false, "Enables the re-tagging of the RDS clusters. Environment variable: RDS_CLUSTERS")
-	flag.BoolVar(&processCloudwatchLogGroups, "cloudwatch-groups", false, "Enables the re-tagging of the CloudWatch log groups. Environment variable: CLOUDWATCH_GROUPS")
-	flag.BoolVar(&processElasticSearch, "elasticsearch", false, "Enables the re-tagging of the ElasticSearch domains. Environment variable: ELASTICSEARCH")
-	flag.BoolVar(&processCloudFrontDist, "cloudfront-distributions", false, "Enables the re-tagging of the CloudFront distributions. Environment variable: CLOUDFRONT_DISTRIBUTIONS")
-	flag.BoolVar(&processRedshiftClusters, "redshift-clusters", false, "Enables the re-tagging of the Redshift clusters. Environment variable: REDSHIFT_CLUSTERS")
-	flag.BoolVar(&processElasticBeanstalkEnv, "elasticbeanstalk-environments", false, "Enables the re-tagging of the ElasticBeanstalk environments. Environment variable: ELASTICBEANSTALK_ENVIRONMENTS")
-	flag.BoolVar(&processS3Buckets, "s3-buckets", false, "Enables the re-tagging of the S3 buckets. Environment variable: S3_BUCKETS")
+	flag.StringVar(&sanityReportPath, "sanity-report", "", "Path of the file where the report of the sanity check failures is written at the end of the run, - for the standard output. Environment variable: SANITY_REPORT")
+	flag.StringVar(&outputPath, "output", "-", "Path of the file where the result of the suggest, check and history commands is written, - for the standard output. Environment variable: OUTPUT")
+	flag.StringVar(&reportFormat, "format", "table", "Format of the compliance report of the check command and of the changes listed by the history command. Accepted values: table, csv, json, and junit for the check command. Environment variable: FORMAT")
+	flag.Float64Var(&maxNonCompliantPercent, "max-non-compliant-percent", 0, "Percentage of non-compliant resources above which the check command fails. Environment variable: MAX_NON_COMPLIANT_PERCENT")
+	flag.StringVar(&metricsListen, "metrics-listen", "", "Address on which the Prometheus metrics are exposed under /metrics, for example :9090. Environment variable: METRICS_LISTEN")
+	flag.StringVar(&metricsTextfile, "metrics-textfile", "", "Path of the file where the Prometheus metrics are written at the end of the run for the node_exporter textfile collector. Environment variable: METRICS_TEXTFILE")
+	flag.StringVar(&listen, "listen", ":8080", "Address on which the serve command exposes /healthz, /status and /metrics. Environment variable: LISTEN")
+	flag.StringVar(&scheduleSpec, "schedule", "24h", "Schedule of the runs of the serve command, either an interval (30m, 6h) or a cron expression (0 2 * * *). Environment variable: SCHEDULE")
+	flag.StringVar(&eventsSource, "events", "-", "Source of the CloudTrail events of the events command: an SQS queue URL, a file or - for the standard input. Environment variable: EVENTS")
+	flag.StringVar(&statePath, "state", "", "Path of the file holding the state of the resources processed by the previous runs of the retag and serve commands, to skip the unchanged resources. Environment variable: STATE")
+	flag.BoolVar(&full, "full", false, "Process all the resources even when unchanged since the previous run, still updating the -state file. Environment variable: FULL")
+	flag.StringVar(&checkpointDir, "checkpoint-dir", "", "Directory where the checkpoints of the retag runs are saved, the awsRetagger/checkpoints directory of the user cache directory when empty. Environment variable: CHECKPOINT_DIR")
+	flag.DurationVar(&checkpointInterval, "checkpoint-interval", time.Minute, "How often the checkpoint of a retag run is saved, 0 to disable the checkpoints. Environment variable: CHECKPOINT_INTERVAL")
+	flag.StringVar(&resume, "resume", "", "ID of the retag run to continue from its checkpoint, refused when the config changed since. Environment variable: RESUME")
+	flag.StringVar(&historyPath, "history", "", "Path of the bbolt database where the retag, serve and events commands record each tag change they make, and that the history command queries. Environment variable: HISTORY")
+	flag.StringVar(&historyKey, "key", "", "Tag key of the changes listed by the history command. Environment variable: KEY")
+	flag.StringVar(&historyValue, "value", "", "Tag value, old or new, of the changes listed by the history command. Environment variable: VALUE")
+	flag.StringVar(&since, "since", "", "Start of the changes listed by the history command, either a duration like 30d or 12h or a date like 2018-01-02. Environment variable: SINCE")
+	flag.DurationVar(&shutdownGrace, "shutdown-grace", 30*time.Second, "How long the in-flight writes and the reports are waited for after a SIGINT or SIGTERM before exiting anyway. Environment variable: SHUTDOWN_GRACE")
+	enabled.RegisterFlags(flag.CommandLine)
+	limits.RegisterFlags(flag.CommandLine)
+	endpoints.RegisterFlags(flag.CommandLine)
+	credentialOptions.RegisterFlags(flag.CommandLine)
+	lockOptions.RegisterFlags(flag.CommandLine)
+	flapOptions.RegisterFlags(flag.CommandLine)
+	flag.Usage = usage
+
+	// The command is the 1st argument, when given
+	command, args := "retag", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+	flag.CommandLine.Parse(args)
+	// The resource of the history command comes before or among the options
+	resource := ""
+	if command == "history" && flag.NArg() > 0 {
+		resource = flag.Arg(0)
+		flag.CommandLine.Parse(flag.Args()[1:])
+	}
 	envflag.Parse()
 
-	if log, err = NewLogger(logLevel, logFormat, os.Stdout); err != nil {
+	// Keep the standard output clean when the result of the command goes there
+	logOutput := io.Writer(os.Stdout)
+	if command != "retag" && outputPath == "-" {
+		logOutput = os.Stderr
+	}
+	if log, err = runner.NewLogger(logLevel, logFormat, logOutput); err != nil {
 		fmt.Printf("Error while setting up the logger: %s\n", err)
 		os.Exit(1)
 	}
-	mapper.SetLogger(log)
-	providers.SetLogger(log)
-	// Load config
-	cfg, err := os.Open(configFilePath)
-	defer cfg.Close()
+	runner.SetLoggers(log)
+	if command == "history" {
+		showHistory(historyPath, resource, historyKey, historyValue, since, outputPath, reportFormat)
+		os.Exit(0)
+	}
+	ctx := notifyShutdown(shutdownGrace)
+
+	sess, err := credentialOptions.NewSession(endpoints.Config())
+	if err != nil {
+		log.WithFields(logrus.Fields{"error": err}).Fatal("Unable to create the AWS session")
+	}
+	identity, err := auth.Identity(sess)
 	if err != nil {
-		log.WithFields(logrus.Fields{"error": err}).Fatal("Unable to read config file")
+		log.WithFields(logrus.Fields{"error": err}).Fatal("Unable to get the identity of the AWS credentials")
 	}
+	log.WithFields(logrus.Fields{"account": aws.StringValue(identity.Account), "arn": aws.StringValue(identity.Arn), "user_id": aws.StringValue(identity.UserId)}).Info("Running as")
+	locker, err := lockOptions.NewLocker(sess)
+	if err != nil {
+		log.WithFields(logrus.Fields{"error": err}).Fatal("Invalid lock options")
+	}
+	lockKeys := lockKeys(&enabled, aws.StringValue(identity.Account), aws.StringValue(sess.Config.Region))
 
-	m := mapper.Mapper{}
-	if err = m.LoadConfig(cfg); err != nil {
-		log.WithFields(logrus.Fields{"error": err}).Fatal("Unable to load config file")
+	if metricsListen != "" || metricsTextfile != "" || command == "serve" {
+		collector = newCollector(sess, aws.StringValue(identity.Account))
+		if metricsListen != "" {
+			go serveMetrics(metricsListen, collector)
+		}
 	}
 
-	sess := session.Must(session.NewSessionWithOptions(session.Options{
-		SharedConfigState: session.SharedConfigEnable,
-	}))
+	start := time.Now()
+	exitCode := 0
+	switch command {
+	case "retag":
+		exitCode = withLock(ctx, locker, lockKeys, func(ctx context.Context) int {
+			return retag(ctx, sess, &enabled, collector, newIncremental(statePath, full), newFlapping(&flapOptions, historyPath), newChangeHistory(historyPath), &limits, newCheckpoints(checkpointDir, checkpointInterval), resume, configFilePath, sanityReportPath)
+		})
+	case "suggest":
+		suggest(ctx, sess, &enabled, collector, outputPath)
+	case "check":
+		exitCode = check(ctx, sess, &enabled, collector, configFilePath, outputPath, reportFormat, maxNonCompliantPercent)
+	case "serve":
+		serve(ctx, sess, &enabled, collector, newIncremental(statePath, full), newFlapping(&flapOptions, historyPath), newChangeHistory(historyPath), &limits, locker, lockKeys, configFilePath, listen, scheduleSpec, metricsTextfile)
+	case "events":
+		consumeEvents(ctx, sess, &enabled, collector, newChangeHistory(historyPath), configFilePath, eventsSource)
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command: %s\n", command)
+		flag.Usage()
+		os.Exit(2)
+	}
 
-	if processEc2Instances {
-		e := providers.NewEc2Processor(sess)
-		e.RetagInstances(&m)
+	interrupted := ctx.Err() != nil
+	if collector != nil {
+		collector.ObserveRun(start, interrupted)
+		if metricsTextfile != "" {
+			if err = collector.WriteTextfile(metricsTextfile); err != nil {
+				log.WithFields(logrus.Fields{"error": err, "path": metricsTextfile}).Fatal("Unable to write the metrics")
+			}
+		}
+	}
+	if interrupted {
+		log.WithFields(logrus.Fields{"command": command, "duration": time.Since(start).Seconds()}).Warn("Run interrupted, the results only cover the resources processed before")
+		exitCode = interruptedExitCode
 	}
+	os.Exit(exitCode)
+}
+
+// lockedExitCode is the exit code of the runs that did not get the lock of
+// the account and region, or lost it
+const lockedExitCode = 5
+
+// lockKeys returns the keys of the locks of the runs on the account and
+// region. The runs processing the global resources also take the lock of the
+// account, as these resources are the same whatever the region.
+func lockKeys(enabled *runner.Providers, account, region string) []string {
+	keys := []string{lock.Key(account, region)}
+	if enabled.Global() {
+		keys = append(keys, lock.AccountKey(account))
+	}
+	return keys
+}
 
-	if processRdsInstances || processRdsClusters {
-		r := providers.NewRdsProcessor(sess)
-		if processRdsInstances {
-			r.RetagInstances(&m)
+// withLock calls fn holding the locks of the keys, with a context cancelled
+// when the lease of the locks is lost. It returns lockedExitCode when another
+// run holds one of the locks or when the lease is lost, and the exit code of
+// fn otherwise.
+func withLock(ctx context.Context, locker *lock.Locker, keys []string, fn func(ctx context.Context) int) int {
+	runCtx, lease, err := locker.Acquire(ctx, keys...)
+	if err != nil {
+		if ctx.Err() != nil {
+			return 0
 		}
-		if processRdsClusters {
-			r.RetagClusters(&m)
+		if _, ok := err.(*lock.LockedError); !ok {
+			log.WithFields(logrus.Fields{"error": err, "keys": keys}).Fatal("Unable to acquire the lock")
 		}
+		log.WithFields(logrus.Fields{"error": err, "keys": keys}).Error("Another run is processing the account and region, nothing done")
+		return lockedExitCode
 	}
+	logrus.RegisterExitHandler(lease.Release)
+	exitCode := fn(runCtx)
+	lease.Release()
+	if lease.Lost() {
+		return lockedExitCode
+	}
+	return exitCode
+}
+
+// newCollector creates a metrics collector labelled with the account and
+// region of the session and instruments the session with it
+func newCollector(sess *session.Session, account string) *metrics.Collector {
+	collector := metrics.NewCollector(account, aws.StringValue(sess.Config.Region))
+	collector.InstrumentSession(sess)
+	return collector
+}
 
-	if processCloudwatchLogGroups {
-		c := providers.NewCwProcessor(sess)
-		c.RetagLogGroups(&m)
+// serveMetrics exposes the metrics of the collector over http
+func serveMetrics(address string, collector *metrics.Collector) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", collector)
+	if err := http.ListenAndServe(address, mux); err != nil {
+		log.WithFields(logrus.Fields{"error": err, "address": address}).Fatal("Unable to expose the metrics")
 	}
+}
 
-	if processElasticSearch {
-		elk := providers.NewElkProcessor(sess)
-		elk.RetagDomains(&m)
+// loadConfig loads the mapper configuration from the given file and exits if
+// it is not valid. It also returns the version of the config loaded.
+func loadConfig(configFilePath string) (*mapper.Mapper, string) {
+	m, version, err := runner.ReadConfigVersion(configFilePath)
+	if err != nil {
+		log.WithFields(logrus.Fields{"error": err, "path": configFilePath}).Fatal("Unable to load config file")
 	}
+	return m, version
+}
 
-	if processCloudFrontDist {
-		cf := providers.NewCloudFrontProcessor(sess)
-		cf.RetagDistributions(&m)
+// retag loads the configuration and retags the enabled resources. It returns
+// the exit code 4 when the change limits are exceeded. Without change limits,
+// the run is checkpointed and can resume a previous run.
+func retag(ctx context.Context, sess *session.Session, enabled *runner.Providers, collector *metrics.Collector, inc *incremental, flaps *flapping, hist *changeHistory, limits *limit.Limits, cps *checkpoints, resume, configFilePath, sanityReportPath string) int {
+	var err error
+	m, version := loadConfig(configFilePath)
+	if collector != nil {
+		m.SanityRecorders = append(m.SanityRecorders, collector)
 	}
-	if processRedshiftClusters {
-		rs, err := providers.NewRedshiftProcessor(sess)
-		if err != nil {
-			log.WithFields(logrus.Fields{"error": err}).Fatal("Unable to initialize the Redshift client")
+
+	var sanityReport *mapper.SanityReport
+	if sanityReportPath != "" {
+		sanityReport = mapper.NewSanityReport()
+		m.SanityRecorders = append(m.SanityRecorders, sanityReport)
+	}
+
+	exitCode := 0
+	if limits.Enabled() {
+		if resume != "" {
+			log.WithFields(logrus.Fields{"run_id": resume}).Fatal("The runs with change limits cannot be resumed, as their changes are only applied once all planned")
 		}
-		rs.RetagClusters(&m)
+		applied := enabled.RunLimited(ctx, sess, inc.Mapper(hist.Mapper(flaps.Mapper(m), newRunID(), history.BatchSize), version), collector, limits)
+		hist.Finish()
+		if !applied {
+			exitCode = 4
+		}
+	} else {
+		cp := cps.Start(resume, version)
+		complete := runner.RunSteps(ctx, enabled.Steps(sess, collector), inc.Mapper(hist.Mapper(flaps.Mapper(m), cp.RunID, history.BatchSize), version), cp, time.Time{}, cps.Autosave())
+		cps.Finish(cp, complete)
+		hist.Finish()
 	}
-	if processElasticBeanstalkEnv {
-		eb := providers.NewElasticBeanstalkProcessor(sess)
-		eb.RetagEnvironments(&m)
+	inc.Save()
+	flaps.Report()
+
+	if sanityReport != nil {
+		sanityReport.Interrupted = ctx.Err() != nil
+		if err = writeOutput(sanityReportPath, sanityReport.Write); err != nil {
+			log.WithFields(logrus.Fields{"error": err, "path": sanityReportPath}).Fatal("Unable to write the sanity report")
+		}
 	}
+	return exitCode
+}
+
+// suggest scans the enabled resources and writes the proposed configuration
+func suggest(ctx context.Context, sess *session.Session, enabled *runner.Providers, collector *metrics.Collector, outputPath string) {
+	s := mapper.NewSuggester()
+	enabled.Run(ctx, sess, s, collector)
+	if err := writeOutput(outputPath, s.Suggest().Write); err != nil {
+		log.WithFields(logrus.Fields{"error": err, "path": outputPath}).Fatal("Unable to write the suggested configuration")
+	}
+}
+
+// check evaluates the compliance of the enabled resources and returns the
+// exit code 3 when the percentage of non-compliant resources is above the
+// threshold. The threshold is not checked when the run is interrupted.
+func check(ctx context.Context, sess *session.Session, enabled *runner.Providers, collector *metrics.Collector, configFilePath, outputPath, format string, maxNonCompliantPercent float64) int {
+	m, _ := loadConfig(configFilePath)
+	c := mapper.NewComplianceChecker(m)
+	enabled.Run(ctx, sess, c, collector)
+
+	report := c.Report()
+	report.Interrupted = ctx.Err() != nil
+	if err := writeOutput(outputPath, func(w io.Writer) error { return report.Write(w, format) }); err != nil {
+		log.WithFields(logrus.Fields{"error": err, "path": outputPath}).Fatal("Unable to write the compliance report")
+	}
+	if !report.Interrupted && report.NonCompliantPercent() > maxNonCompliantPercent {
+		log.WithFields(logrus.Fields{"non_compliant": report.NonCompliant, "resources": len(report.Resources), "threshold": maxNonCompliantPercent}).Error("Too many non-compliant resources")
+		return 3
+	}
+	return 0
+}
 
-	if processS3Buckets {
-		sp := providers.NewS3Processor(sess)
-		sp.RetagBuckets(&m)
+// writeOutput calls the given write function on the file at the given path or
+// on the standard output if the path is -
+func writeOutput(path string, write func(io.Writer) error) error {
+	if path == "-" {
+		return write(os.Stdout)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err = write(f); err != nil {
+		f.Close()
+		return err
 	}
+	return f.Close()
 }
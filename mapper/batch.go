@@ -0,0 +1,100 @@
+package mapper
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// BatchPutTagFn sets the same tags on several resources and returns the errors
+// of the resources that failed by resource ID
+type BatchPutTagFn func([]*string, []*TagItem) map[string]error
+
+// Batcher groups the resources getting the same tags to set them with as few
+// calls as possible
+type Batcher struct {
+	size    int
+	setTags BatchPutTagFn
+	batches map[string]*tagBatch
+	// order keeps the batches in the order they were created
+	order []string
+	// failed counts the resources that failed since the last Flush
+	failed int
+}
+
+// tagBatch holds the resources getting the same tags
+type tagBatch struct {
+	tags        []*TagItem
+	resourceIDs []*string
+	// written are the functions receiving the outcome of the write of each
+	// resource
+	written []WrittenFn
+}
+
+// NewBatcher creates a Batcher sending at most size resources per call to
+// setTags
+func NewBatcher(size int, setTags BatchPutTagFn) *Batcher {
+	return &Batcher{size: size, setTags: setTags, batches: make(map[string]*tagBatch)}
+}
+
+// PutTagFn queues the tags of the resource and sends its batch once full. It
+// can be passed as-is to Retag. As the tags are sent later, it returns nil and
+// reports the outcome to done once the batch is sent.
+func (b *Batcher) PutTagFn(resourceID *string, tags []*TagItem, done WrittenFn) error {
+	key := batchKey(tags)
+	batch, ok := b.batches[key]
+	if !ok {
+		batch = &tagBatch{tags: tags}
+		b.batches[key] = batch
+		b.order = append(b.order, key)
+	}
+	// The resource ID is copied as the caller may reuse the pointer
+	id := *resourceID
+	batch.resourceIDs = append(batch.resourceIDs, &id)
+	batch.written = append(batch.written, done)
+	if len(batch.resourceIDs) >= b.size {
+		b.failed += b.send(batch)
+	}
+	return nil
+}
+
+// Flush sends all the queued tags and returns the number of resources that
+// failed since the last Flush. A nil Batcher has nothing to send.
+func (b *Batcher) Flush() int {
+	if b == nil {
+		return 0
+	}
+	for _, key := range b.order {
+		b.failed += b.send(b.batches[key])
+	}
+	failed := b.failed
+	b.batches, b.order, b.failed = make(map[string]*tagBatch), nil, 0
+	return failed
+}
+
+// send sends a batch and reports the outcome of the write of each resource,
+// emptying the batch
+func (b *Batcher) send(batch *tagBatch) int {
+	if len(batch.resourceIDs) == 0 {
+		return 0
+	}
+	errs := b.setTags(batch.resourceIDs, batch.tags)
+	resourceIDs, written := batch.resourceIDs, batch.written
+	batch.resourceIDs, batch.written = nil, nil
+	for i, resourceID := range resourceIDs {
+		written[i].Report(batch.tags, errs[*resourceID])
+	}
+	log.WithFields(logrus.Fields{"resources": len(resourceIDs), "failed": len(errs), "tags": len(batch.tags)}).Debug("Batch of tags sent")
+	return len(errs)
+}
+
+// batchKey identifies a set of tags whatever their order
+func batchKey(tags []*TagItem) string {
+	items := []string{}
+	for _, tag := range tags {
+		items = append(items, tag.Name+"="+tag.Value)
+	}
+	sort.Strings(items)
+	return strings.Join(items, "\x00")
+}
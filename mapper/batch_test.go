@@ -0,0 +1,96 @@
+package mapper
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	logrus_test "github.com/sirupsen/logrus/hooks/test"
+)
+
+func TestBatcher(t *testing.T) {
+	logger, _ := logrus_test.NewNullLogger()
+	log = logrus.NewEntry(logger)
+
+	calls := [][]string{}
+	b := NewBatcher(2, func(resourceIDs []*string, tags []*TagItem) map[string]error {
+		ids := []string{}
+		errs := map[string]error{}
+		for _, id := range resourceIDs {
+			ids = append(ids, *id)
+			if *id == "broken" {
+				errs[*id] = errors.New("Badaboom")
+			}
+		}
+		calls = append(calls, ids)
+		return errs
+	})
+
+	// outcomes holds the outcome of the write of each resource once its batch
+	// is sent
+	outcomes := map[string]string{}
+	put := func(resourceID *string, tags []*TagItem) {
+		id := *resourceID
+		if err := b.PutTagFn(resourceID, tags, func(written []*TagItem, err error) {
+			outcomes[id] = fmt.Sprintf("%d tags, %v", len(written), err)
+		}); err != nil {
+			t.Errorf("Expecting the queued write to succeed, got: %v\n", err)
+		}
+	}
+
+	resourceID := "r-1"
+	put(&resourceID, []*TagItem{{Name: "Env", Value: "prd"}, {Name: "Team", Value: "web"}})
+	// the pointer given by the caller is reused
+	resourceID = "broken"
+	put(&resourceID, []*TagItem{{Name: "Env", Value: "dev"}})
+	resourceID = "r-3"
+	put(&resourceID, []*TagItem{{Name: "Team", Value: "web", Rule: "keys"}, {Name: "Env", Value: "prd", Rule: "tags"}})
+	if expected := [][]string{{"r-1", "r-3"}}; !reflect.DeepEqual(expected, calls) {
+		t.Errorf("Expecting the full batch to be sent: %v\nGot: %v\n", expected, calls)
+	}
+	if expected := map[string]string{"r-1": "2 tags, <nil>", "r-3": "2 tags, <nil>"}; !reflect.DeepEqual(expected, outcomes) {
+		t.Errorf("Expecting only the writes of the batch sent to be done: %v\nGot: %v\n", expected, outcomes)
+	}
+
+	resourceID = "r-4"
+	put(&resourceID, []*TagItem{{Name: "Env", Value: "prd"}, {Name: "Team", Value: "web"}})
+	if failed := b.Flush(); failed != 1 {
+		t.Errorf("Expecting 1 failed resource, got: %d\n", failed)
+	}
+	if expected := [][]string{{"r-1", "r-3"}, {"r-4"}, {"broken"}}; !reflect.DeepEqual(expected, calls) {
+		t.Errorf("Expecting: %v\nGot: %v\n", expected, calls)
+	}
+	if expected := map[string]string{"r-1": "2 tags, <nil>", "r-3": "2 tags, <nil>", "r-4": "2 tags, <nil>", "broken": "1 tags, Badaboom"}; !reflect.DeepEqual(expected, outcomes) {
+		t.Errorf("Expecting: %v\nGot: %v\n", expected, outcomes)
+	}
+
+	if failed := b.Flush(); failed != 0 || len(calls) != 3 {
+		t.Errorf("Expecting nothing left to send, got %d failed and %d calls\n", failed, len(calls))
+	}
+	if failed := (*Batcher)(nil).Flush(); failed != 0 {
+		t.Errorf("Expecting nothing to send on a nil Batcher\n")
+	}
+}
+
+func TestDirect(t *testing.T) {
+	tags := []*TagItem{{Name: "Env", Value: "prd"}}
+	outcomes := []string{}
+	done := func(written []*TagItem, err error) {
+		outcomes = append(outcomes, fmt.Sprintf("%d tags, %v", len(written), err))
+	}
+	resourceID := "r-1"
+
+	if err := Direct(func(*string, []*TagItem) error { return nil })(&resourceID, tags, done); err != nil {
+		t.Errorf("Unexpected error: %v\n", err)
+	}
+	if err := Direct(func(*string, []*TagItem) error { return errors.New("Badaboom") })(&resourceID, tags, done); err == nil {
+		t.Errorf("Expecting the error of the write to be returned\n")
+	}
+	// done is optional
+	Direct(func(*string, []*TagItem) error { return nil })(&resourceID, tags, nil)
+	if expected := []string{"1 tags, <nil>", "1 tags, Badaboom"}; !reflect.DeepEqual(expected, outcomes) {
+		t.Errorf("Expecting the outcomes to be reported at once: %v\nGot: %v\n", expected, outcomes)
+	}
+}
@@ -0,0 +1,215 @@
+package mapper
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"text/tabwriter"
+)
+
+// Violation describes why a tag makes a resource non-compliant
+type Violation struct {
+	TagName  string `json:"tag_name"`
+	TagValue string `json:"tag_value,omitempty"`
+	Reason   string `json:"reason"`
+}
+
+// ResourceCompliance holds the compliance status of a resource
+type ResourceCompliance struct {
+	ResourceID string       `json:"resource"`
+	Compliant  bool         `json:"compliant"`
+	Violations []*Violation `json:"violations,omitempty"`
+}
+
+// ComplianceChecker evaluates the resources it is given against the required
+// tags (the keys of the defaults) and the allowed values (the keys of the
+// sanity remaps) of the configuration. It never sets any tag.
+type ComplianceChecker struct {
+	Iface
+	config    *Mapper
+	mu        sync.Mutex
+	resources []*ResourceCompliance
+}
+
+// NewComplianceChecker creates a ComplianceChecker using the given
+// configuration
+func NewComplianceChecker(config *Mapper) *ComplianceChecker {
+	return &ComplianceChecker{Iface: config, config: config}
+}
+
+// Retag evaluates the compliance of the resource without calling setTags,
+// unless the context is cancelled
+func (c *ComplianceChecker) Retag(ctx context.Context, resourceID *string, tags *map[string]string, keys []string, setTags PutTagFn) {
+	if ctx.Err() != nil {
+		return
+	}
+	result := &ResourceCompliance{ResourceID: *resourceID, Violations: []*Violation{}}
+
+	for dKey := range c.config.DefaultTagValues {
+		if _, ok := (*tags)[dKey]; !ok {
+			result.Violations = append(result.Violations, &Violation{TagName: dKey, Reason: "required tag is missing"})
+		}
+	}
+	for k, v := range *tags {
+		sanitized, err := c.config.ValidateTag(k, v)
+		switch err.(type) {
+		case nil:
+			if sanitized.Value != v {
+				result.Violations = append(result.Violations, &Violation{TagName: k, TagValue: v, Reason: fmt.Sprintf("value not allowed, should be %s", sanitized.Value)})
+			}
+		case *ErrSanityConfig:
+			// no constraint on the values of this tag
+		case *ErrSanityNoMapping:
+			result.Violations = append(result.Violations, &Violation{TagName: k, TagValue: v, Reason: "value not allowed"})
+		default:
+			result.Violations = append(result.Violations, &Violation{TagName: k, TagValue: v, Reason: err.Error()})
+		}
+	}
+	sort.Slice(result.Violations, func(i, j int) bool { return result.Violations[i].TagName < result.Violations[j].TagName })
+	result.Compliant = len(result.Violations) == 0
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.resources = append(c.resources, result)
+}
+
+// Report returns the compliance of the resources checked so far
+func (c *ComplianceChecker) Report() *ComplianceReport {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	report := &ComplianceReport{Resources: append([]*ResourceCompliance{}, c.resources...)}
+	for _, res := range report.Resources {
+		if !res.Compliant {
+			report.NonCompliant++
+		}
+	}
+	return report
+}
+
+// ComplianceReport is the result of a compliance check
+type ComplianceReport struct {
+	Resources    []*ResourceCompliance `json:"resources"`
+	NonCompliant int                   `json:"non_compliant"`
+	// Interrupted marks the report of a run that was interrupted, which only
+	// covers the resources checked before
+	Interrupted bool `json:"interrupted,omitempty"`
+}
+
+// NonCompliantPercent returns the percentage of non-compliant resources
+func (r *ComplianceReport) NonCompliantPercent() float64 {
+	if len(r.Resources) == 0 {
+		return 0
+	}
+	return float64(r.NonCompliant) * 100 / float64(len(r.Resources))
+}
+
+// Write outputs the report in the given format: table, csv, json or junit
+func (r *ComplianceReport) Write(w io.Writer, format string) error {
+	switch format {
+	case "table":
+		return r.writeTable(w)
+	case "csv":
+		return r.writeCsv(w)
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(r)
+	case "junit":
+		return r.writeJunit(w)
+	default:
+		return fmt.Errorf("invalid report format requested: %s", format)
+	}
+}
+
+// writeTable outputs 1 line per resource and violation
+func (r *ComplianceReport) writeTable(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "RESOURCE\tCOMPLIANT\tTAG\tVALUE\tREASON")
+	for _, res := range r.Resources {
+		if res.Compliant {
+			fmt.Fprintf(tw, "%s\ttrue\t\t\t\n", res.ResourceID)
+		}
+		for _, v := range res.Violations {
+			fmt.Fprintf(tw, "%s\tfalse\t%s\t%s\t%s\n", res.ResourceID, v.TagName, v.TagValue, v.Reason)
+		}
+	}
+	fmt.Fprintf(tw, "\n%d/%d resources non-compliant (%.2f%%)\n", r.NonCompliant, len(r.Resources), r.NonCompliantPercent())
+	if r.Interrupted {
+		fmt.Fprintln(tw, "Interrupted run: partial report")
+	}
+	return tw.Flush()
+}
+
+// writeCsv outputs 1 record per resource and violation
+func (r *ComplianceReport) writeCsv(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"resource", "compliant", "tag_name", "tag_value", "reason"})
+	for _, res := range r.Resources {
+		if res.Compliant {
+			cw.Write([]string{res.ResourceID, "true", "", "", ""})
+		}
+		for _, v := range res.Violations {
+			cw.Write([]string{res.ResourceID, "false", v.TagName, v.TagValue, v.Reason})
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Content string `xml:",chardata"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+}
+
+type junitProperty struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:"value,attr"`
+}
+
+type junitTestSuite struct {
+	XMLName    xml.Name         `xml:"testsuite"`
+	Name       string           `xml:"name,attr"`
+	Tests      int              `xml:"tests,attr"`
+	Failures   int              `xml:"failures,attr"`
+	Properties []*junitProperty `xml:"properties>property,omitempty"`
+	TestCases  []*junitTestCase `xml:"testcase"`
+}
+
+// writeJunit outputs 1 test case per resource, failed when non-compliant
+func (r *ComplianceReport) writeJunit(w io.Writer) error {
+	suite := junitTestSuite{Name: "tag-compliance", Tests: len(r.Resources), Failures: r.NonCompliant}
+	if r.Interrupted {
+		suite.Properties = append(suite.Properties, &junitProperty{Name: "interrupted", Value: "true"})
+	}
+	for _, res := range r.Resources {
+		tc := &junitTestCase{Name: res.ResourceID, ClassName: "awsRetagger"}
+		if !res.Compliant {
+			tc.Failure = &junitFailure{Message: fmt.Sprintf("%d tag violation(s)", len(res.Violations))}
+			for _, v := range res.Violations {
+				tc.Failure.Content += fmt.Sprintf("%s=%q: %s\n", v.TagName, v.TagValue, v.Reason)
+			}
+		}
+		suite.TestCases = append(suite.TestCases, tc)
+	}
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(suite); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
@@ -0,0 +1,116 @@
+package mapper
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestComplianceCheckerRetag(t *testing.T) {
+	config := Mapper{
+		Sanity: []*TagSanity{
+			{TagName: "Env", Transform: map[string][]string{"prd": {"prod"}, "stg": {}}},
+		},
+		DefaultTagValues: map[string]string{"Env": "unknown", "Team": "unknown"},
+	}
+	testData := []struct {
+		tags       map[string]string
+		violations []*Violation
+	}{
+		{map[string]string{"Env": "prd", "Team": "web", "Name": "foo"}, []*Violation{}},
+		{map[string]string{"Env": "prd"}, []*Violation{{TagName: "Team", Reason: "required tag is missing"}}},
+		{map[string]string{"Env": "prod", "Team": "web"}, []*Violation{{TagName: "Env", TagValue: "prod", Reason: "value not allowed, should be prd"}}},
+		{map[string]string{"Env": "qa"}, []*Violation{{TagName: "Env", TagValue: "qa", Reason: "value not allowed"}, {TagName: "Team", Reason: "required tag is missing"}}},
+	}
+
+	c := NewComplianceChecker(&config)
+	for _, d := range testData {
+		resourceID := "my resource"
+		tags := map[string]string{}
+		for k, v := range d.tags {
+			tags[k] = v
+		}
+		c.Retag(context.Background(), &resourceID, &tags, []string{}, Direct(setTagTestFctFailure))
+		if !reflect.DeepEqual(tags, d.tags) {
+			t.Errorf("The tags should not be modified, got: %v\n", tags)
+		}
+	}
+
+	report := c.Report()
+	if len(report.Resources) != len(testData) {
+		t.Fatalf("Expecting %d resources, got: %d\n", len(testData), len(report.Resources))
+	}
+	for i, d := range testData {
+		if !reflect.DeepEqual(report.Resources[i].Violations, d.violations) {
+			t.Errorf("Expecting violations: %v\nGot: %v\n", d.violations, report.Resources[i].Violations)
+		}
+		if report.Resources[i].Compliant != (len(d.violations) == 0) {
+			t.Errorf("Unexpected compliance for %v\n", d.tags)
+		}
+	}
+	if report.NonCompliant != 3 || report.NonCompliantPercent() != 75 {
+		t.Errorf("Expecting 3 non-compliant resources (75%%), got: %d (%f%%)\n", report.NonCompliant, report.NonCompliantPercent())
+	}
+}
+
+func TestComplianceReportWrite(t *testing.T) {
+	report := &ComplianceReport{
+		Resources: []*ResourceCompliance{
+			{ResourceID: "res1", Compliant: true, Violations: []*Violation{}},
+			{ResourceID: "res2", Violations: []*Violation{{TagName: "Team", Reason: "required tag is missing"}}},
+		},
+		NonCompliant: 1,
+	}
+
+	var buf bytes.Buffer
+	if err := report.Write(&buf, "table"); err != nil || !strings.Contains(buf.String(), "1/2 resources non-compliant (50.00%)") {
+		t.Errorf("Unexpected table output (error: %v):\n%s\n", err, buf.String())
+	}
+
+	buf.Reset()
+	if err := report.Write(&buf, "csv"); err != nil || buf.String() != "resource,compliant,tag_name,tag_value,reason\nres1,true,,,\nres2,false,Team,,required tag is missing\n" {
+		t.Errorf("Unexpected csv output (error: %v):\n%s\n", err, buf.String())
+	}
+
+	buf.Reset()
+	decoded := ComplianceReport{}
+	if err := report.Write(&buf, "json"); err != nil {
+		t.Errorf("Unexpected error: %s\n", err)
+	} else if err = json.Unmarshal(buf.Bytes(), &decoded); err != nil || decoded.NonCompliant != 1 || len(decoded.Resources) != 2 {
+		t.Errorf("Unexpected json output (error: %v):\n%s\n", err, buf.String())
+	}
+
+	buf.Reset()
+	suite := junitTestSuite{}
+	if err := report.Write(&buf, "junit"); err != nil {
+		t.Errorf("Unexpected error: %s\n", err)
+	} else if err = xml.Unmarshal(buf.Bytes(), &suite); err != nil || suite.Tests != 2 || suite.Failures != 1 || suite.TestCases[1].Failure == nil {
+		t.Errorf("Unexpected junit output (error: %v):\n%s\n", err, buf.String())
+	}
+
+	if err := report.Write(&buf, "yaml"); err == nil {
+		t.Errorf("Expecting an error for an invalid format\n")
+	}
+
+	// the report of an interrupted run says so
+	report.Interrupted = true
+	buf.Reset()
+	if err := report.Write(&buf, "table"); err != nil || !strings.Contains(buf.String(), "Interrupted run: partial report") {
+		t.Errorf("Unexpected table output (error: %v):\n%s\n", err, buf.String())
+	}
+	buf.Reset()
+	if err := report.Write(&buf, "json"); err != nil || !strings.Contains(buf.String(), `"interrupted": true`) {
+		t.Errorf("Unexpected json output (error: %v):\n%s\n", err, buf.String())
+	}
+	buf.Reset()
+	suite = junitTestSuite{}
+	if err := report.Write(&buf, "junit"); err != nil {
+		t.Errorf("Unexpected error: %s\n", err)
+	} else if err = xml.Unmarshal(buf.Bytes(), &suite); err != nil || len(suite.Properties) != 1 || suite.Properties[0].Name != "interrupted" {
+		t.Errorf("Unexpected junit output (error: %v):\n%s\n", err, buf.String())
+	}
+}
@@ -0,0 +1,159 @@
+package mapper
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Constraints are the restrictions of an AWS service on the tags of its
+// resources. A zero field means no restriction.
+type Constraints struct {
+	// MaxTags is the maximum number of tags on a resource
+	MaxTags int
+	// MaxKeyLength and MaxValueLength are counted in unicode characters
+	MaxKeyLength, MaxValueLength int
+	// Charset matches the characters allowed in the keys and values
+	Charset *regexp.Regexp
+	// ReservedPrefixes are the prefixes of the keys reserved by the service on
+	// top of the DefaultProtectedKeys skipped by the Mapper, in lower case as
+	// the keys are matched case-insensitively
+	ReservedPrefixes []string
+}
+
+// TagCharset matches the characters allowed by most AWS services in the tags:
+// letters, numbers, spaces and _ . : / = + - @
+var TagCharset = regexp.MustCompile(`^[\p{L}\p{Z}\p{N}_.:/=+\-@]$`)
+
+// DefaultConstraints are the constraints shared by most AWS services: the
+// CloudFront distributions, the CloudWatch log groups, the ElasticBeanstalk
+// environments, the ElasticSearch domains, the Redshift clusters and the S3
+// buckets
+var DefaultConstraints = Constraints{MaxTags: 50, MaxKeyLength: 128, MaxValueLength: 256, Charset: TagCharset}
+
+// rulePriorities gives the order in which the new tags are dropped when a
+// resource would have too many tags, the lowest first. The tags without rule
+// come last.
+var rulePriorities = map[string]int{"defaults": 0, "keys": 1, "copy_tags": 2, "tags": 3, "sanity": 4}
+
+// Constrain returns a PutTagFn checking the tags against the constraints
+// before calling setTags. The invalid values are transformed, the invalid keys
+// rejected and, when the resource having the existingTags would get more
+// tags than allowed, the new tags of the lowest priority are dropped.
+// existingTags is copied, so it can be given before Retag updates it. The
+// outcome reported is the one of the checked tags.
+func Constrain(c *Constraints, existingTags map[string]string, setTags PutTagFn) PutTagFn {
+	existing := make(map[string]bool, len(existingTags))
+	for k := range existingTags {
+		existing[k] = true
+	}
+	return func(resourceID *string, tags []*TagItem, done WrittenFn) error {
+		if tags = c.Check(*resourceID, existing, tags); len(tags) == 0 {
+			done.Report(tags, nil)
+			return nil
+		}
+		return setTags(resourceID, tags, done)
+	}
+}
+
+// Check returns the tags that can be written on the resource having the
+// existing tag keys, logging the reason of the changes
+func (c *Constraints) Check(resourceID string, existing map[string]bool, tags []*TagItem) []*TagItem {
+	valid := []*TagItem{}
+	added := []*TagItem{}
+	for _, tag := range tags {
+		if reason := c.checkKey(tag.Name); reason != "" {
+			log.WithFields(logrus.Fields{"resource": resourceID, "tag_name": tag.Name, "tag_value": tag.Value, "rule": tag.Rule, "reason": reason}).Warn("Rejecting invalid tag")
+			continue
+		}
+		if value, reason := c.fixValue(tag.Value); reason != "" {
+			log.WithFields(logrus.Fields{"resource": resourceID, "tag_name": tag.Name, "tag_value": tag.Value, "new_value": value, "rule": tag.Rule, "reason": reason}).Warn("Transforming invalid tag value")
+			tag = &TagItem{Name: tag.Name, Value: value, Rule: tag.Rule}
+		}
+		valid = append(valid, tag)
+		if !existing[tag.Name] {
+			added = append(added, tag)
+		}
+	}
+
+	if c.MaxTags == 0 || len(existing)+len(added) <= c.MaxTags {
+		return valid
+	}
+	// Drop the new tags of the lowest priority first
+	sort.SliceStable(added, func(i, j int) bool {
+		pi, pj := rulePriority(added[i].Rule), rulePriority(added[j].Rule)
+		if pi != pj {
+			return pi < pj
+		}
+		return added[i].Name < added[j].Name
+	})
+	dropped := make(map[*TagItem]bool)
+	for _, tag := range added[:len(existing)+len(added)-c.MaxTags] {
+		log.WithFields(logrus.Fields{"resource": resourceID, "tag_name": tag.Name, "tag_value": tag.Value, "rule": tag.Rule, "max_tags": c.MaxTags}).Warn("Dropping tag, too many tags on the resource")
+		dropped[tag] = true
+	}
+	kept := []*TagItem{}
+	for _, tag := range valid {
+		if !dropped[tag] {
+			kept = append(kept, tag)
+		}
+	}
+	return kept
+}
+
+// checkKey returns why the key is not valid, empty when it is
+func (c *Constraints) checkKey(key string) string {
+	if key == "" {
+		return "empty key"
+	}
+	if c.MaxKeyLength > 0 && utf8.RuneCountInString(key) > c.MaxKeyLength {
+		return "key too long"
+	}
+	for _, prefix := range c.ReservedPrefixes {
+		if strings.HasPrefix(strings.ToLower(key), prefix) {
+			return "reserved prefix"
+		}
+	}
+	if c.Charset != nil {
+		for _, r := range key {
+			if !c.Charset.MatchString(string(r)) {
+				return "invalid character in key"
+			}
+		}
+	}
+	return ""
+}
+
+// fixValue returns the value with the invalid characters replaced by _ and
+// truncated to the maximum length, and why it was changed
+func (c *Constraints) fixValue(value string) (string, string) {
+	reasons := []string{}
+	if c.Charset != nil {
+		fixed := strings.Map(func(r rune) rune {
+			if c.Charset.MatchString(string(r)) {
+				return r
+			}
+			return '_'
+		}, value)
+		if fixed != value {
+			value = fixed
+			reasons = append(reasons, "invalid character in value")
+		}
+	}
+	if c.MaxValueLength > 0 && utf8.RuneCountInString(value) > c.MaxValueLength {
+		value = string([]rune(value)[:c.MaxValueLength])
+		reasons = append(reasons, "value too long")
+	}
+	return value, strings.Join(reasons, ", ")
+}
+
+// rulePriority returns the priority of the tags of the given rule
+func rulePriority(rule string) int {
+	if p, ok := rulePriorities[rule]; ok {
+		return p
+	}
+	return len(rulePriorities)
+}
@@ -0,0 +1,90 @@
+package mapper
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	logrus_test "github.com/sirupsen/logrus/hooks/test"
+)
+
+func TestConstraintsCheck(t *testing.T) {
+	small := Constraints{MaxTags: 3, MaxKeyLength: 5, MaxValueLength: 4, Charset: TagCharset}
+	testData := []struct {
+		constraints Constraints
+		existing    map[string]bool
+		tags        []*TagItem
+		expected    []*TagItem
+		logEntries  int
+	}{
+		// everything valid
+		{DefaultConstraints, map[string]bool{}, []*TagItem{{Name: "Env", Value: "prd"}}, []*TagItem{{Name: "Env", Value: "prd"}}, 0},
+		// invalid keys are rejected
+		{small, map[string]bool{}, []*TagItem{{Name: "Env", Value: "prd"}, {Name: "Environment", Value: "prd"}, {Name: "E#v", Value: "prd"}, {Name: "", Value: "prd"}}, []*TagItem{{Name: "Env", Value: "prd"}}, 3},
+		// invalid values are transformed
+		{small, map[string]bool{}, []*TagItem{{Name: "Env", Value: "p&d"}, {Name: "Team", Value: "é w"}, {Name: "App", Value: "apache"}}, []*TagItem{{Name: "Env", Value: "p_d"}, {Name: "Team", Value: "é w"}, {Name: "App", Value: "apac"}}, 2},
+		// the reserved prefixes are rejected
+		{Constraints{ReservedPrefixes: []string{"rds:"}}, map[string]bool{}, []*TagItem{{Name: "RDS:Env", Value: "prd"}, {Name: "Env", Value: "rds:prd"}}, []*TagItem{{Name: "Env", Value: "rds:prd"}}, 1},
+		// all characters allowed without charset
+		{Constraints{}, map[string]bool{}, []*TagItem{{Name: "E#v", Value: "p&d"}}, []*TagItem{{Name: "E#v", Value: "p&d"}}, 0},
+		// the new tags of the lowest priority are dropped, the updates of the
+		// existing tags are kept
+		{small, map[string]bool{"Env": true, "Name": true}, []*TagItem{
+			{Name: "Env", Value: "prd", Rule: "sanity"},
+			{Name: "Team", Value: "web", Rule: "defaults"},
+			{Name: "App", Value: "api", Rule: "tags"},
+			{Name: "Svc", Value: "api", Rule: "defaults"},
+		}, []*TagItem{{Name: "Env", Value: "prd", Rule: "sanity"}, {Name: "App", Value: "api", Rule: "tags"}}, 2},
+		{small, map[string]bool{"Name": true}, []*TagItem{
+			{Name: "Team", Value: "web", Rule: "keys"},
+			{Name: "App", Value: "api", Rule: "defaults"},
+			{Name: "Svc", Value: "api", Rule: "copy_tags"},
+		}, []*TagItem{{Name: "Team", Value: "web", Rule: "keys"}, {Name: "Svc", Value: "api", Rule: "copy_tags"}}, 1},
+	}
+
+	logger, hook := logrus_test.NewNullLogger()
+	log = logrus.NewEntry(logger)
+	for _, d := range testData {
+		hook.Reset()
+		if got := d.constraints.Check("my resource", d.existing, d.tags); !reflect.DeepEqual(d.expected, got) {
+			t.Errorf("Expecting: %v\nGot: %v\n", d.expected, got)
+		}
+		if len(hook.Entries) != d.logEntries {
+			t.Errorf("Unexpected number of messages logged. Got %d, expecting %d\nFor test case: %v\n", len(hook.Entries), d.logEntries, d)
+		}
+	}
+}
+
+func TestConstrain(t *testing.T) {
+	logger, _ := logrus_test.NewNullLogger()
+	log = logrus.NewEntry(logger)
+
+	calls := 0
+	setTags := func(resourceID *string, tags []*TagItem) error {
+		calls++
+		return errors.New("Badaboom")
+	}
+	existing := map[string]string{"Env": "prd"}
+	fn := Constrain(&Constraints{MaxTags: 1}, existing, Direct(setTags))
+	// Retag updating the existing tags does not change the constraints
+	existing["Team"] = "web"
+
+	resourceID := "my resource"
+	if err := fn(&resourceID, []*TagItem{{Name: "Team", Value: "web"}}, nil); err != nil || calls != 0 {
+		t.Errorf("Expecting no call when all the tags are dropped, got %d calls and error %v\n", calls, err)
+	}
+	if err := fn(&resourceID, []*TagItem{{Name: "Env", Value: "prd"}}, nil); err == nil || calls != 1 {
+		t.Errorf("Expecting the error of setTags, got %d calls and error %v\n", calls, err)
+	}
+
+	// the outcome carries the tags actually written
+	c := &Constraints{MaxValueLength: 3}
+	var written []*TagItem
+	Constrain(c, nil, Direct(func(*string, []*TagItem) error { return nil }))(&resourceID, []*TagItem{{Name: "Env", Value: "production"}}, func(tags []*TagItem, err error) {
+		written = tags
+	})
+	if expected := []*TagItem{{Name: "Env", Value: "pro"}}; !reflect.DeepEqual(expected, written) {
+		t.Errorf("Expecting the checked tags to be written: %v\nGot: %v\n", expected, written)
+	}
+}
@@ -1,11 +1,40 @@
 package mapper
 
 import (
+	"context"
 	"io"
 )
 
-// PutTagFn is used to specify the function structure to pass to the Retag method
-type PutTagFn func(*string, []*TagItem) error
+// PutTagFn is used to specify the function structure to pass to the Retag
+// method. It returns the error of a write that failed right away, nil once the
+// tags are written or queued to be written later. done, when not nil, receives
+// the outcome of the write once known: right away for a direct write, once
+// sent for a queued one.
+type PutTagFn func(resourceID *string, tags []*TagItem, done WrittenFn) error
+
+// WrittenFn receives the outcome of a write: the tags actually written, and
+// the error when it failed
+type WrittenFn func(tags []*TagItem, err error)
+
+// Report calls f with the outcome of a write, unless f is nil
+func (f WrittenFn) Report(tags []*TagItem, err error) {
+	if f != nil {
+		f(tags, err)
+	}
+}
+
+// SetTagsFn writes the tags of a resource right away, like the SetTags method
+// of the providers
+type SetTagsFn func(*string, []*TagItem) error
+
+// Direct returns a PutTagFn writing the tags right away with setTags
+func Direct(setTags SetTagsFn) PutTagFn {
+	return func(resourceID *string, tags []*TagItem, done WrittenFn) error {
+		err := setTags(resourceID, tags)
+		done.Report(tags, err)
+		return err
+	}
+}
 
 // Iface has been created for testing purposes. It allows to create mocks
 // when testing class that depend on the mapper
@@ -18,7 +47,7 @@ type Iface interface {
 	ValidateTag(string, string) (*TagItem, error)
 	MergeMaps(*map[string]string, *map[string]string)
 
-	Retag(*string, *map[string]string, []string, PutTagFn)
+	Retag(context.Context, *string, *map[string]string, []string, PutTagFn)
 }
 
 var _ Iface = (*Mapper)(nil)
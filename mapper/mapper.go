@@ -1,7 +1,9 @@
 package mapper
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"io"
 	"regexp"
 
@@ -17,6 +19,9 @@ func SetLogger(logger *logrus.Entry) { log = logger }
 type TagItem struct {
 	Name  string `json:"name"`
 	Value string `json:"value"`
+	// Rule is the section of the configuration the tag comes from when set by
+	// Retag: copy_tags, tags, keys, defaults or sanity
+	Rule string `json:"-"`
 }
 
 // TagMapper makes the relation between an existing tag on a resource and a list
@@ -51,6 +56,10 @@ type TagSanity struct {
 	Transform map[string][]string `json:"remap"`
 }
 
+// DefaultProtectedKeys are the patterns of the tag keys reserved by AWS, which
+// are never written whatever the configuration
+var DefaultProtectedKeys = []string{"aws:.*", "elasticbeanstalk:.*"}
+
 // Mapper contains the different mappings between attributes and the list of
 // tags that should be present on that resource
 type Mapper struct {
@@ -60,6 +69,11 @@ type Mapper struct {
 	KeyMap           []*KeyMapper      `json:"keys,omitempty"`
 	Sanity           []*TagSanity      `json:"sanity,omitempty"`
 	DefaultTagValues map[string]string `json:"defaults,omitempty"`
+	// ProtectedKeys are the patterns of the tag keys never written, in
+	// addition to DefaultProtectedKeys
+	ProtectedKeys []string `json:"protected_keys,omitempty"`
+	// SanityRecorders are notified of every sanity check failure
+	SanityRecorders []SanityRecorder `json:"-"`
 }
 
 // LoadConfig loads a json-formatted config into the current Mapper using the
@@ -69,6 +83,36 @@ func (m *Mapper) LoadConfig(configReader io.Reader) error {
 	return jsonParser.Decode(m)
 }
 
+// Validate checks that all the regular expressions of the configuration
+// compile, so a bad configuration can be rejected before being used
+func (m *Mapper) Validate() error {
+	patterns := []string{}
+	for _, tagCp := range m.CopyTag {
+		patterns = append(patterns, tagCp.Source...)
+	}
+	for _, mapping := range m.TagMap {
+		if mapping.Source == nil {
+			return errors.New("tags mapping without source")
+		}
+		patterns = append(patterns, mapping.Source.Value)
+	}
+	for _, keyM := range m.KeyMap {
+		patterns = append(patterns, keyM.KeyPattern)
+	}
+	for _, elt := range m.Sanity {
+		for _, alt := range elt.Transform {
+			patterns = append(patterns, alt...)
+		}
+	}
+	patterns = append(patterns, m.ProtectedKeys...)
+	for _, pattern := range patterns {
+		if _, err := regexp.Compile("(?i)^" + pattern + "$"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // StripDefaults removes from the existing tags the ones that are set to the
 // default value
 func (m *Mapper) StripDefaults(existingTags *map[string]string) {
@@ -249,16 +293,26 @@ func (m *Mapper) MergeMaps(mainMap, complementary *map[string]string) {
 	}
 }
 
-// Retag does the different re-tagging operations and calls the given setTags function
-func (m *Mapper) Retag(resourceID *string, tags *map[string]string, keys []string, setTags PutTagFn) {
+// Retag does the different re-tagging operations and calls the given setTags
+// function. Nothing is done once the context is cancelled, a write already
+// started by setTags being left to complete.
+func (m *Mapper) Retag(ctx context.Context, resourceID *string, tags *map[string]string, keys []string, setTags PutTagFn) {
 	var (
 		newTags, mapFromKey, mapFromMissing *map[string]string
 		err                                 error
 	)
+	if ctx.Err() != nil {
+		return
+	}
 	m.StripDefaults(tags)
 	if newTags, err = m.GetFromTags(tags); err != nil {
 		log.WithFields(logrus.Fields{"error": err}).Error("GetFromTags failed")
 	}
+	// rules holds the section of the configuration each new tag comes from
+	rules := make(map[string]string)
+	for k, v := range *newTags {
+		rules[k] = m.fromTagsRule(k, v)
+	}
 
 	for _, item := range keys {
 		if mapFromKey, err = m.GetFromKey(item, tags); err != nil {
@@ -266,8 +320,10 @@ func (m *Mapper) Retag(resourceID *string, tags *map[string]string, keys []strin
 		}
 		m.MergeMaps(newTags, mapFromKey)
 	}
+	attributeRule(rules, newTags, "keys")
 	mapFromMissing = m.GetMissingDefaults(tags)
 	m.MergeMaps(newTags, mapFromMissing)
+	attributeRule(rules, newTags, "defaults")
 
 	// This part evaluates if the existing tags need to be updated
 	sanitized := make(map[string]string)
@@ -277,17 +333,63 @@ func (m *Mapper) Retag(resourceID *string, tags *map[string]string, keys []strin
 		}
 	}
 	m.MergeMaps(newTags, &sanitized)
+	attributeRule(rules, newTags, "sanity")
 
 	finalTags := []*TagItem{}
 	for k, v := range *newTags {
 		finalTag := m.sanitize(resourceID, &k, &v)
+		finalTag.Rule = rules[k]
+		if protected, err := m.IsProtected(finalTag.Name); err != nil || protected {
+			log.WithFields(logrus.Fields{"error": err, "resource": *resourceID, "tag_name": finalTag.Name, "tag_value": finalTag.Value, "rule": finalTag.Rule}).Warn("Skipping protected tag")
+			continue
+		}
 		log.WithFields(logrus.Fields{"resource": *resourceID, "tag_name": (*finalTag).Name, "tag_value": (*finalTag).Value}).Debug("Prepare to set tag on resource")
 		finalTags = append(finalTags, finalTag)
 	}
 
 	if len(finalTags) != 0 {
-		if err = setTags(resourceID, finalTags); err != nil {
-			log.WithFields(logrus.Fields{"error": err, "resource": *resourceID}).Error("Failed to set tag on resource")
+		// The outcome of a batched write comes once the resource pointer may
+		// have been reused
+		id := *resourceID
+		setTags(resourceID, finalTags, func(_ []*TagItem, err error) {
+			if err != nil {
+				log.WithFields(logrus.Fields{"error": err, "resource": id}).Error("Failed to set tag on resource")
+			}
+		})
+	}
+}
+
+// IsProtected checks if the tag key matches one of the DefaultProtectedKeys or
+// of the configured protected keys. The patterns are case-insensitive regular
+// expressions matching the whole key.
+func (m *Mapper) IsProtected(tagName string) (bool, error) {
+	for _, pattern := range append(append([]string{}, DefaultProtectedKeys...), m.ProtectedKeys...) {
+		match, err := regexp.MatchString("(?i)^"+pattern+"$", tagName)
+		if err != nil || match {
+			return match, err
+		}
+	}
+	return false, nil
+}
+
+// fromTagsRule tells if a tag returned by GetFromTags comes from the tags
+// mapping or from the copy_tags
+func (m *Mapper) fromTagsRule(name, value string) string {
+	for _, mapping := range m.TagMap {
+		for _, dest := range mapping.Destination {
+			if dest.Name == name && dest.Value == value {
+				return "tags"
+			}
+		}
+	}
+	return "copy_tags"
+}
+
+// attributeRule records the given rule for the tags that have none yet
+func attributeRule(rules map[string]string, tags *map[string]string, rule string) {
+	for k := range *tags {
+		if _, ok := rules[k]; !ok {
+			rules[k] = rule
 		}
 	}
 }
@@ -306,6 +408,9 @@ func (m *Mapper) sanitize(resourceID, tagName, tagValue *string) *TagItem {
 		default:
 			log.WithFields(logrus.Fields{"error": err}).Error("ValidateTag failed")
 		}
+		for _, recorder := range m.SanityRecorders {
+			recorder.RecordSanityFailure(*resourceID, *tagName, *tagValue, err)
+		}
 	}
 	return sanitizedTag
 }
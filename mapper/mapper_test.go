@@ -1,6 +1,7 @@
 package mapper
 
 import (
+	"context"
 	"errors"
 	"reflect"
 	"regexp/syntax"
@@ -53,6 +54,27 @@ func TestLoadConfig(t *testing.T) {
 	}
 }
 
+func TestValidate(t *testing.T) {
+	testData := []struct {
+		config        Mapper
+		expectedError error
+	}{
+		{Mapper{}, nil},
+		{Mapper{CopyTag: []*TagCopy{{Source: []string{"env.*"}, Destination: "env"}}, Sanity: []*TagSanity{{TagName: "Env", Transform: map[string][]string{"prd": {"prod.*"}}}}}, nil},
+		{Mapper{CopyTag: []*TagCopy{{Source: []string{"EN)V"}, Destination: "env"}}}, &syntax.Error{Code: syntax.ErrUnexpectedParen, Expr: "(?i)^EN)V$"}},
+		{Mapper{TagMap: []*TagMapper{{Source: &TagItem{Name: "Name", Value: "a)b"}}}}, &syntax.Error{Code: syntax.ErrUnexpectedParen, Expr: "(?i)^a)b$"}},
+		{Mapper{TagMap: []*TagMapper{{Destination: []*TagItem{{Name: "env", Value: "prd"}}}}}, errors.New("tags mapping without source")},
+		{Mapper{KeyMap: []*KeyMapper{{KeyPattern: ".*a)b.*"}}}, &syntax.Error{Code: syntax.ErrUnexpectedParen, Expr: "(?i)^.*a)b.*$"}},
+		{Mapper{Sanity: []*TagSanity{{TagName: "Service", Transform: map[string][]string{"web": {"a)b"}}}}}, &syntax.Error{Code: syntax.ErrUnexpectedParen, Expr: "(?i)^a)b$"}},
+		{Mapper{ProtectedKeys: []string{"kubernetes.io/cluster/.*", "own)er"}}, &syntax.Error{Code: syntax.ErrUnexpectedParen, Expr: "(?i)^own)er$"}},
+	}
+	for _, d := range testData {
+		if err := d.config.Validate(); !reflect.DeepEqual(err, d.expectedError) {
+			t.Errorf("Validate returned: %v, expecting: %v\n", err, d.expectedError)
+		}
+	}
+}
+
 func TestGetFromTags(t *testing.T) {
 	testData := []struct {
 		input, expected map[string]string
@@ -351,27 +373,27 @@ func TestRetag(t *testing.T) {
 		expectedError error
 	}{
 		// empty source tag and keys
-		{"my resource", map[string]string{}, []string{}, setTagTestFctSuccess, 3, map[string]string{"Env": "unknown", "Team": "unknown", "Service": "unknown"}, configWorking, nil},
+		{"my resource", map[string]string{}, []string{}, Direct(setTagTestFctSuccess), 3, map[string]string{"Env": "unknown", "Team": "unknown", "Service": "unknown"}, configWorking, nil},
 		// non-matching tag existence, empty key
-		{"my resource", map[string]string{"foo": "bar"}, []string{}, setTagTestFctSuccess, 4, map[string]string{"Env": "unknown", "Team": "unknown", "Service": "unknown"}, configWorking, nil},
+		{"my resource", map[string]string{"foo": "bar"}, []string{}, Direct(setTagTestFctSuccess), 4, map[string]string{"Env": "unknown", "Team": "unknown", "Service": "unknown"}, configWorking, nil},
 		// 1 matching tag existence with transformation, empty key
-		{"my resource", map[string]string{"Env": "prod", "Service": "whatever"}, []string{}, setTagTestFctSuccess, 2, map[string]string{"Env": "prd", "Team": "unknown"}, configWorking, nil},
+		{"my resource", map[string]string{"Env": "prod", "Service": "whatever"}, []string{}, Direct(setTagTestFctSuccess), 2, map[string]string{"Env": "prd", "Team": "unknown"}, configWorking, nil},
 		// 1 matching tag existence without transformation, empty key
-		{"my resource", map[string]string{"Env": "prd", "Service": "whatever"}, []string{}, setTagTestFctSuccess, 2, map[string]string{"Team": "unknown"}, configWorking, nil},
+		{"my resource", map[string]string{"Env": "prd", "Service": "whatever"}, []string{}, Direct(setTagTestFctSuccess), 2, map[string]string{"Team": "unknown"}, configWorking, nil},
 		// 1 matching tag existence, matching key
-		{"my resource", map[string]string{"Env": "prd", "Service": "whatever"}, []string{"web-apache"}, setTagTestFctSuccess, 2, map[string]string{"Team": "web", "Component": "apache"}, configWorking, nil},
+		{"my resource", map[string]string{"Env": "prd", "Service": "whatever"}, []string{"web-apache"}, Direct(setTagTestFctSuccess), 2, map[string]string{"Team": "web", "Component": "apache"}, configWorking, nil},
 		// 1 matching tag existence with transformation, overlapping key
-		{"my resource", map[string]string{"Env": "prod", "Service": "whatever"}, []string{"non-staging-stuff"}, setTagTestFctSuccess, 2, map[string]string{"Env": "prd", "Team": "unknown"}, configWorking, nil},
+		{"my resource", map[string]string{"Env": "prod", "Service": "whatever"}, []string{"non-staging-stuff"}, Direct(setTagTestFctSuccess), 2, map[string]string{"Env": "prd", "Team": "unknown"}, configWorking, nil},
 		// 1 matching copy tag with transformation, overlapping key
-		{"my resource", map[string]string{"Account": "prod", "Service": "whatever"}, []string{"non-staging-stuff"}, setTagTestFctSuccess, 3, map[string]string{"Env": "prd", "Team": "unknown"}, configWorking, nil},
+		{"my resource", map[string]string{"Account": "prod", "Service": "whatever"}, []string{"non-staging-stuff"}, Direct(setTagTestFctSuccess), 3, map[string]string{"Env": "prd", "Team": "unknown"}, configWorking, nil},
 		// 1 matching copy tag, partially overlapping tag map, partially overlapping key
-		{"my resource", map[string]string{"Account": "prd", "Name": "dev-data-app", "Service": "Alice in chains", "noiseTag": "blah"}, []string{"non-staging-apache"}, setTagTestFctSuccess, 7, map[string]string{"Env": "prd", "Team": "data", "Component": "apache"}, configWorking, nil},
+		{"my resource", map[string]string{"Account": "prd", "Name": "dev-data-app", "Service": "Alice in chains", "noiseTag": "blah"}, []string{"non-staging-apache"}, Direct(setTagTestFctSuccess), 7, map[string]string{"Env": "prd", "Team": "data", "Component": "apache"}, configWorking, nil},
 		// setTag errors out
-		{"my resource", map[string]string{"Env": "prd", "Service": "whatever"}, []string{}, setTagTestFctFailure, 3, map[string]string{}, configWorking, errors.New("Failed to set tag on resource")},
+		{"my resource", map[string]string{"Env": "prd", "Service": "whatever"}, []string{}, Direct(setTagTestFctFailure), 3, map[string]string{}, configWorking, errors.New("Failed to set tag on resource")},
 		// bad config errors out
-		{"my resource", map[string]string{"Name": "prod", "Service": "whatever"}, []string{}, setTagTestFctSuccess, 3, map[string]string{}, Mapper{CopyTag: []*TagCopy{{Source: []string{"Accou)nt"}, Destination: "Env"}}}, errors.New("GetFromTags failed")},
-		{"my resource", map[string]string{"Service": "whatever"}, []string{"bla"}, setTagTestFctSuccess, 2, map[string]string{}, Mapper{KeyMap: []*KeyMapper{{KeyPattern: ".*a)b.*", Destination: []*TagItem{{Name: "Env", Value: "prd"}}}}}, errors.New("GetFromKey failed")},
-		{"my resource", map[string]string{"Env": "prd", "Service": "whatever"}, []string{}, setTagTestFctSuccess, 2, map[string]string{}, Mapper{Sanity: []*TagSanity{{TagName: "Service", Transform: map[string][]string{"web": {"a)b"}}}}}, errors.New("ValidateTag failed")},
+		{"my resource", map[string]string{"Name": "prod", "Service": "whatever"}, []string{}, Direct(setTagTestFctSuccess), 3, map[string]string{}, Mapper{CopyTag: []*TagCopy{{Source: []string{"Accou)nt"}, Destination: "Env"}}}, errors.New("GetFromTags failed")},
+		{"my resource", map[string]string{"Service": "whatever"}, []string{"bla"}, Direct(setTagTestFctSuccess), 2, map[string]string{}, Mapper{KeyMap: []*KeyMapper{{KeyPattern: ".*a)b.*", Destination: []*TagItem{{Name: "Env", Value: "prd"}}}}}, errors.New("GetFromKey failed")},
+		{"my resource", map[string]string{"Env": "prd", "Service": "whatever"}, []string{}, Direct(setTagTestFctSuccess), 2, map[string]string{}, Mapper{Sanity: []*TagSanity{{TagName: "Service", Transform: map[string][]string{"web": {"a)b"}}}}}, errors.New("ValidateTag failed")},
 	}
 
 	logger, hook := logrus_test.NewNullLogger()
@@ -382,7 +404,7 @@ func TestRetag(t *testing.T) {
 		hook.Reset()
 		testRetagUpdateTags = map[string]string{}
 
-		d.config.Retag(&d.resourceID, &d.tags, d.keys, d.setTags)
+		d.config.Retag(context.Background(), &d.resourceID, &d.tags, d.keys, d.setTags)
 		if !reflect.DeepEqual(d.expected, testRetagUpdateTags) {
 			t.Errorf("Expecting: %v\nGot: %v\n", d.expected, testRetagUpdateTags)
 		}
@@ -409,3 +431,97 @@ func TestRetag(t *testing.T) {
 		}
 	}
 }
+
+func TestRetagRules(t *testing.T) {
+	m := Mapper{
+		KeyMap:           []*KeyMapper{{KeyPattern: ".*apache.*", Destination: []*TagItem{{Name: "Team", Value: "web"}}}},
+		TagMap:           []*TagMapper{{Source: &TagItem{Name: "Name", Value: ".*dev.*"}, Destination: []*TagItem{{Name: "Env", Value: "dev"}}}},
+		CopyTag:          []*TagCopy{{Source: []string{"Account"}, Destination: "Owner"}},
+		Sanity:           []*TagSanity{{TagName: "Service", Transform: map[string][]string{"api": {"rest"}}}},
+		DefaultTagValues: map[string]string{"Component": "unknown"},
+	}
+	logger, _ := logrus_test.NewNullLogger()
+	log = logrus.NewEntry(logger)
+
+	resourceID := "my resource"
+	got := map[string]string{}
+	m.Retag(context.Background(), &resourceID, &map[string]string{"Name": "dev-app", "Account": "alice", "Service": "rest"}, []string{"apache"}, func(resourceID *string, tags []*TagItem, _ WrittenFn) error {
+		for _, tag := range tags {
+			got[tag.Name] = tag.Rule
+		}
+		return nil
+	})
+	expected := map[string]string{"Env": "tags", "Owner": "copy_tags", "Team": "keys", "Component": "defaults", "Service": "sanity"}
+	if !reflect.DeepEqual(expected, got) {
+		t.Errorf("Expecting: %v\nGot: %v\n", expected, got)
+	}
+}
+
+func TestRetagCancelled(t *testing.T) {
+	m := Mapper{DefaultTagValues: map[string]string{"Component": "unknown"}}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	resourceID := "my resource"
+	m.Retag(ctx, &resourceID, &map[string]string{}, []string{}, func(resourceID *string, tags []*TagItem, _ WrittenFn) error {
+		t.Errorf("Expecting no tag to be set once the context is cancelled, got: %v\n", tags)
+		return nil
+	})
+}
+
+func TestIsProtected(t *testing.T) {
+	m := Mapper{ProtectedKeys: []string{"kubernetes.io/cluster/.*", "owner"}}
+	testData := []struct {
+		tagName       string
+		protected     bool
+		expectedError bool
+	}{
+		{"aws:cloudformation:stack-name", true, false},
+		{"elasticbeanstalk:environment-name", true, false},
+		{"kubernetes.io/cluster/prod", true, false},
+		{"Owner", true, false},
+		{"owners", false, false},
+		{"Env", false, false},
+	}
+	for _, d := range testData {
+		protected, err := m.IsProtected(d.tagName)
+		if protected != d.protected || (err != nil) != d.expectedError {
+			t.Errorf("Expecting %v (error: %v) for %s, got %v (error: %v)\n", d.protected, d.expectedError, d.tagName, protected, err)
+		}
+	}
+	if _, err := (&Mapper{ProtectedKeys: []string{"a)b"}}).IsProtected("Env"); err == nil {
+		t.Errorf("Expecting an error for an invalid pattern\n")
+	}
+}
+
+func TestRetagProtectedKeys(t *testing.T) {
+	m := Mapper{
+		CopyTag:          []*TagCopy{{Source: []string{"Account"}, Destination: "aws:account"}},
+		Sanity:           []*TagSanity{{TagName: "elasticbeanstalk:environment-name", Transform: map[string][]string{"prd": {"prod"}}}},
+		DefaultTagValues: map[string]string{"Env": "unknown", "owner": "nobody"},
+		ProtectedKeys:    []string{"owner"},
+	}
+	logger, hook := logrus_test.NewNullLogger()
+	log = logrus.NewEntry(logger)
+
+	resourceID := "my resource"
+	got := map[string]string{}
+	m.Retag(context.Background(), &resourceID, &map[string]string{"Account": "alice", "elasticbeanstalk:environment-name": "prod"}, []string{}, func(resourceID *string, tags []*TagItem, _ WrittenFn) error {
+		for _, tag := range tags {
+			got[tag.Name] = tag.Value
+		}
+		return nil
+	})
+	if expected := map[string]string{"Env": "unknown"}; !reflect.DeepEqual(expected, got) {
+		t.Errorf("Expecting: %v\nGot: %v\n", expected, got)
+	}
+	skipped := 0
+	for _, entry := range hook.Entries {
+		if entry.Message == "Skipping protected tag" {
+			skipped++
+		}
+	}
+	if skipped != 3 {
+		t.Errorf("Expecting 3 skipped tags logged, got %d\n", skipped)
+	}
+}
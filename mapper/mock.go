@@ -1,5 +1,7 @@
 package mapper
 
+import "context"
+
 // MockMapper is used to mock the calls to retag during the tests
 type MockMapper struct {
 	Iface
@@ -12,7 +14,7 @@ type MockMapper struct {
 }
 
 // Retag just records which resource has been called with which tags
-func (m *MockMapper) Retag(resourceID *string, tags *map[string]string, keys []string, setTags PutTagFn) {
+func (m *MockMapper) Retag(ctx context.Context, resourceID *string, tags *map[string]string, keys []string, setTags PutTagFn) {
 	if m.ResourceTags == nil {
 		m.ResourceTags = make(map[string]map[string]string)
 	}
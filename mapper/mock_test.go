@@ -1,6 +1,7 @@
 package mapper
 
 import (
+	"context"
 	"reflect"
 	"testing"
 )
@@ -64,7 +65,7 @@ func TestMockRetag(t *testing.T) {
 			v, _ := d.inputResourceTags[k]
 			inKeys, _ := d.inputResourceKeys[k]
 			t.Logf("%s, %v, %v", k, v, inKeys)
-			m.Retag(&k, &v, inKeys, nil)
+			m.Retag(context.Background(), &k, &v, inKeys, nil)
 		}
 		if !reflect.DeepEqual(d.outputResourceTags, m.ResourceTags) {
 			t.Errorf("Expecting ResourceTags: %v\nGot: %v\n", d.outputResourceTags, m.ResourceTags)
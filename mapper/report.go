@@ -0,0 +1,186 @@
+package mapper
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"sync"
+	"text/tabwriter"
+)
+
+// maxReportExamples is the number of example resources kept per entry of the
+// SanityReport
+const maxReportExamples = 5
+
+// SanityRecorder receives the sanity check failures encountered by the Mapper
+// during the retagging process
+type SanityRecorder interface {
+	RecordSanityFailure(resourceID, tagName, tagValue string, err error)
+}
+
+// SanityReportEntry holds the occurrences of a given tag name and value that
+// failed the sanity check
+type SanityReportEntry struct {
+	TagName  string
+	TagValue string
+	// Count is the number of distinct resources carrying that tag value
+	Count int
+	// Examples is a limited list of resources carrying that tag value
+	Examples  []string
+	resources map[string]bool
+}
+
+// SanityReport aggregates the ErrSanityNoMapping and ErrSanityConfig errors
+// seen during a run, grouped by tag name and value
+type SanityReport struct {
+	// Interrupted marks the report of a run that was interrupted, which only
+	// covers the resources processed before
+	Interrupted bool
+
+	mu        sync.Mutex
+	noMapping map[string]map[string]*SanityReportEntry
+	noConfig  map[string]map[string]*SanityReportEntry
+}
+
+// NewSanityReport creates an empty SanityReport
+func NewSanityReport() *SanityReport {
+	return &SanityReport{
+		noMapping: make(map[string]map[string]*SanityReportEntry),
+		noConfig:  make(map[string]map[string]*SanityReportEntry),
+	}
+}
+
+// RecordSanityFailure registers a sanity check failure for the given resource.
+// A resource is only counted once per tag name and value.
+func (r *SanityReport) RecordSanityFailure(resourceID, tagName, tagValue string, err error) {
+	var group map[string]map[string]*SanityReportEntry
+	switch err.(type) {
+	case *ErrSanityNoMapping:
+		group = r.noMapping
+	case *ErrSanityConfig:
+		group = r.noConfig
+	default:
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := group[tagName]; !ok {
+		group[tagName] = make(map[string]*SanityReportEntry)
+	}
+	entry, ok := group[tagName][tagValue]
+	if !ok {
+		entry = &SanityReportEntry{TagName: tagName, TagValue: tagValue, resources: make(map[string]bool)}
+		group[tagName][tagValue] = entry
+	}
+	if entry.resources[resourceID] {
+		return
+	}
+	entry.resources[resourceID] = true
+	entry.Count++
+	if len(entry.Examples) < maxReportExamples {
+		entry.Examples = append(entry.Examples, resourceID)
+	}
+}
+
+// NoMapping returns the values that have a sanity configuration for their tag
+// but did not match any remap, sorted by tag name and decreasing count
+func (r *SanityReport) NoMapping() []*SanityReportEntry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return sortedEntries(r.noMapping)
+}
+
+// NoConfig returns the values of the tags that have no sanity configuration,
+// sorted by tag name and decreasing count
+func (r *SanityReport) NoConfig() []*SanityReportEntry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return sortedEntries(r.noConfig)
+}
+
+// Empty returns true when no sanity failure has been recorded
+func (r *SanityReport) Empty() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.noMapping) == 0 && len(r.noConfig) == 0
+}
+
+// Skeleton returns a sanity configuration listing the unmapped values for
+// each tag. The remap key is a placeholder that needs to be replaced by the
+// value the tags should be transformed to.
+func (r *SanityReport) Skeleton() []*TagSanity {
+	result := []*TagSanity{}
+	var current *TagSanity
+	for _, entry := range r.NoMapping() {
+		if current == nil || current.TagName != entry.TagName {
+			current = &TagSanity{TagName: entry.TagName, Transform: map[string][]string{"TODO": {}}}
+			result = append(result, current)
+		}
+		current.Transform["TODO"] = append(current.Transform["TODO"], regexp.QuoteMeta(entry.TagValue))
+	}
+	return result
+}
+
+// Write outputs the human-readable report followed by the sanity json snippet
+// for the unmapped values
+func (r *SanityReport) Write(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	if r.Interrupted {
+		fmt.Fprintln(tw, "# Interrupted run: partial report")
+		fmt.Fprintln(tw, "")
+	}
+	fmt.Fprintln(tw, "# Values not matching any sanity remap")
+	fmt.Fprintln(tw, "TAG\tVALUE\tRESOURCES\tEXAMPLES")
+	for _, entry := range r.NoMapping() {
+		fmt.Fprintf(tw, "%s\t%q\t%d\t%v\n", entry.TagName, entry.TagValue, entry.Count, entry.Examples)
+	}
+	fmt.Fprintln(tw, "")
+	fmt.Fprintln(tw, "# Tags without sanity configuration")
+	fmt.Fprintln(tw, "TAG\tDISTINCT VALUES\tOCCURRENCES\tEXAMPLES")
+	noConfig := r.NoConfig()
+	for i := 0; i < len(noConfig); {
+		j, count, examples := i, 0, []string{}
+		for ; j < len(noConfig) && noConfig[j].TagName == noConfig[i].TagName; j++ {
+			count += noConfig[j].Count
+			if len(examples) < maxReportExamples {
+				examples = append(examples, noConfig[j].TagValue)
+			}
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%q\n", noConfig[i].TagName, j-i, count, examples)
+		i = j
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	snippet, err := json.MarshalIndent(map[string][]*TagSanity{"sanity": r.Skeleton()}, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "\n# Sanity configuration skeleton for the unmapped values\n%s\n", snippet)
+	return err
+}
+
+// sortedEntries flattens the given group sorted by tag name, decreasing count
+// and tag value
+func sortedEntries(group map[string]map[string]*SanityReportEntry) []*SanityReportEntry {
+	result := []*SanityReportEntry{}
+	for _, values := range group {
+		for _, entry := range values {
+			result = append(result, entry)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].TagName != result[j].TagName {
+			return result[i].TagName < result[j].TagName
+		}
+		if result[i].Count != result[j].Count {
+			return result[i].Count > result[j].Count
+		}
+		return result[i].TagValue < result[j].TagValue
+	})
+	return result
+}
@@ -0,0 +1,85 @@
+package mapper
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	logrus_test "github.com/sirupsen/logrus/hooks/test"
+)
+
+func TestSanityReportRecord(t *testing.T) {
+	r := NewSanityReport()
+	r.RecordSanityFailure("res1", "env", "prod1", NewErrSanityNoMapping("No match found for the sanity check", "env", "prod1"))
+	r.RecordSanityFailure("res2", "env", "prod1", NewErrSanityNoMapping("No match found for the sanity check", "env", "prod1"))
+	// same resource is only counted once
+	r.RecordSanityFailure("res2", "env", "prod1", NewErrSanityNoMapping("No match found for the sanity check", "env", "prod1"))
+	r.RecordSanityFailure("res3", "env", "qa.1", NewErrSanityNoMapping("No match found for the sanity check", "env", "qa.1"))
+	r.RecordSanityFailure("res3", "Name", "foo", NewErrSanityConfig("No sanity configuration found", "Name"))
+	// unrelated errors are ignored
+	r.RecordSanityFailure("res3", "team", "bar", errors.New("Badaboom"))
+
+	noMapping := r.NoMapping()
+	if len(noMapping) != 2 {
+		t.Fatalf("Expecting 2 unmapped values, got: %v\n", noMapping)
+	}
+	if noMapping[0].TagValue != "prod1" || noMapping[0].Count != 2 || !reflect.DeepEqual(noMapping[0].Examples, []string{"res1", "res2"}) {
+		t.Errorf("Unexpected 1st entry: %v\n", noMapping[0])
+	}
+	if noMapping[1].TagValue != "qa.1" || noMapping[1].Count != 1 {
+		t.Errorf("Unexpected 2nd entry: %v\n", noMapping[1])
+	}
+
+	noConfig := r.NoConfig()
+	if len(noConfig) != 1 || noConfig[0].TagName != "Name" || noConfig[0].Count != 1 {
+		t.Errorf("Unexpected tags without configuration: %v\n", noConfig)
+	}
+
+	expected := []*TagSanity{{TagName: "env", Transform: map[string][]string{"TODO": {"prod1", `qa\.1`}}}}
+	if res := r.Skeleton(); !reflect.DeepEqual(res, expected) {
+		t.Errorf("Expecting skeleton: %v\nGot: %v\n", expected, res)
+	}
+
+	var buf bytes.Buffer
+	if err := r.Write(&buf); err != nil {
+		t.Fatalf("Write returned: %s\n", err)
+	}
+	if !strings.Contains(buf.String(), `"tag_name": "env"`) {
+		t.Errorf("Expecting the sanity snippet in the report, got:\n%s\n", buf.String())
+	}
+}
+
+func TestSanityReportFromRetag(t *testing.T) {
+	logger, _ := logrus_test.NewNullLogger()
+	log = logrus.NewEntry(logger)
+
+	r := NewSanityReport()
+	m := Mapper{
+		Sanity:          []*TagSanity{{TagName: "Env", Transform: map[string][]string{"prd": {"prod"}}}},
+		SanityRecorders: []SanityRecorder{r},
+	}
+	resourceID := "my resource"
+	m.Retag(context.Background(), &resourceID, &map[string]string{"Env": "qa", "Name": "foo"}, []string{}, Direct(setTagTestFctSuccess))
+
+	if noMapping := r.NoMapping(); len(noMapping) != 1 || noMapping[0].TagValue != "qa" || noMapping[0].Count != 1 {
+		t.Errorf("Unexpected unmapped values: %v\n", noMapping)
+	}
+	if noConfig := r.NoConfig(); len(noConfig) != 1 || noConfig[0].TagName != "Name" {
+		t.Errorf("Unexpected tags without configuration: %v\n", noConfig)
+	}
+}
+
+func TestSanityReportWriteInterrupted(t *testing.T) {
+	r := NewSanityReport()
+	for _, interrupted := range []bool{false, true} {
+		r.Interrupted = interrupted
+		var buf bytes.Buffer
+		if err := r.Write(&buf); err != nil || strings.Contains(buf.String(), "Interrupted run") != interrupted {
+			t.Errorf("Expecting the report to be marked as interrupted: %t, got (error: %v):\n%s\n", interrupted, err, buf.String())
+		}
+	}
+}
@@ -0,0 +1,261 @@
+package mapper
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// defaultSuggestMaxValues is the default maximum number of distinct values
+// (once normalized) a tag can have to get a sanity suggestion
+const defaultSuggestMaxValues = 50
+
+// normalizeSeparators matches everything that is not a letter or a digit
+var normalizeSeparators = regexp.MustCompile(`[^a-z0-9]+`)
+
+// normalizeSuffixes are the common long forms found at the end of the values,
+// replaced by their short form during the normalization
+var normalizeSuffixes = []struct{ long, short string }{
+	{"production", "prod"},
+	{"staging", "stg"},
+	{"development", "dev"},
+}
+
+// NormalizeTagValue returns the form used to cluster tag names and values:
+// lower case, without separators and with the common suffixes shortened. For
+// example "My-App_Production", "myapp-prod" and "MyApp prod" are all
+// normalized to "myappprod".
+func NormalizeTagValue(value string) string {
+	result := normalizeSeparators.ReplaceAllString(strings.ToLower(value), "")
+	for _, suffix := range normalizeSuffixes {
+		if strings.HasSuffix(result, suffix.long) {
+			return strings.TrimSuffix(result, suffix.long) + suffix.short
+		}
+	}
+	return result
+}
+
+// ValueCount is a value associated to the number of resources it was found on
+type ValueCount struct {
+	Value string
+	Count int
+}
+
+// SuggestedCopy is a copy_tags rule proposed by the Suggester
+type SuggestedCopy struct {
+	TagCopy
+	// Frequencies is the number of resources each of the tag names was found
+	// on, the destination first
+	Frequencies []ValueCount
+}
+
+// SuggestedRemap is a remap entry of a sanity rule proposed by the Suggester
+type SuggestedRemap struct {
+	Value        string
+	Alternatives []string
+	// Frequencies is the number of resources each of the values was found on,
+	// the remapped value first
+	Frequencies []ValueCount
+}
+
+// SuggestedSanity is a sanity rule proposed by the Suggester
+type SuggestedSanity struct {
+	TagName string
+	Remap   []*SuggestedRemap
+}
+
+// Suggestion is the configuration proposed by the Suggester
+type Suggestion struct {
+	CopyTag []*SuggestedCopy
+	Sanity  []*SuggestedSanity
+	// Skipped lists the tag names that have too many distinct values to get a
+	// sanity suggestion, with their number of distinct values
+	Skipped []ValueCount
+	// Resources is the number of resources that have been scanned
+	Resources int
+}
+
+// Suggester collects the existing tags of the resources it is given to propose
+// a sanity and copy_tags configuration. It never sets any tag.
+type Suggester struct {
+	Iface
+	// MaxValues is the maximum number of distinct normalized values a tag can
+	// have to get a sanity suggestion. Defaults to 50.
+	MaxValues int
+	mu        sync.Mutex
+	resources int
+	// values counts the resources per tag name and value
+	values map[string]map[string]int
+}
+
+// NewSuggester creates an empty Suggester
+func NewSuggester() *Suggester {
+	return &Suggester{MaxValues: defaultSuggestMaxValues, values: make(map[string]map[string]int)}
+}
+
+// Retag records the tags of the resource without calling setTags, unless the
+// context is cancelled
+func (s *Suggester) Retag(ctx context.Context, resourceID *string, tags *map[string]string, keys []string, setTags PutTagFn) {
+	if ctx.Err() != nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.resources++
+	for k, v := range *tags {
+		if _, ok := s.values[k]; !ok {
+			s.values[k] = make(map[string]int)
+		}
+		s.values[k][v]++
+	}
+}
+
+// Suggest clusters the tag names and values collected so far and returns the
+// corresponding configuration proposal
+func (s *Suggester) Suggest() *Suggestion {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result := &Suggestion{Resources: s.resources}
+
+	keyCounts := make(map[string]int)
+	for k, values := range s.values {
+		for _, count := range values {
+			keyCounts[k] += count
+		}
+	}
+
+	for _, cluster := range clusterCounts(keyCounts) {
+		destination := cluster[0].Value
+		if len(cluster) > 1 {
+			cp := &SuggestedCopy{TagCopy: TagCopy{Destination: destination}, Frequencies: cluster}
+			for _, src := range dedupeFold(cluster[1:]) {
+				cp.Source = append(cp.Source, regexp.QuoteMeta(src))
+			}
+			if len(cp.Source) > 0 {
+				result.CopyTag = append(result.CopyTag, cp)
+			}
+		}
+
+		// The values of all the tag names of the cluster end up in the destination
+		valueCounts := make(map[string]int)
+		for _, key := range cluster {
+			for v, count := range s.values[key.Value] {
+				valueCounts[v] += count
+			}
+		}
+		valueClusters := clusterCounts(valueCounts)
+		if len(valueClusters) > s.MaxValues {
+			result.Skipped = append(result.Skipped, ValueCount{Value: destination, Count: len(valueClusters)})
+			continue
+		}
+		sanity := &SuggestedSanity{TagName: destination}
+		for _, valueCluster := range valueClusters {
+			remap := &SuggestedRemap{Value: valueCluster[0].Value, Alternatives: []string{}, Frequencies: valueCluster}
+			for _, alt := range dedupeFold(valueCluster[1:]) {
+				remap.Alternatives = append(remap.Alternatives, regexp.QuoteMeta(alt))
+			}
+			sanity.Remap = append(sanity.Remap, remap)
+		}
+		result.Sanity = append(result.Sanity, sanity)
+	}
+	return result
+}
+
+// Write outputs the suggestion as a json configuration with the frequencies
+// given as comments. The comments need to be removed before using it as
+// configuration.
+func (s *Suggestion) Write(w io.Writer) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "// Configuration suggested from the tags of %d resources\n{\n", s.Resources)
+
+	b.WriteString("  \"copy_tags\": [\n")
+	for i, cp := range s.CopyTag {
+		fmt.Fprintf(&b, "    // %s\n", frequenciesComment(cp.Frequencies))
+		fmt.Fprintf(&b, "    {\"sources\": %s, \"destination\": %s}%s\n", jsonString(cp.Source), jsonString(cp.Destination), separator(i, len(s.CopyTag)))
+	}
+	b.WriteString("  ],\n")
+
+	b.WriteString("  \"sanity\": [\n")
+	for _, skipped := range s.Skipped {
+		fmt.Fprintf(&b, "    // %s skipped: %d distinct values\n", skipped.Value, skipped.Count)
+	}
+	for i, sanity := range s.Sanity {
+		fmt.Fprintf(&b, "    {\n      \"tag_name\": %s, \"remap\": {\n", jsonString(sanity.TagName))
+		for j, remap := range sanity.Remap {
+			fmt.Fprintf(&b, "        // %s\n", frequenciesComment(remap.Frequencies))
+			fmt.Fprintf(&b, "        %s: %s%s\n", jsonString(remap.Value), jsonString(remap.Alternatives), separator(j, len(sanity.Remap)))
+		}
+		fmt.Fprintf(&b, "      }\n    }%s\n", separator(i, len(s.Sanity)))
+	}
+	b.WriteString("  ]\n}\n")
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// clusterCounts groups the given values by normalized form. Each cluster is
+// sorted by decreasing count so its 1st element is the most used value, and
+// the clusters are sorted by their 1st value.
+func clusterCounts(counts map[string]int) [][]ValueCount {
+	clusters := make(map[string][]ValueCount)
+	for v, count := range counts {
+		n := NormalizeTagValue(v)
+		clusters[n] = append(clusters[n], ValueCount{Value: v, Count: count})
+	}
+	result := [][]ValueCount{}
+	for _, cluster := range clusters {
+		sort.Slice(cluster, func(i, j int) bool {
+			if cluster[i].Count != cluster[j].Count {
+				return cluster[i].Count > cluster[j].Count
+			}
+			return cluster[i].Value < cluster[j].Value
+		})
+		result = append(result, cluster)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i][0].Value < result[j][0].Value })
+	return result
+}
+
+// dedupeFold returns the values that are not a case-insensitive duplicate of
+// a previous one, as the mapper regexes are case-insensitive
+func dedupeFold(values []ValueCount) []string {
+	seen := make(map[string]bool)
+	result := []string{}
+	for _, v := range values {
+		lower := strings.ToLower(v.Value)
+		if seen[lower] {
+			continue
+		}
+		seen[lower] = true
+		result = append(result, v.Value)
+	}
+	return result
+}
+
+// frequenciesComment formats the frequencies as "value: count, value: count"
+func frequenciesComment(frequencies []ValueCount) string {
+	items := []string{}
+	for _, f := range frequencies {
+		items = append(items, fmt.Sprintf("%s: %d", jsonString(f.Value), f.Count))
+	}
+	return strings.Join(items, ", ")
+}
+
+// jsonString returns the json representation of a string or list of strings
+func jsonString(v interface{}) string {
+	out, _ := json.Marshal(v)
+	return string(out)
+}
+
+// separator returns the comma needed between json list elements
+func separator(index, length int) string {
+	if index < length-1 {
+		return ","
+	}
+	return ""
+}
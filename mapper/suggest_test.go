@@ -0,0 +1,88 @@
+package mapper
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"reflect"
+	"regexp"
+	"testing"
+)
+
+func TestNormalizeTagValue(t *testing.T) {
+	testData := []struct {
+		input, expected string
+	}{
+		{"", ""},
+		{"prod", "prod"},
+		{"My-App_Production", "myappprod"},
+		{"myapp-prod", "myappprod"},
+		{"MyApp prod", "myappprod"},
+		{"Staging", "stg"},
+		{"user.services", "userservices"},
+	}
+	for _, d := range testData {
+		if res := NormalizeTagValue(d.input); res != d.expected {
+			t.Errorf("Expecting %s to be normalized to %s, got: %s\n", d.input, d.expected, res)
+		}
+	}
+}
+
+func TestSuggest(t *testing.T) {
+	resources := []map[string]string{
+		{"env": "prod", "Name": "web-1"},
+		{"env": "prod", "Name": "web-2"},
+		{"env": "Production", "Name": "web-3"},
+		{"Env": "PROD", "Name": "api-1"},
+		{"env": "stg", "Name": "api-2"},
+		{"ENV": "dev"},
+	}
+	s := NewSuggester()
+	s.MaxValues = 3
+	for i, tags := range resources {
+		resourceID := string(rune('a' + i))
+		s.Retag(context.Background(), &resourceID, &tags, []string{}, Direct(setTagTestFctFailure))
+	}
+
+	res := s.Suggest()
+	if res.Resources != len(resources) {
+		t.Errorf("Expecting %d resources, got: %d\n", len(resources), res.Resources)
+	}
+
+	expectedCopy := []*SuggestedCopy{
+		{TagCopy: TagCopy{Source: []string{"ENV"}, Destination: "env"}, Frequencies: []ValueCount{{"env", 4}, {"ENV", 1}, {"Env", 1}}},
+	}
+	if !reflect.DeepEqual(res.CopyTag, expectedCopy) {
+		t.Errorf("Expecting copy_tags: %v\nGot: %v\n", expectedCopy, res.CopyTag)
+	}
+
+	expectedSanity := []*SuggestedSanity{
+		{TagName: "env", Remap: []*SuggestedRemap{
+			{Value: "dev", Alternatives: []string{}, Frequencies: []ValueCount{{"dev", 1}}},
+			{Value: "prod", Alternatives: []string{"PROD", "Production"}, Frequencies: []ValueCount{{"prod", 2}, {"PROD", 1}, {"Production", 1}}},
+			{Value: "stg", Alternatives: []string{}, Frequencies: []ValueCount{{"stg", 1}}},
+		}},
+	}
+	if !reflect.DeepEqual(res.Sanity, expectedSanity) {
+		t.Errorf("Expecting sanity: %v\nGot: %v\n", expectedSanity, res.Sanity)
+	}
+
+	expectedSkipped := []ValueCount{{"Name", 5}}
+	if !reflect.DeepEqual(res.Skipped, expectedSkipped) {
+		t.Errorf("Expecting skipped tags: %v\nGot: %v\n", expectedSkipped, res.Skipped)
+	}
+
+	// Once the comments are stripped, the output is a valid config
+	var buf bytes.Buffer
+	if err := res.Write(&buf); err != nil {
+		t.Fatalf("Write returned: %s\n", err)
+	}
+	stripped := regexp.MustCompile(`(?m)^\s*//.*$`).ReplaceAll(buf.Bytes(), []byte{})
+	m := Mapper{}
+	if err := json.Unmarshal(stripped, &m); err != nil {
+		t.Fatalf("Invalid configuration generated: %s\n%s\n", err, buf.String())
+	}
+	if len(m.CopyTag) != 1 || len(m.Sanity) != 1 || len(m.Sanity[0].Transform) != 3 {
+		t.Errorf("Unexpected configuration generated: %s\n", buf.String())
+	}
+}
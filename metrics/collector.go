@@ -0,0 +1,152 @@
+package metrics
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+
+	"github.com/VEVO/awsRetagger/mapper"
+)
+
+// Names of the metrics exposed by the Collector
+const (
+	ResourcesScanned  = "awsretagger_resources_scanned_total"
+	ResourcesRetagged = "awsretagger_resources_retagged_total"
+	ResourcesFailed   = "awsretagger_resources_failed_total"
+	SanityFailures    = "awsretagger_sanity_failures_total"
+	APICalls          = "awsretagger_aws_api_calls_total"
+	APIThrottles      = "awsretagger_aws_api_throttles_total"
+	RunDuration       = "awsretagger_run_duration_seconds"
+	LastRunTimestamp  = "awsretagger_last_run_timestamp_seconds"
+	RunInterrupted    = "awsretagger_last_run_interrupted"
+)
+
+const (
+	// handlerName is the name of the handlers added to the aws session
+	handlerName = "awsRetagger.metrics"
+	// reasons of the sanity failures
+	sanityNoMapping     = "no_mapping"
+	sanityNoConfig      = "no_config"
+	sanityInvalidConfig = "invalid_config"
+)
+
+// Collector gathers the metrics of the retagging runs
+type Collector struct {
+	*Registry
+	mu sync.Mutex
+	// providers holds the provider of the resources currently going through
+	// the mapper, so the sanity failures can be attributed to it
+	providers map[string]string
+}
+
+// NewCollector creates a Collector adding the account and region labels to
+// all its metrics
+func NewCollector(account, region string) *Collector {
+	r := NewRegistry(map[string]string{"account": account, "region": region})
+	r.Register(ResourcesScanned, "Number of resources scanned.", Counter)
+	r.Register(ResourcesRetagged, "Number of resources successfully retagged.", Counter)
+	r.Register(ResourcesFailed, "Number of resources that failed to be retagged.", Counter)
+	r.Register(SanityFailures, "Number of sanity check failures.", Counter)
+	r.Register(APICalls, "Number of AWS API calls, retries included.", Counter)
+	r.Register(APIThrottles, "Number of throttled AWS API calls.", Counter)
+	r.Register(RunDuration, "Duration of the last run in seconds.", Gauge)
+	r.Register(LastRunTimestamp, "Unix timestamp of the end of the last run.", Gauge)
+	r.Register(RunInterrupted, "1 when the last run was interrupted by a signal, 0 otherwise.", Gauge)
+	return &Collector{Registry: r, providers: make(map[string]string)}
+}
+
+// InstrumentSession counts the AWS API calls and throttles of the clients
+// created from the given session afterwards
+func (c *Collector) InstrumentSession(sess *session.Session) {
+	sess.Handlers.Send.PushFrontNamed(request.NamedHandler{Name: handlerName, Fn: func(r *request.Request) {
+		c.Add(APICalls, map[string]string{"service": r.ClientInfo.ServiceName, "operation": r.Operation.Name}, 1)
+	}})
+	sess.Handlers.Retry.PushFrontNamed(request.NamedHandler{Name: handlerName, Fn: func(r *request.Request) {
+		if request.IsErrorThrottle(r.Error) {
+			c.Add(APIThrottles, map[string]string{"service": r.ClientInfo.ServiceName, "operation": r.Operation.Name}, 1)
+		}
+	}})
+}
+
+// ObserveRun records the duration and end of a run that started at the given
+// time, and whether it was interrupted
+func (c *Collector) ObserveRun(start time.Time, interrupted bool) {
+	end := time.Now()
+	c.Set(RunDuration, nil, end.Sub(start).Seconds())
+	c.Set(LastRunTimestamp, nil, float64(end.Unix()))
+	if interrupted {
+		c.Set(RunInterrupted, nil, 1)
+	} else {
+		c.Set(RunInterrupted, nil, 0)
+	}
+}
+
+// RecordSanityFailure counts the sanity failures per provider, tag and value.
+// The value is not used as label for the tags without sanity configuration
+// to avoid labels like the Name tag values.
+func (c *Collector) RecordSanityFailure(resourceID, tagName, tagValue string, err error) {
+	c.mu.Lock()
+	provider := c.providers[resourceID]
+	c.mu.Unlock()
+
+	labels := map[string]string{"provider": provider, "tag_name": tagName, "tag_value": tagValue, "reason": sanityNoMapping}
+	switch err.(type) {
+	case *mapper.ErrSanityNoMapping:
+	case *mapper.ErrSanityConfig:
+		labels["tag_value"], labels["reason"] = "", sanityNoConfig
+	default:
+		labels["reason"] = sanityInvalidConfig
+	}
+	c.Add(SanityFailures, labels, 1)
+}
+
+// Mapper returns a mapper counting the resources of the given provider going
+// through m. When the collector is nil, m is returned as-is.
+func (c *Collector) Mapper(provider string, m mapper.Iface) mapper.Iface {
+	if c == nil {
+		return m
+	}
+	return &instrumentedMapper{Iface: m, provider: provider, collector: c}
+}
+
+// instrumentedMapper counts the resources scanned, retagged and failed of a
+// provider
+type instrumentedMapper struct {
+	mapper.Iface
+	provider  string
+	collector *Collector
+}
+
+// Retag counts the resource and the outcome of setTags around the actual
+// Retag, the batched writes being counted once their batch is sent. The
+// resources reached once the context is cancelled are not counted.
+func (m *instrumentedMapper) Retag(ctx context.Context, resourceID *string, tags *map[string]string, keys []string, setTags mapper.PutTagFn) {
+	if ctx.Err() != nil {
+		return
+	}
+	labels := map[string]string{"provider": m.provider}
+	m.collector.Add(ResourcesScanned, labels, 1)
+
+	m.collector.mu.Lock()
+	m.collector.providers[*resourceID] = m.provider
+	m.collector.mu.Unlock()
+	defer func() {
+		m.collector.mu.Lock()
+		delete(m.collector.providers, *resourceID)
+		m.collector.mu.Unlock()
+	}()
+
+	m.Iface.Retag(ctx, resourceID, tags, keys, func(id *string, t []*mapper.TagItem, done mapper.WrittenFn) error {
+		return setTags(id, t, func(written []*mapper.TagItem, err error) {
+			if err != nil {
+				m.collector.Add(ResourcesFailed, labels, 1)
+			} else {
+				m.collector.Add(ResourcesRetagged, labels, 1)
+			}
+			done.Report(written, err)
+		})
+	})
+}
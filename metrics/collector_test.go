@@ -0,0 +1,97 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	logrus_test "github.com/sirupsen/logrus/hooks/test"
+
+	"github.com/VEVO/awsRetagger/mapper"
+)
+
+// sanityMapper fails the sanity check of every tag of the resources and sets
+// them
+type sanityMapper struct {
+	mapper.Iface
+	recorder mapper.SanityRecorder
+}
+
+func (m *sanityMapper) Retag(ctx context.Context, resourceID *string, tags *map[string]string, keys []string, setTags mapper.PutTagFn) {
+	for k, v := range *tags {
+		m.recorder.RecordSanityFailure(*resourceID, k, v, mapper.NewErrSanityNoMapping("No match found for the sanity check", k, v))
+	}
+	setTags(resourceID, []*mapper.TagItem{{Name: "foo", Value: "bar"}}, nil)
+}
+
+func TestCollectorMapper(t *testing.T) {
+	c := NewCollector("123456789012", "us-east-1")
+	inner := &sanityMapper{recorder: c}
+
+	if m := (*Collector)(nil).Mapper("ec2", inner); m != inner {
+		t.Errorf("Expecting a nil collector to return the mapper as-is\n")
+	}
+
+	setTagsOk := mapper.Direct(func(*string, []*mapper.TagItem) error { return nil })
+	setTagsKo := mapper.Direct(func(*string, []*mapper.TagItem) error { return errors.New("Badaboom") })
+	m := c.Mapper("ec2", inner)
+	for _, id := range []string{"i-1", "i-2"} {
+		m.Retag(context.Background(), &id, &map[string]string{"env": "qa"}, []string{}, setTagsOk)
+	}
+	id := "i-3"
+	m.Retag(context.Background(), &id, &map[string]string{}, []string{}, setTagsKo)
+
+	testData := []struct {
+		name     string
+		labels   map[string]string
+		expected float64
+	}{
+		{ResourcesScanned, map[string]string{"provider": "ec2"}, 3},
+		{ResourcesRetagged, map[string]string{"provider": "ec2"}, 2},
+		{ResourcesFailed, map[string]string{"provider": "ec2"}, 1},
+		{SanityFailures, map[string]string{"provider": "ec2", "tag_name": "env", "tag_value": "qa", "reason": "no_mapping"}, 2},
+	}
+	for _, d := range testData {
+		if v := c.Get(d.name, d.labels); v != d.expected {
+			t.Errorf("Expecting %s%v to be %f, got: %f\n", d.name, d.labels, d.expected, v)
+		}
+	}
+
+	// the batched writes are counted once their batch is sent
+	logger, _ := logrus_test.NewNullLogger()
+	mapper.SetLogger(logrus.NewEntry(logger))
+	b := mapper.NewBatcher(10, func([]*string, []*mapper.TagItem) map[string]error {
+		return map[string]error{"i-5": errors.New("Badaboom")}
+	})
+	for _, id := range []string{"i-4", "i-5"} {
+		m.Retag(context.Background(), &id, &map[string]string{}, []string{}, b.PutTagFn)
+	}
+	labels := map[string]string{"provider": "ec2"}
+	if retagged, failed := c.Get(ResourcesRetagged, labels), c.Get(ResourcesFailed, labels); retagged != 2 || failed != 1 {
+		t.Errorf("Expecting the queued writes not to be counted, got %f retagged and %f failed\n", retagged, failed)
+	}
+	b.Flush()
+	if retagged, failed := c.Get(ResourcesRetagged, labels), c.Get(ResourcesFailed, labels); retagged != 3 || failed != 2 {
+		t.Errorf("Expecting the sent writes to be counted, got %f retagged and %f failed\n", retagged, failed)
+	}
+
+	c.RecordSanityFailure("unknown", "Name", "foo", mapper.NewErrSanityConfig("No sanity configuration found", "Name"))
+	if v := c.Get(SanityFailures, map[string]string{"provider": "", "tag_name": "Name", "tag_value": "", "reason": "no_config"}); v != 1 {
+		t.Errorf("Expecting the value to be dropped for the tags without configuration, got: %f\n", v)
+	}
+}
+
+func TestCollectorObserveRun(t *testing.T) {
+	c := NewCollector("123456789012", "us-east-1")
+	for _, interrupted := range []bool{true, false} {
+		c.ObserveRun(time.Now().Add(-time.Minute), interrupted)
+		if v := c.Get(RunDuration, nil); v < 60 {
+			t.Errorf("Expecting a run of at least 60s, got: %f\n", v)
+		}
+		if v := c.Get(RunInterrupted, nil); (v == 1) != interrupted {
+			t.Errorf("Expecting %s to be set for an interrupted run: %t, got: %f\n", RunInterrupted, interrupted, v)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Kinds of metrics supported by the Registry
+const (
+	Counter = "counter"
+	Gauge   = "gauge"
+)
+
+// labelEscaper escapes the label values as expected by the text format
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// family holds all the series of a metric
+type family struct {
+	name, help, kind string
+	// series holds the values indexed by their formatted labels
+	series map[string]float64
+}
+
+// Registry holds a set of metrics and exposes them in the Prometheus text
+// format
+type Registry struct {
+	mu       sync.Mutex
+	families map[string]*family
+	// constLabels are added to all the series of the registry
+	constLabels map[string]string
+}
+
+// NewRegistry creates an empty registry adding the given labels to all its
+// series
+func NewRegistry(constLabels map[string]string) *Registry {
+	return &Registry{families: make(map[string]*family), constLabels: constLabels}
+}
+
+// Register declares a new metric of the given kind
+func (r *Registry) Register(name, help, kind string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.families[name] = &family{name: name, help: help, kind: kind, series: make(map[string]float64)}
+}
+
+// Add adds delta to the series of the metric corresponding to the given labels
+func (r *Registry) Add(name string, labels map[string]string, delta float64) {
+	r.update(name, labels, func(v float64) float64 { return v + delta })
+}
+
+// Set sets the series of the metric corresponding to the given labels to value
+func (r *Registry) Set(name string, labels map[string]string, value float64) {
+	r.update(name, labels, func(float64) float64 { return value })
+}
+
+// Get returns the value of the series of the metric corresponding to the
+// given labels
+func (r *Registry) Get(name string, labels map[string]string) float64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if f, ok := r.families[name]; ok {
+		return f.series[r.formatLabels(labels)]
+	}
+	return 0
+}
+
+func (r *Registry) update(name string, labels map[string]string, fn func(float64) float64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	f, ok := r.families[name]
+	if !ok {
+		panic(fmt.Sprintf("metric %s is not registered", name))
+	}
+	key := r.formatLabels(labels)
+	f.series[key] = fn(f.series[key])
+}
+
+// formatLabels returns the labels, including the constant ones, formatted and
+// sorted the Prometheus way: {name="value",...}
+func (r *Registry) formatLabels(labels map[string]string) string {
+	all := make(map[string]string)
+	for k, v := range r.constLabels {
+		all[k] = v
+	}
+	for k, v := range labels {
+		all[k] = v
+	}
+	if len(all) == 0 {
+		return ""
+	}
+	names := []string{}
+	for k := range all {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	items := []string{}
+	for _, k := range names {
+		items = append(items, k+`="`+labelEscaper.Replace(all[k])+`"`)
+	}
+	return "{" + strings.Join(items, ",") + "}"
+}
+
+// Write outputs all the metrics in the Prometheus text format
+func (r *Registry) Write(w io.Writer) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	names := []string{}
+	for name := range r.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, name := range names {
+		f := r.families[name]
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.kind)
+		keys := []string{}
+		for k := range f.series {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			fmt.Fprintf(&b, "%s%s %s\n", f.name, k, strconv.FormatFloat(f.series[k], 'g', -1, 64))
+		}
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// WriteTextfile writes the metrics into the given file for the Prometheus
+// node_exporter textfile collector. The file is replaced atomically so the
+// collector never reads a partial file.
+func (r *Registry) WriteTextfile(path string) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err = r.Write(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if err = os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// ServeHTTP exposes the metrics over http
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	if err := r.Write(w); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
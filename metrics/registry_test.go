@@ -0,0 +1,71 @@
+package metrics
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRegistryWrite(t *testing.T) {
+	r := NewRegistry(map[string]string{"region": "us-east-1"})
+	r.Register("foo_total", "Foo help.", Counter)
+	r.Register("bar", "Bar help.", Gauge)
+	r.Add("foo_total", map[string]string{"provider": "ec2"}, 1)
+	r.Add("foo_total", map[string]string{"provider": "ec2"}, 2)
+	r.Add("foo_total", map[string]string{"provider": "s3", "tag_value": "a \"quoted\"\nvalue"}, 1)
+	r.Set("bar", nil, 1.5)
+	r.Set("bar", nil, 2.5)
+
+	expected := `# HELP bar Bar help.
+# TYPE bar gauge
+bar{region="us-east-1"} 2.5
+# HELP foo_total Foo help.
+# TYPE foo_total counter
+foo_total{provider="ec2",region="us-east-1"} 3
+foo_total{provider="s3",region="us-east-1",tag_value="a \"quoted\"\nvalue"} 1
+`
+	var buf bytes.Buffer
+	if err := r.Write(&buf); err != nil {
+		t.Fatalf("Write returned: %s\n", err)
+	}
+	if buf.String() != expected {
+		t.Errorf("Expecting:\n%s\nGot:\n%s\n", expected, buf.String())
+	}
+	if v := r.Get("foo_total", map[string]string{"provider": "ec2"}); v != 3 {
+		t.Errorf("Expecting 3, got: %f\n", v)
+	}
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if rec.Body.String() != expected {
+		t.Errorf("Expecting to serve:\n%s\nGot:\n%s\n", expected, rec.Body.String())
+	}
+
+	dir, err := ioutil.TempDir("", "metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "awsretagger.prom")
+	if err = r.WriteTextfile(path); err != nil {
+		t.Fatalf("WriteTextfile returned: %s\n", err)
+	}
+	if content, _ := ioutil.ReadFile(path); string(content) != expected {
+		t.Errorf("Expecting the textfile to contain:\n%s\nGot:\n%s\n", expected, content)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Errorf("Expecting only the textfile in the directory, got: %d files\n", len(files))
+	}
+}
+
+func TestRegistryUnregistered(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Errorf("Expecting a panic when updating an unregistered metric\n")
+		}
+	}()
+	NewRegistry(nil).Add("unknown", nil, 1)
+}
@@ -1,7 +1,9 @@
 package providers
 
 import (
+	"context"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/cloudfront"
 	"github.com/aws/aws-sdk-go/service/cloudfront/cloudfrontiface"
@@ -13,12 +15,18 @@ import (
 // CloudFrontProcessor holds the cloudfront-related actions
 type CloudFrontProcessor struct {
 	svc cloudfrontiface.CloudFrontAPI
+	// Pagination, when set, is where RetagDistributions resumes the listing
+	// from and is kept up to date with the page in progress
+	Pagination *Pagination
 }
 
 // NewCloudFrontProcessor creates a new instance of CloudFrontProcessor containing an already
-// initialized cloudfront client
+// initialized cloudfront client, using the global endpoint of the partition of
+// the session. CloudFront must be available in the partition, see
+// Partition.HasGlobalService.
 func NewCloudFrontProcessor(sess *session.Session) *CloudFrontProcessor {
-	return &CloudFrontProcessor{svc: cloudfront.New(sess)}
+	cfg := PartitionOf(aws.StringValue(sess.Config.Region)).GlobalConfig(endpoints.CloudfrontServiceID)
+	return &CloudFrontProcessor{svc: cloudfront.New(sess, cfg)}
 }
 
 // TagsToMap transform the cloudfront tags structure into a map[string]string for
@@ -47,12 +55,12 @@ func (p *CloudFrontProcessor) SetTags(resourceID *string, tags []*mapper.TagItem
 }
 
 // GetTags gets the tags allocated to an cloudfront resource
-func (p *CloudFrontProcessor) GetTags(resourceID *string) ([]*cloudfront.Tag, error) {
+func (p *CloudFrontProcessor) GetTags(ctx context.Context, resourceID *string) ([]*cloudfront.Tag, error) {
 	input := &cloudfront.ListTagsForResourceInput{
 		Resource: resourceID,
 	}
 
-	result, err := p.svc.ListTagsForResource(input)
+	result, err := p.svc.ListTagsForResourceWithContext(ctx, input)
 	var tagsResult []*cloudfront.Tag
 	if result.Tags != nil {
 		tagsResult = (*result.Tags).Items
@@ -60,44 +68,76 @@ func (p *CloudFrontProcessor) GetTags(resourceID *string) ([]*cloudfront.Tag, er
 	return tagsResult, err
 }
 
-// RetagDistributions parses all distributions and retags them
-func (p *CloudFrontProcessor) RetagDistributions(m *mapper.Mapper) {
-	err := p.svc.ListDistributionsPages(&cloudfront.ListDistributionsInput{},
-		func(page *cloudfront.ListDistributionsOutput, lastPage bool) bool {
-			if page.DistributionList != nil {
-				for _, dist := range (*page.DistributionList).Items {
-					t, err := p.GetTags(dist.ARN)
-					if err != nil {
-						log.WithFields(logrus.Fields{"error": err, "resource": *dist.ARN}).Fatal("Failed to get CloudFront distribution tags")
-					}
-
-					tags := p.TagsToMap(t)
-					keys := []string{}
-					if dist.Id != nil {
-						keys = append(keys, *dist.Id)
-					}
-					if dist.DomainName != nil {
-						keys = append(keys, *dist.DomainName)
-					}
-					if dist.Origins != nil {
-						for _, orig := range (*dist.Origins).Items {
-							keys = append(keys, *orig.DomainName)
-						}
-					}
-					if dist.Aliases != nil {
-						for _, alias := range (*dist.Aliases).Items {
-							keys = append(keys, *alias)
+// RetagDistributions parses all distributions and retags them, until the
+// context is cancelled
+func (p *CloudFrontProcessor) RetagDistributions(ctx context.Context, m mapper.Iface) {
+	err := p.Pagination.paginate(ctx, func(start *string, visit func(next *string)) error {
+		return p.svc.ListDistributionsPagesWithContext(ctx, &cloudfront.ListDistributionsInput{Marker: start},
+			func(page *cloudfront.ListDistributionsOutput, lastPage bool) bool {
+				if page.DistributionList != nil {
+					visit(page.DistributionList.NextMarker)
+					for _, dist := range (*page.DistributionList).Items {
+						if err := p.retagDistribution(ctx, m, dist.ARN, dist.Id, dist.DomainName, dist.Origins, dist.Aliases, dist.Comment); interrupted(ctx, err) {
+							return false
+						} else if err != nil {
+							log.WithFields(logrus.Fields{"error": err, "resource": *dist.ARN}).Fatal("Failed to get CloudFront distribution tags")
 						}
 					}
-					if dist.Comment != nil {
-						keys = append(keys, *dist.Comment)
-					}
-					m.Retag(dist.ARN, &tags, keys, p.SetTags)
 				}
-			}
-			return !lastPage
-		})
+				return !lastPage && ctx.Err() == nil
+			})
+	})
+	if interrupted(ctx, err) {
+		return
+	}
 	if err != nil {
 		log.WithFields(logrus.Fields{"error": err}).Fatal("ListDistributionsPages failed")
 	}
 }
+
+// RetagDistribution retags the distribution of the given ID
+func (p *CloudFrontProcessor) RetagDistribution(ctx context.Context, m mapper.Iface, distributionID *string) error {
+	result, err := p.svc.GetDistributionWithContext(ctx, &cloudfront.GetDistributionInput{Id: distributionID})
+	if err != nil {
+		return err
+	}
+	dist := result.Distribution
+	var cfg cloudfront.DistributionConfig
+	if dist.DistributionConfig != nil {
+		cfg = *dist.DistributionConfig
+	}
+	return p.retagDistribution(ctx, m, dist.ARN, dist.Id, dist.DomainName, cfg.Origins, cfg.Aliases, cfg.Comment)
+}
+
+// retagDistribution retags a distribution from its attributes, as the list
+// and the get calls return them in different structures
+func (p *CloudFrontProcessor) retagDistribution(ctx context.Context, m mapper.Iface, distArn, id, domainName *string, origins *cloudfront.Origins, aliases *cloudfront.Aliases, comment *string) error {
+	t, err := p.GetTags(ctx, distArn)
+	if err != nil {
+		return err
+	}
+
+	tags := p.TagsToMap(t)
+	keys := []string{}
+	if id != nil {
+		keys = append(keys, *id)
+	}
+	if domainName != nil {
+		keys = append(keys, *domainName)
+	}
+	if origins != nil {
+		for _, orig := range (*origins).Items {
+			keys = append(keys, *orig.DomainName)
+		}
+	}
+	if aliases != nil {
+		for _, alias := range (*aliases).Items {
+			keys = append(keys, *alias)
+		}
+	}
+	if comment != nil {
+		keys = append(keys, *comment)
+	}
+	m.Retag(ctx, distArn, &tags, keys, mapper.Constrain(&mapper.DefaultConstraints, tags, mapper.Direct(p.SetTags)))
+	return nil
+}
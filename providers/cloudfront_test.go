@@ -1,11 +1,13 @@
 package providers
 
 import (
+	"context"
 	"errors"
 	"reflect"
 	"testing"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/cloudfront"
 	"github.com/aws/aws-sdk-go/service/cloudfront/cloudfrontiface"
 
@@ -31,7 +33,7 @@ func (m *mockCloudFrontClient) TagResource(input *cloudfront.TagResourceInput) (
 	return &cloudfront.TagResourceOutput{}, m.ReturnError
 }
 
-func (m *mockCloudFrontClient) ListTagsForResource(input *cloudfront.ListTagsForResourceInput) (*cloudfront.ListTagsForResourceOutput, error) {
+func (m *mockCloudFrontClient) ListTagsForResourceWithContext(ctx aws.Context, input *cloudfront.ListTagsForResourceInput, opts ...request.Option) (*cloudfront.ListTagsForResourceOutput, error) {
 	m.ResourceID = input.Resource
 	return &cloudfront.ListTagsForResourceOutput{Tags: m.ResourceTags}, m.ReturnError
 }
@@ -83,7 +85,7 @@ func TestCloudFrontGetTags(t *testing.T) {
 		mockSvc := &mockCloudFrontClient{ReturnError: d.inputError, ResourceTags: d.inputTags}
 		p := CloudFrontProcessor{svc: mockSvc}
 
-		res, err := p.GetTags(&d.inputResource)
+		res, err := p.GetTags(context.Background(), &d.inputResource)
 		if !reflect.DeepEqual(err, d.outputError) {
 			t.Errorf("Expecting error: %v\nGot: %v\n", d.outputError, err)
 		}
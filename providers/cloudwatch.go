@@ -1,6 +1,7 @@
 package providers
 
 import (
+	"context"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
@@ -12,6 +13,9 @@ import (
 // CwProcessor holds the cloudwatch-related actions
 type CwProcessor struct {
 	svc *cloudwatchlogs.CloudWatchLogs
+	// Pagination, when set, is where RetagLogGroups resumes the listing from
+	// and is kept up to date with the page in progress
+	Pagination *Pagination
 }
 
 // NewCwProcessor creates a new instance of CwProcessor containing an already
@@ -46,35 +50,49 @@ func (p *CwProcessor) SetTags(resourceID *string, tags []*mapper.TagItem) error
 }
 
 // GetTags gets the tags allocated to an rds resource
-func (p *CwProcessor) GetTags(resourceID *string) (map[string]*string, error) {
+func (p *CwProcessor) GetTags(ctx context.Context, resourceID *string) (map[string]*string, error) {
 	input := &cloudwatchlogs.ListTagsLogGroupInput{
 		LogGroupName: resourceID,
 	}
 
-	result, err := p.svc.ListTagsLogGroup(input)
+	result, err := p.svc.ListTagsLogGroupWithContext(ctx, input)
 	return result.Tags, err
 }
 
-// RetagLogGroups parses all running and stopped instances and retags them
-func (p *CwProcessor) RetagLogGroups(m *mapper.Mapper) {
-	err := p.svc.DescribeLogGroupsPages(&cloudwatchlogs.DescribeLogGroupsInput{},
-		func(page *cloudwatchlogs.DescribeLogGroupsOutput, lastPage bool) bool {
-			for _, lg := range page.LogGroups {
-				t, err := p.GetTags(lg.LogGroupName)
-				if err != nil {
-					log.WithFields(logrus.Fields{"error": err, "resource": *lg.Arn}).Fatal("Failed to get LogGroup tags")
+// RetagLogGroups parses all the log groups and retags them, until the context
+// is cancelled
+func (p *CwProcessor) RetagLogGroups(ctx context.Context, m mapper.Iface) {
+	err := p.Pagination.paginate(ctx, func(start *string, visit func(next *string)) error {
+		return p.svc.DescribeLogGroupsPagesWithContext(ctx, &cloudwatchlogs.DescribeLogGroupsInput{NextToken: start},
+			func(page *cloudwatchlogs.DescribeLogGroupsOutput, lastPage bool) bool {
+				visit(page.NextToken)
+				for _, lg := range page.LogGroups {
+					if err := p.RetagLogGroup(ctx, m, lg.LogGroupName); interrupted(ctx, err) {
+						return false
+					} else if err != nil {
+						log.WithFields(logrus.Fields{"error": err, "resource": *lg.Arn}).Fatal("Failed to get LogGroup tags")
+					}
 				}
-
-				tags := p.TagsToMap(t)
-				keys := []string{}
-				if lg.LogGroupName != nil {
-					keys = append(keys, *lg.LogGroupName)
-				}
-				m.Retag(lg.LogGroupName, &tags, keys, p.SetTags)
-			}
-			return !lastPage
-		})
+				return !lastPage && ctx.Err() == nil
+			})
+	})
+	if interrupted(ctx, err) {
+		return
+	}
 	if err != nil {
 		log.WithFields(logrus.Fields{"error": err}).Fatal("DescribeLogGroups failed")
 	}
 }
+
+// RetagLogGroup retags the log group of the given name
+func (p *CwProcessor) RetagLogGroup(ctx context.Context, m mapper.Iface, logGroupName *string) error {
+	t, err := p.GetTags(ctx, logGroupName)
+	if err != nil {
+		return err
+	}
+
+	tags := p.TagsToMap(t)
+	keys := []string{*logGroupName}
+	m.Retag(ctx, logGroupName, &tags, keys, mapper.Constrain(&mapper.DefaultConstraints, tags, mapper.Direct(p.SetTags)))
+	return nil
+}
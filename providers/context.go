@@ -0,0 +1,19 @@
+package providers
+
+import (
+	"context"
+
+	"github.com/sirupsen/logrus"
+)
+
+// interrupted checks if the context is cancelled, in which case the listing of
+// the resources ends quietly, the error of the call cut short included
+func interrupted(ctx context.Context, err error) bool {
+	if ctx.Err() == nil {
+		return false
+	}
+	if err != nil {
+		log.WithFields(logrus.Fields{"error": err}).Debug("Listing of the resources interrupted")
+	}
+	return true
+}
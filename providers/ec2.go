@@ -1,6 +1,9 @@
 package providers
 
 import (
+	"context"
+	"time"
+
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ec2"
@@ -10,9 +13,48 @@ import (
 	"github.com/VEVO/awsRetagger/mapper"
 )
 
+// ec2Constraints are the restrictions of EC2 on the tags of the instances. EC2
+// accepts any character in the tags.
+var ec2Constraints = mapper.Constraints{MaxTags: 50, MaxKeyLength: 128, MaxValueLength: 256}
+
+// ec2BatchSize is the maximum number of resources of a CreateTags call
+const ec2BatchSize = 1000
+
+// DefaultEc2States are the states of the instances retagged by default
+var DefaultEc2States = []string{"running", "stopped"}
+
+// ec2PendingState is the state of the instances being launched
+const ec2PendingState = "pending"
+
+// ec2PollInterval is the time between two visits of the pending instances
+const ec2PollInterval = 15 * time.Second
+
+// ec2FleetTag is the tag set by EC2 on the instances of a Spot Fleet
+const ec2FleetTag = "aws:ec2spot:fleet-request-id"
+
 // Ec2Processor holds the ec2-related actions
 type Ec2Processor struct {
 	svc ec2iface.EC2API
+	// Filters are added to the filters of the DescribeInstances calls
+	Filters []*ec2.Filter
+	// Batch, when set, groups the writes of the tags of the resources listed,
+	// which are sent once it is flushed
+	Batch *mapper.Batcher
+	// States are the states of the instances retagged by RetagInstances,
+	// DefaultEc2States when empty
+	States []string
+	// WaitPending, when not zero, is how long RetagInstances waits for the
+	// instances pending at scan time to reach one of the States
+	WaitPending time.Duration
+	// SpotRequests enables the tagging of the spot instance requests and Spot
+	// Fleet requests of the instances with the tags of their instance
+	SpotRequests bool
+	// Pagination, when set, is where RetagInstances resumes the listing from
+	// and is kept up to date with the page in progress
+	Pagination *Pagination
+	// pollInterval is the time between two visits of the pending instances,
+	// ec2PollInterval when zero
+	pollInterval time.Duration
 }
 
 // NewEc2Processor creates a new instance of Ec2Processor containing an already
@@ -47,27 +89,225 @@ func (e *Ec2Processor) SetTags(resourceID *string, tags []*mapper.TagItem) error
 	return err
 }
 
-// RetagInstances parses all running and stopped instances and retags them
-func (e *Ec2Processor) RetagInstances(m *mapper.Mapper) {
-	filters := []*ec2.Filter{
-		{
-			Name:   aws.String("instance-state-name"),
-			Values: []*string{aws.String("running"), aws.String("stopped")},
-		},
+// SetTagsBatch sets the same tags on several ec2 resources with a single call.
+// As CreateTags fails as a whole, the resources are retried one by one when
+// it fails to find the ones responsible.
+func (e *Ec2Processor) SetTagsBatch(resourceIDs []*string, tags []*mapper.TagItem) map[string]error {
+	newTags := []*ec2.Tag{}
+	for _, tag := range tags {
+		if len((*tag).Name) > 0 {
+			newTags = append(newTags, &ec2.Tag{Key: aws.String((*tag).Name), Value: aws.String((*tag).Value)})
+		}
+	}
+	if len(newTags) == 0 || len(resourceIDs) == 0 {
+		return nil
+	}
+	_, err := e.svc.CreateTags(&ec2.CreateTagsInput{Resources: resourceIDs, Tags: newTags})
+	if err == nil {
+		return nil
+	}
+	errs := make(map[string]error)
+	if len(resourceIDs) == 1 {
+		errs[*resourceIDs[0]] = err
+		return errs
+	}
+	for _, resourceID := range resourceIDs {
+		if _, err = e.svc.CreateTags(&ec2.CreateTagsInput{Resources: []*string{resourceID}, Tags: newTags}); err != nil {
+			errs[*resourceID] = err
+		}
+	}
+	return errs
+}
+
+// NewBatcher creates a Batcher sending the tags of up to 1000 resources per
+// CreateTags call
+func (e *Ec2Processor) NewBatcher() *mapper.Batcher {
+	return mapper.NewBatcher(ec2BatchSize, e.SetTagsBatch)
+}
+
+// putTags returns the function writing the tags, through Batch when set
+func (e *Ec2Processor) putTags() mapper.PutTagFn {
+	if e.Batch != nil {
+		return e.Batch.PutTagFn
+	}
+	return mapper.Direct(e.SetTags)
+}
+
+// RetagInstances parses all the instances in the configured states and
+// retags them. With WaitPending, the pending instances are visited again until
+// they leave the pending state. Once the context is cancelled, no more instance
+// is listed.
+func (e *Ec2Processor) RetagInstances(ctx context.Context, m mapper.Iface) {
+	states := e.states()
+	wanted := make(map[string]bool, len(states))
+	values := []*string{}
+	for _, state := range states {
+		wanted[state] = true
+		values = append(values, aws.String(state))
+	}
+	waitPending := e.WaitPending > 0 && !wanted[ec2PendingState]
+	if waitPending {
+		values = append(values, aws.String(ec2PendingState))
+	}
+	filters := []*ec2.Filter{{Name: aws.String("instance-state-name"), Values: values}}
+	filters = append(filters, e.Filters...)
+
+	pending := []*string{}
+	err := e.Pagination.paginate(ctx, func(start *string, visit func(next *string)) error {
+		return e.svc.DescribeInstancesPagesWithContext(ctx, &ec2.DescribeInstancesInput{Filters: filters, NextToken: start},
+			func(page *ec2.DescribeInstancesOutput, lastPage bool) bool {
+				visit(page.NextToken)
+				for _, reservation := range page.Reservations {
+					for _, instance := range reservation.Instances {
+						if waitPending && instanceState(instance) == ec2PendingState {
+							pending = append(pending, instance.InstanceId)
+							continue
+						}
+						e.retagInstance(ctx, m, instance)
+					}
+				}
+				return ctx.Err() == nil
+			})
+	})
+	if interrupted(ctx, err) {
+		return
 	}
-	result, err := e.svc.DescribeInstances(&ec2.DescribeInstancesInput{Filters: filters})
 	if err != nil {
 		log.WithFields(logrus.Fields{"error": err}).Fatal("DescribeInstances failed")
 	}
+	if len(pending) > 0 {
+		e.retagPending(ctx, m, pending, wanted)
+	}
+}
 
+// retagPending visits the pending instances until they leave the pending
+// state or WaitPending expires, retagging those reaching one of the wanted
+// states. The wait ends early when the context is cancelled.
+func (e *Ec2Processor) retagPending(ctx context.Context, m mapper.Iface, pending []*string, wanted map[string]bool) {
+	interval := e.pollInterval
+	if interval == 0 {
+		interval = ec2PollInterval
+	}
+	deadline := time.Now().Add(e.WaitPending)
+	log.WithFields(logrus.Fields{"instances": len(pending), "wait": e.WaitPending}).Info("Waiting for the pending instances")
+	for len(pending) > 0 && time.Now().Before(deadline) {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+		result, err := e.svc.DescribeInstancesWithContext(ctx, &ec2.DescribeInstancesInput{InstanceIds: pending})
+		if interrupted(ctx, err) {
+			return
+		}
+		if err != nil {
+			log.WithFields(logrus.Fields{"error": err}).Error("DescribeInstances of the pending instances failed")
+			return
+		}
+		pending = []*string{}
+		for _, reservation := range result.Reservations {
+			for _, instance := range reservation.Instances {
+				switch state := instanceState(instance); {
+				case state == ec2PendingState:
+					pending = append(pending, instance.InstanceId)
+				case wanted[state]:
+					e.retagInstance(ctx, m, instance)
+				}
+			}
+		}
+	}
+	for _, id := range pending {
+		log.WithFields(logrus.Fields{"resource": *id}).Warn("Instance still pending, skipping it until the next run")
+	}
+}
+
+// states returns the states of the instances to retag
+func (e *Ec2Processor) states() []string {
+	if len(e.States) == 0 {
+		return DefaultEc2States
+	}
+	return e.States
+}
+
+// instanceState returns the name of the state of the instance
+func instanceState(instance *ec2.Instance) string {
+	if instance.State == nil {
+		return ""
+	}
+	return aws.StringValue(instance.State.Name)
+}
+
+// RetagInstance retags the instance of the given ID, whatever its state
+func (e *Ec2Processor) RetagInstance(ctx context.Context, m mapper.Iface, instanceID *string) error {
+	input := &ec2.DescribeInstancesInput{InstanceIds: []*string{instanceID}}
+	if len(e.Filters) > 0 {
+		input.Filters = e.Filters
+	}
+	result, err := e.svc.DescribeInstancesWithContext(ctx, input)
+	if err != nil {
+		return err
+	}
 	for _, reservation := range result.Reservations {
 		for _, instance := range reservation.Instances {
-			tags := e.TagsToMap(instance.Tags)
-			keys := []string{}
-			if instance.KeyName != nil {
-				keys = append(keys, *instance.KeyName)
+			e.retagInstance(ctx, m, instance)
+		}
+	}
+	return nil
+}
+
+func (e *Ec2Processor) retagInstance(ctx context.Context, m mapper.Iface, instance *ec2.Instance) {
+	tags := e.TagsToMap(instance.Tags)
+	keys := []string{}
+	if instance.KeyName != nil {
+		keys = append(keys, *instance.KeyName)
+	}
+	setTags := e.putTags()
+	requests := []*string{}
+	if e.SpotRequests {
+		requests = spotRequestIDs(instance)
+	}
+	if len(requests) == 0 {
+		m.Retag(ctx, instance.InstanceId, &tags, keys, mapper.Constrain(&ec2Constraints, tags, setTags))
+		return
+	}
+
+	// The requests get the tags written on the instance, once they are
+	instanceID := *instance.InstanceId
+	m.Retag(ctx, instance.InstanceId, &tags, keys, mapper.Constrain(&ec2Constraints, tags, func(resourceID *string, items []*mapper.TagItem, done mapper.WrittenFn) error {
+		return setTags(resourceID, items, func(items []*mapper.TagItem, err error) {
+			if err == nil {
+				e.tagRequests(instanceID, requests, items)
 			}
-			m.Retag(instance.InstanceId, &tags, keys, e.SetTags)
+			done.Report(items, err)
+		})
+	}))
+}
+
+// spotRequestIDs returns the spot instance request and the Spot Fleet request
+// the instance was launched by, if any
+func spotRequestIDs(instance *ec2.Instance) []*string {
+	ids := []*string{}
+	if instance.SpotInstanceRequestId != nil {
+		ids = append(ids, instance.SpotInstanceRequestId)
+	}
+	for _, tag := range instance.Tags {
+		if aws.StringValue(tag.Key) == ec2FleetTag && aws.StringValue(tag.Value) != "" {
+			ids = append(ids, tag.Value)
+		}
+	}
+	return ids
+}
+
+// tagRequests sets the tags written on the instance on its spot requests. The
+// protected keys were already left out by the mapper. The requests are not
+// batched and their failures are only logged.
+func (e *Ec2Processor) tagRequests(instanceID string, requests []*string, written []*mapper.TagItem) {
+	if len(written) == 0 {
+		return
+	}
+	for _, id := range requests {
+		if err := e.SetTags(id, written); err != nil {
+			log.WithFields(logrus.Fields{"error": err, "resource": *id, "instance": instanceID}).Warn("Failed to set tag on spot request")
 		}
 	}
 }
@@ -1,13 +1,18 @@
 package providers
 
 import (
+	"context"
 	"errors"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"github.com/sirupsen/logrus"
+	logrus_test "github.com/sirupsen/logrus/hooks/test"
 
 	"github.com/VEVO/awsRetagger/mapper"
 )
@@ -22,9 +27,55 @@ type mockEc2Client struct {
 	ResourceTags []*ec2.Tag
 	// ReturnError is the error that you want your mocked function to return
 	ReturnError error
+	// DescribeInput is the input of the last DescribeInstances call
+	DescribeInput *ec2.DescribeInstancesInput
+	// Reservations are returned by DescribeInstances
+	Reservations []*ec2.Reservation
+	// Pages is the number of pages returned by DescribeInstancesPages
+	Pages int
+	// FailingIDs make the CreateTags calls including them fail
+	FailingIDs map[string]bool
+	// CreateTagsCalls is the number of CreateTags calls
+	CreateTagsCalls int
+	// Polls, when set, are returned by the successive DescribeInstances calls
+	// instead of Reservations, the last one being repeated
+	Polls [][]*ec2.Reservation
+}
+
+func (m *mockEc2Client) DescribeInstancesWithContext(ctx aws.Context, input *ec2.DescribeInstancesInput, opts ...request.Option) (*ec2.DescribeInstancesOutput, error) {
+	m.DescribeInput = input
+	if len(m.Polls) > 0 {
+		reservations := m.Polls[0]
+		if len(m.Polls) > 1 {
+			m.Polls = m.Polls[1:]
+		}
+		return &ec2.DescribeInstancesOutput{Reservations: reservations}, m.ReturnError
+	}
+	return &ec2.DescribeInstancesOutput{Reservations: m.Reservations}, m.ReturnError
+}
+
+// DescribeInstancesPages returns each reservation in its own page
+func (m *mockEc2Client) DescribeInstancesPagesWithContext(ctx aws.Context, input *ec2.DescribeInstancesInput, fn func(*ec2.DescribeInstancesOutput, bool) bool, opts ...request.Option) error {
+	m.DescribeInput = input
+	if m.ReturnError != nil {
+		return m.ReturnError
+	}
+	for i, reservation := range m.Reservations {
+		m.Pages++
+		if !fn(&ec2.DescribeInstancesOutput{Reservations: []*ec2.Reservation{reservation}}, i == len(m.Reservations)-1) {
+			break
+		}
+	}
+	return nil
 }
 
 func (m *mockEc2Client) CreateTags(input *ec2.CreateTagsInput) (*ec2.CreateTagsOutput, error) {
+	m.CreateTagsCalls++
+	for _, id := range input.Resources {
+		if m.FailingIDs[*id] {
+			return &ec2.CreateTagsOutput{}, errors.New("InvalidInstanceID.NotFound")
+		}
+	}
 	m.ResourceIDs = append(m.ResourceIDs, input.Resources...)
 	if len(input.Tags) > 0 {
 		m.ResourceTags = append(m.ResourceTags, input.Tags...)
@@ -83,3 +134,196 @@ func TestEc2SetTags(t *testing.T) {
 		}
 	}
 }
+
+func TestEc2RetagInstances(t *testing.T) {
+	mockSvc := &mockEc2Client{Reservations: []*ec2.Reservation{
+		{Instances: []*ec2.Instance{
+			{InstanceId: aws.String("i-1"), KeyName: aws.String("deploy"), Tags: []*ec2.Tag{{Key: aws.String("team"), Value: aws.String("data")}}},
+			{InstanceId: aws.String("i-2")},
+		}},
+		{Instances: []*ec2.Instance{{InstanceId: aws.String("i-3")}}},
+	}}
+	vpcFilter := &ec2.Filter{Name: aws.String("vpc-id"), Values: []*string{aws.String("vpc-1")}}
+	p := Ec2Processor{svc: mockSvc, Filters: []*ec2.Filter{vpcFilter}}
+	m := &mapper.MockMapper{}
+
+	p.RetagInstances(context.Background(), m)
+	expectedFilters := []*ec2.Filter{
+		{Name: aws.String("instance-state-name"), Values: []*string{aws.String("running"), aws.String("stopped")}},
+		vpcFilter,
+	}
+	if !reflect.DeepEqual(mockSvc.DescribeInput.Filters, expectedFilters) {
+		t.Errorf("Expecting filters: %v\nGot: %v\n", expectedFilters, mockSvc.DescribeInput.Filters)
+	}
+	expectedTags := map[string]map[string]string{"i-1": {"team": "data"}, "i-2": {}, "i-3": {}}
+	if !reflect.DeepEqual(m.ResourceTags, expectedTags) || mockSvc.Pages != 2 {
+		t.Errorf("Expecting tags: %v from 2 pages\nGot: %v from %d pages\n", expectedTags, m.ResourceTags, mockSvc.Pages)
+	}
+	if !reflect.DeepEqual(m.ResourceKeys["i-1"], []string{"deploy"}) {
+		t.Errorf("Expecting keys of i-1 to be [deploy], got: %v\n", m.ResourceKeys["i-1"])
+	}
+
+	if err := p.RetagInstance(context.Background(), m, aws.String("i-1")); err != nil {
+		t.Errorf("Unexpected error: %v\n", err)
+	}
+	if !reflect.DeepEqual(mockSvc.DescribeInput.InstanceIds, []*string{aws.String("i-1")}) || !reflect.DeepEqual(mockSvc.DescribeInput.Filters, []*ec2.Filter{vpcFilter}) {
+		t.Errorf("Unexpected input: %v\n", mockSvc.DescribeInput)
+	}
+}
+
+// setTagMapper sets the same tags on all the resources
+type setTagMapper struct {
+	mapper.Iface
+	tags []*mapper.TagItem
+}
+
+func (m *setTagMapper) Retag(ctx context.Context, resourceID *string, tags *map[string]string, keys []string, setTags mapper.PutTagFn) {
+	setTags(resourceID, m.tags, nil)
+}
+
+// ec2Instance returns an instance in the given state
+func ec2Instance(id, state string) *ec2.Instance {
+	return &ec2.Instance{InstanceId: aws.String(id), State: &ec2.InstanceState{Name: aws.String(state)}}
+}
+
+func TestEc2RetagInstancesWaitPending(t *testing.T) {
+	mockSvc := &mockEc2Client{
+		Reservations: []*ec2.Reservation{{Instances: []*ec2.Instance{ec2Instance("i-1", "running"), ec2Instance("i-2", "pending"), ec2Instance("i-3", "pending"), ec2Instance("i-4", "pending")}}},
+		Polls: [][]*ec2.Reservation{
+			{{Instances: []*ec2.Instance{ec2Instance("i-2", "running"), ec2Instance("i-3", "pending"), ec2Instance("i-4", "pending")}}},
+			{{Instances: []*ec2.Instance{ec2Instance("i-3", "pending"), ec2Instance("i-4", "terminated")}}},
+		},
+	}
+	p := Ec2Processor{svc: mockSvc, States: []string{"running"}, WaitPending: 50 * time.Millisecond, pollInterval: 5 * time.Millisecond}
+	m := &mapper.MockMapper{}
+	logger, hook := logrus_test.NewNullLogger()
+	log = logrus.NewEntry(logger)
+
+	p.RetagInstances(context.Background(), m)
+	if !reflect.DeepEqual(mockSvc.DescribeInput.InstanceIds, []*string{aws.String("i-3")}) {
+		t.Errorf("Expecting the last visit to be on i-3, got: %v\n", aws.StringValueSlice(mockSvc.DescribeInput.InstanceIds))
+	}
+	if _, ok := m.ResourceTags["i-2"]; !ok || len(m.ResourceTags) != 2 {
+		t.Errorf("Expecting i-1 and i-2 to be retagged, got: %v\n", m.ResourceTags)
+	}
+	if entry := hook.LastEntry(); entry == nil || entry.Data["resource"] != "i-3" {
+		t.Errorf("Expecting i-3 to be logged as still pending, got: %v\n", entry)
+	}
+
+	// without waiting, the pending instances are not listed
+	mockSvc = &mockEc2Client{Reservations: mockSvc.Reservations}
+	p = Ec2Processor{svc: mockSvc, States: []string{"running"}}
+	p.RetagInstances(context.Background(), &mapper.MockMapper{})
+	expectedStates := []*string{aws.String("running")}
+	if !reflect.DeepEqual(mockSvc.DescribeInput.Filters[0].Values, expectedStates) {
+		t.Errorf("Expecting states: %v\nGot: %v\n", aws.StringValueSlice(expectedStates), aws.StringValueSlice(mockSvc.DescribeInput.Filters[0].Values))
+	}
+}
+
+func TestEc2RetagInstancesSpotRequests(t *testing.T) {
+	instance := &ec2.Instance{
+		InstanceId:            aws.String("i-1"),
+		SpotInstanceRequestId: aws.String("sir-1"),
+		Tags:                  []*ec2.Tag{{Key: aws.String("aws:ec2spot:fleet-request-id"), Value: aws.String("sfr-1")}, {Key: aws.String("team"), Value: aws.String("data")}},
+	}
+	logger, _ := logrus_test.NewNullLogger()
+	mapper.SetLogger(logrus.NewEntry(logger))
+	testData := []struct {
+		spotRequests bool
+		m            mapper.Iface
+		failingIDs   map[string]bool
+		expectedIDs  []string
+		expectedTags int
+	}{
+		{false, &setTagMapper{tags: []*mapper.TagItem{{Name: "owner", Value: "me"}}}, nil, []string{"i-1"}, 1},
+		{true, &setTagMapper{tags: []*mapper.TagItem{{Name: "owner", Value: "me"}}}, nil, []string{"i-1", "sir-1", "sfr-1"}, 3},
+		// nothing is written on the requests of the instances needing no change
+		{true, &mapper.MockMapper{}, nil, []string{}, 0},
+		// the requests are not tagged when the instance could not be
+		{true, &setTagMapper{tags: []*mapper.TagItem{{Name: "owner", Value: "me"}}}, map[string]bool{"i-1": true}, []string{}, 0},
+		// the protected keys of the mapper are written nowhere
+		{true, &mapper.Mapper{DefaultTagValues: map[string]string{"env": "prd", "owner": "me"}, ProtectedKeys: []string{"owner"}}, nil, []string{"i-1", "sir-1", "sfr-1"}, 3},
+	}
+	for _, d := range testData {
+		mockSvc := &mockEc2Client{Reservations: []*ec2.Reservation{{Instances: []*ec2.Instance{instance}}}, FailingIDs: d.failingIDs}
+		p := Ec2Processor{svc: mockSvc, SpotRequests: d.spotRequests}
+		p.RetagInstances(context.Background(), d.m)
+		if !reflect.DeepEqual(aws.StringValueSlice(mockSvc.ResourceIDs), d.expectedIDs) || len(mockSvc.ResourceTags) != d.expectedTags {
+			t.Errorf("Expecting %v to be tagged with %d tags in total, got: %v with %v\n", d.expectedIDs, d.expectedTags, aws.StringValueSlice(mockSvc.ResourceIDs), mockSvc.ResourceTags)
+		}
+		for _, tag := range mockSvc.ResourceTags {
+			if *tag.Key == "aws:ec2spot:fleet-request-id" || *tag.Key == "team" {
+				t.Errorf("Only the tags written on the instance must be copied, got: %v\n", mockSvc.ResourceTags)
+			}
+		}
+	}
+
+	// the requests of the batched instances are tagged once the batch is sent
+	mockSvc := &mockEc2Client{Reservations: []*ec2.Reservation{{Instances: []*ec2.Instance{instance}}}}
+	p := Ec2Processor{svc: mockSvc, SpotRequests: true}
+	p.Batch = mapper.NewBatcher(10, p.SetTagsBatch)
+	p.RetagInstances(context.Background(), &setTagMapper{tags: []*mapper.TagItem{{Name: "owner", Value: "me"}}})
+	if len(mockSvc.ResourceIDs) != 0 {
+		t.Errorf("Expecting nothing to be tagged before the batch is sent, got: %v\n", aws.StringValueSlice(mockSvc.ResourceIDs))
+	}
+	p.Batch.Flush()
+	if expected := []string{"i-1", "sir-1", "sfr-1"}; !reflect.DeepEqual(aws.StringValueSlice(mockSvc.ResourceIDs), expected) {
+		t.Errorf("Expecting %v to be tagged once the batch is sent, got: %v\n", expected, aws.StringValueSlice(mockSvc.ResourceIDs))
+	}
+}
+
+// cancelMapper sets the tags of the resources like setTagMapper and cancels
+// the run after the 1st one
+type cancelMapper struct {
+	setTagMapper
+	cancel context.CancelFunc
+}
+
+func (m *cancelMapper) Retag(ctx context.Context, resourceID *string, tags *map[string]string, keys []string, setTags mapper.PutTagFn) {
+	if ctx.Err() != nil {
+		return
+	}
+	m.setTagMapper.Retag(ctx, resourceID, tags, keys, setTags)
+	m.cancel()
+}
+
+func TestEc2RetagInstancesInterrupted(t *testing.T) {
+	mockSvc := &mockEc2Client{Reservations: []*ec2.Reservation{
+		{Instances: []*ec2.Instance{ec2Instance("i-1", "running"), ec2Instance("i-2", "running")}},
+		{Instances: []*ec2.Instance{ec2Instance("i-3", "running")}},
+	}}
+	p := Ec2Processor{svc: mockSvc}
+	ctx, cancel := context.WithCancel(context.Background())
+	p.RetagInstances(ctx, &cancelMapper{setTagMapper: setTagMapper{tags: []*mapper.TagItem{{Name: "owner", Value: "me"}}}, cancel: cancel})
+	if !reflect.DeepEqual(aws.StringValueSlice(mockSvc.ResourceIDs), []string{"i-1"}) || mockSvc.Pages != 1 {
+		t.Errorf("Expecting only i-1 to be tagged from 1 page, got: %v from %d pages\n", aws.StringValueSlice(mockSvc.ResourceIDs), mockSvc.Pages)
+	}
+
+	// the error of the listing cut short is not fatal
+	logger, _ := logrus_test.NewNullLogger()
+	log = logrus.NewEntry(logger)
+	mockSvc = &mockEc2Client{ReturnError: errors.New("RequestCanceled")}
+	p = Ec2Processor{svc: mockSvc}
+	p.RetagInstances(ctx, &mapper.MockMapper{})
+}
+
+func TestEc2SetTagsBatch(t *testing.T) {
+	tags := []*mapper.TagItem{{Name: "foo", Value: "bar"}}
+	mockSvc := &mockEc2Client{}
+	p := Ec2Processor{svc: mockSvc}
+
+	if errs := p.SetTagsBatch(aws.StringSlice([]string{"i-1", "i-2", "i-3"}), tags); len(errs) != 0 || mockSvc.CreateTagsCalls != 1 {
+		t.Errorf("Expecting a single successful call, got %d calls and errors: %v\n", mockSvc.CreateTagsCalls, errs)
+	}
+
+	// the failed batch is retried one resource at a time to find the failing one
+	mockSvc = &mockEc2Client{FailingIDs: map[string]bool{"i-2": true}}
+	p = Ec2Processor{svc: mockSvc}
+	errs := p.SetTagsBatch(aws.StringSlice([]string{"i-1", "i-2", "i-3"}), tags)
+	if len(errs) != 1 || errs["i-2"] == nil || mockSvc.CreateTagsCalls != 4 {
+		t.Errorf("Expecting only i-2 to fail after 4 calls, got %d calls and errors: %v\n", mockSvc.CreateTagsCalls, errs)
+	}
+	if !reflect.DeepEqual(mockSvc.ResourceIDs, aws.StringSlice([]string{"i-1", "i-3"})) {
+		t.Errorf("Expecting i-1 and i-3 to be tagged, got: %v\n", aws.StringValueSlice(mockSvc.ResourceIDs))
+	}
+}
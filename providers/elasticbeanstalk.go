@@ -1,6 +1,7 @@
 package providers
 
 import (
+	"context"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/elasticbeanstalk"
@@ -13,6 +14,12 @@ import (
 // ElasticBeanstalkProcessor holds the elasticbeanstalk-related actions
 type ElasticBeanstalkProcessor struct {
 	svc elasticbeanstalkiface.ElasticBeanstalkAPI
+	// Batch, when set, groups the writes of the tags of the resources listed,
+	// which are sent once it is flushed
+	Batch *mapper.Batcher
+	// Pagination, when set, is where RetagEnvironments resumes the listing from and is
+	// kept up to date with the page in progress
+	Pagination *Pagination
 }
 
 // NewElasticBeanstalkProcessor creates a new instance of ElasticBeanstalkProcessor containing an already
@@ -35,9 +42,7 @@ func (p *ElasticBeanstalkProcessor) TagsToMap(tagsInput []*elasticbeanstalk.Tag)
 func (p *ElasticBeanstalkProcessor) SetTags(resourceID *string, tags []*mapper.TagItem) error {
 	newTags := []*elasticbeanstalk.Tag{}
 	for _, tag := range tags {
-		if (*tag).Name != "elasticbeanstalk:environment-name" && (*tag).Name != "elasticbeanstalk:environment-id" {
-			newTags = append(newTags, &elasticbeanstalk.Tag{Key: aws.String((*tag).Name), Value: aws.String((*tag).Value)})
-		}
+		newTags = append(newTags, &elasticbeanstalk.Tag{Key: aws.String((*tag).Name), Value: aws.String((*tag).Value)})
 	}
 	if len(newTags) == 0 {
 		return nil
@@ -50,45 +55,86 @@ func (p *ElasticBeanstalkProcessor) SetTags(resourceID *string, tags []*mapper.T
 	return err
 }
 
+// putTags returns the function writing the tags, through Batch when set
+func (p *ElasticBeanstalkProcessor) putTags() mapper.PutTagFn {
+	if p.Batch != nil {
+		return p.Batch.PutTagFn
+	}
+	return mapper.Direct(p.SetTags)
+}
+
 // GetTags gets the tags allocated to an elasticbeanstalk resource
-func (p *ElasticBeanstalkProcessor) GetTags(resourceID *string) ([]*elasticbeanstalk.Tag, error) {
+func (p *ElasticBeanstalkProcessor) GetTags(ctx context.Context, resourceID *string) ([]*elasticbeanstalk.Tag, error) {
 	input := &elasticbeanstalk.ListTagsForResourceInput{
 		ResourceArn: resourceID,
 	}
 
-	result, err := p.svc.ListTagsForResource(input)
+	result, err := p.svc.ListTagsForResourceWithContext(ctx, input)
 	return result.ResourceTags, err
 }
 
-// RetagEnvironments parses all environments and retags them
-func (p *ElasticBeanstalkProcessor) RetagEnvironments(m *mapper.Mapper) {
-	envs, err := p.svc.DescribeEnvironments(&elasticbeanstalk.DescribeEnvironmentsInput{IncludeDeleted: aws.Bool(false)})
+// RetagEnvironments parses all environments and retags them, until the context
+// is cancelled
+func (p *ElasticBeanstalkProcessor) RetagEnvironments(ctx context.Context, m mapper.Iface) {
+	err := p.Pagination.paginate(ctx, func(start *string, visit func(next *string)) error {
+		return p.describeEnvironmentsPages(ctx, &elasticbeanstalk.DescribeEnvironmentsInput{IncludeDeleted: aws.Bool(false), NextToken: start},
+			func(page *elasticbeanstalk.EnvironmentDescriptionsMessage, lastPage bool) bool {
+				visit(page.NextToken)
+				for _, env := range page.Environments {
+					p.retagEnvironment(ctx, m, env)
+				}
+				return ctx.Err() == nil
+			})
+	})
+	if interrupted(ctx, err) {
+		return
+	}
 	if err != nil {
 		log.WithFields(logrus.Fields{"error": err}).Fatal("DescribeEnvironments failed")
 	}
-	for _, env := range envs.Environments {
-		if *env.Status != "Ready" || *env.Health == "Grey" {
-			continue // only the "Ready" environments can be retagged
-		}
-		t, err := p.GetTags(env.EnvironmentArn)
+}
+
+// describeEnvironmentsPages iterates over the pages of DescribeEnvironments
+// like the other *Pages functions, as the SDK does not provide it
+func (p *ElasticBeanstalkProcessor) describeEnvironmentsPages(ctx context.Context, input *elasticbeanstalk.DescribeEnvironmentsInput, fn func(*elasticbeanstalk.EnvironmentDescriptionsMessage, bool) bool) error {
+	in := *input
+	for {
+		page, err := p.svc.DescribeEnvironmentsWithContext(ctx, &in)
 		if err != nil {
-			log.WithFields(logrus.Fields{"error": err, "resource": *env.EnvironmentArn}).Fatal("Failed to get ElasticBeanstalk environment tags")
-		}
-		tags := p.TagsToMap(t)
-		keys := []string{}
-		if env.EnvironmentName != nil {
-			keys = append(keys, *env.EnvironmentName)
-		}
-		if env.ApplicationName != nil {
-			keys = append(keys, *env.ApplicationName)
+			return err
 		}
-		if env.CNAME != nil {
-			keys = append(keys, *env.CNAME)
+		lastPage := aws.StringValue(page.NextToken) == ""
+		if !fn(page, lastPage) || lastPage {
+			return nil
 		}
-		if env.Description != nil {
-			keys = append(keys, *env.Description)
-		}
-		m.Retag(env.EnvironmentArn, &tags, keys, p.SetTags)
+		in.NextToken = page.NextToken
 	}
+}
 
+func (p *ElasticBeanstalkProcessor) retagEnvironment(ctx context.Context, m mapper.Iface, env *elasticbeanstalk.EnvironmentDescription) {
+	if *env.Status != "Ready" || *env.Health == "Grey" {
+		return // only the "Ready" environments can be retagged
+	}
+	t, err := p.GetTags(ctx, env.EnvironmentArn)
+	if interrupted(ctx, err) {
+		return
+	}
+	if err != nil {
+		log.WithFields(logrus.Fields{"error": err, "resource": *env.EnvironmentArn}).Fatal("Failed to get ElasticBeanstalk environment tags")
+	}
+	tags := p.TagsToMap(t)
+	keys := []string{}
+	if env.EnvironmentName != nil {
+		keys = append(keys, *env.EnvironmentName)
+	}
+	if env.ApplicationName != nil {
+		keys = append(keys, *env.ApplicationName)
+	}
+	if env.CNAME != nil {
+		keys = append(keys, *env.CNAME)
+	}
+	if env.Description != nil {
+		keys = append(keys, *env.Description)
+	}
+	m.Retag(ctx, env.EnvironmentArn, &tags, keys, mapper.Constrain(&mapper.DefaultConstraints, tags, p.putTags()))
 }
@@ -1,13 +1,57 @@
 package providers
 
 import (
+	"context"
 	"reflect"
+	"sort"
+	"strconv"
 	"testing"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/elasticbeanstalk"
+	"github.com/aws/aws-sdk-go/service/elasticbeanstalk/elasticbeanstalkiface"
+	"github.com/sirupsen/logrus"
+	logrus_test "github.com/sirupsen/logrus/hooks/test"
+
+	"github.com/VEVO/awsRetagger/mapper"
 )
 
+// mockElasticBeanstalkClient is used to mock elasticbeanstalk calls
+type mockElasticBeanstalkClient struct {
+	elasticbeanstalkiface.ElasticBeanstalkAPI
+	// Environments are listed one per page
+	Environments []*elasticbeanstalk.EnvironmentDescription
+	// Pages is the number of pages returned by DescribeEnvironments
+	Pages int
+}
+
+// DescribeEnvironments returns the environment at the index given by the
+// token, rejecting the tokens that are not an index
+func (m *mockElasticBeanstalkClient) DescribeEnvironmentsWithContext(ctx aws.Context, input *elasticbeanstalk.DescribeEnvironmentsInput, opts ...request.Option) (*elasticbeanstalk.EnvironmentDescriptionsMessage, error) {
+	i := 0
+	if input.NextToken != nil {
+		var err error
+		if i, err = strconv.Atoi(*input.NextToken); err != nil {
+			return nil, awserr.New("InvalidParameterValue", "invalid token", err)
+		}
+	}
+	m.Pages++
+	output := &elasticbeanstalk.EnvironmentDescriptionsMessage{}
+	if i < len(m.Environments) {
+		output.Environments = []*elasticbeanstalk.EnvironmentDescription{m.Environments[i]}
+	}
+	if i+1 < len(m.Environments) {
+		output.NextToken = aws.String(strconv.Itoa(i + 1))
+	}
+	return output, nil
+}
+
+func (m *mockElasticBeanstalkClient) ListTagsForResourceWithContext(ctx aws.Context, input *elasticbeanstalk.ListTagsForResourceInput, opts ...request.Option) (*elasticbeanstalk.ListTagsForResourceOutput, error) {
+	return &elasticbeanstalk.ListTagsForResourceOutput{ResourceArn: input.ResourceArn, ResourceTags: []*elasticbeanstalk.Tag{}}, nil
+}
+
 func TestElasticBeanstalkTagsToMap(t *testing.T) {
 	testData := []struct {
 		inputTags  []*elasticbeanstalk.Tag
@@ -26,3 +70,55 @@ func TestElasticBeanstalkTagsToMap(t *testing.T) {
 		}
 	}
 }
+
+func TestElasticBeanstalkRetagEnvironments(t *testing.T) {
+	mockSvc := &mockElasticBeanstalkClient{Environments: []*elasticbeanstalk.EnvironmentDescription{
+		{EnvironmentArn: aws.String("arn:env-1"), EnvironmentName: aws.String("env-1"), Status: aws.String("Ready"), Health: aws.String("Green")},
+		{EnvironmentArn: aws.String("arn:env-2"), EnvironmentName: aws.String("env-2"), Status: aws.String("Updating"), Health: aws.String("Green")},
+		{EnvironmentArn: aws.String("arn:env-3"), EnvironmentName: aws.String("env-3"), Status: aws.String("Ready"), Health: aws.String("Yellow")},
+	}}
+	p := ElasticBeanstalkProcessor{svc: mockSvc}
+	m := &mapper.MockMapper{}
+
+	p.RetagEnvironments(context.Background(), m)
+	expectedKeys := map[string][]string{"arn:env-1": {"env-1"}, "arn:env-3": {"env-3"}}
+	if !reflect.DeepEqual(m.ResourceKeys, expectedKeys) || mockSvc.Pages != 3 {
+		t.Errorf("Expecting keys: %v from 3 pages\nGot: %v from %d pages\n", expectedKeys, m.ResourceKeys, mockSvc.Pages)
+	}
+}
+
+func TestElasticBeanstalkRetagEnvironmentsPagination(t *testing.T) {
+	logger, _ := logrus_test.NewNullLogger()
+	log = logrus.NewEntry(logger)
+
+	testData := []struct {
+		start          string
+		outputTokens   []string
+		outputRetagged []string
+	}{
+		{"", []string{"", "1", "2"}, []string{"arn:env-1", "arn:env-2", "arn:env-3"}},
+		{"1", []string{"1", "2"}, []string{"arn:env-2", "arn:env-3"}},
+		// an expired token starts the listing over
+		{"expired", []string{"", "1", "2"}, []string{"arn:env-1", "arn:env-2", "arn:env-3"}},
+	}
+	for _, d := range testData {
+		mockSvc := &mockElasticBeanstalkClient{Environments: []*elasticbeanstalk.EnvironmentDescription{
+			{EnvironmentArn: aws.String("arn:env-1"), EnvironmentName: aws.String("env-1"), Status: aws.String("Ready"), Health: aws.String("Green")},
+			{EnvironmentArn: aws.String("arn:env-2"), EnvironmentName: aws.String("env-2"), Status: aws.String("Ready"), Health: aws.String("Green")},
+			{EnvironmentArn: aws.String("arn:env-3"), EnvironmentName: aws.String("env-3"), Status: aws.String("Ready"), Health: aws.String("Green")},
+		}}
+		tokens := []string{}
+		p := ElasticBeanstalkProcessor{svc: mockSvc, Pagination: &Pagination{Start: d.start, OnPage: func(token string) { tokens = append(tokens, token) }}}
+		m := &mapper.MockMapper{}
+
+		p.RetagEnvironments(context.Background(), m)
+		retagged := []string{}
+		for id := range m.ResourceKeys {
+			retagged = append(retagged, id)
+		}
+		sort.Strings(retagged)
+		if !reflect.DeepEqual(tokens, d.outputTokens) || !reflect.DeepEqual(retagged, d.outputRetagged) {
+			t.Errorf("Expecting to start from %q with pages %v retagging %v\nGot pages %v retagging %v\n", d.start, d.outputTokens, d.outputRetagged, tokens, retagged)
+		}
+	}
+}
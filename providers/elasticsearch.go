@@ -1,6 +1,7 @@
 package providers
 
 import (
+	"context"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/elasticsearchservice"
@@ -12,6 +13,9 @@ import (
 // ElkProcessor holds the elasticsearch-related actions
 type ElkProcessor struct {
 	svc *elasticsearchservice.ElasticsearchService
+	// Batch, when set, groups the writes of the tags of the resources listed,
+	// which are sent once it is flushed
+	Batch *mapper.Batcher
 }
 
 // NewElkProcessor creates a new instance of ElkProcessor containing an already
@@ -45,42 +49,74 @@ func (p *ElkProcessor) SetTags(resourceID *string, tags []*mapper.TagItem) error
 	return err
 }
 
+// putTags returns the function writing the tags, through Batch when set
+func (p *ElkProcessor) putTags() mapper.PutTagFn {
+	if p.Batch != nil {
+		return p.Batch.PutTagFn
+	}
+	return mapper.Direct(p.SetTags)
+}
+
 // GetTags gets the tags allocated to an elasticsearchservice resource
-func (p *ElkProcessor) GetTags(resourceID *string) ([]*elasticsearchservice.Tag, error) {
+func (p *ElkProcessor) GetTags(ctx context.Context, resourceID *string) ([]*elasticsearchservice.Tag, error) {
 	input := &elasticsearchservice.ListTagsInput{
 		ARN: resourceID,
 	}
 
-	result, err := p.svc.ListTags(input)
+	result, err := p.svc.ListTagsWithContext(ctx, input)
 	return result.TagList, err
 }
 
-// RetagDomains parses all elasticsearch domains and retags them
-func (p *ElkProcessor) RetagDomains(m *mapper.Mapper) {
-	result, err := p.svc.ListDomainNames(&elasticsearchservice.ListDomainNamesInput{})
+// RetagDomains parses all elasticsearch domains and retags them, until the
+// context is cancelled
+func (p *ElkProcessor) RetagDomains(ctx context.Context, m mapper.Iface) {
+	result, err := p.svc.ListDomainNamesWithContext(ctx, &elasticsearchservice.ListDomainNamesInput{})
+	if interrupted(ctx, err) {
+		return
+	}
 	if err != nil {
 		log.WithFields(logrus.Fields{"error": err}).Fatal("ListDomainNames failed")
 	}
 
 	for _, domain := range result.DomainNames {
-		domInfo, err := p.svc.DescribeElasticsearchDomain(&elasticsearchservice.DescribeElasticsearchDomainInput{DomainName: domain.DomainName})
+		domInfo, err := p.svc.DescribeElasticsearchDomainWithContext(ctx, &elasticsearchservice.DescribeElasticsearchDomainInput{DomainName: domain.DomainName})
+		if interrupted(ctx, err) {
+			return
+		}
 		if err != nil {
 			log.WithFields(logrus.Fields{"error": err, "resource": *domain.DomainName}).Fatal("Failed to get Elasticsearch domain attributes")
 		}
-		dom := *(domInfo.DomainStatus)
-		t, err := p.GetTags(dom.ARN)
-		if err != nil {
+		if err = p.retagDomain(ctx, m, domInfo.DomainStatus); interrupted(ctx, err) {
+			return
+		} else if err != nil {
 			log.WithFields(logrus.Fields{"error": err, "resource": *domain.DomainName}).Fatal("Failed to get Elasticsearch domain tags")
 		}
+	}
+}
 
-		tags := p.TagsToMap(t)
-		keys := []string{}
-		if dom.DomainId != nil {
-			keys = append(keys, *dom.DomainId)
-		}
-		if dom.DomainName != nil {
-			keys = append(keys, *dom.DomainName)
-		}
-		m.Retag(dom.ARN, &tags, keys, p.SetTags)
+// RetagDomain retags the elasticsearch domain of the given name
+func (p *ElkProcessor) RetagDomain(ctx context.Context, m mapper.Iface, domainName *string) error {
+	domInfo, err := p.svc.DescribeElasticsearchDomainWithContext(ctx, &elasticsearchservice.DescribeElasticsearchDomainInput{DomainName: domainName})
+	if err != nil {
+		return err
+	}
+	return p.retagDomain(ctx, m, domInfo.DomainStatus)
+}
+
+func (p *ElkProcessor) retagDomain(ctx context.Context, m mapper.Iface, dom *elasticsearchservice.ElasticsearchDomainStatus) error {
+	t, err := p.GetTags(ctx, dom.ARN)
+	if err != nil {
+		return err
+	}
+
+	tags := p.TagsToMap(t)
+	keys := []string{}
+	if dom.DomainId != nil {
+		keys = append(keys, *dom.DomainId)
+	}
+	if dom.DomainName != nil {
+		keys = append(keys, *dom.DomainName)
 	}
+	m.Retag(ctx, dom.ARN, &tags, keys, mapper.Constrain(&mapper.DefaultConstraints, tags, p.putTags()))
+	return nil
 }
@@ -0,0 +1,48 @@
+package providers
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/sirupsen/logrus"
+)
+
+// Pagination is the position of the listing of the resources of a provider,
+// so that an interrupted run can resume it from the page in progress
+type Pagination struct {
+	// Start is the token of the page the listing starts from, the first page
+	// when empty
+	Start string
+	// OnPage, when set, is called with the token of each page before its
+	// resources are retagged, empty for the first page
+	OnPage func(token string)
+}
+
+// paginate calls list with the token of the page to start from and the
+// function to call at the beginning of each page with the token of the next
+// one. When the Start token is rejected before any page is listed, like once
+// expired, the listing starts over from the first page. p can be nil.
+func (p *Pagination) paginate(ctx context.Context, list func(start *string, page func(next *string)) error) error {
+	token, listed := "", false
+	if p != nil {
+		token = p.Start
+	}
+	page := func(next *string) {
+		listed = true
+		if p != nil && p.OnPage != nil {
+			p.OnPage(token)
+		}
+		token = aws.StringValue(next)
+	}
+	if token == "" {
+		return list(nil, page)
+	}
+	start := token
+	err := list(aws.String(start), page)
+	if err != nil && !listed && ctx.Err() == nil {
+		log.WithFields(logrus.Fields{"error": err, "token": start}).Warn("Unable to resume the listing from its token, listing from the first page")
+		token = ""
+		return list(nil, page)
+	}
+	return err
+}
@@ -0,0 +1,78 @@
+package providers
+
+import (
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+)
+
+// Partition is the AWS partition of a region: the commercial regions, China or
+// GovCloud. The partitions do not share the ARNs, endpoints and global
+// services.
+type Partition struct {
+	// ID is the partition of the ARNs: aws, aws-cn or aws-us-gov
+	ID string
+}
+
+// dnsSuffixes are the domains of the endpoints of each partition
+var dnsSuffixes = map[string]string{
+	endpoints.AwsPartitionID:      "amazonaws.com",
+	endpoints.AwsCnPartitionID:    "amazonaws.com.cn",
+	endpoints.AwsUsGovPartitionID: "amazonaws.com",
+}
+
+// globalRegions are the regions of the endpoints of the global services in
+// each partition. A service missing from a partition is not available there.
+var globalRegions = map[string]map[string]string{
+	endpoints.AwsPartitionID: {
+		endpoints.CloudfrontServiceID:    "us-east-1",
+		endpoints.IamServiceID:           "us-east-1",
+		endpoints.OrganizationsServiceID: "us-east-1",
+	},
+	endpoints.AwsCnPartitionID: {
+		endpoints.CloudfrontServiceID:    "cn-northwest-1",
+		endpoints.IamServiceID:           "cn-north-1",
+		endpoints.OrganizationsServiceID: "cn-northwest-1",
+	},
+	endpoints.AwsUsGovPartitionID: {
+		endpoints.IamServiceID:           "us-gov-west-1",
+		endpoints.OrganizationsServiceID: "us-gov-west-1",
+	},
+}
+
+// PartitionOf returns the partition of the region, the commercial partition
+// when the region is unknown to the SDK
+func PartitionOf(region string) Partition {
+	if p, ok := endpoints.PartitionForRegion(endpoints.DefaultPartitions(), region); ok {
+		return Partition{ID: p.ID()}
+	}
+	return Partition{ID: endpoints.AwsPartitionID}
+}
+
+// ARN builds the ARN of a resource in the partition
+func (p Partition) ARN(service, region, accountID, resource string) string {
+	return arn.ARN{Partition: p.ID, Service: service, Region: region, AccountID: accountID, Resource: resource}.String()
+}
+
+// HasGlobalService checks if the global service is available in the partition
+func (p Partition) HasGlobalService(service string) bool {
+	_, ok := globalRegions[p.ID][service]
+	return ok
+}
+
+// GlobalConfig returns the configuration of the clients of a global service:
+// the region of its endpoint and, when the SDK does not know it, the endpoint
+// itself. It returns nil if the service is not available in the partition.
+func (p Partition) GlobalConfig(service string) *aws.Config {
+	region, ok := globalRegions[p.ID][service]
+	if !ok {
+		return nil
+	}
+	cfg := aws.NewConfig().WithRegion(region)
+	if _, err := endpoints.DefaultResolver().EndpointFor(service, region); err != nil {
+		cfg.WithEndpoint(fmt.Sprintf("https://%s.%s.%s", service, region, dnsSuffixes[p.ID]))
+	}
+	return cfg
+}
@@ -0,0 +1,66 @@
+package providers
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+)
+
+func TestPartitionARN(t *testing.T) {
+	testData := []struct {
+		region, partition, arn string
+	}{
+		{"us-east-1", "aws", "arn:aws:redshift:us-east-1:123456789012:cluster:web"},
+		{"cn-north-1", "aws-cn", "arn:aws-cn:redshift:cn-north-1:123456789012:cluster:web"},
+		{"us-gov-west-1", "aws-us-gov", "arn:aws-us-gov:redshift:us-gov-west-1:123456789012:cluster:web"},
+		// the unknown regions are considered commercial
+		{"moon-1", "aws", "arn:aws:redshift:moon-1:123456789012:cluster:web"},
+	}
+	for _, d := range testData {
+		p := PartitionOf(d.region)
+		if p.ID != d.partition {
+			t.Errorf("Expecting partition of %s: %s, got: %s\n", d.region, d.partition, p.ID)
+		}
+		if arn := p.ARN("redshift", d.region, "123456789012", "cluster:web"); arn != d.arn {
+			t.Errorf("Expecting ARN: %s\nGot: %s\n", d.arn, arn)
+		}
+
+		rs := RedshiftProcessor{region: aws.String(d.region), accountID: aws.String("123456789012"), partition: p}
+		if arn := rs.getArn("cluster", "web"); arn != d.arn {
+			t.Errorf("Expecting Redshift ARN: %s\nGot: %s\n", d.arn, arn)
+		}
+	}
+}
+
+func TestPartitionGlobalConfig(t *testing.T) {
+	testData := []struct {
+		region, service string
+		available       bool
+		globalRegion    string
+		endpoint        string
+	}{
+		{"eu-west-1", endpoints.CloudfrontServiceID, true, "us-east-1", ""},
+		{"cn-north-1", endpoints.CloudfrontServiceID, true, "cn-northwest-1", "https://cloudfront.cn-northwest-1.amazonaws.com.cn"},
+		{"us-gov-west-1", endpoints.CloudfrontServiceID, false, "", ""},
+		{"us-gov-east-1", endpoints.IamServiceID, true, "us-gov-west-1", ""},
+		{"cn-northwest-1", endpoints.IamServiceID, true, "cn-north-1", ""},
+		{"cn-north-1", endpoints.OrganizationsServiceID, true, "cn-northwest-1", "https://organizations.cn-northwest-1.amazonaws.com.cn"},
+	}
+	for _, d := range testData {
+		p := PartitionOf(d.region)
+		if p.HasGlobalService(d.service) != d.available {
+			t.Errorf("Expecting %s to be available in %s: %v\n", d.service, p.ID, d.available)
+		}
+		cfg := p.GlobalConfig(d.service)
+		if !d.available {
+			if cfg != nil {
+				t.Errorf("Expecting no config for %s in %s, got: %v\n", d.service, p.ID, cfg)
+			}
+			continue
+		}
+		if aws.StringValue(cfg.Region) != d.globalRegion || aws.StringValue(cfg.Endpoint) != d.endpoint {
+			t.Errorf("Expecting %s in %s through %s %q, got: %s %q\n", d.service, p.ID, d.globalRegion, d.endpoint, aws.StringValue(cfg.Region), aws.StringValue(cfg.Endpoint))
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package providers
 
 import (
+	"context"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/rds"
@@ -10,9 +11,22 @@ import (
 	"github.com/VEVO/awsRetagger/mapper"
 )
 
+// rdsConstraints are the restrictions of RDS on the tags of the instances and
+// clusters, which reserves the rds: prefix on top of the aws: one
+var rdsConstraints = mapper.Constraints{MaxTags: 50, MaxKeyLength: 128, MaxValueLength: 256, Charset: mapper.TagCharset, ReservedPrefixes: []string{"rds:"}}
+
 // RdsProcessor holds the rds-related actions
 type RdsProcessor struct {
 	svc rdsiface.RDSAPI
+	// Filters are passed to the DescribeDBInstances and DescribeDBClusters
+	// calls
+	Filters []*rds.Filter
+	// Batch, when set, groups the writes of the tags of the resources listed,
+	// which are sent once it is flushed
+	Batch *mapper.Batcher
+	// Pagination, when set, is where RetagInstances and RetagClusters resume
+	// the listing from and is kept up to date with the page in progress
+	Pagination *Pagination
 }
 
 // NewRdsProcessor creates a new instance of RdsProcessor containing an already
@@ -46,71 +60,160 @@ func (p *RdsProcessor) SetTags(resourceID *string, tags []*mapper.TagItem) error
 	return err
 }
 
+// putTags returns the function writing the tags, through Batch when set
+func (p *RdsProcessor) putTags() mapper.PutTagFn {
+	if p.Batch != nil {
+		return p.Batch.PutTagFn
+	}
+	return mapper.Direct(p.SetTags)
+}
+
 // GetTags gets the tags allocated to an rds resource
-func (p *RdsProcessor) GetTags(resourceID *string) ([]*rds.Tag, error) {
+func (p *RdsProcessor) GetTags(ctx context.Context, resourceID *string) ([]*rds.Tag, error) {
 	input := &rds.ListTagsForResourceInput{
 		ResourceName: resourceID,
 	}
 
-	result, err := p.svc.ListTagsForResource(input)
+	result, err := p.svc.ListTagsForResourceWithContext(ctx, input)
 	return result.TagList, err
 }
 
-// RetagInstances parses all instances and retags them
-func (p *RdsProcessor) RetagInstances(m *mapper.Mapper) {
-	result, err := p.svc.DescribeDBInstances(&rds.DescribeDBInstancesInput{})
+// RetagInstances parses all instances and retags them, until the context is
+// cancelled
+func (p *RdsProcessor) RetagInstances(ctx context.Context, m mapper.Iface) {
+	err := p.Pagination.paginate(ctx, func(start *string, visit func(next *string)) error {
+		return p.svc.DescribeDBInstancesPagesWithContext(ctx, &rds.DescribeDBInstancesInput{Filters: p.Filters, Marker: start},
+			func(page *rds.DescribeDBInstancesOutput, lastPage bool) bool {
+				visit(page.Marker)
+				for _, instance := range page.DBInstances {
+					if err := p.retagInstance(ctx, m, instance); interrupted(ctx, err) {
+						return false
+					} else if err != nil {
+						log.WithFields(logrus.Fields{"error": err, "resource": *instance.DBInstanceArn}).Fatalf("Failed to get DB instance tags")
+					}
+				}
+				return ctx.Err() == nil
+			})
+	})
+	if interrupted(ctx, err) {
+		return
+	}
 	if err != nil {
 		log.WithFields(logrus.Fields{"error": err}).Fatalf("DescribeDBInstances failed")
 	}
+}
 
+// RetagInstance retags the instance of the given identifier
+func (p *RdsProcessor) RetagInstance(ctx context.Context, m mapper.Iface, instanceID *string) error {
+	result, err := p.svc.DescribeDBInstancesWithContext(ctx, &rds.DescribeDBInstancesInput{DBInstanceIdentifier: instanceID, Filters: p.Filters})
+	if err != nil {
+		return err
+	}
 	for _, instance := range result.DBInstances {
-		t, err := p.GetTags(instance.DBInstanceArn)
-		if err != nil {
-			log.WithFields(logrus.Fields{"error": err, "resource": *instance.DBInstanceArn}).Fatalf("Failed to get DB instance tags")
+		if err = p.retagInstance(ctx, m, instance); err != nil {
+			return err
 		}
+	}
+	return nil
+}
 
-		tags := p.TagsToMap(t)
-		keys := []string{}
-		if instance.DBClusterIdentifier != nil {
-			keys = append(keys, *instance.DBClusterIdentifier)
-		}
-		if instance.DBInstanceIdentifier != nil {
-			keys = append(keys, *instance.DBInstanceIdentifier)
-		}
-		if instance.DBName != nil {
-			keys = append(keys, *instance.DBName)
-		}
-		if instance.MasterUsername != nil {
-			keys = append(keys, *instance.MasterUsername)
-		}
-		m.Retag(instance.DBInstanceArn, &tags, keys, p.SetTags)
+func (p *RdsProcessor) retagInstance(ctx context.Context, m mapper.Iface, instance *rds.DBInstance) error {
+	t, err := p.GetTags(ctx, instance.DBInstanceArn)
+	if err != nil {
+		return err
+	}
+
+	tags := p.TagsToMap(t)
+	keys := []string{}
+	if instance.DBClusterIdentifier != nil {
+		keys = append(keys, *instance.DBClusterIdentifier)
+	}
+	if instance.DBInstanceIdentifier != nil {
+		keys = append(keys, *instance.DBInstanceIdentifier)
+	}
+	if instance.DBName != nil {
+		keys = append(keys, *instance.DBName)
 	}
+	if instance.MasterUsername != nil {
+		keys = append(keys, *instance.MasterUsername)
+	}
+	m.Retag(ctx, instance.DBInstanceArn, &tags, keys, mapper.Constrain(&rdsConstraints, tags, p.putTags()))
+	return nil
 }
 
-// RetagClusters parses all clusters and retags them
-func (p *RdsProcessor) RetagClusters(m *mapper.Mapper) {
-	result, err := p.svc.DescribeDBClusters(&rds.DescribeDBClustersInput{})
+// RetagClusters parses all clusters and retags them, until the context is
+// cancelled
+func (p *RdsProcessor) RetagClusters(ctx context.Context, m mapper.Iface) {
+	err := p.Pagination.paginate(ctx, func(start *string, visit func(next *string)) error {
+		return p.describeDBClustersPages(ctx, &rds.DescribeDBClustersInput{Filters: p.Filters, Marker: start},
+			func(page *rds.DescribeDBClustersOutput, lastPage bool) bool {
+				visit(page.Marker)
+				for _, cluster := range page.DBClusters {
+					if err := p.retagCluster(ctx, m, cluster); interrupted(ctx, err) {
+						return false
+					} else if err != nil {
+						log.WithFields(logrus.Fields{"error": err, "resource": *cluster.DBClusterArn}).Fatalf("Failed to get DB cluster tags")
+					}
+				}
+				return ctx.Err() == nil
+			})
+	})
+	if interrupted(ctx, err) {
+		return
+	}
 	if err != nil {
 		log.WithFields(logrus.Fields{"error": err}).Fatalf("DescribeDBClusters failed")
 	}
+}
 
-	for _, cluster := range result.DBClusters {
-		t, err := p.GetTags(cluster.DBClusterArn)
+// describeDBClustersPages iterates over the pages of DescribeDBClusters like
+// the other *Pages functions, as the SDK does not provide it
+func (p *RdsProcessor) describeDBClustersPages(ctx context.Context, input *rds.DescribeDBClustersInput, fn func(*rds.DescribeDBClustersOutput, bool) bool) error {
+	in := *input
+	for {
+		page, err := p.svc.DescribeDBClustersWithContext(ctx, &in)
 		if err != nil {
-			log.WithFields(logrus.Fields{"error": err, "resource": *cluster.DBClusterArn}).Fatalf("Failed to get DB cluster tags")
-		}
-
-		tags := p.TagsToMap(t)
-		keys := []string{}
-		if cluster.DBClusterIdentifier != nil {
-			keys = append(keys, *cluster.DBClusterIdentifier)
+			return err
 		}
-		if cluster.DatabaseName != nil {
-			keys = append(keys, *cluster.DatabaseName)
+		lastPage := aws.StringValue(page.Marker) == ""
+		if !fn(page, lastPage) || lastPage {
+			return nil
 		}
-		if cluster.MasterUsername != nil {
-			keys = append(keys, *cluster.MasterUsername)
+		in.Marker = page.Marker
+	}
+}
+
+// RetagCluster retags the cluster of the given identifier
+func (p *RdsProcessor) RetagCluster(ctx context.Context, m mapper.Iface, clusterID *string) error {
+	result, err := p.svc.DescribeDBClustersWithContext(ctx, &rds.DescribeDBClustersInput{DBClusterIdentifier: clusterID, Filters: p.Filters})
+	if err != nil {
+		return err
+	}
+	for _, cluster := range result.DBClusters {
+		if err = p.retagCluster(ctx, m, cluster); err != nil {
+			return err
 		}
-		m.Retag(cluster.DBClusterArn, &tags, keys, p.SetTags)
 	}
+	return nil
+}
+
+func (p *RdsProcessor) retagCluster(ctx context.Context, m mapper.Iface, cluster *rds.DBCluster) error {
+	t, err := p.GetTags(ctx, cluster.DBClusterArn)
+	if err != nil {
+		return err
+	}
+
+	tags := p.TagsToMap(t)
+	keys := []string{}
+	if cluster.DBClusterIdentifier != nil {
+		keys = append(keys, *cluster.DBClusterIdentifier)
+	}
+	if cluster.DatabaseName != nil {
+		keys = append(keys, *cluster.DatabaseName)
+	}
+	if cluster.MasterUsername != nil {
+		keys = append(keys, *cluster.MasterUsername)
+	}
+	m.Retag(ctx, cluster.DBClusterArn, &tags, keys, mapper.Constrain(&rdsConstraints, tags, p.putTags()))
+	return nil
 }
@@ -1,11 +1,14 @@
 package providers
 
 import (
+	"context"
 	"errors"
 	"reflect"
+	"strconv"
 	"testing"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/rds"
 	"github.com/aws/aws-sdk-go/service/rds/rdsiface"
 
@@ -21,6 +24,35 @@ type mockRdsClient struct {
 	ResourceTags []*rds.Tag
 	// ReturnError is the error that you want your mocked function to return
 	ReturnError error
+	// DBInstances and DBClusters are listed one per page
+	DBInstances []*rds.DBInstance
+	DBClusters  []*rds.DBCluster
+	// Pages is the number of pages returned by the listing calls
+	Pages int
+}
+
+func (m *mockRdsClient) DescribeDBInstancesPagesWithContext(ctx aws.Context, input *rds.DescribeDBInstancesInput, fn func(*rds.DescribeDBInstancesOutput, bool) bool, opts ...request.Option) error {
+	for i, instance := range m.DBInstances {
+		m.Pages++
+		if !fn(&rds.DescribeDBInstancesOutput{DBInstances: []*rds.DBInstance{instance}}, i == len(m.DBInstances)-1) {
+			break
+		}
+	}
+	return nil
+}
+
+// DescribeDBClusters returns the cluster at the index given by the marker
+func (m *mockRdsClient) DescribeDBClustersWithContext(ctx aws.Context, input *rds.DescribeDBClustersInput, opts ...request.Option) (*rds.DescribeDBClustersOutput, error) {
+	m.Pages++
+	i, _ := strconv.Atoi(aws.StringValue(input.Marker))
+	output := &rds.DescribeDBClustersOutput{}
+	if i < len(m.DBClusters) {
+		output.DBClusters = []*rds.DBCluster{m.DBClusters[i]}
+	}
+	if i+1 < len(m.DBClusters) {
+		output.Marker = aws.String(strconv.Itoa(i + 1))
+	}
+	return output, nil
 }
 
 func (m *mockRdsClient) AddTagsToResource(input *rds.AddTagsToResourceInput) (*rds.AddTagsToResourceOutput, error) {
@@ -31,7 +63,7 @@ func (m *mockRdsClient) AddTagsToResource(input *rds.AddTagsToResourceInput) (*r
 	return &rds.AddTagsToResourceOutput{}, m.ReturnError
 }
 
-func (m *mockRdsClient) ListTagsForResource(input *rds.ListTagsForResourceInput) (*rds.ListTagsForResourceOutput, error) {
+func (m *mockRdsClient) ListTagsForResourceWithContext(ctx aws.Context, input *rds.ListTagsForResourceInput, opts ...request.Option) (*rds.ListTagsForResourceOutput, error) {
 	m.ResourceID = input.ResourceName
 	return &rds.ListTagsForResourceOutput{TagList: m.ResourceTags}, m.ReturnError
 }
@@ -102,7 +134,7 @@ func TestRdsGetTags(t *testing.T) {
 		mockSvc := &mockRdsClient{ReturnError: d.inputError, ResourceTags: d.inputTags}
 		p := RdsProcessor{svc: mockSvc}
 
-		res, err := p.GetTags(&d.inputResource)
+		res, err := p.GetTags(context.Background(), &d.inputResource)
 		if !reflect.DeepEqual(err, d.outputError) {
 			t.Errorf("Expecting error: %v\nGot: %v\n", d.outputError, err)
 		}
@@ -116,3 +148,33 @@ func TestRdsGetTags(t *testing.T) {
 		}
 	}
 }
+
+func TestRdsRetagInstancesAndClusters(t *testing.T) {
+	mockSvc := &mockRdsClient{
+		ResourceTags: []*rds.Tag{{Key: aws.String("team"), Value: aws.String("data")}},
+		DBInstances: []*rds.DBInstance{
+			{DBInstanceArn: aws.String("arn:db-1"), DBInstanceIdentifier: aws.String("db-1")},
+			{DBInstanceArn: aws.String("arn:db-2"), DBInstanceIdentifier: aws.String("db-2")},
+		},
+		DBClusters: []*rds.DBCluster{
+			{DBClusterArn: aws.String("arn:cluster-1"), DBClusterIdentifier: aws.String("cluster-1")},
+			{DBClusterArn: aws.String("arn:cluster-2"), DBClusterIdentifier: aws.String("cluster-2")},
+			{DBClusterArn: aws.String("arn:cluster-3"), DBClusterIdentifier: aws.String("cluster-3")},
+		},
+	}
+	p := RdsProcessor{svc: mockSvc}
+
+	m := &mapper.MockMapper{}
+	p.RetagInstances(context.Background(), m)
+	expectedKeys := map[string][]string{"arn:db-1": {"db-1"}, "arn:db-2": {"db-2"}}
+	if !reflect.DeepEqual(m.ResourceKeys, expectedKeys) || mockSvc.Pages != 2 {
+		t.Errorf("Expecting keys: %v from 2 pages\nGot: %v from %d pages\n", expectedKeys, m.ResourceKeys, mockSvc.Pages)
+	}
+
+	m, mockSvc.Pages = &mapper.MockMapper{}, 0
+	p.RetagClusters(context.Background(), m)
+	expectedKeys = map[string][]string{"arn:cluster-1": {"cluster-1"}, "arn:cluster-2": {"cluster-2"}, "arn:cluster-3": {"cluster-3"}}
+	if !reflect.DeepEqual(m.ResourceKeys, expectedKeys) || mockSvc.Pages != 3 {
+		t.Errorf("Expecting keys: %v from 3 pages\nGot: %v from %d pages\n", expectedKeys, m.ResourceKeys, mockSvc.Pages)
+	}
+}
@@ -1,8 +1,8 @@
 package providers
 
 import (
+	"context"
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/arn"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/redshift"
 	"github.com/aws/aws-sdk-go/service/redshift/redshiftiface"
@@ -17,6 +17,13 @@ type RedshiftProcessor struct {
 	svc       redshiftiface.RedshiftAPI
 	region    *string
 	accountID *string
+	partition Partition
+	// Batch, when set, groups the writes of the tags of the resources listed,
+	// which are sent once it is flushed
+	Batch *mapper.Batcher
+	// Pagination, when set, is where RetagClusters resumes the listing from and is
+	// kept up to date with the page in progress
+	Pagination *Pagination
 }
 
 // NewRedshiftProcessor creates a new instance of RedshiftProcessor containing an already
@@ -28,7 +35,8 @@ func NewRedshiftProcessor(sess *session.Session) (*RedshiftProcessor, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &RedshiftProcessor{svc: redshift.New(sess), region: (*sess.Config).Region, accountID: accInfo.Account}, nil
+	region := (*sess.Config).Region
+	return &RedshiftProcessor{svc: redshift.New(sess), region: region, accountID: accInfo.Account, partition: PartitionOf(aws.StringValue(region))}, nil
 }
 
 // TagsToMap transform the redshift tags structure into a map[string]string for
@@ -56,49 +64,86 @@ func (p *RedshiftProcessor) SetTags(resourceID *string, tags []*mapper.TagItem)
 	return err
 }
 
+// putTags returns the function writing the tags, through Batch when set
+func (p *RedshiftProcessor) putTags() mapper.PutTagFn {
+	if p.Batch != nil {
+		return p.Batch.PutTagFn
+	}
+	return mapper.Direct(p.SetTags)
+}
+
 // GetTags gets the tags allocated to an redshift resource
-func (p *RedshiftProcessor) GetTags(resourceID *string) ([]*redshift.TaggedResource, error) {
+func (p *RedshiftProcessor) GetTags(ctx context.Context, resourceID *string) ([]*redshift.TaggedResource, error) {
 	input := &redshift.DescribeTagsInput{
 		ResourceName: resourceID,
 	}
 
-	result, err := p.svc.DescribeTags(input)
+	result, err := p.svc.DescribeTagsWithContext(ctx, input)
 	return result.TaggedResources, err
 }
 
 // getArn builds the arn for the given resourceIdentifier:
 // http://docs.aws.amazon.com/general/latest/gr/aws-arns-and-namespaces.html#arn-syntax-redshift
 func (p *RedshiftProcessor) getArn(resourceType, resourceIdentifier string) string {
-	res := arn.ARN{Partition: "aws", Service: "redshift", Region: *p.region, AccountID: *p.accountID, Resource: resourceType + ":" + resourceIdentifier}
-	return res.String()
+	return p.partition.ARN("redshift", *p.region, *p.accountID, resourceType+":"+resourceIdentifier)
 }
 
-// RetagClusters parses all clusters and retags them
-func (p *RedshiftProcessor) RetagClusters(m *mapper.Mapper) {
-	err := p.svc.DescribeClustersPages(&redshift.DescribeClustersInput{},
-		func(page *redshift.DescribeClustersOutput, lastPage bool) bool {
-			for _, elt := range page.Clusters {
-				clArn := p.getArn("cluster", *elt.ClusterIdentifier)
-				t, err := p.GetTags(&clArn)
-				if err != nil {
-					log.WithFields(logrus.Fields{"error": err, "resource": *elt.ClusterIdentifier}).Fatal("Failed to get Redshift cluster tags")
-				}
-				tags := p.TagsToMap(t)
-				keys := []string{}
-				if elt.ClusterIdentifier != nil {
-					keys = append(keys, *elt.ClusterIdentifier)
-				}
-				if elt.DBName != nil {
-					keys = append(keys, *elt.DBName)
+// RetagClusters parses all clusters and retags them, until the context is
+// cancelled
+func (p *RedshiftProcessor) RetagClusters(ctx context.Context, m mapper.Iface) {
+	err := p.Pagination.paginate(ctx, func(start *string, visit func(next *string)) error {
+		return p.svc.DescribeClustersPagesWithContext(ctx, &redshift.DescribeClustersInput{Marker: start},
+			func(page *redshift.DescribeClustersOutput, lastPage bool) bool {
+				visit(page.Marker)
+				for _, elt := range page.Clusters {
+					if err := p.retagCluster(ctx, m, elt); interrupted(ctx, err) {
+						return false
+					} else if err != nil {
+						log.WithFields(logrus.Fields{"error": err, "resource": *elt.ClusterIdentifier}).Fatal("Failed to get Redshift cluster tags")
+					}
 				}
-				if elt.MasterUsername != nil {
-					keys = append(keys, *elt.MasterUsername)
-				}
-				m.Retag(&clArn, &tags, keys, p.SetTags)
-			}
-			return !lastPage
-		})
+				return !lastPage && ctx.Err() == nil
+			})
+	})
+	if interrupted(ctx, err) {
+		return
+	}
 	if err != nil {
 		log.WithFields(logrus.Fields{"error": err}).Fatal("DescribeClusters failed")
 	}
 }
+
+// RetagCluster retags the cluster of the given identifier
+func (p *RedshiftProcessor) RetagCluster(ctx context.Context, m mapper.Iface, clusterID *string) error {
+	result, err := p.svc.DescribeClustersWithContext(ctx, &redshift.DescribeClustersInput{ClusterIdentifier: clusterID})
+	if err != nil {
+		return err
+	}
+	for _, elt := range result.Clusters {
+		if err = p.retagCluster(ctx, m, elt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *RedshiftProcessor) retagCluster(ctx context.Context, m mapper.Iface, elt *redshift.Cluster) error {
+	clArn := p.getArn("cluster", *elt.ClusterIdentifier)
+	t, err := p.GetTags(ctx, &clArn)
+	if err != nil {
+		return err
+	}
+	tags := p.TagsToMap(t)
+	keys := []string{}
+	if elt.ClusterIdentifier != nil {
+		keys = append(keys, *elt.ClusterIdentifier)
+	}
+	if elt.DBName != nil {
+		keys = append(keys, *elt.DBName)
+	}
+	if elt.MasterUsername != nil {
+		keys = append(keys, *elt.MasterUsername)
+	}
+	m.Retag(ctx, &clArn, &tags, keys, mapper.Constrain(&mapper.DefaultConstraints, tags, p.putTags()))
+	return nil
+}
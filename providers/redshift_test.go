@@ -6,6 +6,7 @@ import (
 	"testing"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/redshift"
 	"github.com/aws/aws-sdk-go/service/redshift/redshiftiface"
 
@@ -29,7 +30,7 @@ func (m *mockRedshiftClient) CreateTags(input *redshift.CreateTagsInput) (*redsh
 	return &redshift.CreateTagsOutput{}, m.ReturnError
 }
 
-func (m *mockRedshiftClient) DescribeTags(input *redshift.DescribeTagsInput) (*redshift.DescribeTagsOutput, error) {
+func (m *mockRedshiftClient) DescribeTagsWithContext(ctx aws.Context, input *redshift.DescribeTagsInput, opts ...request.Option) (*redshift.DescribeTagsOutput, error) {
 	m.ResourceID = input.ResourceName
 	outTags := []*redshift.TaggedResource{}
 	for _, otag := range m.ResourceTags {
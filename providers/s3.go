@@ -1,6 +1,10 @@
 package providers
 
 import (
+	"context"
+	"fmt"
+	"sort"
+
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
@@ -11,16 +15,80 @@ import (
 	"github.com/VEVO/awsRetagger/mapper"
 )
 
-// S3Processor holds the s3-related actions
+// S3Processor holds the s3-related actions. The buckets of all the regions are
+// processed, each through a client of its region.
 type S3Processor struct {
 	svc    s3iface.S3API
 	region *string
+	// newClient creates the client of a region other than the session's
+	newClient func(region string) s3iface.S3API
+	// clients are the clients by region, created on first use
+	clients map[string]s3iface.S3API
+	// locations are the regions of the buckets already located
+	locations map[string]string
 }
 
 // NewS3Processor creates a new instance of S3Processor containing an already
 // initialized s3 client
 func NewS3Processor(sess *session.Session) *S3Processor {
-	return &S3Processor{svc: s3.New(sess), region: sess.Config.Region}
+	return &S3Processor{
+		svc:    s3.New(sess),
+		region: sess.Config.Region,
+		newClient: func(region string) s3iface.S3API {
+			return s3.New(sess, aws.NewConfig().WithRegion(region))
+		},
+	}
+}
+
+// client returns the client of the given region, creating it on first use
+func (e *S3Processor) client(region string) s3iface.S3API {
+	if region == aws.StringValue(e.region) {
+		return e.svc
+	}
+	if e.clients == nil {
+		e.clients = make(map[string]s3iface.S3API)
+	}
+	svc, ok := e.clients[region]
+	if !ok {
+		log.WithFields(logrus.Fields{"region": region}).Debug("Creating the S3 client of the region")
+		svc = e.newClient(region)
+		e.clients[region] = svc
+	}
+	return svc
+}
+
+// location returns the normalized region of the bucket
+func (e *S3Processor) location(ctx context.Context, bucketName *string) (string, error) {
+	if loc, ok := e.locations[*bucketName]; ok {
+		return loc, nil
+	}
+	location, err := e.svc.GetBucketLocationWithContext(ctx, &s3.GetBucketLocationInput{Bucket: bucketName})
+	if err != nil {
+		return "", err
+	}
+	loc := s3.NormalizeBucketLocation(aws.StringValue(location.LocationConstraint))
+	if e.locations == nil {
+		e.locations = make(map[string]string)
+	}
+	e.locations[*bucketName] = loc
+	return loc, nil
+}
+
+// bucketClient returns the client of the region of the bucket, avoiding
+// stuffs like:
+// AuthorizationHeaderMalformed: The authorization header is malformed; the region 'us-east-1' is wrong
+func (e *S3Processor) bucketClient(ctx context.Context, bucketName *string) (s3iface.S3API, error) {
+	loc, err := e.location(ctx, bucketName)
+	if err != nil {
+		return nil, err
+	}
+	return e.client(loc), nil
+}
+
+// isAccessDenied checks if the error is due to missing permissions
+func isAccessDenied(err error) bool {
+	aerr, ok := err.(awserr.Error)
+	return ok && (aerr.Code() == "AccessDenied" || aerr.Code() == "AllAccessDisabled")
 }
 
 // TagsToMap transform the s3 tags structure into a map[string]string for
@@ -33,64 +101,148 @@ func (e *S3Processor) TagsToMap(tagsInput []*s3.Tag) map[string]string {
 	return tagsHash
 }
 
-// SetTags sets tags on a s3 bucket
+// SetTags sets tags on a s3 bucket. As PutBucketTagging replaces the whole tag
+// set, the given tags are merged into the current tag set of the bucket. Like
+// the write, the reads it depends on are never cancelled.
 func (e *S3Processor) SetTags(resourceID *string, tags []*mapper.TagItem) error {
-	newTags := s3.Tagging{}
+	changes := []*mapper.TagItem{}
 	for _, tag := range tags {
 		if len((*tag).Name) > 0 {
-			newTags.TagSet = append(newTags.TagSet, &s3.Tag{Key: aws.String((*tag).Name), Value: aws.String((*tag).Value)})
+			changes = append(changes, tag)
 		}
 	}
+	if len(changes) == 0 {
+		return nil
+	}
 
-	if len(newTags.TagSet) == 0 {
+	ctx := aws.BackgroundContext()
+	svc, err := e.bucketClient(ctx, resourceID)
+	if err != nil {
+		return err
+	}
+	current, err := getTagSet(ctx, svc, resourceID)
+	if err != nil {
+		return err
+	}
+	newTags, changed := mergeTagSet(current, changes)
+	if !changed {
 		return nil
 	}
-	_, err := e.svc.PutBucketTagging(&s3.PutBucketTaggingInput{Bucket: resourceID, Tagging: &newTags})
+	// The mapper never deletes tags, so a smaller tag set means the merge went
+	// wrong
+	if len(newTags) < len(current) {
+		return fmt.Errorf("refusing to replace the %d tags of the bucket with %d tags", len(current), len(newTags))
+	}
+	_, err = svc.PutBucketTagging(&s3.PutBucketTaggingInput{Bucket: resourceID, Tagging: &s3.Tagging{TagSet: newTags}})
 	return err
 }
 
-// RetagBuckets parses all buckets and retags them
-func (e *S3Processor) RetagBuckets(m mapper.Iface) {
-	result, err := e.svc.ListBuckets(&s3.ListBucketsInput{})
+// getTagSet returns the current tags of a bucket, empty when it has none
+func getTagSet(ctx context.Context, svc s3iface.S3API, bucketName *string) ([]*s3.Tag, error) {
+	bTags, err := svc.GetBucketTaggingWithContext(ctx, &s3.GetBucketTaggingInput{Bucket: bucketName})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); !ok || aerr.Code() != "NoSuchTagSet" {
+			return nil, err
+		}
+		// ignore errors when not tagset associated to the bucket
+		return []*s3.Tag{}, nil
+	}
+	return bTags.TagSet, nil
+}
+
+// mergeTagSet returns the current tags updated with the changes, in the order
+// of the current tags followed by the new ones, and if anything changed
+func mergeTagSet(current []*s3.Tag, changes []*mapper.TagItem) ([]*s3.Tag, bool) {
+	values := make(map[string]string)
+	for _, tag := range changes {
+		values[tag.Name] = tag.Value
+	}
+
+	changed := false
+	merged := []*s3.Tag{}
+	for _, tag := range current {
+		if v, ok := values[*tag.Key]; ok {
+			if v != aws.StringValue(tag.Value) {
+				changed = true
+			}
+			tag = &s3.Tag{Key: tag.Key, Value: aws.String(v)}
+			delete(values, *tag.Key)
+		}
+		merged = append(merged, tag)
+	}
+	for _, tag := range changes {
+		if v, ok := values[tag.Name]; ok {
+			merged = append(merged, &s3.Tag{Key: aws.String(tag.Name), Value: aws.String(v)})
+			delete(values, tag.Name)
+			changed = true
+		}
+	}
+	return merged, changed
+}
+
+// RetagBuckets parses all buckets and retags them, region by region. The
+// buckets that cannot be located for lack of permissions are skipped. Once
+// the context is cancelled, no more bucket is processed.
+func (e *S3Processor) RetagBuckets(ctx context.Context, m mapper.Iface) {
+	result, err := e.svc.ListBucketsWithContext(ctx, &s3.ListBucketsInput{})
+	if interrupted(ctx, err) {
+		return
+	}
 	if err != nil {
 		log.WithFields(logrus.Fields{"error": err}).Fatal("ListBuckets failed")
 	}
 
+	byRegion := make(map[string][]*string)
 	for _, bucket := range result.Buckets {
-		// Makes sure we are in the right region and avoid stuffs like:
-		// AuthorizationHeaderMalformed: The authorization header is malformed; the region 'us-east-1' is wrong
-		if location, err := e.svc.GetBucketLocation(&s3.GetBucketLocationInput{Bucket: bucket.Name}); err != nil {
-			log.WithFields(logrus.Fields{"bucket": *bucket.Name, "error": err.Error()}).Fatal("GetBucketLocation failed")
-		} else {
-			loc := ""
-			if location.LocationConstraint != nil {
-				loc = *location.LocationConstraint
-			}
-			loc = s3.NormalizeBucketLocation(loc)
-			if loc != *e.region {
-				log.WithFields(logrus.Fields{"bucket": *bucket.Name, "location": loc}).Debug("Skipping bucket in different region than session")
-				continue // skip if the bucket is not the one specified in the session region
-			}
+		loc, err := e.location(ctx, bucket.Name)
+		if interrupted(ctx, err) {
+			return
 		}
-		// Get the tags
-		bTags, err := e.svc.GetBucketTagging(&s3.GetBucketTaggingInput{Bucket: bucket.Name})
 		if err != nil {
-			emptyTag := false
-			if aerr, ok := err.(awserr.Error); ok {
-				switch aerr.Code() {
-				case "NoSuchTagSet":
-					emptyTag = true // ignore errors when not tagset associated to the bucket
-				}
-			}
-			if !emptyTag {
-				log.WithFields(logrus.Fields{"bucket": *bucket.Name, "error": err.Error()}).Fatal("GetBucketTagging failed")
+			if isAccessDenied(err) {
+				log.WithFields(logrus.Fields{"bucket": *bucket.Name, "error": err.Error()}).Warn("Skipping bucket, GetBucketLocation denied")
+				continue
 			}
+			log.WithFields(logrus.Fields{"bucket": *bucket.Name, "error": err.Error()}).Fatal("GetBucketLocation failed")
 		}
-		tags := e.TagsToMap(bTags.TagSet)
-		keys := []string{}
-		if bucket.Name != nil {
-			keys = append(keys, *bucket.Name)
+		byRegion[loc] = append(byRegion[loc], bucket.Name)
+	}
+
+	regions := []string{}
+	for region := range byRegion {
+		regions = append(regions, region)
+	}
+	sort.Strings(regions)
+	for _, region := range regions {
+		svc := e.client(region)
+		log.WithFields(logrus.Fields{"region": region, "buckets": len(byRegion[region])}).Debug("Retagging the buckets of the region")
+		for _, bucketName := range byRegion[region] {
+			if err = e.retagBucket(ctx, m, svc, bucketName); interrupted(ctx, err) {
+				return
+			} else if err != nil {
+				log.WithFields(logrus.Fields{"bucket": *bucketName, "error": err.Error()}).Fatal("GetBucketTagging failed")
+			}
 		}
-		m.Retag(bucket.Name, &tags, keys, e.SetTags)
 	}
 }
+
+// RetagBucket retags the bucket of the given name through the client of its
+// region
+func (e *S3Processor) RetagBucket(ctx context.Context, m mapper.Iface, bucketName *string) error {
+	svc, err := e.bucketClient(ctx, bucketName)
+	if err != nil {
+		return err
+	}
+	return e.retagBucket(ctx, m, svc, bucketName)
+}
+
+func (e *S3Processor) retagBucket(ctx context.Context, m mapper.Iface, svc s3iface.S3API, bucketName *string) error {
+	tagSet, err := getTagSet(ctx, svc, bucketName)
+	if err != nil {
+		return err
+	}
+	tags := e.TagsToMap(tagSet)
+	keys := []string{*bucketName}
+	m.Retag(ctx, bucketName, &tags, keys, mapper.Constrain(&mapper.DefaultConstraints, tags, mapper.Direct(e.SetTags)))
+	return nil
+}
@@ -1,11 +1,14 @@
 package providers
 
 import (
+	"context"
 	"errors"
 	"reflect"
 	"testing"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3iface"
 	"github.com/sirupsen/logrus"
@@ -32,6 +35,10 @@ type mockS3Client struct {
 	BucketsTags map[string][]*s3.Tag
 	// BucketsErrors output error of a given bucket for GetBucketTagging
 	BucketsErrors map[string]error
+	// LocationErrors output error of a given bucket for GetBucketLocation
+	LocationErrors map[string]error
+	// LocationCalls is the number of GetBucketLocation calls
+	LocationCalls int
 }
 
 func (m *mockS3Client) PutBucketTagging(input *s3.PutBucketTaggingInput) (*s3.PutBucketTaggingOutput, error) {
@@ -42,7 +49,7 @@ func (m *mockS3Client) PutBucketTagging(input *s3.PutBucketTaggingInput) (*s3.Pu
 	return &s3.PutBucketTaggingOutput{}, m.ReturnError
 }
 
-func (m *mockS3Client) ListBuckets(input *s3.ListBucketsInput) (*s3.ListBucketsOutput, error) {
+func (m *mockS3Client) ListBucketsWithContext(ctx aws.Context, input *s3.ListBucketsInput, opts ...request.Option) (*s3.ListBucketsOutput, error) {
 	buckets := []*s3.Bucket{}
 	for bucket := range m.BucketsNRegions {
 		buckets = append(buckets, &s3.Bucket{Name: aws.String(bucket)})
@@ -51,12 +58,13 @@ func (m *mockS3Client) ListBuckets(input *s3.ListBucketsInput) (*s3.ListBucketsO
 	return &output, m.ReturnError
 }
 
-func (m *mockS3Client) GetBucketLocation(input *s3.GetBucketLocationInput) (*s3.GetBucketLocationOutput, error) {
+func (m *mockS3Client) GetBucketLocationWithContext(ctx aws.Context, input *s3.GetBucketLocationInput, opts ...request.Option) (*s3.GetBucketLocationOutput, error) {
+	m.LocationCalls++
 	region, _ := m.BucketsNRegions[*input.Bucket]
-	return &s3.GetBucketLocationOutput{LocationConstraint: aws.String(region)}, nil
+	return &s3.GetBucketLocationOutput{LocationConstraint: aws.String(region)}, m.LocationErrors[*input.Bucket]
 }
 
-func (m *mockS3Client) GetBucketTagging(input *s3.GetBucketTaggingInput) (*s3.GetBucketTaggingOutput, error) {
+func (m *mockS3Client) GetBucketTaggingWithContext(ctx aws.Context, input *s3.GetBucketTaggingInput, opts ...request.Option) (*s3.GetBucketTaggingOutput, error) {
 	var (
 		tags      []*s3.Tag
 		outputErr error
@@ -88,18 +96,47 @@ func TestS3TagsToMap(t *testing.T) {
 func TestS3SetTags(t *testing.T) {
 	testData := []struct {
 		inputResource, outputResource string
+		currentTags                   []*s3.Tag
 		inputTags                     []*mapper.TagItem
 		outputTags                    []*s3.Tag
-		inputError, outputError       error
+		getError, inputError          error
+		outputError                   error
 	}{
-		{"my resource", "", []*mapper.TagItem{{}}, []*s3.Tag{}, nil, nil},
-		{"my resource", "my resource", []*mapper.TagItem{{Name: "foo", Value: "bar"}}, []*s3.Tag{{Key: aws.String("foo"), Value: aws.String("bar")}}, nil, nil},
-		{"my resource", "my resource", []*mapper.TagItem{{Name: "foo", Value: "bar"}, {Name: "Aerosmith", Value: "rocks"}}, []*s3.Tag{{Key: aws.String("foo"), Value: aws.String("bar")}, {Key: aws.String("Aerosmith"), Value: aws.String("rocks")}}, nil, nil},
-		{"my resource", "my resource", []*mapper.TagItem{{Name: "foo", Value: "bar"}}, []*s3.Tag{{Key: aws.String("foo"), Value: aws.String("bar")}}, errors.New("Badaboom"), errors.New("Badaboom")},
+		{"my resource", "", nil, []*mapper.TagItem{{}}, []*s3.Tag{}, nil, nil, nil},
+		{"my resource", "my resource", nil, []*mapper.TagItem{{Name: "foo", Value: "bar"}}, []*s3.Tag{{Key: aws.String("foo"), Value: aws.String("bar")}}, nil, nil, nil},
+		{"my resource", "my resource", nil, []*mapper.TagItem{{Name: "foo", Value: "bar"}, {Name: "Aerosmith", Value: "rocks"}}, []*s3.Tag{{Key: aws.String("foo"), Value: aws.String("bar")}, {Key: aws.String("Aerosmith"), Value: aws.String("rocks")}}, nil, nil, nil},
+		{"my resource", "my resource", nil, []*mapper.TagItem{{Name: "foo", Value: "bar"}}, []*s3.Tag{{Key: aws.String("foo"), Value: aws.String("bar")}}, nil, errors.New("Badaboom"), errors.New("Badaboom")},
+		// the existing tags are kept
+		{
+			"my resource", "my resource",
+			[]*s3.Tag{{Key: aws.String("CostCenter"), Value: aws.String("42")}, {Key: aws.String("aws:cloudformation:stack-name"), Value: aws.String("web")}},
+			[]*mapper.TagItem{{Name: "foo", Value: "bar"}},
+			[]*s3.Tag{{Key: aws.String("CostCenter"), Value: aws.String("42")}, {Key: aws.String("aws:cloudformation:stack-name"), Value: aws.String("web")}, {Key: aws.String("foo"), Value: aws.String("bar")}},
+			nil, nil, nil,
+		},
+		// the existing tags are updated in place
+		{
+			"my resource", "my resource",
+			[]*s3.Tag{{Key: aws.String("Env"), Value: aws.String("prod")}, {Key: aws.String("CostCenter"), Value: aws.String("42")}},
+			[]*mapper.TagItem{{Name: "Team", Value: "web"}, {Name: "Env", Value: "prd"}},
+			[]*s3.Tag{{Key: aws.String("Env"), Value: aws.String("prd")}, {Key: aws.String("CostCenter"), Value: aws.String("42")}, {Key: aws.String("Team"), Value: aws.String("web")}},
+			nil, nil, nil,
+		},
+		// nothing written when nothing changes
+		{"my resource", "", []*s3.Tag{{Key: aws.String("Env"), Value: aws.String("prd")}}, []*mapper.TagItem{{Name: "Env", Value: "prd"}}, []*s3.Tag{}, nil, nil, nil},
+		// a bucket without tag set has no existing tags
+		{"my resource", "my resource", nil, []*mapper.TagItem{{Name: "foo", Value: "bar"}}, []*s3.Tag{{Key: aws.String("foo"), Value: aws.String("bar")}}, awserr.New("NoSuchTagSet", "The TagSet does not exist", nil), nil, nil},
+		// nothing written when the existing tags cannot be read
+		{"my resource", "", nil, []*mapper.TagItem{{Name: "foo", Value: "bar"}}, []*s3.Tag{}, errors.New("Badaboom"), nil, errors.New("Badaboom")},
 	}
 	for _, d := range testData {
-		mockSvc := &mockS3Client{ReturnError: d.inputError, ResourceTags: []*s3.Tag{}}
-		p := S3Processor{svc: mockSvc}
+		mockSvc := &mockS3Client{
+			ReturnError:   d.inputError,
+			ResourceTags:  []*s3.Tag{},
+			BucketsTags:   map[string][]*s3.Tag{d.inputResource: d.currentTags},
+			BucketsErrors: map[string]error{d.inputResource: d.getError},
+		}
+		p := S3Processor{svc: mockSvc, region: aws.String("us-east-1")}
 
 		err := p.SetTags(&d.inputResource, d.inputTags)
 		if !reflect.DeepEqual(err, d.outputError) {
@@ -122,6 +159,21 @@ func TestS3SetTags(t *testing.T) {
 	}
 }
 
+func TestMergeTagSet(t *testing.T) {
+	current := []*s3.Tag{{Key: aws.String("Env"), Value: aws.String("prd")}, {Key: aws.String("Team"), Value: aws.String("web")}}
+	merged, changed := mergeTagSet(current, []*mapper.TagItem{{Name: "Team", Value: "data"}})
+	expected := []*s3.Tag{{Key: aws.String("Env"), Value: aws.String("prd")}, {Key: aws.String("Team"), Value: aws.String("data")}}
+	if !changed || !reflect.DeepEqual(expected, merged) {
+		t.Errorf("Expecting: %v (changed)\nGot: %v (changed: %v)\n", expected, merged, changed)
+	}
+	if aws.StringValue(current[1].Value) != "web" {
+		t.Errorf("The current tag set should not be modified, got: %v\n", current)
+	}
+	if merged, changed = mergeTagSet(current, []*mapper.TagItem{{Name: "Env", Value: "prd"}}); changed || !reflect.DeepEqual(current, merged) {
+		t.Errorf("Expecting no change, got: %v\n", merged)
+	}
+}
+
 func TestS3RetagBuckets(t *testing.T) {
 	testData := []struct {
 		sessionRegion        string
@@ -130,23 +182,30 @@ func TestS3RetagBuckets(t *testing.T) {
 		outputBucketsTags    map[string]map[string]string
 		outputBucketsKeys    map[string][]string
 		inputBucketsErrors   map[string]error
+		inputLocationErrors  map[string]error
+		outputClients        []string
 	}{
-		{"us-east-1", map[string]string{}, map[string][]*s3.Tag{}, nil, nil, map[string]error{}},
+		{"us-east-1", map[string]string{}, map[string][]*s3.Tag{}, nil, nil, map[string]error{}, nil, []string{}},
 		{
 			"us-east-1",
-			map[string]string{"bucket1": "us-east-1", "bucket2": "us-east-1", "homerSimpson": "us-west-2"},
+			map[string]string{"bucket1": "", "bucket2": "us-east-1", "homerSimpson": "us-west-2"},
 			map[string][]*s3.Tag{"bucket1": {&s3.Tag{Key: aws.String("Team"), Value: aws.String("Gryffindor")}, &s3.Tag{Key: aws.String("Strength"), Value: aws.String("chivalry")}}, "homerSimpson": {&s3.Tag{Key: aws.String("Team"), Value: aws.String("Nuclear")}}},
-			map[string]map[string]string{"bucket1": {"Team": "Gryffindor", "Strength": "chivalry"}, "bucket2": {}},
-			map[string][]string{"bucket1": {"bucket1"}, "bucket2": {"bucket2"}},
+			map[string]map[string]string{"bucket1": {"Team": "Gryffindor", "Strength": "chivalry"}, "bucket2": {}, "homerSimpson": {"Team": "Nuclear"}},
+			map[string][]string{"bucket1": {"bucket1"}, "bucket2": {"bucket2"}, "homerSimpson": {"homerSimpson"}},
 			map[string]error{},
+			nil,
+			[]string{"us-west-2"},
 		},
+		// the buckets that cannot be located are skipped
 		{
 			"us-west-2",
-			map[string]string{"bucket1": "us-east-1", "bucket2": "us-east-1", "homerSimpson": "us-west-2"},
-			map[string][]*s3.Tag{"bucket1": {&s3.Tag{Key: aws.String("Team"), Value: aws.String("Gryffindor")}, &s3.Tag{Key: aws.String("Strength"), Value: aws.String("chivalry")}}, "homerSimpson": {&s3.Tag{Key: aws.String("Team"), Value: aws.String("Nuclear")}}},
-			map[string]map[string]string{"homerSimpson": {"Team": "Nuclear"}},
-			map[string][]string{"homerSimpson": {"homerSimpson"}},
+			map[string]string{"bucket1": "EU", "bucket2": "us-east-1", "homerSimpson": "us-west-2"},
+			map[string][]*s3.Tag{"bucket1": {&s3.Tag{Key: aws.String("Team"), Value: aws.String("Gryffindor")}}, "homerSimpson": {&s3.Tag{Key: aws.String("Team"), Value: aws.String("Nuclear")}}},
+			map[string]map[string]string{"bucket1": {"Team": "Gryffindor"}, "homerSimpson": {"Team": "Nuclear"}},
+			map[string][]string{"bucket1": {"bucket1"}, "homerSimpson": {"homerSimpson"}},
 			map[string]error{},
+			map[string]error{"bucket2": awserr.New("AccessDenied", "Access Denied", nil)},
+			[]string{"eu-west-1"},
 		},
 	}
 
@@ -155,10 +214,14 @@ func TestS3RetagBuckets(t *testing.T) {
 	log = logrus.NewEntry(logger)
 
 	for _, d := range testData {
-		mockSvc := &mockS3Client{BucketsNRegions: d.inputBucketsNRegions, BucketsTags: d.inputBucketsTags, BucketsErrors: d.inputBucketsErrors}
+		mockSvc := &mockS3Client{BucketsNRegions: d.inputBucketsNRegions, BucketsTags: d.inputBucketsTags, BucketsErrors: d.inputBucketsErrors, LocationErrors: d.inputLocationErrors}
 		m := mapper.MockMapper{}
-		p := S3Processor{svc: mockSvc, region: &d.sessionRegion}
-		p.RetagBuckets(&m)
+		clients := []string{}
+		p := S3Processor{svc: mockSvc, region: &d.sessionRegion, newClient: func(region string) s3iface.S3API {
+			clients = append(clients, region)
+			return mockSvc
+		}}
+		p.RetagBuckets(context.Background(), &m)
 
 		if !reflect.DeepEqual(d.outputBucketsTags, m.ResourceTags) {
 			t.Errorf("Expecting Mapper.Retag to receive tags: %v\nGot: %v\n", d.outputBucketsTags, m.ResourceTags)
@@ -168,5 +231,19 @@ func TestS3RetagBuckets(t *testing.T) {
 			t.Errorf("Expecting Mapper.Retag to receive keys: %v\nGot: %v\n", d.outputBucketsKeys, m.ResourceKeys)
 		}
 
+		if !reflect.DeepEqual(d.outputClients, clients) {
+			t.Errorf("Expecting clients to be created for: %v\nGot: %v\n", d.outputClients, clients)
+		}
+
+		// the buckets are located once
+		if len(d.inputBucketsNRegions) == 0 {
+			continue
+		}
+		if err := p.SetTags(aws.String("homerSimpson"), []*mapper.TagItem{{Name: "foo", Value: "bar"}}); err != nil {
+			t.Errorf("Unexpected error: %v\n", err)
+		}
+		if located := len(d.inputBucketsNRegions); mockSvc.LocationCalls != located {
+			t.Errorf("Expecting %d GetBucketLocation calls, got: %d\n", located, mockSvc.LocationCalls)
+		}
 	}
 }
@@ -0,0 +1,60 @@
+package providers
+
+import (
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/resourcegroupstaggingapi"
+	"github.com/aws/aws-sdk-go/service/resourcegroupstaggingapi/resourcegroupstaggingapiiface"
+
+	"github.com/VEVO/awsRetagger/mapper"
+)
+
+// taggingBatchSize is the maximum number of ARNs of a TagResources call
+const taggingBatchSize = 20
+
+// TaggingWriter sets the tags of the resources identified by their ARN
+// through the Resource Groups Tagging API, which accepts several resources
+// per call
+type TaggingWriter struct {
+	svc resourcegroupstaggingapiiface.ResourceGroupsTaggingAPIAPI
+}
+
+// NewTaggingWriter creates a new instance of TaggingWriter containing an
+// already initialized resourcegroupstaggingapi client
+func NewTaggingWriter(sess *session.Session) *TaggingWriter {
+	return &TaggingWriter{svc: resourcegroupstaggingapi.New(sess)}
+}
+
+// SetTagsBatch sets the same tags on several resources with a single call and
+// returns the errors of the resources that failed
+func (w *TaggingWriter) SetTagsBatch(resourceARNs []*string, tags []*mapper.TagItem) map[string]error {
+	newTags := make(map[string]*string)
+	for _, tag := range tags {
+		if len((*tag).Name) > 0 {
+			newTags[(*tag).Name] = aws.String((*tag).Value)
+		}
+	}
+	if len(newTags) == 0 || len(resourceARNs) == 0 {
+		return nil
+	}
+	errs := make(map[string]error)
+	result, err := w.svc.TagResources(&resourcegroupstaggingapi.TagResourcesInput{ResourceARNList: resourceARNs, Tags: newTags})
+	if err != nil {
+		for _, arn := range resourceARNs {
+			errs[*arn] = err
+		}
+		return errs
+	}
+	for arn, failure := range result.FailedResourcesMap {
+		errs[arn] = fmt.Errorf("%s: %s", aws.StringValue(failure.ErrorCode), aws.StringValue(failure.ErrorMessage))
+	}
+	return errs
+}
+
+// NewBatcher creates a Batcher sending the tags of up to 20 resources per
+// TagResources call
+func (w *TaggingWriter) NewBatcher() *mapper.Batcher {
+	return mapper.NewBatcher(taggingBatchSize, w.SetTagsBatch)
+}
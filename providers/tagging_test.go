@@ -0,0 +1,55 @@
+package providers
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/resourcegroupstaggingapi"
+	"github.com/aws/aws-sdk-go/service/resourcegroupstaggingapi/resourcegroupstaggingapiiface"
+
+	"github.com/VEVO/awsRetagger/mapper"
+)
+
+// mockTaggingClient is used to mock the resourcegroupstaggingapi calls
+type mockTaggingClient struct {
+	resourcegroupstaggingapiiface.ResourceGroupsTaggingAPIAPI
+	// Inputs are the inputs of the TagResources calls
+	Inputs []*resourcegroupstaggingapi.TagResourcesInput
+	// Failed are the resources reported as failed
+	Failed map[string]*resourcegroupstaggingapi.FailureInfo
+	// ReturnError is the error that you want your mocked function to return
+	ReturnError error
+}
+
+func (m *mockTaggingClient) TagResources(input *resourcegroupstaggingapi.TagResourcesInput) (*resourcegroupstaggingapi.TagResourcesOutput, error) {
+	m.Inputs = append(m.Inputs, input)
+	return &resourcegroupstaggingapi.TagResourcesOutput{FailedResourcesMap: m.Failed}, m.ReturnError
+}
+
+func TestTaggingSetTagsBatch(t *testing.T) {
+	arns := aws.StringSlice([]string{"arn:db-1", "arn:db-2"})
+	tags := []*mapper.TagItem{{Name: "foo", Value: "bar"}, {}}
+
+	mockSvc := &mockTaggingClient{Failed: map[string]*resourcegroupstaggingapi.FailureInfo{
+		"arn:db-2": {ErrorCode: aws.String("InvalidParameterException"), ErrorMessage: aws.String("Badaboom")},
+	}}
+	w := TaggingWriter{svc: mockSvc}
+	errs := w.SetTagsBatch(arns, tags)
+	expected := map[string]error{"arn:db-2": errors.New("InvalidParameterException: Badaboom")}
+	if !reflect.DeepEqual(errs, expected) {
+		t.Errorf("Expecting errors: %v\nGot: %v\n", expected, errs)
+	}
+	expectedInput := &resourcegroupstaggingapi.TagResourcesInput{ResourceARNList: arns, Tags: map[string]*string{"foo": aws.String("bar")}}
+	if len(mockSvc.Inputs) != 1 || !reflect.DeepEqual(mockSvc.Inputs[0], expectedInput) {
+		t.Errorf("Expecting a single call with: %v\nGot: %v\n", expectedInput, mockSvc.Inputs)
+	}
+
+	// all the resources fail with the call
+	w = TaggingWriter{svc: &mockTaggingClient{ReturnError: errors.New("Badaboom")}}
+	expected = map[string]error{"arn:db-1": errors.New("Badaboom"), "arn:db-2": errors.New("Badaboom")}
+	if errs = w.SetTagsBatch(arns, tags); !reflect.DeepEqual(errs, expected) {
+		t.Errorf("Expecting errors: %v\nGot: %v\n", expected, errs)
+	}
+}
@@ -0,0 +1,197 @@
+package runner
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/VEVO/awsRetagger/mapper"
+)
+
+// Checkpoint records the progress of a run so it can be resumed. RunSteps
+// updates it under a lock, so it can be saved from another goroutine through
+// Snapshot.
+type Checkpoint struct {
+	mu sync.Mutex
+	// RunID identifies the run, when it can be resumed on demand
+	RunID string `json:"run_id,omitempty"`
+	// ConfigHash is the version of the config of the run
+	ConfigHash string `json:"config_hash,omitempty"`
+	// Done are the names of the completed steps
+	Done []string `json:"done"`
+	// Step is the name of the step in progress
+	Step string `json:"step,omitempty"`
+	// Token is the pagination token of the page in progress of the step, for
+	// the steps whose listing can resume from a page
+	Token string `json:"token,omitempty"`
+	// Processed are the resources of the step in progress already processed,
+	// since the page in progress for the steps with a pagination token
+	Processed []string `json:"processed,omitempty"`
+}
+
+// Snapshot returns a copy of the checkpoint taken under its lock
+func (cp *Checkpoint) Snapshot() *Checkpoint {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	return &Checkpoint{
+		RunID:      cp.RunID,
+		ConfigHash: cp.ConfigHash,
+		Done:       append([]string(nil), cp.Done...),
+		Step:       cp.Step,
+		Token:      cp.Token,
+		Processed:  append([]string(nil), cp.Processed...),
+	}
+}
+
+// update applies the given change to the checkpoint under its lock
+func (cp *Checkpoint) update(change func()) {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	change()
+}
+
+// Autosave saves the checkpoint of a run after each step and periodically
+// while a step runs
+type Autosave struct {
+	// Interval is the minimum time between two saves while a step runs
+	Interval time.Duration
+	// Save persists the checkpoint
+	Save  func(cp *Checkpoint) error
+	saved time.Time
+}
+
+// due checks if the checkpoint is to be saved: when forced or when the
+// interval elapsed since the previous save. a can be nil.
+func (a *Autosave) due(force bool) bool {
+	return a != nil && a.Save != nil && (force || time.Since(a.saved) >= a.Interval)
+}
+
+// save saves the checkpoint when due. a can be nil.
+func (a *Autosave) save(cp *Checkpoint, force bool) {
+	if !a.due(force) {
+		return
+	}
+	a.saved = time.Now()
+	if err := a.Save(cp); err != nil {
+		log.WithFields(logrus.Fields{"error": err, "step": cp.Step}).Error("Unable to save the checkpoint")
+	}
+}
+
+// RunSteps runs the steps that are not done yet in the checkpoint, skipping
+// the resources already processed, and updates the checkpoint as it goes,
+// saving it through autosave when not nil. Once the deadline is reached or the
+// context is cancelled, the remaining resources are skipped and false is
+// returned. The steps run with a context expiring at the deadline, so their
+// listings and reads stop as well. A zero deadline means no deadline.
+func RunSteps(ctx context.Context, steps []Step, m mapper.Iface, cp *Checkpoint, deadline time.Time, autosave *Autosave) bool {
+	if !deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+	}
+	return runSteps(ctx, steps, m, cp, func() time.Time { return deadline }, autosave)
+}
+
+func runSteps(ctx context.Context, steps []Step, m mapper.Iface, cp *Checkpoint, deadline func() time.Time, autosave *Autosave) bool {
+	done := map[string]bool{}
+	for _, name := range cp.Done {
+		done[name] = true
+	}
+	for _, step := range steps {
+		if done[step.Name] {
+			continue
+		}
+		if cp.Step != step.Name {
+			cp.update(func() { cp.Step, cp.Token, cp.Processed = step.Name, "", nil })
+		}
+		dm := &deadlineMapper{Iface: m, checkpoint: cp, deadline: deadline, processed: map[string]bool{}, autosave: autosave, flush: step.flush}
+		for _, id := range cp.Processed {
+			dm.processed[id] = true
+		}
+		if step.Pagination != nil {
+			step.Pagination.Start = cp.Token
+			step.Pagination.OnPage = func(token string) {
+				if token != cp.Token {
+					// the resources of the previous pages are not listed again,
+					// so their batched tags are sent first
+					dm.flush()
+					cp.update(func() { cp.Token, cp.Processed = token, nil })
+					autosave.save(cp, false)
+				}
+			}
+		}
+
+		step.Run(ctx, dm)
+		step.flush()
+		if dm.expired || ctx.Err() == context.DeadlineExceeded {
+			log.WithFields(logrus.Fields{"step": step.Name, "processed": len(cp.Processed)}).Warn("Deadline reached, stopping the run")
+			return false
+		}
+		if ctx.Err() != nil {
+			log.WithFields(logrus.Fields{"step": step.Name, "processed": len(cp.Processed)}).Warn("Run interrupted, stopping the run")
+			return false
+		}
+		cp.update(func() {
+			cp.Done = append(cp.Done, step.Name)
+			cp.Step, cp.Token, cp.Processed = "", "", nil
+		})
+		autosave.save(cp, true)
+	}
+	return true
+}
+
+// deadlineMapper skips the resources already processed and all the resources
+// once the deadline is reached, recording the processed ones in the
+// checkpoint
+type deadlineMapper struct {
+	mapper.Iface
+	checkpoint *Checkpoint
+	deadline   func() time.Time
+	processed  map[string]bool
+	expired    bool
+	autosave   *Autosave
+	// flush sends the tags batched by the step
+	flush func() int
+}
+
+// Retag calls the actual Retag for the resources to process before the
+// deadline. A resource is recorded as processed once its tags are written,
+// the batched tags being sent before each save of the checkpoint, or at once
+// when it needs no change. The resources which tags failed to be written and
+// the ones left unwritten once the context is cancelled are not recorded, so
+// they are processed again on resume.
+func (m *deadlineMapper) Retag(ctx context.Context, resourceID *string, tags *map[string]string, keys []string, setTags mapper.PutTagFn) {
+	if m.processed[*resourceID] {
+		return
+	}
+	if m.expired || (!m.deadline().IsZero() && time.Now().After(m.deadline())) {
+		m.expired = true
+		return
+	}
+	id := *resourceID
+	written := false
+	m.Iface.Retag(ctx, resourceID, tags, keys, func(rid *string, items []*mapper.TagItem, done mapper.WrittenFn) error {
+		written = true
+		return setTags(rid, items, func(items []*mapper.TagItem, err error) {
+			if err == nil {
+				m.process(id)
+			}
+			done.Report(items, err)
+		})
+	})
+	if !written && ctx.Err() == nil {
+		m.process(id)
+	}
+	if m.autosave.due(false) {
+		m.flush()
+		m.autosave.save(m.checkpoint, true)
+	}
+}
+
+// process records the resource as processed
+func (m *deadlineMapper) process(id string) {
+	m.processed[id] = true
+	m.checkpoint.update(func() { m.checkpoint.Processed = append(m.checkpoint.Processed, id) })
+}
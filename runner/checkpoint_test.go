@@ -0,0 +1,299 @@
+package runner
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	logrus_test "github.com/sirupsen/logrus/hooks/test"
+
+	"github.com/VEVO/awsRetagger/mapper"
+	"github.com/VEVO/awsRetagger/providers"
+)
+
+// retagStep returns a step retagging the given resources, calling before on
+// each of them first
+func retagStep(name string, ids []string, before func(id string)) Step {
+	return Step{Name: name, Run: func(ctx context.Context, m mapper.Iface) {
+		for _, id := range ids {
+			before(id)
+			resourceID := id
+			m.Retag(ctx, &resourceID, &map[string]string{}, []string{}, nil)
+		}
+	}}
+}
+
+func TestRunSteps(t *testing.T) {
+	logger, _ := logrus_test.NewNullLogger()
+	log = logrus.NewEntry(logger)
+
+	testData := []struct {
+		checkpoint         *Checkpoint
+		expireAt           string
+		outputCheckpoint   *Checkpoint
+		outputComplete     bool
+		outputRetaggedKeys []string
+	}{
+		{&Checkpoint{}, "", &Checkpoint{Done: []string{"ec2", "s3"}}, true, []string{"b1", "b2", "i-1", "i-2", "i-3"}},
+		{&Checkpoint{}, "i-3", &Checkpoint{Step: "ec2", Processed: []string{"i-1", "i-2"}}, false, []string{"i-1", "i-2"}},
+		{&Checkpoint{Step: "ec2", Processed: []string{"i-1", "i-2"}}, "b2", &Checkpoint{Done: []string{"ec2"}, Step: "s3", Processed: []string{"b1"}}, false, []string{"b1", "i-3"}},
+		{&Checkpoint{Done: []string{"ec2"}, Step: "s3", Processed: []string{"b1"}}, "", &Checkpoint{Done: []string{"ec2", "s3"}}, true, []string{"b2"}},
+	}
+	for _, d := range testData {
+		deadline := time.Now().Add(time.Hour)
+		expire := func(id string) {
+			if id == d.expireAt {
+				deadline = time.Now().Add(-time.Second)
+			}
+		}
+		steps := []Step{
+			retagStep("ec2", []string{"i-1", "i-2", "i-3"}, expire),
+			retagStep("s3", []string{"b1", "b2"}, expire),
+		}
+		m := &mapper.MockMapper{}
+		cp := d.checkpoint
+		complete := runSteps(context.Background(), steps, m, cp, func() time.Time { return deadline }, nil)
+		if complete != d.outputComplete {
+			t.Errorf("Expecting complete to be %t, got %t\n", d.outputComplete, complete)
+		}
+		if !reflect.DeepEqual(cp, d.outputCheckpoint) {
+			t.Errorf("Expecting checkpoint %+v, got %+v\n", d.outputCheckpoint, cp)
+		}
+		retagged := []string{}
+		for id := range m.ResourceTags {
+			retagged = append(retagged, id)
+		}
+		sort.Strings(retagged)
+		if !reflect.DeepEqual(retagged, d.outputRetaggedKeys) {
+			t.Errorf("Expecting to retag %v, got %v\n", d.outputRetaggedKeys, retagged)
+		}
+	}
+}
+
+func TestRunStepsInterrupted(t *testing.T) {
+	logger, _ := logrus_test.NewNullLogger()
+	log = logrus.NewEntry(logger)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	interrupt := func(id string) {
+		if id == "i-2" {
+			cancel()
+		}
+	}
+	steps := []Step{
+		retagStep("ec2", []string{"i-1", "i-2", "i-3"}, interrupt),
+		retagStep("s3", []string{"b1", "b2"}, interrupt),
+	}
+	cp := &Checkpoint{}
+	if RunSteps(ctx, steps, &mapper.MockMapper{}, cp, time.Time{}, nil) {
+		t.Errorf("Expecting the interrupted run not to be complete\n")
+	}
+	// the resource reached once interrupted is processed again on resume
+	if expected := (&Checkpoint{Step: "ec2", Processed: []string{"i-1"}}); !reflect.DeepEqual(cp, expected) {
+		t.Errorf("Expecting checkpoint %+v, got %+v\n", expected, cp)
+	}
+}
+
+func TestRunStepsDeadlineContext(t *testing.T) {
+	logger, _ := logrus_test.NewNullLogger()
+	log = logrus.NewEntry(logger)
+
+	// the listing of the step stops at the deadline, before reaching any
+	// resource
+	listing := Step{Name: "ec2", Run: func(ctx context.Context, m mapper.Iface) {
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Second):
+			resourceID := "i-1"
+			m.Retag(ctx, &resourceID, &map[string]string{}, []string{}, nil)
+		}
+	}}
+	cp := &Checkpoint{}
+	m := &mapper.MockMapper{}
+	if RunSteps(context.Background(), []Step{listing}, m, cp, time.Now().Add(20*time.Millisecond), nil) {
+		t.Errorf("Expecting the run stopped at the deadline not to be complete\n")
+	}
+	if expected := (&Checkpoint{Step: "ec2"}); !reflect.DeepEqual(cp, expected) || len(m.ResourceTags) != 0 {
+		t.Errorf("Expecting checkpoint %+v without resource processed, got %+v and %v\n", expected, cp, m.ResourceTags)
+	}
+}
+
+// pagedStep returns a step listing the given pages of resources from the
+// token of its pagination, the token of a page being its index
+func pagedStep(name string, pages [][]string, before func(id string)) Step {
+	pagination := &providers.Pagination{}
+	return Step{Name: name, Pagination: pagination, Run: func(ctx context.Context, m mapper.Iface) {
+		start, _ := strconv.Atoi(pagination.Start)
+		for i := start; i < len(pages); i++ {
+			token := ""
+			if i > 0 {
+				token = strconv.Itoa(i)
+			}
+			pagination.OnPage(token)
+			for _, id := range pages[i] {
+				before(id)
+				resourceID := id
+				m.Retag(ctx, &resourceID, &map[string]string{}, []string{}, nil)
+			}
+		}
+	}}
+}
+
+func TestRunStepsPagination(t *testing.T) {
+	logger, _ := logrus_test.NewNullLogger()
+	log = logrus.NewEntry(logger)
+
+	testData := []struct {
+		checkpoint         *Checkpoint
+		expireAt           string
+		outputCheckpoint   *Checkpoint
+		outputComplete     bool
+		outputRetaggedKeys []string
+		outputSaves        int
+	}{
+		// saved on each new page, resource and step
+		{&Checkpoint{}, "", &Checkpoint{Done: []string{"ec2"}}, true, []string{"i-1", "i-2", "i-3", "i-4"}, 6},
+		{&Checkpoint{}, "i-4", &Checkpoint{Step: "ec2", Token: "1", Processed: []string{"i-3"}}, false, []string{"i-1", "i-2", "i-3"}, 4},
+		{&Checkpoint{Step: "ec2", Token: "1", Processed: []string{"i-3"}}, "", &Checkpoint{Done: []string{"ec2"}}, true, []string{"i-4"}, 2},
+	}
+	for _, d := range testData {
+		deadline := time.Now().Add(time.Hour)
+		expire := func(id string) {
+			if id == d.expireAt {
+				deadline = time.Now().Add(-time.Second)
+			}
+		}
+		steps := []Step{pagedStep("ec2", [][]string{{"i-1", "i-2"}, {"i-3", "i-4"}}, expire)}
+		m := &mapper.MockMapper{}
+		cp := d.checkpoint
+		saves := 0
+		autosave := &Autosave{Save: func(*Checkpoint) error { saves++; return nil }}
+		complete := runSteps(context.Background(), steps, m, cp, func() time.Time { return deadline }, autosave)
+		if complete != d.outputComplete {
+			t.Errorf("Expecting complete to be %t, got %t\n", d.outputComplete, complete)
+		}
+		if !reflect.DeepEqual(cp, d.outputCheckpoint) {
+			t.Errorf("Expecting checkpoint %+v, got %+v\n", d.outputCheckpoint, cp)
+		}
+		retagged := []string{}
+		for id := range m.ResourceTags {
+			retagged = append(retagged, id)
+		}
+		sort.Strings(retagged)
+		if !reflect.DeepEqual(retagged, d.outputRetaggedKeys) {
+			t.Errorf("Expecting to retag %v, got %v\n", d.outputRetaggedKeys, retagged)
+		}
+		if saves != d.outputSaves {
+			t.Errorf("Expecting %d saves, got %d\n", d.outputSaves, saves)
+		}
+	}
+}
+
+// writeMapper sets the same tag on all the resources
+type writeMapper struct {
+	mapper.Iface
+}
+
+func (m *writeMapper) Retag(ctx context.Context, resourceID *string, tags *map[string]string, keys []string, setTags mapper.PutTagFn) {
+	setTags(resourceID, []*mapper.TagItem{{Name: "team", Value: "data"}}, nil)
+}
+
+func TestRunStepsBatched(t *testing.T) {
+	logger, _ := logrus_test.NewNullLogger()
+	log = logrus.NewEntry(logger)
+	mapper.SetLogger(logrus.NewEntry(logger))
+
+	tagged := map[string]bool{}
+	b := mapper.NewBatcher(10, func(resourceIDs []*string, tags []*mapper.TagItem) map[string]error {
+		errs := map[string]error{}
+		for _, id := range resourceIDs {
+			if *id == "i-2" {
+				errs[*id] = errors.New("Badaboom")
+				continue
+			}
+			tagged[*id] = true
+		}
+		return errs
+	})
+	pagination := &providers.Pagination{}
+	step := Step{Name: "ec2", Flush: b.Flush, Pagination: pagination, Run: func(ctx context.Context, m mapper.Iface) {
+		for i, page := range [][]string{{"i-1", "i-2"}, {"i-3"}} {
+			token := ""
+			if i > 0 {
+				token = strconv.Itoa(i)
+			}
+			pagination.OnPage(token)
+			for _, id := range page {
+				resourceID := id
+				m.Retag(ctx, &resourceID, &map[string]string{}, []string{}, b.PutTagFn)
+			}
+		}
+	}}
+
+	saves := []string{}
+	autosave := &Autosave{Save: func(cp *Checkpoint) error {
+		for _, id := range cp.Processed {
+			if !tagged[id] {
+				t.Errorf("Expecting only the tagged resources to be processed, got %s in %+v\n", id, cp)
+			}
+		}
+		saves = append(saves, cp.Token+":"+strings.Join(cp.Processed, ","))
+		return nil
+	}}
+	cp := &Checkpoint{}
+	if !RunSteps(context.Background(), []Step{step}, &writeMapper{}, cp, time.Time{}, autosave) {
+		t.Errorf("Expecting the run to be complete\n")
+	}
+	// the failed resource is never processed and the batch is sent before the
+	// token moves
+	if expected := []string{":i-1", ":i-1", "1:", "1:i-3", ":"}; !reflect.DeepEqual(expected, saves) {
+		t.Errorf("Expecting the saves %v, got %v\n", expected, saves)
+	}
+}
+
+func TestCheckpointSnapshot(t *testing.T) {
+	logger, _ := logrus_test.NewNullLogger()
+	log = logrus.NewEntry(logger)
+
+	// the checkpoint is saved from another goroutine, like the exit handlers
+	// do, while the run updates it
+	cp := &Checkpoint{RunID: "run"}
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				cp.Snapshot()
+			}
+		}
+	}()
+	ids := make([]string, 100)
+	for i := range ids {
+		ids[i] = "i-" + strconv.Itoa(i)
+	}
+	RunSteps(context.Background(), []Step{retagStep("ec2", ids, func(string) {})}, &mapper.MockMapper{}, cp, time.Time{}, nil)
+	close(stop)
+	wg.Wait()
+
+	snapshot := cp.Snapshot()
+	if expected := (&Checkpoint{RunID: "run", Done: []string{"ec2"}}); !reflect.DeepEqual(snapshot, expected) {
+		t.Errorf("Expecting snapshot %+v, got %+v\n", expected, snapshot)
+	}
+	// the snapshot is not updated with the checkpoint
+	cp.update(func() { cp.Done = append(cp.Done, "s3") })
+	if len(snapshot.Done) != 1 {
+		t.Errorf("Expecting the snapshot to be a copy, got %+v\n", snapshot)
+	}
+}
@@ -0,0 +1,38 @@
+package runner
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+
+	"github.com/VEVO/awsRetagger/mapper"
+)
+
+// ReadConfig loads and validates the mapper configuration from the given file
+func ReadConfig(configFilePath string) (*mapper.Mapper, error) {
+	m, _, err := ReadConfigVersion(configFilePath)
+	return m, err
+}
+
+// ReadConfigVersion loads and validates the mapper configuration from the
+// given file like ReadConfig, and returns the version of the content loaded,
+// which the file may no longer have
+func ReadConfigVersion(configFilePath string) (*mapper.Mapper, string, error) {
+	content, err := ioutil.ReadFile(configFilePath)
+	if err != nil {
+		return nil, "", err
+	}
+
+	m := mapper.Mapper{}
+	if err = m.LoadConfig(bytes.NewReader(content)); err != nil {
+		return nil, "", err
+	}
+	return &m, ConfigVersion(content), m.Validate()
+}
+
+// ConfigVersion returns the version of a config, as the hash of its content
+func ConfigVersion(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
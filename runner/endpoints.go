@@ -0,0 +1,76 @@
+package runner
+
+import (
+	"flag"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+)
+
+// Endpoints are the URLs replacing the default endpoints of the AWS services,
+// keyed by the endpoint ID of the service (ec2, rds, s3, logs, es, cloudfront,
+// redshift, elasticbeanstalk, tagging, sts, sqs...), to reach LocalStack or
+// VPC interface endpoints. A flag value can hold a comma-separated list.
+type Endpoints map[string]string
+
+// RegisterFlags defines the flag setting the endpoints. It can be repeated.
+func (e *Endpoints) RegisterFlags(fs *flag.FlagSet) {
+	fs.Var(e, "endpoint", "Endpoint URL of an AWS service, in the service=url form, for example ec2=http://localhost:4566. Environment variable: ENDPOINT")
+}
+
+func (e *Endpoints) String() string {
+	items := []string{}
+	for service, u := range *e {
+		items = append(items, service+"="+u)
+	}
+	sort.Strings(items)
+	return strings.Join(items, ",")
+}
+
+// Set adds the service=url items of a flag value
+func (e *Endpoints) Set(s string) error {
+	for _, item := range strings.Split(s, ",") {
+		parts := strings.SplitN(strings.TrimSpace(item), "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return fmt.Errorf("invalid endpoint %q, expecting service=url", item)
+		}
+		if u, err := url.Parse(parts[1]); err != nil || u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("invalid endpoint URL %q", parts[1])
+		}
+		if *e == nil {
+			*e = make(Endpoints)
+		}
+		(*e)[parts[0]] = parts[1]
+	}
+	return nil
+}
+
+// EndpointFor resolves the endpoint of a service, its custom URL when set and
+// the default endpoint otherwise. The requests are still signed for the
+// region of the client.
+func (e Endpoints) EndpointFor(service, region string, opts ...func(*endpoints.Options)) (endpoints.ResolvedEndpoint, error) {
+	if u, ok := e[service]; ok {
+		return endpoints.ResolvedEndpoint{URL: u, SigningRegion: region}, nil
+	}
+	return endpoints.DefaultResolver().EndpointFor(service, region, opts...)
+}
+
+// Config returns the configuration of the session applying the endpoints to
+// all the clients created from it. The S3 buckets are addressed in the path
+// of the custom S3 endpoint, as LocalStack and the VPC endpoints do not
+// resolve the bucket sub-domains.
+func (e Endpoints) Config() *aws.Config {
+	cfg := aws.NewConfig()
+	if len(e) == 0 {
+		return cfg
+	}
+	cfg.WithEndpointResolver(e)
+	if _, ok := e[endpoints.S3ServiceID]; ok {
+		cfg.WithS3ForcePathStyle(true)
+	}
+	return cfg
+}
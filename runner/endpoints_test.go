@@ -0,0 +1,74 @@
+package runner
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/rds"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func TestEndpointsSet(t *testing.T) {
+	testData := []struct {
+		values    []string
+		endpoints Endpoints
+		isErr     bool
+	}{
+		{[]string{"ec2=http://localhost:4566"}, Endpoints{"ec2": "http://localhost:4566"}, false},
+		{[]string{"ec2=http://localhost:4566, s3=https://bucket.vpce-1a2b.s3.us-east-1.vpce.amazonaws.com", "rds=http://localhost:4567"}, Endpoints{"ec2": "http://localhost:4566", "s3": "https://bucket.vpce-1a2b.s3.us-east-1.vpce.amazonaws.com", "rds": "http://localhost:4567"}, false},
+		{[]string{"ec2"}, nil, true},
+		{[]string{"=http://localhost:4566"}, nil, true},
+		{[]string{"ec2=localhost:4566"}, nil, true},
+	}
+	for _, d := range testData {
+		var e Endpoints
+		var err error
+		for _, value := range d.values {
+			if err = e.Set(value); err != nil {
+				break
+			}
+		}
+		if (err != nil) != d.isErr {
+			t.Errorf("Expecting error for %v: %v, got: %v\n", d.values, d.isErr, err)
+		}
+		if !d.isErr && !reflect.DeepEqual(e, d.endpoints) {
+			t.Errorf("Expecting endpoints: %v\nGot: %v\n", d.endpoints, e)
+		}
+	}
+}
+
+func TestEndpointsConfig(t *testing.T) {
+	e := Endpoints{"ec2": "http://localhost:4566", "s3": "http://localhost:4572"}
+	sess := session.Must(session.NewSession(e.Config(), &aws.Config{Region: aws.String("eu-west-1")}))
+
+	testData := []struct {
+		service, endpoint, signingRegion string
+	}{
+		{"ec2", "http://localhost:4566", "eu-west-1"},
+		{"s3", "http://localhost:4572", "eu-west-1"},
+		{"rds", "https://rds.eu-west-1.amazonaws.com", "eu-west-1"},
+	}
+	for _, d := range testData {
+		cfg := sess.ClientConfig(d.service)
+		if cfg.Endpoint != d.endpoint || cfg.SigningRegion != d.signingRegion {
+			t.Errorf("Expecting %s at %s signed for %s, got: %s signed for %s\n", d.service, d.endpoint, d.signingRegion, cfg.Endpoint, cfg.SigningRegion)
+		}
+	}
+
+	// the clients of the processors get the endpoints
+	if endpoint := ec2.New(sess).Endpoint; endpoint != "http://localhost:4566" {
+		t.Errorf("Expecting the EC2 client to use the custom endpoint, got: %s\n", endpoint)
+	}
+	if endpoint := rds.New(sess).Endpoint; endpoint != "https://rds.eu-west-1.amazonaws.com" {
+		t.Errorf("Expecting the RDS client to use the default endpoint, got: %s\n", endpoint)
+	}
+	if !aws.BoolValue(s3.New(sess).Config.S3ForcePathStyle) {
+		t.Errorf("Expecting the S3 client to use the path-style addressing\n")
+	}
+	if cfg := (Endpoints{"ec2": "http://localhost:4566"}).Config(); cfg.S3ForcePathStyle != nil {
+		t.Errorf("Expecting the S3 addressing to be unchanged without S3 endpoint\n")
+	}
+}
@@ -0,0 +1,58 @@
+package runner
+
+import (
+	"context"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/sirupsen/logrus"
+
+	"github.com/VEVO/awsRetagger/limit"
+	"github.com/VEVO/awsRetagger/mapper"
+	"github.com/VEVO/awsRetagger/metrics"
+)
+
+// topRules is the number of rules logged when a limit is exceeded
+const topRules = 5
+
+// RunLimited passes the enabled resources through the given mapper like Run.
+// When limits are set, the changes of all the resources are planned first and
+// applied only if they stay within the limits. It returns false when the
+// changes were not applied. A plan interrupted by the cancellation of the
+// context is never applied, as the limits cannot be checked.
+func (p *Providers) RunLimited(ctx context.Context, sess *session.Session, m mapper.Iface, collector *metrics.Collector, limits *limit.Limits) bool {
+	if !limits.Enabled() {
+		p.Run(ctx, sess, m, collector)
+		return true
+	}
+
+	plan := limit.NewPlan()
+	steps := p.Steps(sess, collector)
+	for _, step := range steps {
+		step.Run(ctx, plan.Mapper(step.Name, m))
+		if ctx.Err() != nil {
+			log.WithFields(logrus.Fields{"step": step.Name, "changes": len(plan.Changes)}).Warn("Run interrupted while planning, no change applied")
+			return false
+		}
+	}
+
+	exceeded := plan.Check(limits)
+	if len(exceeded) > 0 {
+		for _, e := range exceeded {
+			log.WithFields(logrus.Fields{"provider": e.Provider, "limit": e.Limit, "threshold": e.Threshold, "changes": e.Changes, "scanned": e.Scanned}).Error(e.String())
+		}
+		for _, r := range plan.TopRules(topRules) {
+			log.WithFields(logrus.Fields{"rule": r.Rule, "resources": r.Resources}).Error("Top rule changing the resources")
+		}
+		if !limits.Force {
+			log.WithFields(logrus.Fields{"changes": len(plan.Changes)}).Error("Change limits exceeded, no change applied")
+			return false
+		}
+		log.WithFields(logrus.Fields{"changes": len(plan.Changes)}).Warn("Change limits exceeded, applying the changes anyway")
+	}
+
+	plan.Apply(ctx)
+	for _, step := range steps {
+		step.flush()
+	}
+	log.WithFields(logrus.Fields{"changes": len(plan.Changes), "failed": plan.Failed}).Info("Planned changes applied")
+	return true
+}
@@ -0,0 +1,59 @@
+package runner
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/VEVO/awsRetagger/events"
+	"github.com/VEVO/awsRetagger/filter"
+	"github.com/VEVO/awsRetagger/flap"
+	"github.com/VEVO/awsRetagger/history"
+	"github.com/VEVO/awsRetagger/limit"
+	"github.com/VEVO/awsRetagger/lock"
+	"github.com/VEVO/awsRetagger/mapper"
+	"github.com/VEVO/awsRetagger/providers"
+)
+
+var log *logrus.Entry
+
+// SetLogger is used to pass the loger from the main program
+func SetLogger(logger *logrus.Entry) { log = logger }
+
+// SetLoggers passes the logger to all the packages of the retagger
+func SetLoggers(logger *logrus.Entry) {
+	SetLogger(logger)
+	mapper.SetLogger(logger)
+	providers.SetLogger(logger)
+	events.SetLogger(logger)
+	filter.SetLogger(logger)
+	flap.SetLogger(logger)
+	history.SetLogger(logger)
+	limit.SetLogger(logger)
+	lock.SetLogger(logger)
+}
+
+// NewLogger creates a new logger instance
+func NewLogger(logLevel, format string, output io.Writer) (*logrus.Entry, error) {
+	switch format {
+	case "text":
+		logrus.SetFormatter(&logrus.TextFormatter{})
+	case "json":
+		logrus.SetFormatter(&logrus.JSONFormatter{})
+	default:
+		return nil, fmt.Errorf("invalid format requested: %s", format)
+	}
+	logrus.SetOutput(output)
+
+	level, err := logrus.ParseLevel(logLevel)
+	if err != nil {
+		return nil, err
+	}
+	logrus.SetLevel(level)
+	context := logrus.WithFields(logrus.Fields{
+		"app": "awsRetagger",
+	})
+
+	return context, nil
+}
@@ -0,0 +1,275 @@
+package runner
+
+import (
+	"context"
+	"flag"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/sirupsen/logrus"
+
+	"github.com/VEVO/awsRetagger/events"
+	"github.com/VEVO/awsRetagger/filter"
+	"github.com/VEVO/awsRetagger/mapper"
+	"github.com/VEVO/awsRetagger/metrics"
+	"github.com/VEVO/awsRetagger/providers"
+)
+
+// Providers holds which resources are enabled
+type Providers struct {
+	Ec2Instances, RdsInstances, RdsClusters, CloudwatchLogGroups, ElasticSearch, CloudFrontDist, RedshiftClusters, ElasticBeanstalkEnv, S3Buckets bool
+	// Filter selects the resources to retag among the enabled providers
+	Filter filter.Filter
+	// Ec2States is the comma-separated list of the states of the EC2 instances
+	// to retag
+	Ec2States string
+	// Ec2WaitPending is how long the EC2 instances pending at scan time are
+	// waited for
+	Ec2WaitPending time.Duration
+	// Ec2SpotRequests enables the tagging of the spot requests of the instances
+	Ec2SpotRequests bool
+}
+
+// RegisterFlags defines the flags enabling the providers and filtering their
+// resources
+func (p *Providers) RegisterFlags(fs *flag.FlagSet) {
+	p.Filter.RegisterFlags(fs)
+	fs.BoolVar(&p.Ec2Instances, "ec2-instances", false, "Enables the re-tagging of the EC2 instances. Environment variable: EC2_INSTANCES")
+	fs.StringVar(&p.Ec2States, "ec2-states", strings.Join(providers.DefaultEc2States, ","), "Comma-separated list of the states of the EC2 instances to retag. Environment variable: EC2_STATES")
+	fs.DurationVar(&p.Ec2WaitPending, "wait-pending", 0, "How long to wait for the EC2 instances pending at scan time to reach one of the retagged states before ending their step, 0 to skip them until the next run. Environment variable: WAIT_PENDING")
+	fs.BoolVar(&p.Ec2SpotRequests, "ec2-spot-requests", false, "Also tags the spot instance requests and Spot Fleet requests of the EC2 instances with the tags of their instance. Environment variable: EC2_SPOT_REQUESTS")
+	fs.BoolVar(&p.RdsInstances, "rds-instances", false, "Enables the re-tagging of the RDS instances. Environment variable: RDS_INSTANCES")
+	fs.BoolVar(&p.RdsClusters, "rds-clusters", false, "Enables the re-tagging of the RDS clusters. Environment variable: RDS_CLUSTERS")
+	fs.BoolVar(&p.CloudwatchLogGroups, "cloudwatch-groups", false, "Enables the re-tagging of the CloudWatch log groups. Environment variable: CLOUDWATCH_GROUPS")
+	fs.BoolVar(&p.ElasticSearch, "elasticsearch", false, "Enables the re-tagging of the ElasticSearch domains. Environment variable: ELASTICSEARCH")
+	fs.BoolVar(&p.CloudFrontDist, "cloudfront-distributions", false, "Enables the re-tagging of the CloudFront distributions. Environment variable: CLOUDFRONT_DISTRIBUTIONS")
+	fs.BoolVar(&p.RedshiftClusters, "redshift-clusters", false, "Enables the re-tagging of the Redshift clusters. Environment variable: REDSHIFT_CLUSTERS")
+	fs.BoolVar(&p.ElasticBeanstalkEnv, "elasticbeanstalk-environments", false, "Enables the re-tagging of the ElasticBeanstalk environments. Environment variable: ELASTICBEANSTALK_ENVIRONMENTS")
+	fs.BoolVar(&p.S3Buckets, "s3-buckets", false, "Enables the re-tagging of the S3 buckets. Environment variable: S3_BUCKETS")
+}
+
+// Step retags all the resources of a provider
+type Step struct {
+	// Name is the name of the provider, as used in the metrics
+	Name string
+	// Run retags the resources until the context is cancelled
+	Run func(ctx context.Context, m mapper.Iface)
+	// Flush, when set, sends the tags batched by Run and returns the number of
+	// resources that failed
+	Flush func() int
+	// Pagination, when set, is where Run resumes the listing of the resources
+	// from and reports the page in progress
+	Pagination *providers.Pagination
+}
+
+// flush sends the tags batched by the step, if any, logging and returning the
+// number of resources that failed
+func (s *Step) flush() int {
+	if s.Flush == nil {
+		return 0
+	}
+	failed := s.Flush()
+	if failed > 0 {
+		log.WithFields(logrus.Fields{"step": s.Name, "failed": failed}).Warn("Failed to set the tags of some batched resources")
+	}
+	return failed
+}
+
+// Steps returns the steps of the enabled providers. When the collector is not
+// nil, the resources of each provider are counted. The tags are written in
+// batches where the services allow it, so each step must be flushed once run.
+// The steps of the paginated listings can resume from a page.
+func (p *Providers) Steps(sess *session.Session, collector *metrics.Collector) []Step {
+	steps := []Step{}
+	add := func(name string, run func(ctx context.Context, m mapper.Iface), batch *mapper.Batcher, pagination *providers.Pagination) {
+		if !p.Filter.MatchType(name) {
+			return
+		}
+		steps = append(steps, Step{Name: name, Run: func(ctx context.Context, m mapper.Iface) { run(ctx, p.Filter.Mapper(collector.Mapper(name, m))) }, Flush: batch.Flush, Pagination: pagination})
+	}
+	tagging := providers.NewTaggingWriter(sess)
+
+	if p.Ec2Instances {
+		e := p.newEc2Processor(sess)
+		e.Batch = e.NewBatcher()
+		e.Pagination = &providers.Pagination{}
+		add(events.Ec2Instances, func(ctx context.Context, m mapper.Iface) { e.RetagInstances(ctx, m) }, e.Batch, e.Pagination)
+	}
+	if p.RdsInstances {
+		batch, pagination := tagging.NewBatcher(), &providers.Pagination{}
+		add(events.RdsInstances, func(ctx context.Context, m mapper.Iface) {
+			r := p.newRdsProcessor(sess)
+			r.Batch, r.Pagination = batch, pagination
+			r.RetagInstances(ctx, m)
+		}, batch, pagination)
+	}
+	if p.RdsClusters {
+		batch, pagination := tagging.NewBatcher(), &providers.Pagination{}
+		add(events.RdsClusters, func(ctx context.Context, m mapper.Iface) {
+			r := p.newRdsProcessor(sess)
+			r.Batch, r.Pagination = batch, pagination
+			r.RetagClusters(ctx, m)
+		}, batch, pagination)
+	}
+	if p.CloudwatchLogGroups {
+		pagination := &providers.Pagination{}
+		add(events.CloudwatchLogGroups, func(ctx context.Context, m mapper.Iface) {
+			c := providers.NewCwProcessor(sess)
+			c.Pagination = pagination
+			c.RetagLogGroups(ctx, m)
+		}, nil, pagination)
+	}
+	if p.ElasticSearch {
+		batch := tagging.NewBatcher()
+		add(events.ElasticsearchDomains, func(ctx context.Context, m mapper.Iface) {
+			elk := providers.NewElkProcessor(sess)
+			elk.Batch = batch
+			elk.RetagDomains(ctx, m)
+		}, batch, nil)
+	}
+	if p.CloudFrontDist && cloudFrontAvailable(sess) {
+		pagination := &providers.Pagination{}
+		add(events.CloudFrontDistributions, func(ctx context.Context, m mapper.Iface) {
+			cf := providers.NewCloudFrontProcessor(sess)
+			cf.Pagination = pagination
+			cf.RetagDistributions(ctx, m)
+		}, nil, pagination)
+	}
+	if p.RedshiftClusters {
+		batch, pagination := tagging.NewBatcher(), &providers.Pagination{}
+		add(events.RedshiftClusters, func(ctx context.Context, m mapper.Iface) {
+			rs := newRedshiftProcessor(sess)
+			rs.Batch, rs.Pagination = batch, pagination
+			rs.RetagClusters(ctx, m)
+		}, batch, pagination)
+	}
+	if p.ElasticBeanstalkEnv {
+		batch, pagination := tagging.NewBatcher(), &providers.Pagination{}
+		add(events.ElasticBeanstalkEnvironments, func(ctx context.Context, m mapper.Iface) {
+			eb := providers.NewElasticBeanstalkProcessor(sess)
+			eb.Batch, eb.Pagination = batch, pagination
+			eb.RetagEnvironments(ctx, m)
+		}, batch, pagination)
+	}
+	if p.S3Buckets {
+		add(events.S3Buckets, func(ctx context.Context, m mapper.Iface) { providers.NewS3Processor(sess).RetagBuckets(ctx, m) }, nil, nil)
+	}
+	return steps
+}
+
+// Global tells if the enabled resources include the ones not bound to the
+// region of the session: the S3 buckets of all the regions and the global
+// CloudFront distributions
+func (p *Providers) Global() bool {
+	return p.S3Buckets || p.CloudFrontDist
+}
+
+// Run passes the enabled resources through the given mapper. When the
+// collector is not nil, the resources of each provider are counted. Once the
+// context is cancelled, the tags already batched are sent and the remaining
+// steps are skipped.
+func (p *Providers) Run(ctx context.Context, sess *session.Session, m mapper.Iface, collector *metrics.Collector) {
+	for _, step := range p.Steps(sess, collector) {
+		step.Run(ctx, m)
+		step.flush()
+		if ctx.Err() != nil {
+			log.WithFields(logrus.Fields{"step": step.Name}).Warn("Run interrupted, skipping the remaining resources")
+			return
+		}
+	}
+}
+
+// EventHandlers returns the handlers retagging a single resource of each
+// enabled provider
+func (p *Providers) EventHandlers(sess *session.Session, m mapper.Iface, collector *metrics.Collector) map[string]events.Handler {
+	handlers := map[string]events.Handler{}
+	// mapperOf returns the mapper of a provider, nil when its resources are
+	// filtered out
+	mapperOf := func(name string) mapper.Iface {
+		if !p.Filter.MatchType(name) {
+			return nil
+		}
+		return p.Filter.Mapper(collector.Mapper(name, m))
+	}
+
+	if em := mapperOf(events.Ec2Instances); p.Ec2Instances && em != nil {
+		e := p.newEc2Processor(sess)
+		handlers[events.Ec2Instances] = func(ctx context.Context, id *string) error { return e.RetagInstance(ctx, em, id) }
+	}
+	if rm := mapperOf(events.RdsInstances); p.RdsInstances && rm != nil {
+		r := p.newRdsProcessor(sess)
+		handlers[events.RdsInstances] = func(ctx context.Context, id *string) error { return r.RetagInstance(ctx, rm, id) }
+	}
+	if rm := mapperOf(events.RdsClusters); p.RdsClusters && rm != nil {
+		r := p.newRdsProcessor(sess)
+		handlers[events.RdsClusters] = func(ctx context.Context, id *string) error { return r.RetagCluster(ctx, rm, id) }
+	}
+	if cm := mapperOf(events.CloudwatchLogGroups); p.CloudwatchLogGroups && cm != nil {
+		c := providers.NewCwProcessor(sess)
+		handlers[events.CloudwatchLogGroups] = func(ctx context.Context, id *string) error { return c.RetagLogGroup(ctx, cm, id) }
+	}
+	if em := mapperOf(events.ElasticsearchDomains); p.ElasticSearch && em != nil {
+		elk := providers.NewElkProcessor(sess)
+		handlers[events.ElasticsearchDomains] = func(ctx context.Context, id *string) error { return elk.RetagDomain(ctx, em, id) }
+	}
+	if cm := mapperOf(events.CloudFrontDistributions); p.CloudFrontDist && cm != nil && cloudFrontAvailable(sess) {
+		cf := providers.NewCloudFrontProcessor(sess)
+		handlers[events.CloudFrontDistributions] = func(ctx context.Context, id *string) error { return cf.RetagDistribution(ctx, cm, id) }
+	}
+	if rm := mapperOf(events.RedshiftClusters); p.RedshiftClusters && rm != nil {
+		rs := newRedshiftProcessor(sess)
+		handlers[events.RedshiftClusters] = func(ctx context.Context, id *string) error { return rs.RetagCluster(ctx, rm, id) }
+	}
+	if p.ElasticBeanstalkEnv {
+		log.Warn("The ElasticBeanstalk environments are not supported by the events, they are only retaggable once ready")
+	}
+	if sm := mapperOf(events.S3Buckets); p.S3Buckets && sm != nil {
+		sp := providers.NewS3Processor(sess)
+		handlers[events.S3Buckets] = func(ctx context.Context, id *string) error { return sp.RetagBucket(ctx, sm, id) }
+	}
+	return handlers
+}
+
+// newEc2Processor creates an Ec2Processor with the server-side filters and the
+// instance options
+func (p *Providers) newEc2Processor(sess *session.Session) *providers.Ec2Processor {
+	e := providers.NewEc2Processor(sess)
+	e.Filters = p.Filter.Ec2Filters()
+	for _, state := range strings.Split(p.Ec2States, ",") {
+		if state = strings.TrimSpace(state); state != "" {
+			e.States = append(e.States, state)
+		}
+	}
+	e.WaitPending = p.Ec2WaitPending
+	e.SpotRequests = p.Ec2SpotRequests
+	return e
+}
+
+// newRdsProcessor creates an RdsProcessor with the server-side filters
+func (p *Providers) newRdsProcessor(sess *session.Session) *providers.RdsProcessor {
+	r := providers.NewRdsProcessor(sess)
+	r.Filters = p.Filter.Rds
+	return r
+}
+
+// cloudFrontAvailable checks that CloudFront is available in the partition of
+// the session, as it is not in GovCloud
+func cloudFrontAvailable(sess *session.Session) bool {
+	partition := providers.PartitionOf(aws.StringValue(sess.Config.Region))
+	if !partition.HasGlobalService(endpoints.CloudfrontServiceID) {
+		log.WithFields(logrus.Fields{"partition": partition.ID}).Warn("CloudFront is not available in the partition, skipping the CloudFront distributions")
+		return false
+	}
+	return true
+}
+
+func newRedshiftProcessor(sess *session.Session) *providers.RedshiftProcessor {
+	rs, err := providers.NewRedshiftProcessor(sess)
+	if err != nil {
+		log.WithFields(logrus.Fields{"error": err}).Fatal("Unable to initialize the Redshift client")
+	}
+	return rs
+}
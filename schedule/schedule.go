@@ -0,0 +1,161 @@
+package schedule
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule gives the time of the next run
+type Schedule interface {
+	// Next returns the first time strictly after t a run should start
+	Next(t time.Time) time.Time
+}
+
+// Parse returns the schedule corresponding to the given specification, either
+// a duration (15m, 2h or @every 2h) or a standard 5-fields cron expression
+// (minute, hour, day of month, month, day of week)
+func Parse(spec string) (Schedule, error) {
+	spec = strings.TrimSpace(spec)
+	if d, err := time.ParseDuration(strings.TrimSpace(strings.TrimPrefix(spec, "@every"))); err == nil {
+		if d <= 0 {
+			return nil, fmt.Errorf("invalid interval: %s", spec)
+		}
+		return Every(d), nil
+	}
+	return ParseCron(spec)
+}
+
+// Every runs at a fixed interval
+type Every time.Duration
+
+// Next returns t plus the interval
+func (e Every) Next(t time.Time) time.Time {
+	return t.Add(time.Duration(e))
+}
+
+// Cron runs following a cron expression. Each field holds the bitmask of the
+// matching values.
+type Cron struct {
+	minute, hour, dom, month, dow uint64
+	// domStar and dowStar are set when the day of month or day of week is *,
+	// as a day then matches when any of the 2 fields matches, like in cron
+	domStar, dowStar bool
+}
+
+// cronFields defines the accepted range of each field of a cron expression
+var cronFields = []struct {
+	name     string
+	min, max uint
+}{
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day of month", 1, 31},
+	{"month", 1, 12},
+	{"day of week", 0, 7},
+}
+
+// ParseCron parses a 5-fields cron expression. Each field accepts *, values,
+// ranges (1-5), steps (*/15 or 1-30/5) and lists of those (1,15,30). Sunday is
+// both 0 and 7 for the day of week.
+func ParseCron(spec string) (*Cron, error) {
+	fields := strings.Fields(spec)
+	if len(fields) != len(cronFields) {
+		return nil, fmt.Errorf("invalid cron expression %q: expecting %d fields, got %d", spec, len(cronFields), len(fields))
+	}
+	masks := make([]uint64, len(fields))
+	for i, field := range fields {
+		mask, err := parseCronField(field, cronFields[i].min, cronFields[i].max)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cron expression %q: %s field: %s", spec, cronFields[i].name, err)
+		}
+		masks[i] = mask
+	}
+	// Sunday is both 0 and 7
+	if masks[4]&(1<<7) != 0 {
+		masks[4] |= 1
+	}
+	return &Cron{
+		minute: masks[0], hour: masks[1], dom: masks[2], month: masks[3], dow: masks[4],
+		domStar: fields[2] == "*", dowStar: fields[4] == "*",
+	}, nil
+}
+
+// parseCronField returns the bitmask of the values matching the field
+func parseCronField(field string, min, max uint) (uint64, error) {
+	var mask uint64
+	for _, part := range strings.Split(field, ",") {
+		rangeSpec, step := part, uint64(1)
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			if step, err = strconv.ParseUint(part[i+1:], 10, 8); err != nil || step == 0 {
+				return 0, fmt.Errorf("invalid step in %q", part)
+			}
+			rangeSpec = part[:i]
+		}
+		low, high := min, max
+		if rangeSpec != "*" {
+			bounds := strings.SplitN(rangeSpec, "-", 2)
+			l, err := strconv.ParseUint(bounds[0], 10, 8)
+			if err != nil {
+				return 0, fmt.Errorf("invalid value in %q", part)
+			}
+			low, high = uint(l), uint(l)
+			if len(bounds) == 2 {
+				h, err := strconv.ParseUint(bounds[1], 10, 8)
+				if err != nil {
+					return 0, fmt.Errorf("invalid value in %q", part)
+				}
+				high = uint(h)
+			} else if step != 1 {
+				// 5/15 means every 15 starting at 5
+				high = max
+			}
+		}
+		if low < min || high > max || low > high {
+			return 0, fmt.Errorf("%q is out of the %d-%d range", part, min, max)
+		}
+		for v := low; v <= high; v += uint(step) {
+			mask |= 1 << v
+		}
+	}
+	return mask, nil
+}
+
+// Next returns the first minute strictly after t matching the expression, or
+// the zero time if there is none in the next 5 years
+func (c *Cron) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		if c.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !c.matchDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if c.hour&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if c.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+// matchDay checks the day of month and day of week fields
+func (c *Cron) matchDay(t time.Time) bool {
+	domMatch := c.dom&(1<<uint(t.Day())) != 0
+	dowMatch := c.dow&(1<<uint(t.Weekday())) != 0
+	if c.domStar || c.dowStar {
+		return domMatch && dowMatch
+	}
+	return domMatch || dowMatch
+}
@@ -0,0 +1,49 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	testData := []struct {
+		spec          string
+		from, next    string
+		expectedError bool
+	}{
+		{"15m", "2017-11-22T10:07:00Z", "2017-11-22T10:22:00Z", false},
+		{"@every 2h", "2017-11-22T10:07:00Z", "2017-11-22T12:07:00Z", false},
+		{"-5m", "", "", true},
+		{"*/15 * * * *", "2017-11-22T10:07:30Z", "2017-11-22T10:15:00Z", false},
+		{"*/15 * * * *", "2017-11-22T10:15:00Z", "2017-11-22T10:30:00Z", false},
+		{"30 2 * * *", "2017-11-22T10:07:00Z", "2017-11-23T02:30:00Z", false},
+		{"0 0 1 * *", "2017-12-15T10:07:00Z", "2018-01-01T00:00:00Z", false},
+		{"0 9 * * 1-5", "2017-11-24T10:00:00Z", "2017-11-27T09:00:00Z", false},
+		{"0 9 * * 7", "2017-11-22T10:00:00Z", "2017-11-26T09:00:00Z", false},
+		// day of month or day of week when both are set
+		{"0 0 25 * 1", "2017-11-22T10:00:00Z", "2017-11-25T00:00:00Z", false},
+		{"10-20/5,45 3 * * *", "2017-11-22T03:16:00Z", "2017-11-22T03:20:00Z", false},
+		{"5/20 * * * *", "2017-11-22T03:26:00Z", "2017-11-22T03:45:00Z", false},
+		{"0 0 30 2 *", "2017-11-22T03:26:00Z", "0001-01-01T00:00:00Z", false},
+		{"* * * *", "", "", true},
+		{"60 * * * *", "", "", true},
+		{"*/0 * * * *", "", "", true},
+		{"a * * * *", "", "", true},
+		{"5-1 * * * *", "", "", true},
+	}
+	for _, d := range testData {
+		s, err := Parse(d.spec)
+		if (err != nil) != d.expectedError {
+			t.Errorf("Unexpected error for %q: %v\n", d.spec, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		from, _ := time.Parse(time.RFC3339, d.from)
+		expected, _ := time.Parse(time.RFC3339, d.next)
+		if next := s.Next(from); !next.Equal(expected) {
+			t.Errorf("Expecting next run of %q after %s to be %s, got: %s\n", d.spec, d.from, d.next, next)
+		}
+	}
+}
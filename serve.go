@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/sirupsen/logrus"
+
+	"github.com/VEVO/awsRetagger/history"
+	"github.com/VEVO/awsRetagger/limit"
+	"github.com/VEVO/awsRetagger/lock"
+	"github.com/VEVO/awsRetagger/mapper"
+	"github.com/VEVO/awsRetagger/metrics"
+	"github.com/VEVO/awsRetagger/runner"
+	"github.com/VEVO/awsRetagger/schedule"
+)
+
+// configPollInterval is how often the server checks if the config file changed
+const configPollInterval = 10 * time.Second
+
+// serverStatus is the status of the server exposed over http
+type serverStatus struct {
+	Running         bool      `json:"running"`
+	Runs            int       `json:"runs"`
+	LastRunStart    time.Time `json:"last_run_start"`
+	LastRunEnd      time.Time `json:"last_run_end"`
+	LastRunDuration float64   `json:"last_run_duration_seconds"`
+	NextRun         time.Time `json:"next_run"`
+	ConfigLoadedAt  time.Time `json:"config_loaded_at"`
+	// ChangeLimitsExceeded is true when the last run changed nothing because
+	// of the change limits
+	ChangeLimitsExceeded bool `json:"change_limits_exceeded"`
+	// Interrupted is true when the last run was interrupted by the shutdown
+	// of the server
+	Interrupted bool `json:"interrupted"`
+	// ConfigError is the error of the last reload of the config file, if any
+	ConfigError string `json:"config_error,omitempty"`
+	// LockError is why the last run was skipped, when another run held the
+	// lock
+	LockError string `json:"lock_error,omitempty"`
+}
+
+// server retags the enabled resources on a schedule, reloading the config
+// file when it changes
+type server struct {
+	sess            *session.Session
+	enabled         *runner.Providers
+	collector       *metrics.Collector
+	schedule        schedule.Schedule
+	configFilePath  string
+	metricsTextfile string
+	inc             *incremental
+	flaps           *flapping
+	hist            *changeHistory
+	limits          *limit.Limits
+	// locker takes the locks of the lockKeys for each run, when not nil
+	locker   *lock.Locker
+	lockKeys []string
+
+	mu     sync.Mutex
+	mapper *mapper.Mapper
+	// configVersion is the version of the config the mapper was loaded from
+	configVersion string
+	// configStat is the state of the config file when it was last read
+	configStat os.FileInfo
+	status     serverStatus
+}
+
+// newServer creates a server with the config loaded from the given file
+func newServer(sess *session.Session, enabled *runner.Providers, collector *metrics.Collector, inc *incremental, limits *limit.Limits, sched schedule.Schedule, configFilePath, metricsTextfile string) *server {
+	s := &server{sess: sess, enabled: enabled, collector: collector, inc: inc, limits: limits, schedule: sched, configFilePath: configFilePath, metricsTextfile: metricsTextfile}
+	s.configStat, _ = os.Stat(configFilePath)
+	s.mapper, s.configVersion = loadConfig(configFilePath)
+	s.mapper.SanityRecorders = append(s.mapper.SanityRecorders, collector)
+	s.status.ConfigLoadedAt = time.Now()
+	return s
+}
+
+// loop runs a 1st retagging cycle and then the scheduled ones until the
+// context is cancelled. As the cycles run in the loop, they never overlap: a
+// cycle taking longer than the schedule delays the next one.
+func (s *server) loop(ctx context.Context) {
+	poll := time.NewTicker(configPollInterval)
+	defer poll.Stop()
+	s.runCycle(ctx)
+	for ctx.Err() == nil {
+		next := s.schedule.Next(time.Now())
+		if next.IsZero() {
+			log.Fatal("The schedule never triggers a run")
+		}
+		s.mu.Lock()
+		s.status.NextRun = next
+		s.mu.Unlock()
+		log.WithFields(logrus.Fields{"next_run": next}).Info("Waiting for the next run")
+
+		timer := time.NewTimer(time.Until(next))
+	Wait:
+		for {
+			select {
+			case <-poll.C:
+				s.reloadConfig()
+			case <-timer.C:
+				break Wait
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			}
+		}
+		s.reloadConfig()
+		s.runCycle(ctx)
+	}
+}
+
+// reloadConfig loads the config file when it changed since it was last read.
+// The current mapper is kept if the new config fails to load or validate.
+func (s *server) reloadConfig() {
+	stat, err := os.Stat(s.configFilePath)
+	if err != nil {
+		s.setConfigError(err)
+		return
+	}
+	if s.configStat != nil && stat.ModTime().Equal(s.configStat.ModTime()) && stat.Size() == s.configStat.Size() {
+		return
+	}
+	s.configStat = stat
+
+	m, version, err := runner.ReadConfigVersion(s.configFilePath)
+	if err != nil {
+		s.setConfigError(err)
+		return
+	}
+	m.SanityRecorders = append(m.SanityRecorders, s.collector)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.mapper, s.configVersion = m, version
+	s.status.ConfigLoadedAt = time.Now()
+	s.status.ConfigError = ""
+	log.WithFields(logrus.Fields{"path": s.configFilePath}).Info("Config file reloaded")
+}
+
+func (s *server) setConfigError(err error) {
+	log.WithFields(logrus.Fields{"error": err, "path": s.configFilePath}).Error("Unable to reload the config file, keeping the current config")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status.ConfigError = err.Error()
+}
+
+// runCycle retags the enabled resources once, until the context is cancelled.
+// The run is skipped when another run holds the lock.
+func (s *server) runCycle(ctx context.Context) {
+	runCtx, lease, err := s.locker.Acquire(ctx, s.lockKeys...)
+	if err != nil {
+		if ctx.Err() == nil {
+			log.WithFields(logrus.Fields{"error": err, "keys": s.lockKeys}).Warn("Unable to acquire the lock, skipping the run")
+			s.mu.Lock()
+			s.status.LockError = err.Error()
+			s.mu.Unlock()
+		}
+		return
+	}
+	defer lease.Release()
+
+	s.mu.Lock()
+	s.status.LockError = ""
+	m, version := s.mapper, s.configVersion
+	start := time.Now()
+	s.status.Running = true
+	s.status.LastRunStart = start
+	s.mu.Unlock()
+
+	log.Info("Starting run")
+	applied := s.enabled.RunLimited(runCtx, s.sess, s.inc.Mapper(s.hist.Mapper(s.flaps.Mapper(m), newRunID(), history.BatchSize), version), s.collector, s.limits)
+	s.hist.Finish()
+	s.inc.Save()
+	s.flaps.Report()
+	interrupted := ctx.Err() != nil
+	s.collector.ObserveRun(start, interrupted)
+	if s.metricsTextfile != "" {
+		if err := s.collector.WriteTextfile(s.metricsTextfile); err != nil {
+			log.WithFields(logrus.Fields{"error": err, "path": s.metricsTextfile}).Error("Unable to write the metrics")
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status.Running = false
+	s.status.Runs++
+	s.status.ChangeLimitsExceeded = !applied && !interrupted
+	s.status.Interrupted = interrupted
+	s.status.LastRunEnd = time.Now()
+	s.status.LastRunDuration = s.status.LastRunEnd.Sub(start).Seconds()
+	if interrupted {
+		log.WithFields(logrus.Fields{"duration": s.status.LastRunDuration}).Warn("Run interrupted")
+		return
+	}
+	log.WithFields(logrus.Fields{"duration": s.status.LastRunDuration}).Info("Run finished")
+}
+
+// handler exposes the health, the status and the metrics of the server
+func (s *server) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok\n"))
+	})
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		status := s.status
+		s.mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(status)
+	})
+	mux.Handle("/metrics", s.collector)
+	return mux
+}
+
+// serve exposes the server over http and runs the retagging cycles until the
+// context is cancelled, each holding the locks of the lockKeys
+func serve(ctx context.Context, sess *session.Session, enabled *runner.Providers, collector *metrics.Collector, inc *incremental, flaps *flapping, hist *changeHistory, limits *limit.Limits, locker *lock.Locker, lockKeys []string, configFilePath, listen, scheduleSpec, metricsTextfile string) {
+	sched, err := schedule.Parse(scheduleSpec)
+	if err != nil {
+		log.WithFields(logrus.Fields{"error": err}).Fatal("Invalid schedule")
+	}
+	s := newServer(sess, enabled, collector, inc, limits, sched, configFilePath, metricsTextfile)
+	s.locker, s.lockKeys = locker, lockKeys
+	s.flaps, s.hist = flaps, hist
+
+	go func() {
+		if err := http.ListenAndServe(listen, s.handler()); err != nil {
+			log.WithFields(logrus.Fields{"error": err, "address": listen}).Fatal("Unable to expose the status")
+		}
+	}()
+	s.loop(ctx)
+}
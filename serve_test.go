@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/sirupsen/logrus"
+	logrus_test "github.com/sirupsen/logrus/hooks/test"
+
+	"github.com/VEVO/awsRetagger/lock"
+	"github.com/VEVO/awsRetagger/metrics"
+	"github.com/VEVO/awsRetagger/runner"
+	"github.com/VEVO/awsRetagger/schedule"
+)
+
+const (
+	serveConfig      = `{"defaults": {"team": "infra"}}`
+	serveConfigNew   = `{"defaults": {"team": "infra", "env": "prd"}}`
+	serveConfigError = `{"protected_keys": ["a)b"], "defaults": {"team": "data"}}`
+)
+
+// newTestServer returns a server with no provider enabled and the given config
+// written in dir
+func newTestServer(t *testing.T, dir, config string) (*server, string) {
+	logger, _ := logrus_test.NewNullLogger()
+	log = logrus.NewEntry(logger)
+	runner.SetLoggers(log)
+	path := filepath.Join(dir, "config.json")
+	if err := ioutil.WriteFile(path, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	sched, err := schedule.Parse("5ms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess := session.Must(session.NewSession(&aws.Config{Region: aws.String("us-east-1"), Credentials: credentials.NewStaticCredentials("id", "secret", "")}))
+	return newServer(sess, &runner.Providers{}, metrics.NewCollector("123456789012", "us-east-1"), nil, nil, sched, path, ""), path
+}
+
+func TestServerReloadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "serve")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, path := newTestServer(t, dir, serveConfig)
+	if s.configVersion != runner.ConfigVersion([]byte(serveConfig)) {
+		t.Errorf("Expecting the version of the config loaded, got: %s\n", s.configVersion)
+	}
+
+	// unchanged, the config is not loaded again
+	m := s.mapper
+	s.reloadConfig()
+	if s.mapper != m {
+		t.Errorf("Expecting the mapper to be kept while the config file is unchanged\n")
+	}
+
+	if err = ioutil.WriteFile(path, []byte(serveConfigNew), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s.reloadConfig()
+	if s.mapper == m || s.mapper.DefaultTagValues["env"] != "prd" || s.status.ConfigError != "" {
+		t.Errorf("Expecting the new config to be loaded, got: %v (error: %s)\n", s.mapper.DefaultTagValues, s.status.ConfigError)
+	}
+	if s.configVersion != runner.ConfigVersion([]byte(serveConfigNew)) {
+		t.Errorf("Expecting the version of the new config, got: %s\n", s.configVersion)
+	}
+
+	s.runCycle(context.Background())
+	if s.status.Runs != 1 || s.status.Running {
+		t.Errorf("Expecting a run done with the new config, got: %+v\n", s.status)
+	}
+}
+
+func TestServerReloadInvalidConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "serve")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, path := newTestServer(t, dir, serveConfig)
+	m, version := s.mapper, s.configVersion
+
+	if err = ioutil.WriteFile(path, []byte(serveConfigError), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s.reloadConfig()
+	if s.mapper != m || s.configVersion != version || s.status.ConfigError == "" {
+		t.Errorf("Expecting the current config to be kept with the error reported, got: %v (error: %q)\n", s.mapper.DefaultTagValues, s.status.ConfigError)
+	}
+
+	// the version recorded is still the one of the config actually used
+	s.runCycle(context.Background())
+	if s.configVersion != runner.ConfigVersion([]byte(serveConfig)) || s.status.Runs != 1 {
+		t.Errorf("Expecting a run with the previous config, got version %s and status: %+v\n", s.configVersion, s.status)
+	}
+
+	// the error is cleared once the config is fixed
+	if err = ioutil.WriteFile(path, []byte(serveConfigNew), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s.reloadConfig()
+	if s.mapper == m || s.status.ConfigError != "" {
+		t.Errorf("Expecting the fixed config to be loaded, got: %v (error: %q)\n", s.mapper.DefaultTagValues, s.status.ConfigError)
+	}
+}
+
+// overlapBackend is a lock backend counting the runs holding the lock at the
+// same time. Each run takes longer than the schedule of the test server, and
+// the run is cancelled once it reaches runs.
+type overlapBackend struct {
+	mu             sync.Mutex
+	held, maxHeld  int
+	acquired, runs int
+	cancel         context.CancelFunc
+}
+
+func (b *overlapBackend) Acquire(ctx context.Context, key, owner string, expires time.Time) error {
+	b.mu.Lock()
+	b.held++
+	if b.held > b.maxHeld {
+		b.maxHeld = b.held
+	}
+	b.acquired++
+	if b.acquired == b.runs {
+		b.cancel()
+	}
+	b.mu.Unlock()
+	time.Sleep(20 * time.Millisecond)
+	return nil
+}
+
+func (b *overlapBackend) Renew(ctx context.Context, key, owner string, expires time.Time) error {
+	return nil
+}
+
+func (b *overlapBackend) Release(ctx context.Context, key, owner string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.held--
+	return nil
+}
+
+func TestServerRunsDoNotOverlap(t *testing.T) {
+	dir, err := ioutil.TempDir("", "serve")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the runs of the loop taking longer than the schedule delay the next ones
+	s, _ := newTestServer(t, dir, serveConfig)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	backend := &overlapBackend{runs: 3, cancel: cancel}
+	s.locker, s.lockKeys = &lock.Locker{Backend: backend, TTL: time.Minute, Owner: "serve"}, []string{"123456789012/us-east-1"}
+	s.loop(ctx)
+	if backend.acquired != 3 || backend.maxHeld != 1 || backend.held != 0 {
+		t.Errorf("Expecting 3 runs one at a time, got %d runs with up to %d at a time and %d left\n", backend.acquired, backend.maxHeld, backend.held)
+	}
+
+	// the run is skipped while another server holds the lock
+	files := &lock.FileBackend{Dir: dir}
+	other := &lock.Locker{Backend: files, TTL: time.Minute, Owner: "other"}
+	_, lease, err := other.Acquire(context.Background(), "123456789012/us-east-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, _ = newTestServer(t, dir, serveConfig)
+	s.locker, s.lockKeys = &lock.Locker{Backend: files, TTL: time.Minute, Owner: "serve"}, []string{"123456789012/us-east-1"}
+	s.runCycle(context.Background())
+	if s.status.Runs != 0 || s.status.LockError == "" {
+		t.Errorf("Expecting the run to be skipped while the lock is held, got: %+v\n", s.status)
+	}
+	lease.Release()
+	s.runCycle(context.Background())
+	if s.status.Runs != 1 || s.status.LockError != "" {
+		t.Errorf("Expecting the run once the lock is released, got: %+v\n", s.status)
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// interruptedExitCode is the exit code of the runs interrupted by a signal,
+// like a shell does for SIGINT
+const interruptedExitCode = 130
+
+// notifyShutdown returns a context cancelled on the 1st SIGINT or SIGTERM. No
+// more resource is then dispatched and the run has the grace period to let the
+// in-flight writes finish and to write its reports. Once the grace period
+// expires, or on a 2nd signal, the process exits right away, running the exit
+// handlers so that the lock is released and the checkpoint saved.
+func notifyShutdown(grace time.Duration) context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		log.WithFields(logrus.Fields{"signal": sig.String(), "grace": grace}).Warn("Shutting down, letting the in-flight writes finish")
+		cancel()
+		select {
+		case sig = <-signals:
+			log.WithFields(logrus.Fields{"signal": sig.String()}).Error("Signal received again, exiting without waiting")
+		case <-time.After(grace):
+			log.WithFields(logrus.Fields{"grace": grace}).Error("Grace period expired, exiting without waiting")
+		}
+		logrus.Exit(interruptedExitCode)
+	}()
+	return ctx
+}
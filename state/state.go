@@ -0,0 +1,167 @@
+package state
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/VEVO/awsRetagger/mapper"
+)
+
+// retention is how long the resources not seen anymore are kept in the state
+const retention = 30 * 24 * time.Hour
+
+// Resource is the state of a resource at the end of its last processing
+type Resource struct {
+	// Hash is the hash of the tags and keys of the resource
+	Hash string `json:"hash"`
+	// ConfigVersion is the version of the config the resource was processed
+	// under
+	ConfigVersion string `json:"config_version"`
+	// Seen is the last time the resource was listed
+	Seen time.Time `json:"seen"`
+}
+
+// State holds the state of the resources processed by the previous runs, so
+// the unchanged ones can be skipped
+type State struct {
+	Resources map[string]*Resource `json:"resources"`
+}
+
+// New creates an empty state
+func New() *State {
+	return &State{Resources: make(map[string]*Resource)}
+}
+
+// Load reads the state from the given file. A missing file gives an empty
+// state.
+func Load(path string) (*State, error) {
+	s := New()
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if err = json.NewDecoder(f).Decode(s); err != nil {
+		return nil, err
+	}
+	if s.Resources == nil {
+		s.Resources = make(map[string]*Resource)
+	}
+	return s, nil
+}
+
+// Save writes the state into the given file, dropping the resources not seen
+// for the retention period. The file is replaced atomically so an
+// interrupted run never leaves a partial state.
+func (s *State) Save(path string) error {
+	for id, r := range s.Resources {
+		if time.Since(r.Seen) > retention {
+			delete(s.Resources, id)
+		}
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err = json.NewEncoder(tmp).Encode(s); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Hash returns the hash of the tags and keys of a resource
+func Hash(tags map[string]string, keys []string) string {
+	names := []string{}
+	for k := range tags {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	h := sha256.New()
+	for _, k := range names {
+		h.Write([]byte(k + "\x00" + tags[k] + "\x00"))
+	}
+	h.Write([]byte("\x01"))
+	for _, k := range keys {
+		h.Write([]byte(k + "\x00"))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Mapper returns a mapper skipping the resources of which the tags, keys and
+// config version did not change since they were last processed. When full is
+// true, all the resources go through m but the state is still updated.
+func (s *State) Mapper(m mapper.Iface, configVersion string, full bool) *Mapper {
+	return &Mapper{Iface: m, state: s, configVersion: configVersion, full: full}
+}
+
+// Mapper skips the unchanged resources and records the state of the others
+type Mapper struct {
+	mapper.Iface
+	state         *State
+	configVersion string
+	full          bool
+	// Skipped is the number of resources skipped as unchanged
+	Skipped int
+}
+
+// Retag calls the actual Retag when the resource changed since it was last
+// processed and records its state once processed. When the tags are updated,
+// the state is recorded once they are written, batched writes included, and
+// the recorded hash is the one of the tags written. A resource which tags
+// failed to be updated is not recorded so it is processed again next time,
+// like a resource which processing was interrupted by the cancellation of the
+// context or which planned changes were not applied.
+func (m *Mapper) Retag(ctx context.Context, resourceID *string, tags *map[string]string, keys []string, setTags mapper.PutTagFn) {
+	current := make(map[string]string)
+	for k, v := range *tags {
+		current[k] = v
+	}
+	hash := Hash(current, keys)
+	now := time.Now()
+
+	if r, ok := m.state.Resources[*resourceID]; ok {
+		r.Seen = now
+		if !m.full && r.Hash == hash && r.ConfigVersion == m.configVersion {
+			m.Skipped++
+			return
+		}
+	}
+
+	id := *resourceID
+	written := false
+	m.Iface.Retag(ctx, resourceID, tags, keys, func(rid *string, items []*mapper.TagItem, done mapper.WrittenFn) error {
+		written = true
+		return setTags(rid, items, func(items []*mapper.TagItem, err error) {
+			defer done.Report(items, err)
+			if err != nil {
+				delete(m.state.Resources, id)
+				return
+			}
+			for _, item := range items {
+				if item.Name != "" {
+					current[item.Name] = item.Value
+				}
+			}
+			m.state.Resources[id] = &Resource{Hash: Hash(current, keys), ConfigVersion: m.configVersion, Seen: now}
+		})
+	})
+	if written || ctx.Err() != nil {
+		return
+	}
+	m.state.Resources[id] = &Resource{Hash: hash, ConfigVersion: m.configVersion, Seen: now}
+}
@@ -0,0 +1,122 @@
+package state
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/VEVO/awsRetagger/mapper"
+)
+
+// fakeMapper sets the same tags on all the resources
+type fakeMapper struct {
+	mapper.Iface
+	tags     []*mapper.TagItem
+	retagged []string
+}
+
+func (m *fakeMapper) Retag(ctx context.Context, resourceID *string, tags *map[string]string, keys []string, setTags mapper.PutTagFn) {
+	m.retagged = append(m.retagged, *resourceID)
+	if len(m.tags) > 0 {
+		setTags(resourceID, m.tags, nil)
+	}
+}
+
+func TestMapperRetag(t *testing.T) {
+	s := New()
+	fm := &fakeMapper{tags: []*mapper.TagItem{{Name: "team", Value: "data"}}}
+	id := "i-123"
+
+	testData := []struct {
+		tags          map[string]string
+		keys          []string
+		configVersion string
+		full          bool
+		setTagsErr    error
+		retagged      bool
+		// pending leaves the write queued for good, like a plan not applied
+		pending bool
+	}{
+		// 1st time, the tags are updated
+		{map[string]string{"env": "prod"}, []string{"key"}, "v1", false, nil, true, false},
+		// unchanged once updated
+		{map[string]string{"env": "prod", "team": "data"}, []string{"key"}, "v1", false, nil, false, false},
+		// the keys changed
+		{map[string]string{"env": "prod", "team": "data"}, []string{"other"}, "v1", false, nil, true, false},
+		{map[string]string{"env": "prod", "team": "data"}, []string{"other"}, "v1", true, nil, true, false},
+		// the config changed
+		{map[string]string{"env": "prod", "team": "data"}, []string{"other"}, "v2", false, nil, true, false},
+		{map[string]string{"env": "prod", "team": "data"}, []string{"other"}, "v2", false, nil, false, false},
+		// the tags changed and failed to be updated
+		{map[string]string{"env": "staging"}, []string{"other"}, "v2", false, errors.New("Badaboom"), true, false},
+		{map[string]string{"env": "staging"}, []string{"other"}, "v2", false, nil, true, false},
+		// the write is not done
+		{map[string]string{"env": "dev"}, []string{"other"}, "v2", false, nil, true, true},
+		{map[string]string{"env": "dev"}, []string{"other"}, "v2", false, nil, true, false},
+	}
+	for i, d := range testData {
+		fm.retagged = nil
+		m := s.Mapper(fm, d.configVersion, d.full)
+		tags := d.tags
+		m.Retag(context.Background(), &id, &tags, d.keys, func(r *string, t []*mapper.TagItem, done mapper.WrittenFn) error {
+			if d.pending {
+				return nil
+			}
+			done.Report(t, d.setTagsErr)
+			return d.setTagsErr
+		})
+		if retagged := len(fm.retagged) == 1; retagged != d.retagged {
+			t.Errorf("Case %d: expecting retagged to be %t, got %t\n", i, d.retagged, retagged)
+		}
+		if !d.retagged && m.Skipped != 1 {
+			t.Errorf("Case %d: expecting the resource to be counted as skipped\n", i)
+		}
+	}
+}
+
+func TestLoadSave(t *testing.T) {
+	dir, err := ioutil.TempDir("", "state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state.json")
+
+	s, err := Load(path)
+	if err != nil || len(s.Resources) != 0 {
+		t.Fatalf("Expecting an empty state from a missing file, got %v and %v\n", s, err)
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	s.Resources["recent"] = &Resource{Hash: "a", ConfigVersion: "v1", Seen: now}
+	s.Resources["old"] = &Resource{Hash: "b", ConfigVersion: "v1", Seen: now.Add(-retention - time.Hour)}
+	if err = s.Save(path); err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+
+	loaded, err := Load(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	expected := map[string]*Resource{"recent": {Hash: "a", ConfigVersion: "v1", Seen: now}}
+	if !reflect.DeepEqual(loaded.Resources, expected) {
+		t.Errorf("Expecting %v, got %v\n", expected, loaded.Resources)
+	}
+}
+
+func TestHash(t *testing.T) {
+	if Hash(map[string]string{"a": "b", "c": "d"}, []string{"k"}) != Hash(map[string]string{"c": "d", "a": "b"}, []string{"k"}) {
+		t.Errorf("Expecting the hash not to depend on the order of the tags\n")
+	}
+	if Hash(map[string]string{"a": "bc"}, nil) == Hash(map[string]string{"ab": "c"}, nil) {
+		t.Errorf("Expecting different tags to give different hashes\n")
+	}
+	if Hash(map[string]string{"a": "b"}, nil) == Hash(map[string]string{"a": "b"}, []string{"k"}) {
+		t.Errorf("Expecting different keys to give different hashes\n")
+	}
+}